@@ -26,4 +26,33 @@ type FileTarget struct {
 type WaitingFile struct {
 	Name string
 	Size int64
+
+	// IsDir is whether the file is a directory tree, sent with
+	// "tailscale file cp" of a directory. Its Size is the total size
+	// of the files in it.
+	IsDir bool `json:",omitempty"`
+}
+
+// PartialFile is the JSON type returned by a GET of a peer API
+// /v0/put/NAME URL. It describes what the peer has received of an
+// interrupted transfer of NAME, so the sender can resume it with a PUT
+// whose Content-Range header starts at or before Offset.
+type PartialFile struct {
+	// Offset is the number of bytes of the file received. It's a
+	// multiple of ChunkSize; any received bytes of a final partial
+	// chunk aren't counted.
+	Offset int64
+
+	// ChunkSize is the size of the chunks hashed in ChunkHashes.
+	ChunkSize int64
+
+	// ChunkHashes are the hex SHA-256 hashes of each ChunkSize chunk
+	// of the first Offset bytes, so the sender can check that they
+	// match what it's sending before resuming after them.
+	ChunkHashes []string
 }
+
+// FileSHA256Header is the header of a peer API file PUT containing the
+// hex SHA-256 hash of the whole file. If present, the receiver rejects
+// and discards the file unless the bytes it received match.
+const FileSHA256Header = "Tailscale-File-Sha256"
@@ -0,0 +1,483 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailscale
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/paths"
+	"tailscale.com/safesocket"
+	"tailscale.com/tailcfg"
+)
+
+// LocalClient is a client for the LocalAPI of a tailscaled.
+//
+// The zero value is a client for the tailscaled listening on
+// TailscaledSocket. Its methods are safe for concurrent use, but its
+// fields must not be changed after its first request.
+type LocalClient struct {
+	// Socket is the path of tailscaled's Unix socket (or the name
+	// of its named pipe on Windows). If empty, TailscaledSocket is
+	// used.
+	Socket string
+
+	// Dial, if non-nil, is used to connect to tailscaled instead of
+	// Socket, such as to talk to a tailscaled over TCP in tests.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	clientOnce sync.Once
+	client     *http.Client
+}
+
+// defaultLocalClient is the client used by the package-level funcs.
+var defaultLocalClient LocalClient
+
+// LocalAPIError is an error response from the LocalAPI.
+type LocalAPIError struct {
+	StatusCode int    // HTTP status code, such as 403
+	Status     string // HTTP status, such as "403 Forbidden"
+	Message    string // error message from tailscaled, if any
+	Body       []byte // raw response body
+}
+
+func (e *LocalAPIError) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	return fmt.Sprintf("HTTP %s: %s", e.Status, bytes.TrimSpace(e.Body))
+}
+
+// IsAccessDeniedError reports whether err is a LocalAPIError saying
+// that the caller isn't permitted to make the request, such as a
+// non-root user changing prefs.
+func IsAccessDeniedError(err error) bool {
+	var e *LocalAPIError
+	return errors.As(err, &e) && e.StatusCode == http.StatusForbidden
+}
+
+// IsNotFoundError reports whether err is a LocalAPIError saying that
+// the requested item, such as a WhoIs address or waiting file, doesn't
+// exist.
+func IsNotFoundError(err error) bool {
+	var e *LocalAPIError
+	return errors.As(err, &e) && e.StatusCode == http.StatusNotFound
+}
+
+func (lc *LocalClient) socket() string {
+	if lc.Socket != "" {
+		return lc.Socket
+	}
+	return TailscaledSocket
+}
+
+func (lc *LocalClient) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if addr != "local-tailscaled.sock:80" {
+		return nil, fmt.Errorf("unexpected URL address %q", addr)
+	}
+	if lc.Dial != nil {
+		return lc.Dial(ctx, network, addr)
+	}
+	if lc.socket() == paths.DefaultTailscaledSocket() {
+		// On macOS, when dialing from non-sandboxed program to sandboxed GUI running
+		// a TCP server on a random port, find the random port. For HTTP connections,
+		// we don't send the token. It gets added in an HTTP Basic-Auth header.
+		if port, _, err := safesocket.LocalTCPPortAndToken(); err == nil {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", "localhost:"+strconv.Itoa(port))
+		}
+	}
+	return safesocket.Connect(lc.socket(), 41112)
+}
+
+// DoLocalRequest makes an HTTP request to tailscaled. See the
+// package-level DoLocalRequest for the form of the URL.
+//
+// It may mutate the request to add Authorization headers.
+func (lc *LocalClient) DoLocalRequest(req *http.Request) (*http.Response, error) {
+	lc.clientOnce.Do(func() {
+		lc.client = &http.Client{
+			Transport: &http.Transport{DialContext: lc.dial},
+		}
+	})
+	if lc.Dial == nil {
+		if _, token, err := safesocket.LocalTCPPortAndToken(); err == nil {
+			req.SetBasicAuth("", token)
+		}
+	}
+	return lc.client.Do(req)
+}
+
+// errorFromResponse returns a *LocalAPIError for res, whose body is
+// body.
+func errorFromResponse(res *http.Response, body []byte) error {
+	e := &LocalAPIError{
+		StatusCode: res.StatusCode,
+		Status:     res.Status,
+		Body:       body,
+	}
+	var j errorJSON
+	if err := json.Unmarshal(body, &j); err == nil && j.Error != "" {
+		e.Message = j.Error
+	}
+	return e
+}
+
+func (lc *LocalClient) send(ctx context.Context, method, path string, wantStatus int, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "http://local-tailscaled.sock"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	res, err := lc.DoLocalRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	slurp, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != wantStatus {
+		return nil, errorFromResponse(res, slurp)
+	}
+	return slurp, nil
+}
+
+func (lc *LocalClient) get200(ctx context.Context, path string) ([]byte, error) {
+	return lc.send(ctx, "GET", path, 200, nil)
+}
+
+// getJSON does a GET of path and decodes the JSON response into v.
+func (lc *LocalClient) getJSON(ctx context.Context, path string, v interface{}) error {
+	body, err := lc.get200(ctx, path)
+	if err != nil {
+		return err
+	}
+	return decodeJSON(path, body, v)
+}
+
+func decodeJSON(path string, body []byte, v interface{}) error {
+	if err := json.Unmarshal(body, v); err != nil {
+		if max := 200; len(body) > max {
+			body = append(body[:max], "..."...)
+		}
+		return fmt.Errorf("invalid JSON from %s: %w; body: %q", path, err, body)
+	}
+	return nil
+}
+
+// WhoIs returns the owner of the remoteAddr, which must be an IP or IP:port.
+func (lc *LocalClient) WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	r := new(apitype.WhoIsResponse)
+	if err := lc.getJSON(ctx, "/localapi/v0/whois?addr="+url.QueryEscape(remoteAddr), r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// WhoIsPeer is like WhoIs, but only identifies peers: it fails for
+// remoteAddr at one of this node's own Tailscale IPs, as any local
+// process can connect from those.
+func (lc *LocalClient) WhoIsPeer(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	r := new(apitype.WhoIsResponse)
+	if err := lc.getJSON(ctx, "/localapi/v0/whois?peer=true&addr="+url.QueryEscape(remoteAddr), r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Goroutines returns a dump of the Tailscale daemon's current goroutines.
+func (lc *LocalClient) Goroutines(ctx context.Context) ([]byte, error) {
+	return lc.get200(ctx, "/localapi/v0/goroutines")
+}
+
+// BugReport logs and returns a log marker that can be shared by the user with support.
+func (lc *LocalClient) BugReport(ctx context.Context, note string) (string, error) {
+	body, err := lc.send(ctx, "POST", "/localapi/v0/bugreport?note="+url.QueryEscape(note), 200, nil)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// Status returns the Tailscale daemon's status.
+func (lc *LocalClient) Status(ctx context.Context) (*ipnstate.Status, error) {
+	return lc.status(ctx, "")
+}
+
+// StatusWithoutPeers returns the Tailscale daemon's status, without the peer info.
+func (lc *LocalClient) StatusWithoutPeers(ctx context.Context) (*ipnstate.Status, error) {
+	return lc.status(ctx, "?peers=false")
+}
+
+func (lc *LocalClient) status(ctx context.Context, queryString string) (*ipnstate.Status, error) {
+	st := new(ipnstate.Status)
+	if err := lc.getJSON(ctx, "/localapi/v0/status"+queryString, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// WaitingFiles returns the files received by Taildrop that are
+// waiting to be picked up.
+func (lc *LocalClient) WaitingFiles(ctx context.Context) ([]apitype.WaitingFile, error) {
+	var wfs []apitype.WaitingFile
+	if err := lc.getJSON(ctx, "/localapi/v0/files/", &wfs); err != nil {
+		return nil, err
+	}
+	return wfs, nil
+}
+
+// DeleteWaitingFile deletes the waiting file baseName.
+func (lc *LocalClient) DeleteWaitingFile(ctx context.Context, baseName string) error {
+	_, err := lc.send(ctx, "DELETE", "/localapi/v0/files/"+url.PathEscape(baseName), http.StatusNoContent, nil)
+	return err
+}
+
+// GetWaitingFile opens the waiting file baseName. The caller must
+// close rc.
+//
+// If the file is a directory (see apitype.WaitingFile.IsDir), rc is a
+// tar archive of it, which dirtar.Extract extracts, and size is -1.
+func (lc *LocalClient) GetWaitingFile(ctx context.Context, baseName string) (rc io.ReadCloser, size int64, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://local-tailscaled.sock/localapi/v0/files/"+url.PathEscape(baseName), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	res, err := lc.DoLocalRequest(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, 0, errorFromResponse(res, body)
+	}
+	if res.ContentLength == -1 {
+		if res.Header.Get("Content-Type") == "application/x-tar" {
+			return res.Body, -1, nil
+		}
+		res.Body.Close()
+		return nil, 0, fmt.Errorf("unexpected chunking")
+	}
+	return res.Body, res.ContentLength, nil
+}
+
+// FileTargets returns the nodes that files can be sent to.
+func (lc *LocalClient) FileTargets(ctx context.Context) ([]apitype.FileTarget, error) {
+	var fts []apitype.FileTarget
+	if err := lc.getJSON(ctx, "/localapi/v0/file-targets", &fts); err != nil {
+		return nil, err
+	}
+	return fts, nil
+}
+
+// FileTransfers returns the Taildrop file transfers in progress and
+// the most recently finished ones, in both directions.
+func (lc *LocalClient) FileTransfers(ctx context.Context) ([]ipn.FileTransfer, error) {
+	var fts []ipn.FileTransfer
+	if err := lc.getJSON(ctx, "/localapi/v0/file-transfers", &fts); err != nil {
+		return nil, err
+	}
+	return fts, nil
+}
+
+// PushFile sends the file name, whose contents r has size bytes (or -1
+// if unknown), to the node target by Taildrop.
+func (lc *LocalClient) PushFile(ctx context.Context, target tailcfg.StableNodeID, size int64, name string, r io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, "PUT", "http://local-tailscaled.sock/localapi/v0/file-put/"+string(target)+"/"+url.PathEscape(name), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	res, err := lc.DoLocalRequest(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 200 {
+		return errorFromResponse(res, body)
+	}
+	return nil
+}
+
+// CheckIPForwarding returns an error describing why IP forwarding
+// isn't set up correctly for advertising routes, if it isn't.
+func (lc *LocalClient) CheckIPForwarding(ctx context.Context) error {
+	var jres struct {
+		Warning string
+	}
+	if err := lc.getJSON(ctx, "/localapi/v0/check-ip-forwarding", &jres); err != nil {
+		return err
+	}
+	if jres.Warning != "" {
+		return errors.New(jres.Warning)
+	}
+	return nil
+}
+
+// GetPrefs returns the current prefs.
+func (lc *LocalClient) GetPrefs(ctx context.Context) (*ipn.Prefs, error) {
+	var p ipn.Prefs
+	if err := lc.getJSON(ctx, "/localapi/v0/prefs", &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// EditPrefs changes the prefs set in mp, returning the resulting
+// prefs.
+func (lc *LocalClient) EditPrefs(ctx context.Context, mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
+	mpj, err := json.Marshal(mp)
+	if err != nil {
+		return nil, err
+	}
+	body, err := lc.send(ctx, "PATCH", "/localapi/v0/prefs", http.StatusOK, bytes.NewReader(mpj))
+	if err != nil {
+		return nil, err
+	}
+	var p ipn.Prefs
+	if err := decodeJSON("/localapi/v0/prefs", body, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Start applies opts, such as the prefs to use or an auth key to log
+// in with, and starts tailscaled's state machine, as "tailscale up"
+// does.
+func (lc *LocalClient) Start(ctx context.Context, opts ipn.Options) error {
+	j, err := json.Marshal(opts)
+	if err != nil {
+		return err
+	}
+	_, err = lc.send(ctx, "POST", "/localapi/v0/start", http.StatusNoContent, bytes.NewReader(j))
+	return err
+}
+
+// StartLoginInteractive starts an interactive login. The URL to visit
+// to log in is sent to watchers of tailscaled's state.
+func (lc *LocalClient) StartLoginInteractive(ctx context.Context) error {
+	_, err := lc.send(ctx, "POST", "/localapi/v0/login-interactive", http.StatusNoContent, nil)
+	return err
+}
+
+// Logout logs out the current node.
+func (lc *LocalClient) Logout(ctx context.Context) error {
+	_, err := lc.send(ctx, "POST", "/localapi/v0/logout", http.StatusNoContent, nil)
+	return err
+}
+
+// PingType is the kind of ping done by Ping.
+type PingType string
+
+const (
+	// PingDisco pings the peer's magicsock with a discovery message.
+	PingDisco PingType = "disco"
+	// PingTSMP pings the peer with a TSMP ping, which goes through
+	// WireGuard and the peer's packet filter.
+	PingTSMP PingType = "TSMP"
+)
+
+// Ping pings the tailnet IP ip and waits for the result.
+func (lc *LocalClient) Ping(ctx context.Context, ip netaddr.IP, typ PingType) (*ipnstate.PingResult, error) {
+	v := url.Values{}
+	v.Set("ip", ip.String())
+	v.Set("type", string(typ))
+	body, err := lc.send(ctx, "POST", "/localapi/v0/ping?"+v.Encode(), 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	pr := new(ipnstate.PingResult)
+	if err := decodeJSON("/localapi/v0/ping", body, pr); err != nil {
+		return nil, err
+	}
+	return pr, nil
+}
+
+// SetDNS adds a DNS TXT record for the given domain name, containing
+// the provided TXT value. See the package-level SetDNS.
+func (lc *LocalClient) SetDNS(ctx context.Context, name, value string) error {
+	v := url.Values{}
+	v.Set("name", name)
+	v.Set("value", value)
+	_, err := lc.send(ctx, "POST", "/localapi/v0/set-dns?"+v.Encode(), 200, nil)
+	return err
+}
+
+// CurrentDERPMap returns the current DERPMap that is being used by the local tailscaled.
+func (lc *LocalClient) CurrentDERPMap(ctx context.Context) (*tailcfg.DERPMap, error) {
+	var derpMap tailcfg.DERPMap
+	if err := lc.getJSON(ctx, "/localapi/v0/derpmap", &derpMap); err != nil {
+		return nil, err
+	}
+	return &derpMap, nil
+}
+
+// WatchIPNBus subscribes to tailscaled's notification bus, which
+// carries state changes, network maps, login URLs, incoming file
+// progress and the like. mask selects which messages and fields are
+// sent; see ipn.NotifyWatchOpt.
+//
+// The caller must call Close on the returned watcher when done with
+// it. Canceling ctx also ends the watch.
+func (lc *LocalClient) WatchIPNBus(ctx context.Context, mask ipn.NotifyWatchOpt) (*IPNBusWatcher, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://local-tailscaled.sock/localapi/v0/watch-ipn-bus?mask="+strconv.FormatUint(uint64(mask), 10), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := lc.DoLocalRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, errorFromResponse(res, body)
+	}
+	return &IPNBusWatcher{
+		body: res.Body,
+		dec:  json.NewDecoder(res.Body),
+	}, nil
+}
+
+// IPNBusWatcher is an active subscription to tailscaled's notification
+// bus, as returned by LocalClient.WatchIPNBus.
+type IPNBusWatcher struct {
+	body io.ReadCloser
+	dec  *json.Decoder
+}
+
+// Next blocks until the next notification arrives and returns it. It
+// returns an error once the watch ends, such as when the watcher is
+// closed, its context is canceled or tailscaled goes away.
+func (w *IPNBusWatcher) Next() (ipn.Notify, error) {
+	var n ipn.Notify
+	if err := w.dec.Decode(&n); err != nil {
+		return ipn.Notify{}, err
+	}
+	return n, nil
+}
+
+// Close stops the watch.
+func (w *IPNBusWatcher) Close() error {
+	return w.body.Close()
+}
@@ -0,0 +1,252 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailscale
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// testClient returns a LocalClient whose requests are served by h.
+func testClient(t *testing.T, h http.HandlerFunc) *LocalClient {
+	t.Helper()
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+	return &LocalClient{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", ts.Listener.Addr().String())
+		},
+	}
+}
+
+func TestLocalClientStatus(t *testing.T) {
+	lc := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.URL.Path != "/localapi/v0/status" {
+			t.Errorf("got %s %s", r.Method, r.URL)
+		}
+		if r.Host != "local-tailscaled.sock" {
+			t.Errorf("Host = %q", r.Host)
+		}
+		st := &ipnstate.Status{BackendState: "Running", AuthURL: "peers"}
+		if r.FormValue("peers") == "false" {
+			st.AuthURL = "nopeers"
+		}
+		json.NewEncoder(w).Encode(st)
+	})
+	ctx := context.Background()
+	st, err := lc.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.BackendState != "Running" || st.AuthURL != "peers" {
+		t.Errorf("Status = %+v", st)
+	}
+	st, err = lc.StatusWithoutPeers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.AuthURL != "nopeers" {
+		t.Errorf("StatusWithoutPeers didn't ask for no peers")
+	}
+}
+
+func TestLocalClientEditPrefs(t *testing.T) {
+	lc := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PATCH" || r.URL.Path != "/localapi/v0/prefs" {
+			t.Errorf("got %s %s", r.Method, r.URL)
+		}
+		var mp ipn.MaskedPrefs
+		if err := json.NewDecoder(r.Body).Decode(&mp); err != nil {
+			t.Error(err)
+		}
+		if !mp.HostnameSet || mp.Hostname != "foo" || mp.RouteAllSet {
+			t.Errorf("MaskedPrefs = %v", mp.Pretty())
+		}
+		json.NewEncoder(w).Encode(&mp.Prefs)
+	})
+	p, err := lc.EditPrefs(context.Background(), &ipn.MaskedPrefs{
+		Prefs:       ipn.Prefs{Hostname: "foo"},
+		HostnameSet: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Hostname != "foo" {
+		t.Errorf("Hostname = %q", p.Hostname)
+	}
+}
+
+func TestLocalClientErrors(t *testing.T) {
+	lc := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/localapi/v0/prefs":
+			http.Error(w, "prefs access denied", http.StatusForbidden)
+		case "/localapi/v0/whois":
+			http.Error(w, "no match for IP:port", http.StatusNotFound)
+		case "/localapi/v0/set-dns":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(500)
+			io.WriteString(w, `{"error":"set-dns failed"}`)
+		}
+	})
+	ctx := context.Background()
+
+	_, err := lc.GetPrefs(ctx)
+	if !IsAccessDeniedError(err) || IsNotFoundError(err) {
+		t.Errorf("GetPrefs error = %v; want access denied", err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "prefs access denied") {
+		t.Errorf("GetPrefs error %q lacks server's message", err)
+	}
+
+	_, err = lc.WhoIs(ctx, "100.64.0.1:1234")
+	if !IsNotFoundError(err) {
+		t.Errorf("WhoIs error = %v; want not found", err)
+	}
+
+	err = lc.SetDNS(ctx, "_acme-challenge.foo", "bar")
+	if err == nil || err.Error() != "set-dns failed" {
+		t.Errorf("SetDNS error = %v; want JSON error message", err)
+	}
+	var e *LocalAPIError
+	if !errors.As(err, &e) || e.StatusCode != 500 {
+		t.Errorf("SetDNS error %#v isn't a 500 LocalAPIError", err)
+	}
+}
+
+func TestLocalClientPing(t *testing.T) {
+	lc := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/localapi/v0/ping" {
+			t.Errorf("got %s %s", r.Method, r.URL)
+		}
+		if got := r.FormValue("ip"); got != "100.64.0.2" {
+			t.Errorf("ip = %q", got)
+		}
+		if got := r.FormValue("type"); got != "TSMP" {
+			t.Errorf("type = %q", got)
+		}
+		json.NewEncoder(w).Encode(&ipnstate.PingResult{IP: "100.64.0.2", NodeName: "peer", LatencySeconds: 0.5})
+	})
+	pr, err := lc.Ping(context.Background(), netaddr.MustParseIP("100.64.0.2"), PingTSMP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr.NodeName != "peer" || pr.LatencySeconds != 0.5 {
+		t.Errorf("PingResult = %+v", pr)
+	}
+}
+
+func TestLocalClientStart(t *testing.T) {
+	lc := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/localapi/v0/start" {
+			t.Errorf("got %s %s", r.Method, r.URL)
+		}
+		var opts ipn.Options
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+			t.Error(err)
+		}
+		if opts.AuthKey != "tskey-123" || opts.UpdatePrefs == nil || !opts.UpdatePrefs.WantRunning {
+			t.Errorf("Options = %+v", opts)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	err := lc.Start(context.Background(), ipn.Options{
+		AuthKey:     "tskey-123",
+		UpdatePrefs: &ipn.Prefs{WantRunning: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalClientFiles(t *testing.T) {
+	lc := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/localapi/v0/files/a b.txt":
+			io.WriteString(w, "contents")
+		case r.Method == "PUT" && r.URL.Path == "/localapi/v0/file-put/nStable1/c.txt":
+			b, _ := ioutil.ReadAll(r.Body)
+			if string(b) != "sent" {
+				t.Errorf("pushed %q", b)
+			}
+		case r.Method == "GET" && r.URL.Path == "/localapi/v0/file-transfers":
+			json.NewEncoder(w).Encode([]ipn.FileTransfer{{ID: "1", Direction: ipn.FileSend, Name: "c.txt", State: ipn.FileTransferDone, Size: 4, Bytes: 4}})
+		default:
+			t.Errorf("got %s %s", r.Method, r.URL)
+			http.Error(w, "not found", 404)
+		}
+	})
+	ctx := context.Background()
+	rc, size, err := lc.GetWaitingFile(ctx, "a b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(b) != "contents" || size != int64(len("contents")) {
+		t.Errorf("GetWaitingFile = %q, %d", b, size)
+	}
+	if err := lc.PushFile(ctx, "nStable1", 4, "c.txt", strings.NewReader("sent")); err != nil {
+		t.Fatal(err)
+	}
+	fts, err := lc.FileTransfers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fts) != 1 || fts[0].Name != "c.txt" || fts[0].State != ipn.FileTransferDone {
+		t.Errorf("FileTransfers = %+v", fts)
+	}
+}
+
+func TestLocalClientWatchIPNBus(t *testing.T) {
+	lc := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/localapi/v0/watch-ipn-bus" {
+			t.Errorf("got %s %s", r.Method, r.URL)
+		}
+		if got, want := r.FormValue("mask"), "18"; got != want {
+			t.Errorf("mask = %q; want %q", got, want)
+		}
+		enc := json.NewEncoder(w)
+		running := ipn.Running
+		enc.Encode(ipn.Notify{State: &running})
+		url := "https://login.example.com/a/b"
+		enc.Encode(ipn.Notify{BrowseToURL: &url})
+	})
+	w, err := lc.WatchIPNBus(context.Background(), ipn.NotifyInitialState|ipn.NotifyNoNetMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	n, err := w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.State == nil || *n.State != ipn.Running {
+		t.Errorf("first Notify = %v; want state=Running", n)
+	}
+	n, err = w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.BrowseToURL == nil {
+		t.Errorf("second Notify = %v; want URL", n)
+	}
+	if _, err := w.Next(); err != io.EOF {
+		t.Errorf("Next at end = %v; want EOF", err)
+	}
+}
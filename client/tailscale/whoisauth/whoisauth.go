@@ -0,0 +1,192 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package whoisauth provides HTTP middleware that identifies the
+// tailnet user and node making each request with WhoIs and only lets
+// allowed callers through.
+package whoisauth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/types/logger"
+)
+
+// WhoIsFunc looks up the tailnet identity of remoteAddr, an ip:port
+// such as an http.Request's RemoteAddr.
+type WhoIsFunc func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+
+// LocalAPI is a WhoIsFunc that asks the local tailscaled. It only
+// identifies peers, as any local process can connect from the node's
+// own Tailscale IPs.
+func LocalAPI(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	return tailscale.WhoIsPeer(ctx, remoteAddr)
+}
+
+// WhoIser is implemented by *tsnet.Server.
+type WhoIser interface {
+	WhoIs(addr string) (w *apitype.WhoIsResponse, ok bool)
+}
+
+// errNotTailnet is returned by the WhoIsFunc of FromWhoIser for
+// callers that aren't on the tailnet.
+var errNotTailnet = errors.New("not a tailnet address")
+
+// FromWhoIser returns a WhoIsFunc that uses w, such as a
+// *tsnet.Server.
+func FromWhoIser(w WhoIser) WhoIsFunc {
+	return func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+		res, ok := w.WhoIs(remoteAddr)
+		if !ok {
+			return nil, errNotTailnet
+		}
+		return res, nil
+	}
+}
+
+// Policy says which tailnet callers are allowed. A caller is allowed
+// if it matches any of Users or Capabilities. The zero Policy allows
+// every tailnet caller.
+//
+// There's no way to allow nodes by ACL tag, as the network map only
+// carries the tags nodes requested, which they can set to anything.
+type Policy struct {
+	// Users are the login names of allowed users, such as
+	// "alice@example.com". Nodes that advertise tags never match
+	// Users, as a tagged node belongs to its tags rather than the
+	// user who created it.
+	Users []string
+
+	// Capabilities are node capabilities of allowed nodes, such as
+	// "https://tailscale.com/cap/is-admin".
+	Capabilities []string
+}
+
+// Allows reports whether p allows the caller w.
+func (p Policy) Allows(w *apitype.WhoIsResponse) bool {
+	if w == nil || w.Node == nil || w.UserProfile == nil {
+		return false
+	}
+	if len(p.Users) == 0 && len(p.Capabilities) == 0 {
+		return true
+	}
+	// Requested tags can only make a node lose its user's access,
+	// so they're safe to go by here.
+	tagged := len(w.Node.Hostinfo.RequestTags) > 0
+	return (!tagged && containsAny(p.Users, []string{w.UserProfile.LoginName})) ||
+		containsAny(p.Capabilities, w.Node.Capabilities)
+}
+
+func containsAny(allowed, have []string) bool {
+	for _, a := range allowed {
+		for _, h := range have {
+			if a == h {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Handler is an http.Handler that passes requests from callers allowed
+// by Policy to Next, with their identity in the request context (see
+// FromContext), and rejects all others with 403 Forbidden.
+//
+// Lookups are cached per connection if the http.Server's ConnContext
+// is ConnContext; otherwise every request does a lookup.
+type Handler struct {
+	WhoIs  WhoIsFunc
+	Policy Policy
+	Next   http.Handler
+
+	// Logf, if non-nil, logs rejected requests.
+	Logf logger.Logf
+}
+
+// New returns a Handler that uses whoIs to identify callers and
+// passes those allowed by pol to next.
+func New(whoIs WhoIsFunc, pol Policy, next http.Handler) *Handler {
+	return &Handler{WhoIs: whoIs, Policy: pol, Next: next}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	res, err := h.lookup(r)
+	if err != nil {
+		h.logf("whoisauth: rejecting %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if !h.Policy.Allows(res) {
+		h.logf("whoisauth: rejecting %s %s from %s (%s): not allowed", r.Method, r.URL.Path, r.RemoteAddr, res.UserProfile.LoginName)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	h.Next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), whoIsKey{}, res)))
+}
+
+func (h *Handler) logf(format string, args ...interface{}) {
+	if h.Logf != nil {
+		h.Logf(format, args...)
+	}
+}
+
+// lookup returns the identity of r's caller, from the connection's
+// cache if there is one.
+func (h *Handler) lookup(r *http.Request) (*apitype.WhoIsResponse, error) {
+	cc, _ := r.Context().Value(connCacheKey{}).(*connCache)
+	if cc == nil {
+		return h.whoIs(r)
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.res == nil {
+		res, err := h.whoIs(r)
+		if err != nil {
+			// Not cached, in case it was transient.
+			return nil, err
+		}
+		cc.res = res
+	}
+	return cc.res, nil
+}
+
+func (h *Handler) whoIs(r *http.Request) (*apitype.WhoIsResponse, error) {
+	res, err := h.WhoIs(r.Context(), r.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	if res == nil || res.Node == nil || res.UserProfile == nil {
+		return nil, errNotTailnet
+	}
+	return res, nil
+}
+
+type whoIsKey struct{}
+
+// FromContext returns the identity of the caller of a request that
+// was allowed by a Handler, given the request's context.
+func FromContext(ctx context.Context) (res *apitype.WhoIsResponse, ok bool) {
+	res, ok = ctx.Value(whoIsKey{}).(*apitype.WhoIsResponse)
+	return res, ok
+}
+
+type connCacheKey struct{}
+
+// connCache is the identity of the caller on one connection.
+type connCache struct {
+	mu  sync.Mutex
+	res *apitype.WhoIsResponse // nil until looked up
+}
+
+// ConnContext is an http.Server ConnContext func that makes Handlers
+// cache the caller's identity for the lifetime of each connection.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connCacheKey{}, new(connCache))
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package whoisauth
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func whoIsResponse(login string, tags, caps []string) *apitype.WhoIsResponse {
+	return &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{
+			Hostinfo:     tailcfg.Hostinfo{RequestTags: tags},
+			Capabilities: caps,
+		},
+		UserProfile: &tailcfg.UserProfile{LoginName: login},
+	}
+}
+
+func TestPolicyAllows(t *testing.T) {
+	alice := whoIsResponse("alice@example.com", nil, nil)
+	server := whoIsResponse("tagged-devices", []string{"tag:server"}, nil)
+	aliceServer := whoIsResponse("alice@example.com", []string{"tag:server"}, nil)
+	admin := whoIsResponse("bob@example.com", nil, []string{"https://tailscale.com/cap/is-admin"})
+	tests := []struct {
+		name string
+		pol  Policy
+		w    *apitype.WhoIsResponse
+		want bool
+	}{
+		{"zero_policy", Policy{}, alice, true},
+		{"zero_policy_nil", Policy{}, nil, false},
+		{"user", Policy{Users: []string{"alice@example.com"}}, alice, true},
+		{"other_user", Policy{Users: []string{"carol@example.com"}}, alice, false},
+		{"user_tagged_node", Policy{Users: []string{"alice@example.com"}}, aliceServer, false},
+		{"cap", Policy{Capabilities: []string{"https://tailscale.com/cap/is-admin"}}, admin, true},
+		{"tagged_user", Policy{Users: []string{"tagged-devices"}}, server, false},
+		{"any_of", Policy{Users: []string{"carol@example.com"}, Capabilities: []string{"https://tailscale.com/cap/is-admin"}}, admin, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.pol.Allows(tt.w); got != tt.want {
+				t.Errorf("Allows = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var lookups int32
+	var res atomic.Value // of *apitype.WhoIsResponse
+	res.Store((*apitype.WhoIsResponse)(nil))
+	whoIs := func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+		atomic.AddInt32(&lookups, 1)
+		w := res.Load().(*apitype.WhoIsResponse)
+		if w == nil {
+			return nil, errors.New("no such peer")
+		}
+		return w, nil
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		who, ok := FromContext(r.Context())
+		if !ok {
+			t.Errorf("no WhoIsResponse in context")
+			return
+		}
+		w.Write([]byte(who.UserProfile.LoginName))
+	})
+	ts := httptest.NewUnstartedServer(New(whoIs, Policy{Users: []string{"alice@example.com"}}, next))
+	ts.Config.ConnContext = ConnContext
+	ts.Start()
+	defer ts.Close()
+
+	get := func() (int, string) {
+		t.Helper()
+		resp, err := ts.Client().Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	if code, _ := get(); code != http.StatusForbidden {
+		t.Errorf("non-tailnet caller got %v; want 403", code)
+	}
+
+	res.Store(whoIsResponse("bob@example.com", nil, nil))
+	if code, _ := get(); code != http.StatusForbidden {
+		t.Errorf("disallowed caller got %v; want 403", code)
+	}
+
+	// A new connection picks up the new identity; further requests
+	// on it are served from the cache.
+	ts.CloseClientConnections()
+	res.Store(whoIsResponse("alice@example.com", nil, nil))
+	before := atomic.LoadInt32(&lookups)
+	for i := 0; i < 3; i++ {
+		if code, body := get(); code != http.StatusOK || body != "alice@example.com" {
+			t.Errorf("allowed caller got %v, %q", code, body)
+		}
+	}
+	if n := atomic.LoadInt32(&lookups) - before; n != 1 {
+		t.Errorf("%d lookups for 3 requests on one connection; want 1", n)
+	}
+}
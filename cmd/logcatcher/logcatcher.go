@@ -0,0 +1,127 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The logcatcher binary is a self-hosted log server for logtail
+// clients such as tailscaled. Point clients at it with
+// TS_LOG_TARGET=https://<logcatcher's address>.
+//
+// It stores each client's logs on disk, keyed by collection and public
+// ID, and serves them back at /c/<collection>/<public ID>.
+package main // import "tailscale.com/cmd/logcatcher"
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"tailscale.com/smallzstd"
+	"tailscale.com/tsweb"
+)
+
+var (
+	addr           = flag.String("a", "127.0.0.1:8080", "server address; listening on addresses other than loopback requires --query-token-file")
+	dir            = flag.String("dir", "", "directory to store logs in")
+	retention      = flag.Duration("retention", 30*24*time.Hour, "how long to keep logs for, or 0 to keep them forever")
+	collections    = flag.String("collections", "", "optional comma-separated list of the collections to accept logs for; empty means any")
+	maxBodySize    = flag.Int64("max-upload-size", 8<<20, "maximum size of an upload, after decompression")
+	queryTokenFile = flag.String("query-token-file", "", "if non-empty, path to a file containing the bearer token required to query logs; whitespace is trimmed")
+	tlsCertFile    = flag.String("tls-cert", "", "if non-empty, path to a TLS certificate to serve HTTPS with")
+	tlsKeyFile     = flag.String("tls-key", "", "path to the -tls-cert certificate's private key")
+)
+
+// expireInterval is how often logs older than --retention are removed.
+const expireInterval = time.Hour
+
+func main() {
+	flag.Parse()
+	if *dir == "" {
+		log.Fatalf("logcatcher: --dir not specified")
+	}
+
+	// The decoder's memory limit is the maximum size of the
+	// decoded data, which is what we want here.
+	dec, err := smallzstd.NewDecoder(nil, zstd.WithDecoderMaxMemory(uint64(*maxBodySize)))
+	if err != nil {
+		log.Fatalf("logcatcher: %v", err)
+	}
+	s := &server{
+		store:       newStore(*dir, *retention),
+		maxBodySize: *maxBodySize,
+		decodeZstd: func(b []byte) ([]byte, error) {
+			return dec.DecodeAll(b, nil)
+		},
+	}
+	if *collections != "" {
+		s.collections = map[string]bool{}
+		for _, c := range strings.Split(*collections, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				s.collections[c] = true
+			}
+		}
+	}
+	if *queryTokenFile != "" {
+		b, err := ioutil.ReadFile(*queryTokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.queryToken = strings.TrimSpace(string(b))
+		if s.queryToken == "" {
+			log.Fatalf("logcatcher: %s is empty", *queryTokenFile)
+		}
+	}
+	if s.queryToken == "" && !isLoopbackAddr(*addr) {
+		log.Fatalf("logcatcher: --query-token-file is required to listen on %q, as anyone who can reach it could otherwise read all logs", *addr)
+	}
+
+	go expireLoop(s.store)
+
+	mux := http.NewServeMux()
+	mux.Handle("/c/", s)
+	tsweb.Debugger(mux)
+
+	httpsrv := &http.Server{
+		Addr:    *addr,
+		Handler: mux,
+	}
+	if *tlsCertFile != "" {
+		log.Printf("logcatcher: serving on %s with TLS", *addr)
+		err = httpsrv.ListenAndServeTLS(*tlsCertFile, *tlsKeyFile)
+	} else {
+		log.Printf("logcatcher: serving on %s", *addr)
+		err = httpsrv.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("logcatcher: %v", err)
+	}
+}
+
+// isLoopbackAddr reports whether the listen address addr is only
+// reachable from the local machine.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// expireLoop periodically removes logs older than the store's
+// retention.
+func expireLoop(st *store) {
+	for {
+		if err := st.expire(); err != nil {
+			log.Printf("expiring logs: %v", err)
+		}
+		time.Sleep(expireInterval)
+	}
+}
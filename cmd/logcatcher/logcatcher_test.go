@@ -0,0 +1,185 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/logtail"
+)
+
+func newTestServer(t *testing.T) (*server, *time.Time) {
+	dir, err := ioutil.TempDir("", "logcatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	now := time.Date(2021, 6, 10, 12, 0, 0, 0, time.UTC)
+	st := newStore(dir, 7*24*time.Hour)
+	st.now = func() time.Time { return now }
+	s := &server{
+		store:       st,
+		collections: map[string]bool{"test.log.example.com": true},
+		maxBodySize: 1 << 20,
+		decodeZstd: func([]byte) ([]byte, error) {
+			return nil, errors.New("no zstd in tests")
+		},
+	}
+	return s, &now
+}
+
+func do(s *server, method, path, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rec
+}
+
+func TestUploadAndQuery(t *testing.T) {
+	s, now := newTestServer(t)
+	priv, err := logtail.NewPrivateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := priv.Public().String()
+	upload := "/c/test.log.example.com/" + priv.String()
+
+	tests := []struct {
+		path, body string
+		want       int
+	}{
+		{upload, `{"text": "one"}`, 200},
+		{upload, `[{"text": "two"}, {"text": "three", "logtail": {"client_time": "2021-06-10T11:59:59Z"}}]`, 200},
+		{upload, `[{"text": "four"}, "bogus"]`, 400},
+		{upload, `not json`, 400},
+		{"/c/test.log.example.com/abc", `{"text": "bad ID"}`, 400},
+		{"/c/other.log.example.com/" + priv.String(), `{"text": "wrong collection"}`, 403},
+	}
+	for _, tt := range tests {
+		if rec := do(s, "POST", tt.path, tt.body); rec.Code != tt.want {
+			t.Errorf("POST %s %s: got %d; want %d: %s", tt.path, tt.body, rec.Code, tt.want, rec.Body)
+		}
+	}
+
+	query := func(params string) []string {
+		t.Helper()
+		rec := do(s, "GET", "/c/test.log.example.com/"+pub+params, "")
+		if rec.Code != 200 {
+			t.Fatalf("query %s: %d: %s", params, rec.Code, rec.Body)
+		}
+		var texts []string
+		for _, line := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n") {
+			if !strings.Contains(line, `"server_time":"2021-06-10T12:00:00Z"`) {
+				t.Errorf("entry missing server time: %s", line)
+			}
+			i := strings.Index(line, `"text":"`)
+			if i < 0 {
+				t.Fatalf("entry missing text: %s", line)
+			}
+			texts = append(texts, strings.SplitN(line[i+len(`"text":"`):], `"`, 2)[0])
+		}
+		return texts
+	}
+	if got, want := strings.Join(query(""), ","), "one,two,three,four"; got != want {
+		t.Errorf("query = %s; want %s", got, want)
+	}
+	if got, want := strings.Join(query("?n=2"), ","), "three,four"; got != want {
+		t.Errorf("query n=2 = %s; want %s", got, want)
+	}
+	if got, want := strings.Join(query("?q=thr"), ","), "three"; got != want {
+		t.Errorf("query q=thr = %s; want %s", got, want)
+	}
+	if rec := do(s, "GET", "/c/test.log.example.com/"+pub+"?since=2021-06-10T12:00:01Z", ""); rec.Body.Len() != 0 {
+		t.Errorf("query since later = %q; want nothing", rec.Body)
+	}
+
+	if rec := do(s, "GET", "/c/test.log.example.com", ""); strings.TrimSpace(rec.Body.String()) != pub {
+		t.Errorf("list = %q; want %s", rec.Body, pub)
+	}
+
+	s.queryToken = "secret"
+	if rec := do(s, "GET", "/c/", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("query without token: %d; want 401", rec.Code)
+	}
+	req := httptest.NewRequest("GET", "/c/", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if got := strings.TrimSpace(rec.Body.String()); got != "test.log.example.com" {
+		t.Errorf("list collections = %q", got)
+	}
+
+	// After the retention period, the logs are removed.
+	*now = now.Add(9 * 24 * time.Hour)
+	if err := s.store.expire(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(s.store.dir, "test.log.example.com")); !os.IsNotExist(err) {
+		t.Errorf("collection not removed after expiry: %v", err)
+	}
+}
+
+func TestFollow(t *testing.T) {
+	s, _ := newTestServer(t)
+	priv, err := logtail.NewPrivateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := "/c/test.log.example.com/" + priv.String()
+	do(s, "POST", upload, `{"text": "before-x"}`)
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	res, err := http.Get(ts.URL + "/c/test.log.example.com/" + priv.Public().String() + "?follow=1&n=10&q=-x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	br := bufio.NewReader(res.Body)
+	readText := func() string {
+		t.Helper()
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return line
+	}
+	if line := readText(); !strings.Contains(line, `"before-x"`) {
+		t.Errorf("got %s; want before", line)
+	}
+	do(s, "POST", upload, `[{"text": "skip"}, {"text": "after-x"}]`)
+	if line := readText(); !strings.Contains(line, `"after-x"`) {
+		t.Errorf("got %s; want after", line)
+	}
+}
+
+func TestIsLoopbackAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1:8080", true},
+		{"[::1]:8080", true},
+		{"localhost:8080", true},
+		{":8080", false},
+		{"0.0.0.0:8080", false},
+		{"100.64.0.1:8080", false},
+		{"example.com:8080", false},
+		{"bogus", false},
+	}
+	for _, tt := range tests {
+		if got := isLoopbackAddr(tt.addr); got != tt.want {
+			t.Errorf("isLoopbackAddr(%q) = %v; want %v", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/logtail"
+)
+
+var (
+	metricUploads        = expvar.NewInt("counter_logcatcher_uploads")
+	metricUploadErrors   = expvar.NewInt("counter_logcatcher_upload_errors")
+	metricEntries        = expvar.NewInt("counter_logcatcher_entries")
+	metricInvalidEntries = expvar.NewInt("counter_logcatcher_invalid_entries")
+	metricUploadBytes    = expvar.NewInt("counter_logcatcher_upload_bytes")
+)
+
+// validCollection matches the collection names the server accepts,
+// like "tailnode.log.tailscale.io".
+var validCollection = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,127}$`)
+
+// server implements the logtail upload API, and an API to query and
+// tail the uploaded logs:
+//
+//	POST /c/<collection>/<private ID>  uploads logs, like logtail.Logger
+//	GET  /c/                           lists collections
+//	GET  /c/<collection>               lists a collection's public IDs
+//	GET  /c/<collection>/<public ID>   returns logs as JSON lines
+//
+// Logs are filtered with the query parameters since and until (RFC
+// 3339 times, by server time; since defaults to a day ago), q (a
+// substring) and n (the maximum number of the newest entries,
+// default 1000). With follow=1, the newest n entries are followed by
+// new ones as they're uploaded.
+type server struct {
+	store *store
+
+	// collections, if non-nil, are the only collections that can
+	// be uploaded to.
+	collections map[string]bool
+
+	// queryToken, if non-empty, is the bearer token required to
+	// read logs. main only leaves it empty when listening on a
+	// loopback address.
+	queryToken string
+
+	// maxBodySize is the maximum size of an upload, after
+	// decompression.
+	maxBodySize int64
+
+	// decodeZstd decompresses a zstd upload, failing if it's
+	// larger than maxBodySize.
+	decodeZstd func([]byte) ([]byte, error)
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/c/")
+	if path == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+	parts := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	if len(parts) > 2 || len(parts) > 0 && parts[0] != "" && !validCollection.MatchString(parts[0]) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == "POST" {
+		if len(parts) != 2 {
+			http.Error(w, "want POST /c/<collection>/<private ID>", http.StatusNotFound)
+			return
+		}
+		s.serveUpload(w, r, parts[0], parts[1])
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.permitQuery(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="logcatcher"`)
+		http.Error(w, "query token required", http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case parts[0] == "":
+		s.serveList(w, r)
+	case len(parts) == 1:
+		s.serveList(w, r, parts[0])
+	default:
+		s.serveQuery(w, r, parts[0], parts[1])
+	}
+}
+
+func (s *server) permitQuery(r *http.Request) bool {
+	if s.queryToken == "" {
+		return true
+	}
+	tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(tok), []byte(s.queryToken)) == 1
+}
+
+// serveUpload stores the log entries uploaded by the instance with
+// the private ID privID to collection.
+//
+// Errors the client can't fix by retrying are 400s, which
+// logtail.Logger treats as a successful upload.
+func (s *server) serveUpload(w http.ResponseWriter, r *http.Request, collection, privID string) {
+	metricUploads.Add(1)
+	uploadError := func(msg string, code int) {
+		metricUploadErrors.Add(1)
+		http.Error(w, msg, code)
+	}
+	if s.collections != nil && !s.collections[collection] {
+		uploadError("unknown collection", http.StatusForbidden)
+		return
+	}
+	id, err := logtail.ParsePrivateID(privID)
+	if err != nil || id.IsZero() {
+		uploadError("invalid private ID", http.StatusBadRequest)
+		return
+	}
+	inst := instance{collection: collection, id: id.Public()}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, s.maxBodySize+1))
+	if err != nil {
+		uploadError(err.Error(), http.StatusBadRequest)
+		return
+	}
+	if int64(len(body)) > s.maxBodySize {
+		uploadError("upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	metricUploadBytes.Add(int64(len(body)))
+	switch enc := r.Header.Get("Content-Encoding"); enc {
+	case "":
+	case "zstd":
+		if n, err := strconv.ParseInt(r.Header.Get("Orig-Content-Length"), 10, 64); err == nil && n > s.maxBodySize {
+			uploadError("upload too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, err = s.decodeZstd(body)
+		if err != nil {
+			uploadError("zstd: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		uploadError(fmt.Sprintf("unsupported Content-Encoding %q", enc), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	entries, invalid := parseUpload(body, s.store.now())
+	metricEntries.Add(int64(len(entries)))
+	metricInvalidEntries.Add(int64(invalid))
+	if len(entries) > 0 {
+		if err := s.store.append(inst, entries); err != nil {
+			log.Printf("storing logs for %s/%s: %v", collection, inst.id, err)
+			uploadError("storage error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if invalid > 0 {
+		uploadError(fmt.Sprintf("%d invalid log entries", invalid), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseUpload parses an upload body, a JSON log entry object or an
+// array of them, and returns its entries with their logtail metadata's
+// server_time set to now, and the number of invalid entries.
+func parseUpload(body []byte, now time.Time) (entries [][]byte, invalid int) {
+	body = bytes.TrimSpace(body)
+	var raws []json.RawMessage
+	if len(body) > 0 && body[0] == '[' {
+		if err := json.Unmarshal(body, &raws); err != nil {
+			return nil, 1
+		}
+	} else if len(body) > 0 {
+		raws = []json.RawMessage{body}
+	}
+	serverTime, _ := json.Marshal(now.UTC().Format(time.RFC3339Nano))
+	for _, raw := range raws {
+		var e map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &e); err != nil || e == nil {
+			invalid++
+			continue
+		}
+		meta := map[string]json.RawMessage{}
+		if m, ok := e["logtail"]; ok {
+			if err := json.Unmarshal(m, &meta); err != nil || meta == nil {
+				meta = map[string]json.RawMessage{}
+			}
+		}
+		meta["server_time"] = serverTime
+		e["logtail"], _ = json.Marshal(meta)
+		b, err := json.Marshal(e)
+		if err != nil {
+			invalid++
+			continue
+		}
+		entries = append(entries, b)
+	}
+	return entries, invalid
+}
+
+// serveList writes the collections, or with a collection, its public
+// IDs, one per line.
+func (s *server) serveList(w http.ResponseWriter, r *http.Request, dir ...string) {
+	names, err := s.store.list(dir...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, n := range names {
+		fmt.Fprintln(w, n)
+	}
+}
+
+// serveQuery writes the logs of the instance with the public ID pubID
+// in collection.
+func (s *server) serveQuery(w http.ResponseWriter, r *http.Request, collection, pubID string) {
+	id, err := logtail.ParsePublicID(pubID)
+	if err != nil {
+		http.Error(w, "invalid public ID", http.StatusBadRequest)
+		return
+	}
+	inst := instance{collection: collection, id: id}
+
+	q := query{
+		since:  s.store.now().Add(-24 * time.Hour),
+		substr: r.FormValue("q"),
+		max:    1000,
+	}
+	for name, t := range map[string]*time.Time{"since": &q.since, "until": &q.until} {
+		if v := r.FormValue(name); v != "" {
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s: %v", name, err), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if v := r.FormValue("n"); v != "" {
+		if q.max, err = strconv.Atoi(v); err != nil || q.max < 0 {
+			http.Error(w, "invalid n", http.StatusBadRequest)
+			return
+		}
+	}
+	follow, _ := strconv.ParseBool(r.FormValue("follow"))
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !follow {
+		entries, err := s.store.query(inst, q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeEntries(w, entries)
+		return
+	}
+
+	recent, ch, cancel, err := s.store.tail(inst, q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer cancel()
+	writeEntries(w, recent)
+	f, _ := w.(http.Flusher)
+	for {
+		if f != nil {
+			f.Flush()
+		}
+		select {
+		case e := <-ch:
+			if q.substr != "" && !bytes.Contains(e, []byte(q.substr)) {
+				continue
+			}
+			if err := writeEntries(w, [][]byte{e}); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeEntries(w io.Writer, entries [][]byte) error {
+	for _, e := range entries {
+		if _, err := w.Write(e); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/logtail"
+)
+
+// dayFormat is the time format of the names of a store's files, one
+// per instance per UTC day.
+const dayFormat = "2006-01-02"
+
+// instance identifies the logs of one logtail client.
+type instance struct {
+	collection string
+	id         logtail.PublicID
+}
+
+// store is an append-only, on-disk store of log entries. Each
+// instance's entries are JSON lines in files named like
+// <dir>/<collection>/<public ID>/2006-01-02.json, by the UTC day the
+// server received them on.
+//
+// Changes to a directory's files are serialized by its lock (see
+// lockDir), so different instances' logs are written concurrently.
+type store struct {
+	dir       string
+	retention time.Duration // or 0 to keep logs forever
+	now       func() time.Time
+
+	mu       sync.Mutex // guards the following; never held during file I/O
+	tails    map[instance]map[chan []byte]bool
+	dirLocks map[string]*dirLock
+}
+
+// dirLock is the lock of one of a store's directories.
+type dirLock struct {
+	mu   sync.Mutex
+	refs int // lockDir callers holding or waiting for mu; guarded by store.mu
+}
+
+func newStore(dir string, retention time.Duration) *store {
+	return &store{
+		dir:       dir,
+		retention: retention,
+		now:       time.Now,
+		tails:     map[instance]map[chan []byte]bool{},
+		dirLocks:  map[string]*dirLock{},
+	}
+}
+
+// lockDir locks the store's directory dir, which needn't exist, and
+// returns the func to unlock it.
+func (s *store) lockDir(dir string) (unlock func()) {
+	s.mu.Lock()
+	l := s.dirLocks[dir]
+	if l == nil {
+		l = &dirLock{}
+		s.dirLocks[dir] = l
+	}
+	l.refs++
+	s.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(s.dirLocks, dir)
+		}
+	}
+}
+
+func (s *store) instanceDir(inst instance) string {
+	return filepath.Join(s.dir, inst.collection, inst.id.String())
+}
+
+// append appends entries, each a JSON object without a trailing
+// newline, to inst's logs, and sends them to inst's tails.
+func (s *store) append(inst instance, entries [][]byte) error {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		buf.Write(e)
+		buf.WriteByte('\n')
+	}
+
+	dir := s.instanceDir(inst)
+	defer s.lockDir(dir)()
+	// Hold the collection's lock too, so expire doesn't remove it
+	// before the instance's directory is created in it.
+	unlockCollection := s.lockDir(filepath.Dir(dir))
+	err := os.MkdirAll(dir, 0700)
+	unlockCollection()
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(dir, s.now().UTC().Format(dayFormat)+".json")
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.tails[inst] {
+		for _, e := range entries {
+			select {
+			case ch <- e:
+			default:
+				// The tail's reader is too slow; it misses out.
+			}
+		}
+	}
+	return nil
+}
+
+// query is a filter on log entries.
+type query struct {
+	since, until time.Time // by server time; zero means unbounded
+	substr       string    // if non-empty, only entries containing it
+	max          int       // return at most this many of the newest entries; 0 for all
+}
+
+func (q query) match(e []byte, serverTime time.Time) bool {
+	if !q.since.IsZero() && serverTime.Before(q.since) {
+		return false
+	}
+	if !q.until.IsZero() && !serverTime.Before(q.until) {
+		return false
+	}
+	return q.substr == "" || bytes.Contains(e, []byte(q.substr))
+}
+
+// entryServerTime returns the time the server received the stored log
+// entry e, or the zero time if it's unknown.
+func entryServerTime(e []byte) time.Time {
+	var v struct {
+		Logtail struct {
+			ServerTime time.Time `json:"server_time"`
+		} `json:"logtail"`
+	}
+	json.Unmarshal(e, &v)
+	return v.Logtail.ServerTime
+}
+
+// query returns inst's log entries that match q, oldest first.
+func (s *store) query(inst instance, q query) ([][]byte, error) {
+	days, err := s.days(inst)
+	if err != nil {
+		return nil, err
+	}
+	var res [][]byte
+	for _, day := range days {
+		t, _ := time.Parse(dayFormat, day)
+		if !q.since.IsZero() && t.Add(24*time.Hour).Before(q.since) {
+			continue
+		}
+		if !q.until.IsZero() && !t.Before(q.until) {
+			break
+		}
+		res, err = s.scan(inst, day, q, res)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// scan appends the entries in inst's file for day that match q to res,
+// keeping at most q.max of them.
+func (s *store) scan(inst instance, day string, q query, res [][]byte) ([][]byte, error) {
+	f, err := os.Open(filepath.Join(s.instanceDir(inst), day+".json"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	bs := bufio.NewScanner(f)
+	bs.Buffer(nil, 16<<20)
+	for bs.Scan() {
+		e := bs.Bytes()
+		if len(e) == 0 || !q.match(e, entryServerTime(e)) {
+			continue
+		}
+		res = append(res, append([]byte(nil), e...))
+		if q.max > 0 && len(res) > q.max {
+			res = res[1:]
+		}
+	}
+	return res, bs.Err()
+}
+
+// days returns the days that inst has logs for, oldest first.
+func (s *store) days(inst instance) ([]string, error) {
+	fis, err := ioutil.ReadDir(s.instanceDir(inst))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var days []string
+	for _, fi := range fis {
+		day := strings.TrimSuffix(fi.Name(), ".json")
+		if _, err := time.Parse(dayFormat, day); err == nil && day != fi.Name() {
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+// tail returns inst's log entries that match q, unless q.max is 0, and
+// a channel of the entries appended after them. The caller must call
+// cancel when it's done with the channel.
+func (s *store) tail(inst instance, q query) (recent [][]byte, ch <-chan []byte, cancel func(), err error) {
+	// Holding the instance's lock means nothing is appended between
+	// the query and the tail starting.
+	defer s.lockDir(s.instanceDir(inst))()
+	if q.max > 0 {
+		recent, err = s.query(inst, q)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	c := make(chan []byte, 256)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tails[inst] == nil {
+		s.tails[inst] = map[chan []byte]bool{}
+	}
+	s.tails[inst][c] = true
+	cancel = func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.tails[inst], c)
+		if len(s.tails[inst]) == 0 {
+			delete(s.tails, inst)
+		}
+	}
+	return recent, c, cancel, nil
+}
+
+// list returns the names of the subdirectories of the store's
+// directory dir, such as collections or the instances in a collection.
+func (s *store) list(dir ...string) ([]string, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(append([]string{s.dir}, dir...)...))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fis {
+		if fi.IsDir() {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
+
+// expire removes the files of logs older than the store's retention,
+// then instance and collection directories left empty.
+func (s *store) expire() error {
+	if s.retention <= 0 {
+		return nil
+	}
+	cutoff := s.now().Add(-s.retention)
+
+	collections, err := s.list()
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for _, c := range collections {
+		ids, _ := s.list(c)
+		for _, id := range ids {
+			if err := s.expireDir(filepath.Join(s.dir, c, id), cutoff); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		// Fails, as it should, unless the collection is now empty.
+		cdir := filepath.Join(s.dir, c)
+		unlock := s.lockDir(cdir)
+		os.Remove(cdir)
+		unlock()
+	}
+	return firstErr
+}
+
+// expireDir removes the files of logs older than cutoff from the
+// instance directory dir, and dir too if that leaves it empty.
+func (s *store) expireDir(dir string, cutoff time.Time) error {
+	defer s.lockDir(dir)()
+	fis, _ := ioutil.ReadDir(dir)
+	left := len(fis)
+	var firstErr error
+	for _, fi := range fis {
+		day, err := time.Parse(dayFormat, strings.TrimSuffix(fi.Name(), ".json"))
+		if err != nil || !day.Add(24*time.Hour).Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		left--
+	}
+	if left == 0 {
+		os.Remove(dir)
+	}
+	return firstErr
+}
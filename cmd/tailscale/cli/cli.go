@@ -106,6 +106,7 @@ change in the future.
 			versionCmd,
 			webCmd,
 			fileCmd,
+			serveCmd,
 			bugReportCmd,
 		},
 		FlagSet:   rootfs,
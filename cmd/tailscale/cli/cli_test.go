@@ -568,6 +568,96 @@ func TestPrefsFromUpArgs(t *testing.T) {
 			},
 			wantErr: `invalid value --netfilter-mode="bogus"`,
 		},
+		{
+			name: "auto_exit_node",
+			args: upArgsFromOSArgs("linux", "--exit-node=auto", "--exit-node-allow-lan-access"),
+			want: &ipn.Prefs{
+				ControlURL:             ipn.DefaultControlURL,
+				WantRunning:            true,
+				AllowSingleHosts:       true,
+				CorpDNS:                true,
+				NetfilterMode:          preftype.NetfilterOn,
+				AutoExitNode:           true,
+				ExitNodeAllowLANAccess: true,
+			},
+		},
+		{
+			name: "exit_node_bypass",
+			args: upArgsFromOSArgs("linux",
+				"--exit-node=100.105.106.107",
+				"--exit-node-bypass-prefixes=52.1.2.3/8,2001:db8::/32,192.0.2.1",
+				"--exit-node-bypass-domains=zoom.us,meet.google.com.",
+			),
+			want: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				WantRunning:      true,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+				ExitNodeIP:       netaddr.MustParseIP("100.105.106.107"),
+				ExitNodeBypassPrefixes: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("52.0.0.0/8"),
+					netaddr.MustParseIPPrefix("2001:db8::/32"),
+					netaddr.MustParseIPPrefix("192.0.2.1/32"),
+				},
+				ExitNodeBypassDomains: []string{"zoom.us", "meet.google.com"},
+			},
+		},
+		{
+			name: "error_exit_node_bypass_without_exit_node",
+			args: upArgsT{
+				exitNodeBypassPrefixes: "52.0.0.0/8",
+			},
+			wantErr: "--exit-node-bypass-prefixes can only be used with --exit-node",
+		},
+		{
+			name: "static_endpoints_and_exclusions",
+			args: upArgsFromOSArgs("linux",
+				"--static-endpoints=203.0.113.1:41641,[2001:db8::1]:41641",
+				"--exclude-endpoint-interfaces=docker0,veth*",
+				"--exclude-endpoint-prefixes=172.17.0.1/16",
+			),
+			want: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				WantRunning:      true,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+				StaticEndpoints: []netaddr.IPPort{
+					netaddr.MustParseIPPort("203.0.113.1:41641"),
+					netaddr.MustParseIPPort("[2001:db8::1]:41641"),
+				},
+				ExcludeEndpointInterfaces: []string{"docker0", "veth*"},
+				ExcludeEndpointPrefixes: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("172.17.0.0/16"),
+				},
+			},
+		},
+		{
+			name: "exclude_endpoint_bare_ips",
+			args: upArgsFromOSArgs("linux",
+				"--exclude-endpoint-prefixes=192.168.1.5,fd00::1,10.0.0.0/8",
+			),
+			want: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				WantRunning:      true,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+				ExcludeEndpointPrefixes: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("192.168.1.5/32"),
+					netaddr.MustParseIPPrefix("fd00::1/128"),
+					netaddr.MustParseIPPrefix("10.0.0.0/8"),
+				},
+			},
+		},
+		{
+			name: "error_exclude_endpoint_prefix_invalid",
+			args: upArgsT{
+				excludeEndpointNets: "foo",
+			},
+			wantErr: `"foo" is not a valid IP address or CIDR prefix`,
+		},
 		{
 			name: "error_exit_node_ip_is_self_ip",
 			args: upArgsT{
@@ -675,6 +765,12 @@ func TestPrefFlagMapping(t *testing.T) {
 		case "NotepadURLs":
 			// TODO(bradfitz): https://github.com/tailscale/tailscale/issues/1830
 			continue
+		case "Serve":
+			// Set by "tailscale serve" and preserved by runUp.
+			continue
+		case "FileAutoAcceptDir", "FileMaxInboxSize", "FileMaxSize", "FileAllowSenders", "FileDenySenders":
+			// Set by "tailscale file config" and preserved by runUp.
+			continue
 		}
 		t.Errorf("unexpected new ipn.Pref field %q is not handled by up.go (see addPrefFlagMapping and checkForAccidentalSettingReverts)", prefName)
 	}
@@ -796,3 +892,63 @@ func TestUpdatePrefs(t *testing.T) {
 		})
 	}
 }
+
+func TestParseServeTarget(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		in        string
+		wantProxy string
+		wantDir   string
+		wantErr   bool
+	}{
+		{in: "3000", wantProxy: "http://127.0.0.1:3000"},
+		{in: "localhost:8080", wantProxy: "http://localhost:8080"},
+		{in: "http://127.0.0.1:3000/app", wantProxy: "http://127.0.0.1:3000/app"},
+		{in: "https://127.0.0.1:8443", wantProxy: "https://127.0.0.1:8443"},
+		{in: dir, wantDir: dir},
+		{in: dir + "/does-not-exist", wantErr: true},
+		{in: "example.com", wantErr: true},
+		{in: "99999", wantErr: true},
+	}
+	for _, tt := range tests {
+		proxy, dir, err := parseServeTarget(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseServeTarget(%q) error = %v; wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if proxy != tt.wantProxy || dir != tt.wantDir {
+			t.Errorf("parseServeTarget(%q) = %q, %q; want %q, %q", tt.in, proxy, dir, tt.wantProxy, tt.wantDir)
+		}
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"500", 500, false},
+		{"10K", 10 << 10, false},
+		{"10m", 10 << 20, false},
+		{"2G", 2 << 30, false},
+		{"1T", 1 << 40, false},
+		{"", 0, true},
+		{"G", 0, true},
+		{"-1", 0, true},
+		{"1.5G", 0, true},
+		{"1P", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.in)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("parseByteSize(%q) = %v, %v; want %v, err %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+		if err == nil {
+			if back, _ := parseByteSize(formatByteSize(got)); back != got && got != 0 {
+				t.Errorf("formatByteSize(%v) = %q doesn't round-trip", got, formatByteSize(got))
+			}
+		}
+	}
+}
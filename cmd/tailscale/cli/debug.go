@@ -15,10 +15,13 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/peterbourgon/ff/v2/ffcli"
 	"tailscale.com/client/tailscale"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
 )
@@ -26,6 +29,9 @@ import (
 var debugCmd = &ffcli.Command{
 	Name: "debug",
 	Exec: runDebug,
+	Subcommands: []*ffcli.Command{
+		debugPeerCmd,
+	},
 	FlagSet: (func() *flag.FlagSet {
 		fs := flag.NewFlagSet("debug", flag.ExitOnError)
 		fs.BoolVar(&debugArgs.goroutines, "daemon-goroutines", false, "If true, dump the tailscaled daemon's goroutines")
@@ -141,3 +147,97 @@ func runDebug(ctx context.Context, args []string) error {
 	}
 	return nil
 }
+
+var debugPeerCmd = &ffcli.Command{
+	Name:       "peer",
+	ShortUsage: "debug peer [--json] <hostname-or-IP>",
+	ShortHelp:  "Show path latency, loss and path change history for a peer",
+	Exec:       runDebugPeer,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("peer", flag.ExitOnError)
+		fs.BoolVar(&debugPeerArgs.json, "json", false, "output the peer's status in JSON format")
+		return fs
+	})(),
+}
+
+var debugPeerArgs struct {
+	json bool
+}
+
+func runDebugPeer(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: debug peer <hostname-or-IP>")
+	}
+	st, err := tailscale.Status(ctx)
+	if err != nil {
+		return err
+	}
+	ps := findPeer(st, args[0])
+	if ps == nil {
+		return fmt.Errorf("no peer found matching %q", args[0])
+	}
+	if debugPeerArgs.json {
+		j, _ := json.MarshalIndent(ps, "", "\t")
+		fmt.Printf("%s\n", j)
+		return nil
+	}
+
+	fmt.Printf("Peer:    %s (%s)\n", dnsOrQuoteHostname(st, ps), firstIPString(ps.TailscaleIPs))
+	switch {
+	case ps.CurAddr != "":
+		fmt.Printf("Path:    direct %s\n", ps.CurAddr)
+	case ps.Relay != "":
+		fmt.Printf("Path:    relay %q\n", ps.Relay)
+	default:
+		fmt.Printf("Path:    none\n")
+	}
+	ss := ps.PathStats
+	if ss == nil {
+		fmt.Printf("\nNo path statistics for this peer.\n")
+		return nil
+	}
+	fmt.Printf("Pings:   %d sent, %d pongs, %d lost (%.1f%% loss)\n",
+		ss.PingsSent, ss.PongsReceived, ss.PingsLost, ss.LossFraction*100)
+
+	if len(ss.Latency) > 0 {
+		fmt.Printf("\nRecent latency:\n")
+		tw := tabwriter.NewWriter(os.Stdout, 0, 2, 2, ' ', 0)
+		for _, l := range ss.Latency {
+			fmt.Fprintf(tw, "  %s\t%s\t%v\n", l.At.Local().Format(time.Stamp), l.Addr,
+				time.Duration(l.LatencySeconds*float64(time.Second)).Round(100*time.Microsecond))
+		}
+		tw.Flush()
+	}
+	if len(ss.PathChanges) > 0 {
+		fmt.Printf("\nPath changes:\n")
+		tw := tabwriter.NewWriter(os.Stdout, 0, 2, 2, ' ', 0)
+		for _, c := range ss.PathChanges {
+			from, to := c.From, c.To
+			if from == "" {
+				from = "-"
+			}
+			if to == "" {
+				to = "-"
+			}
+			fmt.Fprintf(tw, "  %s\t%s -> %s\t%s\n", c.At.Local().Format(time.Stamp), from, to, c.Reason)
+		}
+		tw.Flush()
+	}
+	return nil
+}
+
+// findPeer returns the peer in st whose MagicDNS name, hostname or
+// Tailscale IP is hostOrIP, or nil if there isn't one.
+func findPeer(st *ipnstate.Status, hostOrIP string) *ipnstate.PeerStatus {
+	for _, ps := range st.Peer {
+		if hostOrIP == dnsOrQuoteHostname(st, ps) || hostOrIP == ps.DNSName || hostOrIP == ps.HostName {
+			return ps
+		}
+		for _, ip := range ps.TailscaleIPs {
+			if hostOrIP == ip.String() {
+				return ps
+			}
+		}
+	}
+	return nil
+}
@@ -7,6 +7,9 @@ package cli
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -30,16 +33,20 @@ import (
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn"
 	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/dirtar"
 	"tailscale.com/version"
 )
 
 var fileCmd = &ffcli.Command{
 	Name:       "file",
-	ShortUsage: "file <cp|get> ...",
+	ShortUsage: "file <cp|get|config|status> ...",
 	ShortHelp:  "Send or receive files",
 	Subcommands: []*ffcli.Command{
 		fileCpCmd,
 		fileGetCmd,
+		fileConfigCmd,
+		fileStatusCmd,
 	},
 	Exec: func(context.Context, []string) error {
 		// TODO(bradfitz): is there a better ffcli way to
@@ -52,7 +59,7 @@ var fileCmd = &ffcli.Command{
 var fileCpCmd = &ffcli.Command{
 	Name:       "cp",
 	ShortUsage: "file cp <files...> <target>:",
-	ShortHelp:  "Copy file(s) to a host",
+	ShortHelp:  "Copy files or directories to a host",
 	Exec:       runCp,
 	FlagSet: (func() *flag.FlagSet {
 		fs := flag.NewFlagSet("cp", flag.ExitOnError)
@@ -96,7 +103,7 @@ func runCp(ctx context.Context, args []string) error {
 		return err
 	}
 
-	peerAPIBase, isOffline, err := discoverPeerAPIBase(ctx, ip)
+	stableID, isOffline, err := discoverFileTarget(ctx, ip)
 	if err != nil {
 		return fmt.Errorf("can't send to %s: %v", target, err)
 	}
@@ -119,6 +126,8 @@ func runCp(ctx context.Context, args []string) error {
 		var fileContents io.Reader
 		var name = cpArgs.name
 		var contentLength int64 = -1
+		var file *os.File // if non-nil, sent instead of fileContents, resumably
+		var isDir bool
 		if fileArg == "-" {
 			fileContents = os.Stdin
 			if name == "" {
@@ -141,45 +150,194 @@ func runCp(ctx context.Context, args []string) error {
 				return err
 			}
 			if fi.IsDir() {
-				return errors.New("directories not supported")
+				isDir = true
+			} else {
+				contentLength = fi.Size()
+				file = f
 			}
-			contentLength = fi.Size()
-			fileContents = io.LimitReader(f, contentLength)
 			if name == "" {
-				name = filepath.Base(fileArg)
+				abs, err := filepath.Abs(fileArg)
+				if err != nil {
+					return err
+				}
+				name = filepath.Base(abs)
 			}
+		}
 
-			if slow, _ := strconv.ParseBool(os.Getenv("TS_DEBUG_SLOW_PUSH")); slow {
-				fileContents = &slowReader{r: fileContents}
+		dstURL := "http://local-tailscaled.sock/localapi/v0/file-put/" + string(stableID) + "/" + url.PathEscape(name)
+		prog := newProgressBar(name, contentLength)
+		if isDir {
+			err = putDir(ctx, dstURL+"/", fileArg, prog)
+		} else if file != nil {
+			err = putFileResumable(ctx, dstURL, file, contentLength, prog)
+		} else {
+			err = putFile(ctx, dstURL, fileContents, 0, contentLength, "", prog)
+		}
+		prog.done(err)
+		var pe *putError
+		if errors.As(err, &pe) {
+			if pe.code == http.StatusForbidden && strings.TrimSpace(string(pe.body)) == "not owner" {
+				return fmt.Errorf("can't send to %s: owned by different user who doesn't accept files from you", target)
 			}
+			os.Stdout.Write(pe.body)
 		}
-
-		dstURL := peerAPIBase + "/v0/put/" + url.PathEscape(name)
-		req, err := http.NewRequestWithContext(ctx, "PUT", dstURL, fileContents)
 		if err != nil {
 			return err
 		}
-		req.ContentLength = contentLength
-		if cpArgs.verbose {
-			log.Printf("sending to %v ...", dstURL)
+	}
+	return nil
+}
+
+// putError is a non-200 response to a file PUT.
+type putError struct {
+	status string
+	code   int
+	body   []byte
+}
+
+func (e *putError) Error() string { return e.status }
+
+// maxPutAttempts is how many times putFileResumable tries to send a
+// file before giving up.
+const maxPutAttempts = 10
+
+// putFileResumable sends f, which has size bytes, to the LocalAPI put
+// URL dstURL. Each attempt, including the first so that a transfer an
+// earlier run was interrupted in is resumed too, starts after the bytes
+// the receiver already has. The receiver verifies the whole file
+// against its SHA-256 hash.
+func putFileResumable(ctx context.Context, dstURL string, f *os.File, size int64, prog *progressBar) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, size)); err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	for attempt := 1; ; attempt++ {
+		offset, err := resumeOffset(ctx, dstURL, f, size)
+		if err == nil {
+			err = putFile(ctx, dstURL, io.NewSectionReader(f, offset, size-offset), offset, size, sum, prog)
+			if err == nil {
+				return nil
+			}
 		}
-		res, err := http.DefaultClient.Do(req)
-		if err != nil {
+		var pe *putError
+		if errors.As(err, &pe) && pe.code < 500 {
 			return err
 		}
-		if res.StatusCode == 200 {
-			io.Copy(ioutil.Discard, res.Body)
-			res.Body.Close()
-			continue
+		if ctx.Err() != nil || attempt == maxPutAttempts {
+			return err
+		}
+		delay := time.Duration(attempt) * time.Second
+		fmt.Fprintf(os.Stderr, "# transfer interrupted: %v; resuming in %v\n", err, delay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
 		}
-		io.Copy(os.Stdout, res.Body)
-		res.Body.Close()
-		return errors.New(res.Status)
 	}
-	return nil
 }
 
-func discoverPeerAPIBase(ctx context.Context, ipStr string) (base string, isOffline bool, err error) {
+// resumeOffset returns the offset in f, which has size bytes, to
+// resume sending it to dstURL from: the end of the chunks the receiver
+// has already received that match f.
+//
+// Errors are only returned if the receiver can't be reached. If it
+// can't resume transfers, the offset is 0.
+func resumeOffset(ctx context.Context, dstURL string, f *os.File, size int64) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", dstURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tailscale.DoLocalRequest(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	var pf apitype.PartialFile
+	if res.StatusCode != 200 || json.NewDecoder(res.Body).Decode(&pf) != nil || pf.ChunkSize <= 0 {
+		return 0, nil
+	}
+	var offset int64
+	for _, want := range pf.ChunkHashes {
+		if offset+pf.ChunkSize > size {
+			break
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, io.NewSectionReader(f, offset, pf.ChunkSize)); err != nil {
+			return 0, err
+		}
+		if hex.EncodeToString(h.Sum(nil)) != want {
+			break
+		}
+		offset += pf.ChunkSize
+	}
+	if offset == size && size > 0 {
+		// Resend the last chunk so the receiver gets a request
+		// to finish the file.
+		offset -= pf.ChunkSize
+	}
+	if cpArgs.verbose && offset > 0 {
+		log.Printf("resuming after %d of %d bytes", offset, size)
+	}
+	return offset, nil
+}
+
+// putDir sends the directory tree at dir, as a tar archive, to the
+// LocalAPI put URL dstURL, which ends in a slash.
+func putDir(ctx context.Context, dstURL, dir string, prog *progressBar) error {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() { pw.CloseWithError(dirtar.Write(pw, dir)) }()
+	return putFile(ctx, dstURL, pr, 0, -1, "", prog)
+}
+
+// putFile sends the bytes of a file from offset onwards, which body
+// contains, to the LocalAPI put URL dstURL. size is the size of the
+// whole file, or -1 if unknown. If non-empty, sum is the hex SHA-256
+// hash of the whole file. Progress is reported to prog.
+func putFile(ctx context.Context, dstURL string, body io.Reader, offset, size int64, sum string, prog *progressBar) error {
+	if slow, _ := strconv.ParseBool(os.Getenv("TS_DEBUG_SLOW_PUSH")); slow {
+		body = &slowReader{r: body}
+	}
+	body = prog.reader(body, offset)
+	contentLength := int64(-1)
+	if size >= 0 {
+		contentLength = size - offset
+	}
+	if contentLength == 0 {
+		body = http.NoBody
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", dstURL, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = contentLength
+	if offset > 0 {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, size-1, size))
+	}
+	if sum != "" {
+		req.Header.Set(apitype.FileSHA256Header, sum)
+	}
+	if cpArgs.verbose {
+		log.Printf("sending to %v ...", dstURL)
+	}
+	res, err := tailscale.DoLocalRequest(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 200 {
+		io.Copy(ioutil.Discard, res.Body)
+		return nil
+	}
+	slurp, _ := ioutil.ReadAll(res.Body)
+	return &putError{status: res.Status, code: res.StatusCode, body: slurp}
+}
+
+// discoverFileTarget returns the ID of the node with the Tailscale IP
+// ipStr to send files to.
+func discoverFileTarget(ctx context.Context, ipStr string) (id tailcfg.StableNodeID, isOffline bool, err error) {
 	ip, err := netaddr.ParseIP(ipStr)
 	if err != nil {
 		return "", false, err
@@ -195,7 +353,19 @@ func discoverPeerAPIBase(ctx context.Context, ipStr string) (base string, isOffl
 				continue
 			}
 			isOffline = n.Online != nil && !*n.Online
-			return ft.PeerAPIURL, isOffline, nil
+			return n.StableID, isOffline, nil
+		}
+	}
+	// Other users' nodes aren't file targets, but they might accept
+	// files from us anyway (see "tailscale file config"), so let them
+	// decide.
+	if st, err := tailscale.Status(ctx); err == nil {
+		for _, peer := range st.Peer {
+			for _, pip := range peer.TailscaleIPs {
+				if pip == ip && len(peer.PeerAPIURL) > 0 && st.Self != nil && peer.UserID != st.Self.UserID {
+					return peer.ID, false, nil
+				}
+			}
 		}
 	}
 	return "", false, fileTargetErrorDetail(ctx, ip)
@@ -300,12 +470,13 @@ func runCpTargets(ctx context.Context, args []string) error {
 
 var fileGetCmd = &ffcli.Command{
 	Name:       "get",
-	ShortUsage: "file get [--wait] [--verbose] <target-directory>",
+	ShortUsage: "file get [--wait] [--loop] [--verbose] <target-directory>",
 	ShortHelp:  "Move files out of the Tailscale file inbox",
 	Exec:       runFileGet,
 	FlagSet: (func() *flag.FlagSet {
 		fs := flag.NewFlagSet("get", flag.ExitOnError)
 		fs.BoolVar(&getArgs.wait, "wait", false, "wait for a file to arrive if inbox is empty")
+		fs.BoolVar(&getArgs.loop, "loop", false, "run forever, moving files out of the inbox as they arrive")
 		fs.BoolVar(&getArgs.verbose, "verbose", false, "verbose output")
 		return fs
 	})(),
@@ -313,6 +484,7 @@ var fileGetCmd = &ffcli.Command{
 
 var getArgs struct {
 	wait    bool
+	loop    bool
 	verbose bool
 }
 
@@ -330,6 +502,9 @@ func runFileGet(ctx context.Context, args []string) error {
 	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
 		return fmt.Errorf("%q is not a directory", dir)
 	}
+	if getArgs.loop {
+		return getFilesLoop(ctx, dir)
+	}
 
 	var wfs []apitype.WaitingFile
 	var err error
@@ -351,13 +526,74 @@ func runFileGet(ctx context.Context, args []string) error {
 
 	deleted := 0
 	for _, wf := range wfs {
-		rc, size, err := tailscale.GetWaitingFile(ctx, wf.Name)
+		if err := getWaitingFile(ctx, dir, wf); err != nil {
+			return err
+		}
+		deleted++
+	}
+	if getArgs.verbose {
+		log.Printf("moved %d files", deleted)
+	}
+	return nil
+}
+
+// getFilesLoop moves files from the inbox into dir as they arrive,
+// until ctx is done. Files that can't be moved, such as because dir
+// already has one of the same name, are logged and left in the inbox
+// to be retried when the next file arrives.
+func getFilesLoop(ctx context.Context, dir string) error {
+	// Every notification from tailscaled says whether files are
+	// waiting, so don't check more often than this.
+	lim := rate.NewLimiter(rate.Every(time.Second), 1)
+	failed := map[string]string{} // file name => last error logged
+	for {
+		if err := lim.Wait(ctx); err != nil {
+			return err
+		}
+		wfs, err := tailscale.WaitingFiles(ctx)
+		if err != nil {
+			return fmt.Errorf("getting WaitingFiles: %v", err)
+		}
+		for _, wf := range wfs {
+			if err := getWaitingFile(ctx, dir, wf); err != nil {
+				if failed[wf.Name] != err.Error() {
+					log.Printf("%v", err)
+					failed[wf.Name] = err.Error()
+				}
+				continue
+			}
+			delete(failed, wf.Name)
+		}
+		if getArgs.verbose {
+			log.Printf("waiting for file...")
+		}
+		if err := waitForFile(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// getWaitingFile moves the file or directory wf from the inbox into
+// dir.
+func getWaitingFile(ctx context.Context, dir string, wf apitype.WaitingFile) error {
+	rc, size, err := tailscale.GetWaitingFile(ctx, wf.Name)
+	if err != nil {
+		return fmt.Errorf("opening inbox file %q: %v", wf.Name, err)
+	}
+	targetFile := filepath.Join(dir, wf.Name)
+	if wf.IsDir {
+		err = extractDir(targetFile, rc)
+		rc.Close()
 		if err != nil {
-			return fmt.Errorf("opening inbox file %q: %v", wf.Name, err)
+			return err
+		}
+		if getArgs.verbose {
+			log.Printf("wrote directory %v (%d bytes)", wf.Name, wf.Size)
 		}
-		targetFile := filepath.Join(dir, wf.Name)
+	} else {
 		of, err := os.OpenFile(targetFile, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
 		if err != nil {
+			rc.Close()
 			if _, err := os.Stat(targetFile); err == nil {
 				return fmt.Errorf("refusing to overwrite %v", targetFile)
 			}
@@ -366,6 +602,8 @@ func runFileGet(ctx context.Context, args []string) error {
 		_, err = io.Copy(of, rc)
 		rc.Close()
 		if err != nil {
+			of.Close()
+			os.Remove(targetFile)
 			return fmt.Errorf("failed to write %v: %v", targetFile, err)
 		}
 		if err := of.Close(); err != nil {
@@ -374,20 +612,32 @@ func runFileGet(ctx context.Context, args []string) error {
 		if getArgs.verbose {
 			log.Printf("wrote %v (%d bytes)", wf.Name, size)
 		}
-		if err := tailscale.DeleteWaitingFile(ctx, wf.Name); err != nil {
-			return fmt.Errorf("deleting %q from inbox: %v", wf.Name, err)
+	}
+	if err := tailscale.DeleteWaitingFile(ctx, wf.Name); err != nil {
+		return fmt.Errorf("deleting %q from inbox: %v", wf.Name, err)
+	}
+	return nil
+}
+
+// extractDir extracts the tar archive r of a received directory into
+// the new directory targetDir.
+func extractDir(targetDir string, r io.Reader) error {
+	if err := os.Mkdir(targetDir, 0755); err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("refusing to overwrite %v", targetDir)
 		}
-		deleted++
+		return err
 	}
-	if getArgs.verbose {
-		log.Printf("moved %d files", deleted)
+	if err := dirtar.Extract(r, targetDir, nil); err != nil {
+		os.RemoveAll(targetDir)
+		return fmt.Errorf("failed to write %v: %v", targetDir, err)
 	}
 	return nil
 }
 
 func wipeInbox(ctx context.Context) error {
-	if getArgs.wait {
-		return errors.New("can't use --wait with /dev/null target")
+	if getArgs.wait || getArgs.loop {
+		return errors.New("can't use --wait or --loop with /dev/null target")
 	}
 	wfs, err := tailscale.WaitingFiles(ctx)
 	if err != nil {
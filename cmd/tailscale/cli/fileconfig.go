@@ -0,0 +1,166 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+)
+
+var fileConfigCmd = &ffcli.Command{
+	Name:       "config",
+	ShortUsage: "file config [flags]",
+	ShortHelp:  "Configure how files are received",
+	LongHelp: strings.TrimSpace(`
+"tailscale file config" sets how this node receives files sent with
+"tailscale file cp". With no flags, it prints the current settings.
+
+Sizes are in bytes, optionally with a K, M, G or T suffix (powers of
+1024); 0 means no limit. Senders are tailnet login names, such as
+"alice@example.com", or "@example.com" for everyone in a domain, and
+are comma-separated. Files from your own devices are always accepted,
+unless your login is in --deny-senders.
+`),
+	Exec:    runFileConfig,
+	FlagSet: fileConfigFlagSet,
+}
+
+var fileConfigFlagSet = (func() *flag.FlagSet {
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	fs.StringVar(&fileConfigArgs.autoAcceptDir, "auto-accept-dir", "", "directory to move received files into as they arrive, instead of leaving them in the inbox for \"tailscale file get\"; empty to disable")
+	fs.StringVar(&fileConfigArgs.maxInboxSize, "max-inbox-size", "0", "most space received files may take up in the inbox")
+	fs.StringVar(&fileConfigArgs.maxFileSize, "max-file-size", "0", "largest file (or directory) to accept")
+	fs.StringVar(&fileConfigArgs.allowSenders, "allow-senders", "", "other users to accept files from")
+	fs.StringVar(&fileConfigArgs.denySenders, "deny-senders", "", "users to refuse files from")
+	return fs
+})()
+
+var fileConfigArgs struct {
+	autoAcceptDir string
+	maxInboxSize  string
+	maxFileSize   string
+	allowSenders  string
+	denySenders   string
+}
+
+func runFileConfig(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("usage: tailscale file config [flags]")
+	}
+	mp := new(ipn.MaskedPrefs)
+	changed := false
+	var err error
+	fileConfigFlagSet.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		changed = true
+		switch f.Name {
+		case "auto-accept-dir":
+			mp.FileAutoAcceptDirSet = true
+			if dir := fileConfigArgs.autoAcceptDir; dir != "" {
+				mp.FileAutoAcceptDir, err = filepath.Abs(dir)
+			}
+		case "max-inbox-size":
+			mp.FileMaxInboxSizeSet = true
+			mp.FileMaxInboxSize, err = parseByteSize(fileConfigArgs.maxInboxSize)
+		case "max-file-size":
+			mp.FileMaxSizeSet = true
+			mp.FileMaxSize, err = parseByteSize(fileConfigArgs.maxFileSize)
+		case "allow-senders":
+			mp.FileAllowSendersSet = true
+			mp.FileAllowSenders, err = parseLogins(fileConfigArgs.allowSenders)
+		case "deny-senders":
+			mp.FileDenySendersSet = true
+			mp.FileDenySenders, err = parseLogins(fileConfigArgs.denySenders)
+		}
+		if err != nil {
+			err = fmt.Errorf("--%s: %v", f.Name, err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	prefs, err := tailscale.GetPrefs(ctx)
+	if err != nil {
+		return err
+	}
+	if changed {
+		if prefs, err = tailscale.EditPrefs(ctx, mp); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("auto-accept-dir: %s\n", orNone(prefs.FileAutoAcceptDir))
+	fmt.Printf("max-inbox-size:  %s\n", formatByteSize(prefs.FileMaxInboxSize))
+	fmt.Printf("max-file-size:   %s\n", formatByteSize(prefs.FileMaxSize))
+	fmt.Printf("allow-senders:   %s\n", orNone(strings.Join(prefs.FileAllowSenders, ",")))
+	fmt.Printf("deny-senders:    %s\n", orNone(strings.Join(prefs.FileDenySenders, ",")))
+	return nil
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
+
+var byteSizeSuffixes = "KMGT"
+
+// parseByteSize parses a size in bytes like "500", "10M" or "2G".
+func parseByteSize(s string) (int64, error) {
+	num, mult := s, int64(1)
+	if s != "" {
+		if i := strings.Index(byteSizeSuffixes, strings.ToUpper(s[len(s)-1:])); i >= 0 {
+			num, mult = s[:len(s)-1], 1<<(10*(i+1))
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 || n > (1<<62)/mult {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// formatByteSize formats n like parseByteSize accepts it, using the
+// largest suffix that represents it exactly.
+func formatByteSize(n int64) string {
+	if n == 0 {
+		return "no limit"
+	}
+	suffix := ""
+	for i := 0; i < len(byteSizeSuffixes) && n%1024 == 0; i++ {
+		n /= 1024
+		suffix = byteSizeSuffixes[i : i+1]
+	}
+	return strconv.FormatInt(n, 10) + suffix
+}
+
+// parseLogins parses a comma-separated list of login names, or of
+// "@domain" patterns.
+func parseLogins(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var ret []string
+	for _, l := range strings.Split(s, ",") {
+		l = strings.TrimSpace(l)
+		if i := strings.LastIndexByte(l, '@'); i < 0 || i == len(l)-1 {
+			return nil, fmt.Errorf("invalid login %q", l)
+		}
+		ret = append(ret, l)
+	}
+	return ret, nil
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+)
+
+var fileStatusCmd = &ffcli.Command{
+	Name:       "status",
+	ShortUsage: "file status",
+	ShortHelp:  "Show file transfers in progress and recently finished",
+	Exec:       runFileStatus,
+}
+
+func runFileStatus(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("usage: tailscale file status")
+	}
+	fts, err := tailscale.FileTransfers(ctx)
+	if err != nil {
+		return err
+	}
+	if len(fts) == 0 {
+		fmt.Println("no file transfers")
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 2, 2, ' ', 0)
+	fmt.Fprintf(tw, "DIRECTION\tNAME\tPEER\tSTATE\tBYTES\tRATE\tETA\n")
+	for _, ft := range fts {
+		dir := "to"
+		if ft.Direction == ipn.FileReceive {
+			dir = "from"
+		}
+		bytes := humanBytes(ft.Bytes)
+		if ft.Size >= 0 {
+			bytes += "/" + humanBytes(ft.Size)
+		}
+		rate, eta := "-", "-"
+		if ft.Rate > 0 {
+			rate = humanBytes(int64(ft.Rate)) + "/s"
+		}
+		switch {
+		case ft.Error != "":
+			eta = ft.Error
+		case ft.ETA > 0:
+			eta = ft.ETA.String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", dir, ft.Name, ft.Peer, ft.State, bytes, rate, eta)
+	}
+	return tw.Flush()
+}
+
+// humanBytes formats n bytes for people to read, like "1.5 MiB".
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTP"[exp])
+}
+
+// progressBarInterval is how often a progressBar is redrawn.
+const progressBarInterval = 250 * time.Millisecond
+
+// progressBar draws the progress of sending a file on stderr.
+//
+// A nil *progressBar is valid and draws nothing, which is what
+// newProgressBar returns when stderr isn't a terminal.
+type progressBar struct {
+	name string
+	size int64 // or -1 if unknown
+
+	mu     sync.Mutex
+	n      int64     // bytes sent
+	start  time.Time // of the current attempt
+	startN int64     // n at start
+	drawn  time.Time // when last drawn
+}
+
+func newProgressBar(name string, size int64) *progressBar {
+	if cpArgs.verbose {
+		// Don't mix the bar with the log output.
+		return nil
+	}
+	fi, err := os.Stderr.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	return &progressBar{name: name, size: size}
+}
+
+// reader returns r, the bytes of the file from offset onwards, wrapped
+// to report its progress.
+func (p *progressBar) reader(r io.Reader, offset int64) io.Reader {
+	if p == nil {
+		return r
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.n = offset
+	p.start = time.Now()
+	p.startN = offset
+	return &progressReader{r: r, p: p}
+}
+
+func (p *progressBar) add(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.n += int64(n)
+	if now := time.Now(); now.Sub(p.drawn) >= progressBarInterval {
+		p.drawn = now
+		p.drawLocked()
+	}
+}
+
+// done draws the final state of the transfer, which failed if err is
+// non-nil, and ends the line.
+func (p *progressBar) done(err error) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.start.IsZero() {
+		return // nothing was drawn
+	}
+	p.drawLocked()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, " failed")
+	}
+	fmt.Fprintf(os.Stderr, "\n")
+}
+
+func (p *progressBar) drawLocked() {
+	const barWidth = 20
+	name := p.name
+	if len(name) > 24 {
+		name = name[:21] + "..."
+	}
+	var rate float64
+	if d := time.Since(p.start).Seconds(); d > 0 {
+		rate = float64(p.n-p.startN) / d
+	}
+	line := fmt.Sprintf("%-24s", name)
+	if p.size > 0 {
+		filled := int(p.n * barWidth / p.size)
+		if filled > barWidth {
+			filled = barWidth
+		}
+		line += fmt.Sprintf(" [%s%s] %3d%%", strings.Repeat("#", filled), strings.Repeat("-", barWidth-filled), p.n*100/p.size)
+	}
+	line += " " + humanBytes(p.n)
+	if p.size >= 0 {
+		line += "/" + humanBytes(p.size)
+	}
+	if rate > 0 {
+		line += " " + humanBytes(int64(rate)) + "/s"
+		if p.size > p.n {
+			eta := time.Duration(float64(p.size-p.n) / rate * float64(time.Second))
+			line += " ETA " + eta.Round(time.Second).String()
+		}
+	}
+	// Pad to clear what's left of a longer previous line.
+	fmt.Fprintf(os.Stderr, "\r%-79s", line)
+}
+
+// progressReader is an io.Reader that reports the bytes read from r to
+// p.
+type progressReader struct {
+	r io.Reader
+	p *progressBar
+}
+
+func (r *progressReader) Read(b []byte) (n int, err error) {
+	n, err = r.r.Read(b)
+	if n > 0 {
+		r.p.add(n)
+	}
+	return n, err
+}
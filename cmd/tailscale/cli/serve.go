@@ -0,0 +1,165 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+)
+
+var serveCmd = &ffcli.Command{
+	Name:       "serve",
+	ShortUsage: "serve [flags] [<target>]",
+	ShortHelp:  "Serve a local web server or directory to the tailnet",
+	LongHelp: strings.TrimSpace(`
+"tailscale serve" makes tailscaled accept HTTP requests on a port of
+this node's Tailscale IPs and handle them with <target>, which is one of:
+
+  - a local HTTP server to reverse-proxy to, as a port number ("3000"),
+    host:port ("localhost:3000") or URL ("http://127.0.0.1:3000/app")
+  - a directory of static files to serve ("/var/www" or "./public")
+
+Proxied requests carry Tailscale-User-Login and Tailscale-User-Name
+headers identifying the tailnet user making them.
+
+With --tls, tailscaled terminates TLS itself, using the certificate
+and key in NAME.crt and NAME.key in the "certs" directory of its state
+directory, where NAME is this node's DNS name, or a self-signed
+certificate if those don't exist.
+
+With no arguments, it prints the current configuration.
+`),
+	Exec: runServe,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("serve", flag.ExitOnError)
+		fs.UintVar(&serveArgs.port, "port", 443, "port on this node's Tailscale IPs to serve on")
+		fs.StringVar(&serveArgs.path, "path", "/", "URL path prefix to serve target at")
+		fs.BoolVar(&serveArgs.tls, "tls", true, "terminate TLS on the port")
+		fs.BoolVar(&serveArgs.remove, "remove", false, "stop serving --path on --port")
+		fs.BoolVar(&serveArgs.reset, "reset", false, "stop serving everything")
+		return fs
+	})(),
+}
+
+var serveArgs struct {
+	port   uint
+	path   string
+	tls    bool
+	remove bool
+	reset  bool
+}
+
+func runServe(ctx context.Context, args []string) error {
+	prefs, err := tailscale.GetPrefs(ctx)
+	if err != nil {
+		return err
+	}
+	if !serveArgs.remove && !serveArgs.reset && len(args) == 0 {
+		if len(prefs.Serve) == 0 {
+			fmt.Println("Not serving anything.")
+		}
+		for _, r := range prefs.Serve {
+			fmt.Println(r)
+		}
+		return nil
+	}
+
+	var rules []ipn.ServeRule
+	switch {
+	case serveArgs.reset:
+		if len(args) > 0 {
+			return errors.New("--reset takes no arguments")
+		}
+	case serveArgs.remove:
+		if len(args) > 0 {
+			return errors.New("--remove takes no arguments")
+		}
+		found := false
+		for _, r := range prefs.Serve {
+			if r.Port == uint16(serveArgs.port) && r.Path == serveArgs.path {
+				found = true
+				continue
+			}
+			rules = append(rules, r)
+		}
+		if !found {
+			return fmt.Errorf("not serving %s on port %d", serveArgs.path, serveArgs.port)
+		}
+	default:
+		if len(args) != 1 {
+			return errors.New("usage: tailscale serve [flags] <target>")
+		}
+		if serveArgs.port == 0 || serveArgs.port > 0xffff {
+			return fmt.Errorf("invalid --port %d", serveArgs.port)
+		}
+		proxy, dir, err := parseServeTarget(args[0])
+		if err != nil {
+			return err
+		}
+		nr := ipn.ServeRule{
+			Port:  uint16(serveArgs.port),
+			TLS:   serveArgs.tls,
+			Path:  serveArgs.path,
+			Proxy: proxy,
+			Dir:   dir,
+		}
+		for _, r := range prefs.Serve {
+			if r.Port == nr.Port && r.Path == nr.Path {
+				continue // replaced by nr
+			}
+			rules = append(rules, r)
+		}
+		rules = append(rules, nr)
+	}
+
+	if err := ipn.CheckServeRules(rules); err != nil {
+		return err
+	}
+	_, err = tailscale.EditPrefs(ctx, &ipn.MaskedPrefs{
+		Prefs:    ipn.Prefs{Serve: rules},
+		ServeSet: true,
+	})
+	return err
+}
+
+// parseServeTarget parses the target argument of "tailscale serve",
+// returning either the URL of the HTTP server to proxy to or the
+// absolute path of the directory to serve.
+func parseServeTarget(s string) (proxy, dir string, err error) {
+	if _, err := strconv.ParseUint(s, 10, 16); err == nil {
+		return "http://127.0.0.1:" + s, "", nil
+	}
+	if strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") {
+		return s, "", nil
+	}
+	if strings.HasPrefix(s, "localhost:") || strings.HasPrefix(s, "127.0.0.1:") || strings.HasPrefix(s, "[::1]:") {
+		return "http://" + s, "", nil
+	}
+	if strings.HasPrefix(s, "/") || strings.HasPrefix(s, ".") {
+		abs, err := filepath.Abs(s)
+		if err != nil {
+			return "", "", err
+		}
+		fi, err := os.Stat(abs)
+		if err != nil {
+			return "", "", err
+		}
+		if !fi.IsDir() {
+			return "", "", fmt.Errorf("%s is not a directory", s)
+		}
+		return "", abs, nil
+	}
+	return "", "", fmt.Errorf("invalid serve target %q; want a port, host:port, URL or directory", s)
+}
@@ -138,10 +138,14 @@ func runStatus(ctx context.Context, args []string) error {
 			ps.OS,
 		)
 		relay := ps.Relay
+		exitNode := "exit node"
+		if st.AutoExitNode {
+			exitNode = "exit node (auto)"
+		}
 		anyTraffic := ps.TxBytes != 0 || ps.RxBytes != 0
 		if !active {
 			if ps.ExitNode {
-				f("idle; exit node")
+				f("idle; %s", exitNode)
 			} else if anyTraffic {
 				f("idle")
 			} else {
@@ -150,7 +154,7 @@ func runStatus(ctx context.Context, args []string) error {
 		} else {
 			f("active; ")
 			if ps.ExitNode {
-				f("exit node; ")
+				f("%s; ", exitNode)
 			}
 			if relay != "" && ps.CurAddr == "" {
 				f("relay %q", relay)
@@ -166,6 +170,12 @@ func runStatus(ctx context.Context, args []string) error {
 
 	if statusArgs.self && st.Self != nil {
 		printPS(st.Self)
+		if len(st.Self.StaticAddrs) > 0 {
+			f("%-15s static endpoints: %s\n", "", strings.Join(st.Self.StaticAddrs, ", "))
+		}
+		if len(st.Self.ExcludedAddrs) > 0 {
+			f("%-15s excluded endpoints: %s\n", "", strings.Join(st.Self.ExcludedAddrs, ", "))
+		}
 	}
 	if statusArgs.peers {
 		var peers []*ipnstate.PeerStatus
@@ -185,10 +195,23 @@ func runStatus(ctx context.Context, args []string) error {
 			printPS(ps)
 		}
 	}
+	if st.AutoExitNode && !hasExitNode(st) {
+		f("# --exit-node=auto: no exit node available\n")
+	}
 	os.Stdout.Write(buf.Bytes())
 	return nil
 }
 
+// hasExitNode reports whether any peer in st is in use as the exit node.
+func hasExitNode(st *ipnstate.Status) bool {
+	for _, ps := range st.Peer {
+		if ps.ExitNode {
+			return true
+		}
+	}
+	return false
+}
+
 // peerActive reports whether ps has recent activity.
 //
 // TODO: have the server report this bool instead.
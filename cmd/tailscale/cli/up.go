@@ -10,6 +10,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path"
 	"reflect"
 	"runtime"
 	"sort"
@@ -26,6 +27,7 @@ import (
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/preftype"
+	"tailscale.com/util/dnsname"
 	"tailscale.com/version/distro"
 )
 
@@ -63,14 +65,19 @@ func newUpFlagSet(goos string, upArgs *upArgsT) *flag.FlagSet {
 	upf.BoolVar(&upArgs.acceptRoutes, "accept-routes", false, "accept routes advertised by other Tailscale nodes")
 	upf.BoolVar(&upArgs.acceptDNS, "accept-dns", true, "accept DNS configuration from the admin panel")
 	upf.BoolVar(&upArgs.singleRoutes, "host-routes", true, "install host routes to other Tailscale nodes")
-	upf.StringVar(&upArgs.exitNodeIP, "exit-node", "", "Tailscale IP of the exit node for internet traffic")
+	upf.StringVar(&upArgs.exitNodeIP, "exit-node", "", "Tailscale IP of the exit node for internet traffic, or \"auto\" to pick the fastest available one")
 	upf.BoolVar(&upArgs.exitNodeAllowLANAccess, "exit-node-allow-lan-access", false, "Allow direct access to the local network when routing traffic via an exit node")
+	upf.StringVar(&upArgs.exitNodeBypassPrefixes, "exit-node-bypass-prefixes", "", "IP addresses or ranges to reach directly rather than via the exit node (comma-separated, e.g. \"52.0.0.0/8,192.0.2.1\")")
+	upf.StringVar(&upArgs.exitNodeBypassDomains, "exit-node-bypass-domains", "", "domains (and their subdomains) to reach directly rather than via the exit node; requires --accept-dns (comma-separated, e.g. \"zoom.us\")")
 	upf.BoolVar(&upArgs.shieldsUp, "shields-up", false, "don't allow incoming connections")
 	upf.StringVar(&upArgs.advertiseTags, "advertise-tags", "", "comma-separated ACL tags to request; each must start with \"tag:\" (e.g. \"tag:eng,tag:montreal,tag:ssh\")")
 	upf.StringVar(&upArgs.authKey, "authkey", "", "node authorization key")
 	upf.StringVar(&upArgs.hostname, "hostname", "", "hostname to use instead of the one provided by the OS")
 	upf.StringVar(&upArgs.advertiseRoutes, "advertise-routes", "", "routes to advertise to other nodes (comma-separated, e.g. \"10.0.0.0/8,192.168.0.0/24\")")
 	upf.BoolVar(&upArgs.advertiseDefaultRoute, "advertise-exit-node", false, "offer to be an exit node for internet traffic for the tailnet")
+	upf.StringVar(&upArgs.staticEndpoints, "static-endpoints", "", "additional public UDP endpoints to advertise to peers (comma-separated ip:port, e.g. \"203.0.113.1:41641\")")
+	upf.StringVar(&upArgs.excludeEndpointIfaces, "exclude-endpoint-interfaces", "", "local interfaces whose addresses are not advertised as endpoints (comma-separated names or patterns, e.g. \"docker0,veth*\")")
+	upf.StringVar(&upArgs.excludeEndpointNets, "exclude-endpoint-prefixes", "", "IP addresses or ranges not to advertise as endpoints (comma-separated, e.g. \"172.17.0.0/16,192.168.1.5\")")
 	if safesocket.GOOSUsesPeerCreds(goos) {
 		upf.StringVar(&upArgs.opUser, "operator", "", "Unix username to allow to operate on tailscaled without sudo")
 	}
@@ -99,12 +106,17 @@ type upArgsT struct {
 	singleRoutes           bool
 	exitNodeIP             string
 	exitNodeAllowLANAccess bool
+	exitNodeBypassPrefixes string
+	exitNodeBypassDomains  string
 	shieldsUp              bool
 	forceReauth            bool
 	forceDaemon            bool
 	advertiseRoutes        string
 	advertiseDefaultRoute  bool
 	advertiseTags          string
+	staticEndpoints        string
+	excludeEndpointIfaces  string
+	excludeEndpointNets    string
 	snat                   bool
 	netfilterMode          string
 	authKey                string
@@ -123,6 +135,23 @@ var (
 	ipv6default = netaddr.MustParseIPPrefix("::/0")
 )
 
+// parseIPOrPrefix parses s as a CIDR prefix or, if it has no length,
+// as a single IP address: a /32 or /128 prefix.
+func parseIPOrPrefix(s string) (netaddr.IPPrefix, error) {
+	if !strings.Contains(s, "/") {
+		ip, err := netaddr.ParseIP(s)
+		if err != nil {
+			return netaddr.IPPrefix{}, fmt.Errorf("%q is not a valid IP address or CIDR prefix", s)
+		}
+		return netaddr.IPPrefixFrom(ip, ip.BitLen()), nil
+	}
+	ipp, err := netaddr.ParseIPPrefix(s)
+	if err != nil {
+		return netaddr.IPPrefix{}, fmt.Errorf("%q is not a valid IP address or CIDR prefix", s)
+	}
+	return ipp, nil
+}
+
 // prefsFromUpArgs returns the ipn.Prefs for the provided args.
 //
 // Note that the parameters upArgs and warnf are named intentionally
@@ -171,17 +200,46 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 	})
 
 	var exitNodeIP netaddr.IP
-	if upArgs.exitNodeIP != "" {
+	autoExitNode := upArgs.exitNodeIP == "auto"
+	switch {
+	case autoExitNode:
+		// LocalBackend picks the exit node.
+	case upArgs.exitNodeIP != "":
 		var err error
 		exitNodeIP, err = netaddr.ParseIP(upArgs.exitNodeIP)
 		if err != nil {
 			return nil, fmt.Errorf("invalid IP address %q for --exit-node: %v", upArgs.exitNodeIP, err)
 		}
-	} else if upArgs.exitNodeAllowLANAccess {
+	case upArgs.exitNodeAllowLANAccess:
 		return nil, fmt.Errorf("--exit-node-allow-lan-access can only be used with --exit-node")
+	case upArgs.exitNodeBypassPrefixes != "":
+		return nil, fmt.Errorf("--exit-node-bypass-prefixes can only be used with --exit-node")
+	case upArgs.exitNodeBypassDomains != "":
+		return nil, fmt.Errorf("--exit-node-bypass-domains can only be used with --exit-node")
 	}
 
-	if upArgs.exitNodeIP != "" {
+	var bypassPrefixes []netaddr.IPPrefix
+	if upArgs.exitNodeBypassPrefixes != "" {
+		for _, s := range strings.Split(upArgs.exitNodeBypassPrefixes, ",") {
+			ipp, err := parseIPOrPrefix(s)
+			if err != nil {
+				return nil, err
+			}
+			bypassPrefixes = append(bypassPrefixes, ipp.Masked())
+		}
+	}
+
+	var bypassDomains []string
+	if upArgs.exitNodeBypassDomains != "" {
+		for _, s := range strings.Split(upArgs.exitNodeBypassDomains, ",") {
+			if _, err := dnsname.ToFQDN(s); err != nil {
+				return nil, fmt.Errorf("invalid domain %q for --exit-node-bypass-domains: %v", s, err)
+			}
+			bypassDomains = append(bypassDomains, strings.TrimSuffix(s, "."))
+		}
+	}
+
+	if !exitNodeIP.IsZero() {
 		for _, ip := range st.TailscaleIPs {
 			if exitNodeIP == ip {
 				return nil, fmt.Errorf("cannot use %s as the exit node as it is a local IP address to this machine, did you mean --advertise-exit-node?", upArgs.exitNodeIP)
@@ -200,6 +258,38 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 		}
 	}
 
+	var staticEndpoints []netaddr.IPPort
+	if upArgs.staticEndpoints != "" {
+		for _, s := range strings.Split(upArgs.staticEndpoints, ",") {
+			ipp, err := netaddr.ParseIPPort(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid --static-endpoints value %q: %v", s, err)
+			}
+			staticEndpoints = append(staticEndpoints, ipp)
+		}
+	}
+
+	var excludeIfaces []string
+	if upArgs.excludeEndpointIfaces != "" {
+		excludeIfaces = strings.Split(upArgs.excludeEndpointIfaces, ",")
+		for _, name := range excludeIfaces {
+			if _, err := path.Match(name, ""); err != nil {
+				return nil, fmt.Errorf("invalid --exclude-endpoint-interfaces pattern %q: %v", name, err)
+			}
+		}
+	}
+
+	var excludePrefixes []netaddr.IPPrefix
+	if upArgs.excludeEndpointNets != "" {
+		for _, s := range strings.Split(upArgs.excludeEndpointNets, ",") {
+			ipp, err := parseIPOrPrefix(s)
+			if err != nil {
+				return nil, err
+			}
+			excludePrefixes = append(excludePrefixes, ipp.Masked())
+		}
+	}
+
 	if len(upArgs.hostname) > 256 {
 		return nil, fmt.Errorf("hostname too long: %d bytes (max 256)", len(upArgs.hostname))
 	}
@@ -209,7 +299,10 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 	prefs.WantRunning = true
 	prefs.RouteAll = upArgs.acceptRoutes
 	prefs.ExitNodeIP = exitNodeIP
+	prefs.AutoExitNode = autoExitNode
 	prefs.ExitNodeAllowLANAccess = upArgs.exitNodeAllowLANAccess
+	prefs.ExitNodeBypassPrefixes = bypassPrefixes
+	prefs.ExitNodeBypassDomains = bypassDomains
 	prefs.CorpDNS = upArgs.acceptDNS
 	prefs.AllowSingleHosts = upArgs.singleRoutes
 	prefs.ShieldsUp = upArgs.shieldsUp
@@ -217,6 +310,9 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 	prefs.AdvertiseTags = tags
 	prefs.Hostname = upArgs.hostname
 	prefs.ForceDaemon = upArgs.forceDaemon
+	prefs.StaticEndpoints = staticEndpoints
+	prefs.ExcludeEndpointInterfaces = excludeIfaces
+	prefs.ExcludeEndpointPrefixes = excludePrefixes
 	prefs.OperatorUser = upArgs.opUser
 
 	if goos == "linux" {
@@ -342,6 +438,14 @@ func runUp(ctx context.Context, args []string) error {
 	if err != nil {
 		return err
 	}
+	// Serve has its own command, "tailscale serve", so keep it as is.
+	prefs.Serve = curPrefs.Serve
+	// As do the Taildrop receive settings, "tailscale file config".
+	prefs.FileAutoAcceptDir = curPrefs.FileAutoAcceptDir
+	prefs.FileMaxInboxSize = curPrefs.FileMaxInboxSize
+	prefs.FileMaxSize = curPrefs.FileMaxSize
+	prefs.FileAllowSenders = curPrefs.FileAllowSenders
+	prefs.FileDenySenders = curPrefs.FileDenySenders
 
 	env := upCheckEnv{
 		goos:          runtime.GOOS,
@@ -496,7 +600,7 @@ func init() {
 	addPrefFlagMapping("advertise-routes", "AdvertiseRoutes")
 
 	// And this flag has two ipn.Prefs:
-	addPrefFlagMapping("exit-node", "ExitNodeIP", "ExitNodeID")
+	addPrefFlagMapping("exit-node", "ExitNodeIP", "ExitNodeID", "AutoExitNode")
 
 	// The rest are 1:1:
 	addPrefFlagMapping("accept-dns", "CorpDNS")
@@ -509,8 +613,13 @@ func init() {
 	addPrefFlagMapping("shields-up", "ShieldsUp")
 	addPrefFlagMapping("snat-subnet-routes", "NoSNAT")
 	addPrefFlagMapping("exit-node-allow-lan-access", "ExitNodeAllowLANAccess")
+	addPrefFlagMapping("exit-node-bypass-prefixes", "ExitNodeBypassPrefixes")
+	addPrefFlagMapping("exit-node-bypass-domains", "ExitNodeBypassDomains")
 	addPrefFlagMapping("unattended", "ForceDaemon")
 	addPrefFlagMapping("operator", "OperatorUser")
+	addPrefFlagMapping("static-endpoints", "StaticEndpoints")
+	addPrefFlagMapping("exclude-endpoint-interfaces", "ExcludeEndpointInterfaces")
+	addPrefFlagMapping("exclude-endpoint-prefixes", "ExcludeEndpointPrefixes")
 }
 
 func addPrefFlagMapping(flagName string, prefNames ...string) {
@@ -672,6 +781,9 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]interfac
 	ret := make(map[string]interface{})
 
 	exitNodeIPStr := func() string {
+		if prefs.AutoExitNode {
+			return "auto"
+		}
 		if !prefs.ExitNodeIP.IsZero() {
 			return prefs.ExitNodeIP.String()
 		}
@@ -710,6 +822,14 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]interfac
 			set(exitNodeIPStr())
 		case "exit-node-allow-lan-access":
 			set(prefs.ExitNodeAllowLANAccess)
+		case "exit-node-bypass-prefixes":
+			ss := make([]string, len(prefs.ExitNodeBypassPrefixes))
+			for i, p := range prefs.ExitNodeBypassPrefixes {
+				ss[i] = p.String()
+			}
+			set(strings.Join(ss, ","))
+		case "exit-node-bypass-domains":
+			set(strings.Join(prefs.ExitNodeBypassDomains, ","))
 		case "advertise-tags":
 			set(strings.Join(prefs.AdvertiseTags, ","))
 		case "hostname":
@@ -733,6 +853,20 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]interfac
 			set(prefs.NetfilterMode.String())
 		case "unattended":
 			set(prefs.ForceDaemon)
+		case "static-endpoints":
+			ss := make([]string, len(prefs.StaticEndpoints))
+			for i, ep := range prefs.StaticEndpoints {
+				ss[i] = ep.String()
+			}
+			set(strings.Join(ss, ","))
+		case "exclude-endpoint-interfaces":
+			set(strings.Join(prefs.ExcludeEndpointInterfaces, ","))
+		case "exclude-endpoint-prefixes":
+			ss := make([]string, len(prefs.ExcludeEndpointPrefixes))
+			for i, p := range prefs.ExcludeEndpointPrefixes {
+				ss[i] = p.String()
+			}
+			set(strings.Join(ss, ","))
 		}
 	})
 	return ret
@@ -0,0 +1,46 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin
+
+package main
+
+import (
+	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/ssh/tailssh"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/netstack"
+)
+
+// beSFTPServer is the tailssh.SFTPSubcommand subcommand.
+var beSFTPServer = func([]string) error { return tailssh.SFTPServerMain() }
+
+func init() {
+	startSSH = startSSHServer
+	subCommands[tailssh.SFTPSubcommand] = &beSFTPServer
+}
+
+func startSSHServer(logf logger.Logf, b *ipnlocal.LocalBackend, ns *netstack.Impl, port uint16, policyFile string) error {
+	pol, err := tailssh.LoadPolicy(policyFile)
+	if err != nil {
+		return err
+	}
+	hostKey, err := b.SSHHostKey()
+	if err != nil {
+		return err
+	}
+	srv, err := tailssh.NewServer(logf, hostKey, b.WhoIsPeer, pol)
+	if err != nil {
+		return err
+	}
+	if ns != nil {
+		// In netstack mode, netstack hands connections to port of
+		// the Tailscale IPs straight to srv, rather than to a
+		// listener on the host. With only subnet routes on netstack,
+		// it never sees them.
+		ns.SetTCPHandler(port, srv.HandleConn)
+	}
+	b.SetSSHHandler(port, srv.HandleConn)
+	return nil
+}
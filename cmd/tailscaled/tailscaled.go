@@ -28,6 +28,8 @@ import (
 	"time"
 
 	"github.com/go-multierror/multierror"
+	"tailscale.com/ipn/hooks"
+	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/ipnserver"
 	"tailscale.com/logpolicy"
 	"tailscale.com/net/dns"
@@ -84,11 +86,22 @@ var args struct {
 	socketpath string
 	verbose    int
 	socksAddr  string // listen address for SOCKS5 server
+	sshPort    uint16 // TCP port of the SSH server; 0 means none
+	sshPolicy  string // path of the SSH server's policy file
+
+	proxyProtoPorts []uint16 // netstack-forwarded TCP ports that get a PROXY protocol header
+	hooksConfig     string   // path of the event hooks' JSON config file
+	metricsListen   string   // listen address for the Prometheus metrics server
 }
 
 var (
 	installSystemDaemon   func([]string) error // non-nil on some platforms
 	uninstallSystemDaemon func([]string) error // non-nil on some platforms
+
+	// startSSH configures b, or ns in netstack mode, to run an SSH
+	// server on port of the Tailscale IPs, with the policy in
+	// policyFile.
+	startSSH func(logf logger.Logf, b *ipnlocal.LocalBackend, ns *netstack.Impl, port uint16, policyFile string) error // non-nil on some platforms
 )
 
 var subCommands = map[string]*func([]string) error{
@@ -115,6 +128,11 @@ func main() {
 	flag.Var(flagtype.PortValue(&args.port, 0), "port", "UDP port to listen on for WireGuard and peer-to-peer traffic; 0 means automatically select")
 	flag.StringVar(&args.statepath, "state", paths.DefaultTailscaledStateFile(), "path of state file")
 	flag.StringVar(&args.socketpath, "socket", paths.DefaultTailscaledSocket(), "path of the service unix socket")
+	flag.Var(flagtype.PortValue(&args.sshPort, 0), "ssh-port", "TCP port on the Tailscale IPs to run an SSH server on; 0 means no SSH server")
+	flag.StringVar(&args.sshPolicy, "ssh-policy", "", "path of the SSH server's JSON policy file mapping tailnet users to local users")
+	flag.Var(flagtype.PortListValue(&args.proxyProtoPorts), "proxy-protocol-ports", "comma-separated destination ports of TCP connections forwarded by netstack to prepend a PROXY protocol v2 header to, identifying the tailnet client")
+	flag.StringVar(&args.metricsListen, "metrics-listen", "", `optional [ip]:port to serve Prometheus metrics on at /metrics (e.g. "localhost:9100")`)
+	flag.StringVar(&args.hooksConfig, "hooks", "", "path of a JSON file configuring commands or webhooks to run on state changes, peers going online or offline, and received files")
 	flag.BoolVar(&printVersion, "version", false, "print version information and exit")
 
 	if len(os.Args) > 1 {
@@ -242,6 +260,20 @@ func run() error {
 		onlySubnets := wrapNetstack && !useNetstack
 		ns = mustStartNetstack(logf, e, onlySubnets)
 	}
+	if len(args.proxyProtoPorts) > 0 {
+		if ns == nil {
+			log.Fatalf("--proxy-protocol-ports requires netstack (--tun=userspace-networking)")
+		}
+		ns.SetProxyProtocolPorts(args.proxyProtoPorts)
+	}
+
+	var metricsListener net.Listener
+	if args.metricsListen != "" {
+		metricsListener, err = net.Listen("tcp", args.metricsListen)
+		if err != nil {
+			log.Fatalf("metrics listener: %v", err)
+		}
+	}
 
 	if socksListener != nil {
 		srv := tssocks.NewServer(logger.WithPrefix(logf, "socks5: "), e, ns)
@@ -279,7 +311,43 @@ func run() error {
 		SurviveDisconnects: runtime.GOOS != "windows",
 		DebugMux:           debugMux,
 	}
+	if args.sshPort != 0 {
+		if startSSH == nil {
+			log.Fatalf("--ssh-port not supported on %v", runtime.GOOS)
+		}
+		if args.sshPolicy == "" {
+			log.Fatalf("--ssh-port requires --ssh-policy")
+		}
+	}
+	var hookRunner *hooks.Runner
+	if args.hooksConfig != "" {
+		hc, err := hooks.LoadConfig(args.hooksConfig)
+		if err != nil {
+			log.Fatalf("--hooks: %v", err)
+		}
+		hookRunner = hooks.NewRunner(logf, hc)
+	}
+	opts.OnLocalBackend = func(b *ipnlocal.LocalBackend) {
+		if ns != nil {
+			ns.SetWhoIsFunc(b.WhoIsPeer)
+		}
+		if hookRunner != nil {
+			b.SetHooks(hookRunner)
+		}
+		if metricsListener != nil {
+			go runMetricsServer(metricsListener, b)
+		}
+		if args.sshPort != 0 {
+			if err := startSSH(logf, b, ns, args.sshPort, args.sshPolicy); err != nil {
+				log.Fatalf("SSH server: %v", err)
+			}
+		}
+	}
 	err = ipnserver.Run(ctx, logf, pol.PublicID.String(), ipnserver.FixedEngine(e), opts)
+	if hookRunner != nil {
+		// Wait for running hooks rather than leaving them behind.
+		hookRunner.Close()
+	}
 	// Cancelation is not an error: it is the only way to stop ipnserver.
 	if err != nil && err != context.Canceled {
 		logf("ipnserver.Run: %v", err)
@@ -383,6 +451,16 @@ func runDebugServer(mux *http.ServeMux, addr string) {
 	}
 }
 
+// runMetricsServer serves b's metrics on ln at /metrics.
+func runMetricsServer(ln net.Listener, b *ipnlocal.LocalBackend) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		b.WriteMetrics(w)
+	})
+	log.Fatalf("metrics server exited: %v", http.Serve(ln, mux))
+}
+
 func mustStartNetstack(logf logger.Logf, e wgengine.Engine, onlySubnets bool) *netstack.Impl {
 	tunDev, magicConn, ok := e.(wgengine.InternalsGetter).GetInternals()
 	if !ok {
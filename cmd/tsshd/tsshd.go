@@ -2,59 +2,72 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// +build !windows
+// +build linux darwin
 
 // The tsshd binary is an SSH server that accepts connections
-// from anybody on the same Tailscale network.
+// from peers on the same Tailscale network.
 //
-// It does not use passwords or SSH public key.
+// It does not use passwords or SSH public keys. Instead, it asks
+// the local tailscaled who is connecting and lets them log in as
+// the local users the --policy file maps them to. See package
+// tailscale.com/ssh/tailssh for the policy format, which also
+// configures session recording.
 //
-// Any user name is accepted; users are logged in as whoever is
-// running this daemon.
+// tailscaled can also run the same server itself; see its
+// --ssh-port flag.
 //
 // Warning: use at your own risk. This code has had very few eyeballs
 // on it.
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
-	"os/exec"
-	"syscall"
 	"time"
-	"unsafe"
 
-	"github.com/gliderlabs/ssh"
-	"github.com/kr/pty"
-	gossh "golang.org/x/crypto/ssh"
 	"inet.af/netaddr"
+	"tailscale.com/client/tailscale"
 	"tailscale.com/net/interfaces"
-	"tailscale.com/net/tsaddr"
+	"tailscale.com/ssh/tailssh"
+	"tailscale.com/tailcfg"
 )
 
 var (
-	port    = flag.Int("port", 2200, "port to listen on")
-	hostKey = flag.String("hostkey", "", "SSH host key")
+	port       = flag.Int("port", 2200, "port to listen on")
+	hostKey    = flag.String("hostkey", "", "SSH host key")
+	policyFile = flag.String("policy", "", "JSON policy file mapping tailnet users to local users")
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == tailssh.SFTPSubcommand {
+		if err := tailssh.SFTPServerMain(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	flag.Parse()
 	if *hostKey == "" {
 		log.Fatalf("missing required --hostkey")
 	}
+	if *policyFile == "" {
+		log.Fatalf("missing required --policy")
+	}
 	hostKey, err := ioutil.ReadFile(*hostKey)
 	if err != nil {
 		log.Fatal(err)
 	}
-	signer, err := gossh.ParsePrivateKey(hostKey)
+	pol, err := tailssh.LoadPolicy(*policyFile)
 	if err != nil {
-		log.Printf("failed to parse SSH host key: %v", err)
-		return
+		log.Fatal(err)
+	}
+	srv, err := tailssh.NewServer(log.Printf, hostKey, whoIs, pol)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	warned := false
@@ -84,93 +97,28 @@ func main() {
 		}
 		listen := net.JoinHostPort(addr.String(), fmt.Sprint(*port))
 		log.Printf("tailscale ssh server listening on %v, %v", iface.Name, listen)
-		s := &ssh.Server{
-			Addr:    listen,
-			Handler: handleSSH,
+		ln, err := net.Listen("tcp", listen)
+		if err != nil {
+			log.Fatal(err)
 		}
-		s.AddHostKey(signer)
-
-		err = s.ListenAndServe()
+		err = srv.Serve(ln)
 		log.Fatalf("tailscale sshd failed: %v", err)
 	}
-
 }
 
-func handleSSH(s ssh.Session) {
-	user := s.User()
-	addr := s.RemoteAddr()
-	ta, ok := addr.(*net.TCPAddr)
-	if !ok {
-		log.Printf("tsshd: rejecting non-TCP addr %T %v", addr, addr)
-		s.Exit(1)
-		return
-	}
-	tanetaddr, ok := netaddr.FromStdIP(ta.IP)
-	if !ok {
-		log.Printf("tsshd: rejecting unparseable addr %v", ta.IP)
-		s.Exit(1)
-		return
-	}
-	if !tsaddr.IsTailscaleIP(tanetaddr) {
-		log.Printf("tsshd: rejecting non-Tailscale addr %v", ta.IP)
-		s.Exit(1)
-		return
-	}
-
-	log.Printf("new session for %q from %v", user, ta)
-	defer log.Printf("closing session for %q from %v", user, ta)
-	ptyReq, winCh, isPty := s.Pty()
-	if !isPty {
-		fmt.Fprintf(s, "TODO scp etc")
-		s.Exit(1)
-		return
+// whoIs asks tailscaled's LocalAPI which peer is at ipp. Connections
+// from the node's own Tailscale IPs, which any local user can make,
+// aren't identified.
+func whoIs(ipp netaddr.IPPort) (*tailcfg.Node, tailcfg.UserProfile, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := tailscale.WhoIsPeer(ctx, ipp.String())
+	if err != nil {
+		log.Printf("whois %v: %v", ipp, err)
+		return nil, tailcfg.UserProfile{}, false
 	}
-
-	userWantsShell := len(s.Command()) == 0
-
-	if userWantsShell {
-		shell, err := shellOfUser(s.User())
-		if err != nil {
-			fmt.Fprintf(s, "failed to find shell: %v\n", err)
-			s.Exit(1)
-			return
-		}
-		cmd := exec.Command(shell)
-		cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", ptyReq.Term))
-		f, err := pty.Start(cmd)
-		if err != nil {
-			log.Printf("running shell: %v", err)
-			s.Exit(1)
-			return
-		}
-		defer f.Close()
-		go func() {
-			for win := range winCh {
-				setWinsize(f, win.Width, win.Height)
-			}
-		}()
-		go func() {
-			io.Copy(f, s) // stdin
-		}()
-		io.Copy(s, f) // stdout
-		cmd.Process.Kill()
-		if err := cmd.Wait(); err != nil {
-			s.Exit(1)
-		}
-		s.Exit(0)
-		return
+	if res.Node == nil || res.UserProfile == nil {
+		return nil, tailcfg.UserProfile{}, false
 	}
-
-	fmt.Fprintf(s, "TODO: args\n")
-	s.Exit(1)
-}
-
-func shellOfUser(user string) (string, error) {
-	// TODO
-	return "/bin/bash", nil
-}
-
-func setWinsize(f *os.File, w, h int) {
-	syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(syscall.TIOCSWINSZ),
-		uintptr(unsafe.Pointer(&struct{ h, w, x, y uint16 }{uint16(h), uint16(w), 0, 0})))
+	return res.Node, *res.UserProfile, true
 }
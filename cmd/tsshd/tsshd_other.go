@@ -2,10 +2,10 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// +build windows
+// +build !linux,!darwin
 
 package main
 
 func main() {
-	panic("tsshd does not work on windows yet")
+	panic("tsshd does not work on this platform yet")
 }
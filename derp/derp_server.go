@@ -125,6 +125,9 @@ type Server struct {
 	multiForwarderDeleted        expvar.Int
 	removePktForwardOther        expvar.Int
 	avgQueueDuration             *uint64 // In milliseconds; accessed atomically
+	queueDuration                metrics.HistogramVec
+	queueDurationData            *metrics.Histogram
+	queueDurationDisco           *metrics.Histogram
 
 	// verifyClients only accepts client connections to the DERP server if the clientKey is a
 	// known peer in the network, as specified by a running tailscaled's client's local api.
@@ -194,7 +197,12 @@ func NewServer(privateKey key.Private, logf logger.Logf) *Server {
 		watchers:             map[*sclient]bool{},
 		sentTo:               map[key.Public]map[key.Public]int64{},
 		avgQueueDuration:     new(uint64),
-		keyOfAddr:            map[netaddr.IPPort]key.Public{},
+		queueDuration: metrics.HistogramVec{
+			Labels:  []string{"queue"},
+			Buckets: metrics.ExponentialBuckets(.0001, 2, 16), // 100µs to ~3.3s
+			Help:    "Time packets spent queued for sending to a client, by queue (data or disco).",
+		},
+		keyOfAddr: map[netaddr.IPPort]key.Public{},
 	}
 	s.initMetacert()
 	s.packetsRecvDisco = s.packetsRecvByKind.Get("disco")
@@ -209,6 +217,8 @@ func NewServer(privateKey key.Private, logf logger.Logf) *Server {
 	}
 	s.packetsDroppedTypeDisco = s.packetsDroppedType.Get("disco")
 	s.packetsDroppedTypeOther = s.packetsDroppedType.Get("other")
+	s.queueDurationData = s.queueDuration.Get("data")
+	s.queueDurationDisco = s.queueDuration.Get("disco")
 	return s
 }
 
@@ -737,9 +747,9 @@ func (c *sclient) sendPkt(dst *sclient, p pkt) error {
 	// Attempt to queue for sending up to 3 times. On each attempt, if
 	// the queue is full, try to drop from queue head to prioritize
 	// fresher packets.
-	sendQueue := dst.sendQueue
+	sendQueue, queueDuration := dst.sendQueue, s.queueDurationData
 	if disco.LooksLikeDiscoWrapper(p.bs) {
-		sendQueue = dst.discoSendQueue
+		sendQueue, queueDuration = dst.discoSendQueue, s.queueDurationDisco
 	}
 	for attempt := 0; attempt < 3; attempt++ {
 		select {
@@ -757,7 +767,7 @@ func (c *sclient) sendPkt(dst *sclient, p pkt) error {
 		select {
 		case pkt := <-sendQueue:
 			s.recordDrop(pkt.bs, c.key, dstKey, dropReasonQueueHead)
-			c.recordQueueTime(pkt.enqueuedAt)
+			c.recordQueueTime(pkt.enqueuedAt, queueDuration)
 		default:
 		}
 	}
@@ -1019,9 +1029,12 @@ func expMovingAverage(prev, newValue, alpha float64) float64 {
 	return alpha*newValue + (1-alpha)*prev
 }
 
-// recordQueueTime updates the average queue duration metric after a packet has been sent.
-func (c *sclient) recordQueueTime(enqueuedAt time.Time) {
-	elapsed := float64(time.Since(enqueuedAt).Milliseconds())
+// recordQueueTime updates the average queue duration metric, and the
+// histogram h of the queue, after a packet has been sent.
+func (c *sclient) recordQueueTime(enqueuedAt time.Time, h *metrics.Histogram) {
+	d := time.Since(enqueuedAt)
+	h.Observe(d.Seconds())
+	elapsed := float64(d.Milliseconds())
 	for {
 		old := atomic.LoadUint64(c.s.avgQueueDuration)
 		newAvg := expMovingAverage(math.Float64frombits(old), elapsed, 0.1)
@@ -1072,11 +1085,11 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 			continue
 		case msg := <-c.sendQueue:
 			werr = c.sendPacket(msg.src, msg.bs)
-			c.recordQueueTime(msg.enqueuedAt)
+			c.recordQueueTime(msg.enqueuedAt, c.s.queueDurationData)
 			continue
 		case msg := <-c.discoSendQueue:
 			werr = c.sendPacket(msg.src, msg.bs)
-			c.recordQueueTime(msg.enqueuedAt)
+			c.recordQueueTime(msg.enqueuedAt, c.s.queueDurationDisco)
 			continue
 		case <-keepAliveTick.C:
 			werr = c.sendKeepAlive()
@@ -1100,10 +1113,10 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 			continue
 		case msg := <-c.sendQueue:
 			werr = c.sendPacket(msg.src, msg.bs)
-			c.recordQueueTime(msg.enqueuedAt)
+			c.recordQueueTime(msg.enqueuedAt, c.s.queueDurationData)
 		case msg := <-c.discoSendQueue:
 			werr = c.sendPacket(msg.src, msg.bs)
-			c.recordQueueTime(msg.enqueuedAt)
+			c.recordQueueTime(msg.enqueuedAt, c.s.queueDurationDisco)
 		case <-keepAliveTick.C:
 			werr = c.sendKeepAlive()
 		}
@@ -1368,6 +1381,7 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("average_queue_duration_ms", expvar.Func(func() interface{} {
 		return math.Float64frombits(atomic.LoadUint64(s.avgQueueDuration))
 	}))
+	m.Set("queue_duration_seconds", &s.queueDuration)
 	var expvarVersion expvar.String
 	expvarVersion.Set(version.Long)
 	m.Set("version", &expvarVersion)
@@ -198,6 +198,56 @@ func NoteDERPRegionReceivedFrame(region int) {
 	selfCheckLocked()
 }
 
+// DERPRegionState is the state of magicsock's connection to a DERP
+// region.
+type DERPRegionState struct {
+	RegionID  int
+	Home      bool      // whether it's magicsock's home region
+	Connected bool      // whether it's currently connected
+	LastFrame time.Time // when a frame was last received; zero if never
+}
+
+// DERPRegionStates returns the state of the home DERP region and of
+// the other regions there have been connections to, ordered by region
+// ID.
+func DERPRegionStates() []DERPRegionState {
+	mu.Lock()
+	defer mu.Unlock()
+	seen := map[int]bool{}
+	var ret []DERPRegionState
+	add := func(rid int) {
+		if rid == 0 || seen[rid] {
+			return
+		}
+		seen[rid] = true
+		ret = append(ret, DERPRegionState{
+			RegionID:  rid,
+			Home:      rid == derpHomeRegion,
+			Connected: derpRegionConnected[rid],
+			LastFrame: derpRegionLastFrame[rid],
+		})
+	}
+	add(derpHomeRegion)
+	for rid := range derpRegionConnected {
+		add(rid)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].RegionID < ret[j].RegionID })
+	return ret
+}
+
+// SubsystemErrors returns the subsystems whose health has been
+// reported, including SysOverall once it's being checked, mapped to
+// their current error, or nil if they're healthy.
+func SubsystemErrors() map[Subsystem]error {
+	mu.Lock()
+	defer mu.Unlock()
+	ret := make(map[Subsystem]error, len(sysErr))
+	for sys, err := range sysErr {
+		ret[sys] = err
+	}
+	return ret
+}
+
 // state is an ipn.State.String() value: "Running", "Stopped", "NeedsLogin", etc.
 func SetIPNState(state string, wantRunning bool) {
 	mu.Lock()
@@ -51,6 +51,36 @@ type EngineStatus struct {
 	LivePeers      map[tailcfg.NodeKey]ipnstate.PeerStatusLite
 }
 
+// NotifyWatchOpt is a bitmask of options for a watcher of the
+// notification bus (see LocalBackend.WatchNotifications), selecting
+// which Notify messages and fields it receives.
+type NotifyWatchOpt uint64
+
+const (
+	// NotifyWatchEngineUpdates includes the periodic Engine status
+	// updates, which are otherwise omitted.
+	NotifyWatchEngineUpdates NotifyWatchOpt = 1 << iota
+
+	// NotifyInitialState makes the first Notify contain the current
+	// State and any pending BrowseToURL.
+	NotifyInitialState
+
+	// NotifyInitialPrefs makes the first Notify contain the current Prefs.
+	NotifyInitialPrefs
+
+	// NotifyInitialNetMap makes the first Notify contain the current
+	// NetMap, if any.
+	NotifyInitialNetMap
+
+	// NotifyNoNetMap omits NetMap from all messages, for watchers that
+	// don't need the (potentially large) network map.
+	NotifyNoNetMap
+
+	// NotifyNoPrivateKeys removes the node's private keys from any
+	// NetMap or Prefs sent.
+	NotifyNoPrivateKeys
+)
+
 // Notify is a communication from a backend (e.g. tailscaled) to a frontend
 // (cmd/tailscale, iOS, macOS, Win Tasktray).
 // In any given notification, any or all of these may be nil, meaning
@@ -85,6 +115,12 @@ type Notify struct {
 	// of being transferred.
 	IncomingFiles []PartialFile `json:",omitempty"`
 
+	// FileTransfers, if non-nil, is the state of the Taildrop file
+	// transfers in progress or recently finished, in both
+	// directions. Like IncomingFiles, nil means this Notify doesn't
+	// update them.
+	FileTransfers []FileTransfer `json:",omitempty"`
+
 	// LocalTCPPort, if non-nil, informs the UI frontend which
 	// (non-zero) localhost TCP port it's listening on.
 	// This is currently only used by Tailscale when run in the
@@ -130,6 +166,9 @@ func (n Notify) String() string {
 	if len(n.IncomingFiles) != 0 {
 		sb.WriteString("IncomingFiles ")
 	}
+	if len(n.FileTransfers) != 0 {
+		sb.WriteString("FileTransfers ")
+	}
 	if n.LocalTCPPort != nil {
 		fmt.Fprintf(&sb, "tcpport=%v ", n.LocalTCPPort)
 	}
@@ -155,6 +194,42 @@ type PartialFile struct {
 	Done bool `json:",omitempty"`
 }
 
+// Directions of a FileTransfer.
+const (
+	FileSend    = "send"
+	FileReceive = "receive"
+)
+
+// States of a FileTransfer.
+const (
+	FileTransferActive = "active"
+	FileTransferDone   = "done"
+	FileTransferFailed = "failed"
+)
+
+// FileTransfer is the progress of a Taildrop file transfer, either
+// one being sent by this node (through the LocalAPI) or received.
+type FileTransfer struct {
+	ID        string    // unique among this node's transfers
+	Direction string    // FileSend or FileReceive
+	Name      string    // e.g. "foo.jpg"
+	Peer      string    // name of the node sending or receiving it
+	State     string    // one of the FileTransfer* states
+	Started   time.Time // time transfer started
+	Updated   time.Time // time of the last progress or state change
+	Size      int64     // total size in bytes, or -1 if unknown
+	Bytes     int64     // bytes transferred so far, including any resumed from
+
+	// Rate is the recent transfer rate in bytes per second.
+	Rate float64 `json:",omitempty"`
+
+	// ETA is the estimated time remaining, if known.
+	ETA time.Duration `json:",omitempty"`
+
+	// Error is why the transfer failed, for FileTransferFailed.
+	Error string `json:",omitempty"`
+}
+
 // StateKey is an opaque identifier for a set of LocalBackend state
 // (preferences, private keys, etc.).
 //
@@ -0,0 +1,328 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package hooks runs operator-configured commands and webhooks when
+// tailscaled's state changes, such as when the node goes Running, a
+// peer comes online or a Taildrop file arrives.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+)
+
+// Event types.
+const (
+	EventState       = "state"        // the backend state changed; Event.State is set
+	EventPeerOnline  = "peer-online"  // a peer connected to the coordination server; Event.Peer is set
+	EventPeerOffline = "peer-offline" // a peer disconnected; Event.Peer is set
+	EventNetMap      = "netmap"       // a new network map arrived
+	EventFile        = "file"         // a Taildrop file was received; Event.File is set
+)
+
+// Event is the JSON document describing an event that's given to hooks,
+// on stdin for Exec hooks and as the request body for URL hooks.
+type Event struct {
+	Type  string    // one of the Event* constants
+	Time  time.Time // when the event happened
+	State string    `json:",omitempty"` // for EventState, the new state, such as "Running"
+	Peer  *Peer     `json:",omitempty"`
+	File  *File     `json:",omitempty"`
+}
+
+// Peer identifies the peer a peer-online or peer-offline event is about.
+type Peer struct {
+	ID        tailcfg.StableNodeID
+	Name      string // MagicDNS name, such as "foo.example.ts.net."
+	Addresses []netaddr.IPPrefix
+}
+
+// File describes a received Taildrop file.
+type File struct {
+	Name string // base name of the file
+	Size int64  // in bytes
+	From string // name of the sending node
+}
+
+// debounceKey returns the key that events are coalesced by while a
+// hook's Debounce period passes: events about the same peer, or
+// otherwise of the same type.
+func (ev *Event) debounceKey() string {
+	if ev.Peer != nil {
+		return "peer/" + string(ev.Peer.ID)
+	}
+	if ev.File != nil {
+		return ev.Type + "/" + ev.File.Name
+	}
+	return ev.Type
+}
+
+// Config is the hook configuration, loaded from a JSON file like:
+//
+//	{
+//	  "Hooks": [
+//	    {"Events": ["state"], "Exec": ["/usr/local/bin/on-tailscale-state"]},
+//	    {"Events": ["peer-online", "peer-offline"], "URL": "https://fleet.example.com/hook",
+//	     "Debounce": "30s"}
+//	  ]
+//	}
+type Config struct {
+	Hooks []Hook
+}
+
+// Hook is a command or webhook to run on some set of events. Exactly
+// one of Exec and URL must be set.
+type Hook struct {
+	// Events are the types of event (see the Event* constants) the
+	// hook runs on. Empty means all of them.
+	Events []string `json:",omitempty"`
+
+	// Exec, if non-empty, is the command and arguments to run, with
+	// the event's JSON on its stdin and its type in $TS_HOOK_EVENT.
+	// The hook fails if the command exits unsuccessfully.
+	Exec []string `json:",omitempty"`
+
+	// URL, if non-empty, is an HTTP(S) URL to POST the event's JSON
+	// to. The hook fails unless the response status is 2xx.
+	URL string `json:",omitempty"`
+
+	// Timeout is how long a single run of the hook may take, as a
+	// Go duration string. It defaults to 10s.
+	Timeout string `json:",omitempty"`
+
+	// Debounce is how long to wait after an event before running
+	// the hook, as a Go duration string. Further events of the same
+	// kind in that time (such as a peer going offline and back
+	// online) replace it, so the hook runs once with the latest.
+	// It defaults to 1s; "0s" disables debouncing.
+	Debounce string `json:",omitempty"`
+
+	timeout  time.Duration
+	debounce time.Duration
+}
+
+const (
+	defaultTimeout  = 10 * time.Second
+	defaultDebounce = time.Second
+)
+
+func (h *Hook) String() string {
+	if len(h.Exec) > 0 {
+		return fmt.Sprintf("hook %q", h.Exec[0])
+	}
+	return fmt.Sprintf("hook %q", h.URL)
+}
+
+func (h *Hook) wants(typ string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadConfig reads and parses the hook configuration file at path.
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(b)
+}
+
+// ParseConfig parses the JSON hook configuration b.
+func ParseConfig(b []byte) (*Config, error) {
+	c := new(Config)
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("parsing hook config: %w", err)
+	}
+	for i := range c.Hooks {
+		h := &c.Hooks[i]
+		if (len(h.Exec) == 0) == (h.URL == "") {
+			return nil, fmt.Errorf("hook %d: need exactly one of Exec and URL", i)
+		}
+		if h.URL != "" {
+			u, err := url.Parse(h.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return nil, fmt.Errorf("hook %d: invalid URL %q", i, h.URL)
+			}
+		}
+		for _, e := range h.Events {
+			switch e {
+			case EventState, EventPeerOnline, EventPeerOffline, EventNetMap, EventFile:
+			default:
+				return nil, fmt.Errorf("hook %d: unknown event type %q", i, e)
+			}
+		}
+		var err error
+		if h.timeout, err = parseDuration(h.Timeout, defaultTimeout); err != nil || h.timeout <= 0 {
+			return nil, fmt.Errorf("hook %d: invalid Timeout %q", i, h.Timeout)
+		}
+		if h.debounce, err = parseDuration(h.Debounce, defaultDebounce); err != nil || h.debounce < 0 {
+			return nil, fmt.Errorf("hook %d: invalid Debounce %q", i, h.Debounce)
+		}
+	}
+	return c, nil
+}
+
+func parseDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// Runner runs the hooks of a Config as events are fired.
+type Runner struct {
+	logf   logger.Logf
+	hooks  []*runnerHook
+	client *http.Client
+
+	mu      sync.Mutex
+	closed  bool
+	pending map[pendingKey]*Event // latest event of each key waiting out its hook's Debounce
+	wg      sync.WaitGroup        // for scheduled runs
+}
+
+// runnerHook is a Hook being run by a Runner.
+type runnerHook struct {
+	*Hook
+	mu sync.Mutex // serializes runs of the hook
+}
+
+type pendingKey struct {
+	h   *runnerHook
+	key string
+}
+
+// NewRunner returns a Runner for the hooks in c, which must have been
+// returned by ParseConfig or LoadConfig. Hook failures are logged to
+// logf.
+func NewRunner(logf logger.Logf, c *Config) *Runner {
+	r := &Runner{
+		logf:    logger.WithPrefix(logf, "hooks: "),
+		client:  &http.Client{},
+		pending: map[pendingKey]*Event{},
+	}
+	for i := range c.Hooks {
+		r.hooks = append(r.hooks, &runnerHook{Hook: &c.Hooks[i]})
+	}
+	return r
+}
+
+// Fire schedules the hooks that want ev to run. It doesn't block.
+func (r *Runner) Fire(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	key := ev.debounceKey()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	for _, h := range r.hooks {
+		if !h.wants(ev.Type) {
+			continue
+		}
+		k := pendingKey{h, key}
+		ev := ev
+		if _, ok := r.pending[k]; ok {
+			r.pending[k] = &ev // replace the event the scheduled run will use
+			continue
+		}
+		r.pending[k] = &ev
+		r.wg.Add(1)
+		time.AfterFunc(h.debounce, func() { r.run(k) })
+	}
+}
+
+// Close stops running hooks for new events and waits for scheduled
+// and running hooks to finish.
+func (r *Runner) Close() {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	r.wg.Wait()
+}
+
+func (r *Runner) run(k pendingKey) {
+	defer r.wg.Done()
+	r.mu.Lock()
+	ev := r.pending[k]
+	delete(r.pending, k)
+	r.mu.Unlock()
+
+	h := k.h
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	t0 := time.Now()
+	if err := r.runHook(ctx, h.Hook, ev); err != nil {
+		r.logf("%v failed for %s event after %v: %v", h, ev.Type, time.Since(t0).Round(time.Millisecond), err)
+	}
+}
+
+// maxOutput is how much of a failed Exec hook's output is logged.
+const maxOutput = 512
+
+func (r *Runner) runHook(ctx context.Context, h *Hook, ev *Event) error {
+	j, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if len(h.Exec) > 0 {
+		cmd := exec.CommandContext(ctx, h.Exec[0], h.Exec[1:]...)
+		cmd.Env = append(os.Environ(), "TS_HOOK_EVENT="+ev.Type)
+		cmd.Stdin = bytes.NewReader(j)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			if len(out) > maxOutput {
+				out = out[:maxOutput]
+			}
+			if s := strings.TrimSpace(string(out)); s != "" {
+				return fmt.Errorf("%w; output: %q", err, s)
+			}
+			return err
+		}
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", h.URL, bytes.NewReader(j))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<20))
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("HTTP %s", res.Status)
+	}
+	return nil
+}
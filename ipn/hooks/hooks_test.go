@@ -0,0 +1,144 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantErr string
+	}{
+		{`{"Hooks": [{"Exec": ["/bin/true"]}, {"URL": "https://example.com/", "Events": ["state"]}]}`, ""},
+		{`{"Hooks": [{"Events": ["state"]}]}`, "exactly one of Exec and URL"},
+		{`{"Hooks": [{"Exec": ["/bin/true"], "URL": "https://example.com/"}]}`, "exactly one of Exec and URL"},
+		{`{"Hooks": [{"URL": "ftp://example.com/"}]}`, "invalid URL"},
+		{`{"Hooks": [{"Exec": ["/bin/true"], "Events": ["reboot"]}]}`, "unknown event type"},
+		{`{"Hooks": [{"Exec": ["/bin/true"], "Timeout": "soon"}]}`, "invalid Timeout"},
+		{`{"Hooks": [{"Exec": ["/bin/true"], "Debounce": "-1s"}]}`, "invalid Debounce"},
+	}
+	for _, tt := range tests {
+		c, err := ParseConfig([]byte(tt.in))
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("ParseConfig(%s): %v", tt.in, err)
+				continue
+			}
+			if h := c.Hooks[0]; h.timeout != defaultTimeout || h.debounce != defaultDebounce {
+				t.Errorf("defaults not applied: timeout %v, debounce %v", h.timeout, h.debounce)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("ParseConfig(%s) error = %v; want %q", tt.in, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRunnerURL(t *testing.T) {
+	var mu sync.Mutex
+	var got []Event
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev Event
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		got = append(got, ev)
+		mu.Unlock()
+		if ev.Type == EventNetMap {
+			http.Error(w, "nope", http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	c, err := ParseConfig([]byte(fmt.Sprintf(`{"Hooks": [{"URL": %q, "Debounce": "50ms"}]}`, ts.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logMu sync.Mutex
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		logMu.Lock()
+		defer logMu.Unlock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	r := NewRunner(logf, c)
+
+	// The two state events are debounced into one run with the
+	// latest state; the peer events are for different peers.
+	r.Fire(Event{Type: EventState, State: "Starting"})
+	r.Fire(Event{Type: EventState, State: "Running"})
+	r.Fire(Event{Type: EventPeerOnline, Peer: &Peer{ID: "n1"}})
+	r.Fire(Event{Type: EventPeerOffline, Peer: &Peer{ID: "n2"}})
+	r.Fire(Event{Type: EventNetMap})
+	r.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	byType := map[string]int{}
+	for _, ev := range got {
+		byType[ev.Type]++
+		if ev.Type == EventState && ev.State != "Running" {
+			t.Errorf("state hook got %q; want latest state, Running", ev.State)
+		}
+		if ev.Time.IsZero() {
+			t.Errorf("%s event has no time", ev.Type)
+		}
+	}
+	want := map[string]int{EventState: 1, EventPeerOnline: 1, EventPeerOffline: 1, EventNetMap: 1}
+	if fmt.Sprint(byType) != fmt.Sprint(want) {
+		t.Errorf("hook runs by type = %v; want %v", byType, want)
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	if len(logs) != 1 || !strings.Contains(logs[0], "failed for netmap event") || !strings.Contains(logs[0], "500") {
+		t.Errorf("logs = %q; want one netmap failure", logs)
+	}
+}
+
+func TestRunnerExec(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh")
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	c, err := ParseConfig([]byte(fmt.Sprintf(`{"Hooks": [{"Exec": [%q, "-c", "echo $TS_HOOK_EVENT > %s; cat >> %s"], "Debounce": "0s", "Events": ["file"]}]}`, sh, out, out)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRunner(t.Logf, c)
+	r.Fire(Event{Type: EventState, State: "Running"}) // not wanted
+	r.Fire(Event{Type: EventFile, File: &File{Name: "a.txt", Size: 3, From: "peer"}})
+	r.Close()
+
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitN(string(b), "\n", 2)
+	if lines[0] != EventFile {
+		t.Errorf("TS_HOOK_EVENT = %q; want %q", lines[0], EventFile)
+	}
+	var ev Event
+	if err := json.Unmarshal([]byte(lines[1]), &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.File == nil || ev.File.Name != "a.txt" || ev.File.From != "peer" {
+		t.Errorf("hook got event %+v", ev)
+	}
+}
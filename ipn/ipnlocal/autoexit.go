@@ -0,0 +1,255 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+const (
+	// autoExitNodeInterval is how often the exit node candidates are
+	// pinged when Prefs.AutoExitNode is set.
+	autoExitNodeInterval = 30 * time.Second
+
+	// autoExitPingTimeout is how long to wait for each candidate's
+	// disco pong before counting it as unresponsive.
+	autoExitPingTimeout = 5 * time.Second
+
+	// autoExitMaxMisses is how many rounds in a row the current
+	// automatic exit node can miss its ping before we fail over to
+	// another one.
+	autoExitMaxMisses = 2
+)
+
+// exitNodeIDLocked returns the ID of the exit node in use: the
+// automatically picked one if Prefs.AutoExitNode is set, else
+// Prefs.ExitNodeID. It's empty before prefs are loaded.
+//
+// b.mu must be held.
+func (b *LocalBackend) exitNodeIDLocked() tailcfg.StableNodeID {
+	if b.prefs == nil {
+		return ""
+	}
+	if b.prefs.AutoExitNode {
+		return b.autoExitNodeID
+	}
+	return b.prefs.ExitNodeID
+}
+
+// reconfigPrefsLocked returns the prefs to configure the engine and
+// router with: b.prefs, but if Prefs.AutoExitNode is set, with
+// ExitNodeID set to the automatically picked exit node. Until one is
+// picked, or while none is reachable, no exit node is used, rather than
+// dropping all traffic that would go through one.
+//
+// b.mu must be held.
+func (b *LocalBackend) reconfigPrefsLocked() *ipn.Prefs {
+	p := b.prefs
+	if p != nil && p.AutoExitNode {
+		p = p.Clone()
+		p.ExitNodeID = b.autoExitNodeID
+	}
+	return p
+}
+
+// kickAutoExitNode asks autoExitNodeLoop to re-evaluate the
+// automatic exit node choice now, rather than at its next tick.
+func (b *LocalBackend) kickAutoExitNode() {
+	select {
+	case b.autoExitKick <- struct{}{}:
+	default:
+	}
+}
+
+// autoExitNodeLoop periodically re-evaluates the automatic exit node
+// until b is closed.
+func (b *LocalBackend) autoExitNodeLoop() {
+	t := time.NewTicker(autoExitNodeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-t.C:
+		case <-b.autoExitKick:
+		}
+		b.updateAutoExitNode()
+	}
+}
+
+// updateAutoExitNode pings the exit node candidates and, if
+// Prefs.AutoExitNode is set, switches to a different exit node when
+// the current one is missing, unresponsive, or much slower than
+// another.
+func (b *LocalBackend) updateAutoExitNode() {
+	b.mu.Lock()
+	// b.prefs is nil until Start, which the loop doesn't wait for.
+	auto := b.prefs != nil && b.prefs.AutoExitNode
+	running := b.state == ipn.Running
+	nm := b.netMap
+	cur, misses := b.autoExitNodeID, b.autoExitMisses
+	if !auto {
+		b.autoExitNodeID = ""
+		b.autoExitMisses = 0
+	}
+	b.mu.Unlock()
+
+	if !auto || !running || nm == nil {
+		return
+	}
+
+	cands := exitNodeCandidates(nm)
+	latency := b.pingPeers(cands)
+	next, misses := pickAutoExitNode(cands, latency, cur, misses)
+
+	b.mu.Lock()
+	if b.prefs == nil || !b.prefs.AutoExitNode || b.autoExitNodeID != cur {
+		// Changed while we were pinging; the next round will
+		// catch up.
+		b.mu.Unlock()
+		return
+	}
+	b.autoExitNodeID = next
+	b.autoExitMisses = misses
+	b.mu.Unlock()
+
+	if next == cur {
+		if misses > 0 {
+			b.logf("auto exit node: %v missed %d ping round(s)", cur, misses)
+		}
+		return
+	}
+	if next == "" {
+		b.logf("auto exit node: none of %d candidates available, was %v", len(cands), cur)
+	} else {
+		b.logf("auto exit node: picked %v (%v), was %q", next, latency[next].Round(time.Millisecond), cur)
+	}
+	b.authReconfig()
+}
+
+// exitNodeCandidates returns the peers in nm that offer exit node
+// services and aren't known to be offline, sorted by StableID.
+func exitNodeCandidates(nm *netmap.NetworkMap) []*tailcfg.Node {
+	var ret []*tailcfg.Node
+	for _, p := range nm.Peers {
+		if p.StableID == "" || (p.Online != nil && !*p.Online) {
+			continue
+		}
+		for _, r := range p.AllowedIPs {
+			if r == ipv4Default || r == ipv6Default {
+				ret = append(ret, p)
+				break
+			}
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].StableID < ret[j].StableID })
+	return ret
+}
+
+// pingPeers sends a disco ping to each of peers concurrently and
+// returns the round trip times of those that answered within
+// autoExitPingTimeout.
+func (b *LocalBackend) pingPeers(peers []*tailcfg.Node) map[tailcfg.StableNodeID]time.Duration {
+	var (
+		mu  sync.Mutex
+		ret = map[tailcfg.StableNodeID]time.Duration{}
+		wg  sync.WaitGroup
+	)
+	for _, p := range peers {
+		ip, ok := nodeTailscaleIP(p)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(id tailcfg.StableNodeID, ip netaddr.IP) {
+			defer wg.Done()
+			ch := make(chan *ipnstate.PingResult, 1)
+			b.e.Ping(ip, false, func(pr *ipnstate.PingResult) {
+				select {
+				case ch <- pr:
+				default:
+				}
+			})
+			timer := time.NewTimer(autoExitPingTimeout)
+			defer timer.Stop()
+			select {
+			case pr := <-ch:
+				if pr.Err != "" {
+					return
+				}
+				mu.Lock()
+				ret[id] = time.Duration(pr.LatencySeconds * float64(time.Second))
+				mu.Unlock()
+			case <-timer.C:
+			case <-b.ctx.Done():
+			}
+		}(p.StableID, ip)
+	}
+	wg.Wait()
+	return ret
+}
+
+// nodeTailscaleIP returns n's Tailscale IP, preferring IPv4.
+func nodeTailscaleIP(n *tailcfg.Node) (ip netaddr.IP, ok bool) {
+	for _, a := range n.Addresses {
+		if !a.IsSingleIP() {
+			continue
+		}
+		if a.IP().Is4() {
+			return a.IP(), true
+		}
+		if !ok {
+			ip, ok = a.IP(), true
+		}
+	}
+	return ip, ok
+}
+
+// pickAutoExitNode returns which of cands to use as the exit node,
+// given the latencies of those that answered a ping, the current
+// choice cur (possibly empty), and how many rounds in a row cur has
+// missed its ping. It also returns the updated miss count.
+//
+// The current choice is kept while it's a candidate and keeps
+// answering, unless another candidate is at least a third faster.
+// After autoExitMaxMisses unanswered rounds, it's replaced by the
+// fastest responsive candidate. If none answered, the result is empty.
+func pickAutoExitNode(cands []*tailcfg.Node, latency map[tailcfg.StableNodeID]time.Duration, cur tailcfg.StableNodeID, curMisses int) (next tailcfg.StableNodeID, misses int) {
+	var best tailcfg.StableNodeID
+	curIsCand := false
+	for _, n := range cands {
+		if n.StableID == cur {
+			curIsCand = true
+		}
+		d, ok := latency[n.StableID]
+		if !ok {
+			continue
+		}
+		if best == "" || d < latency[best] {
+			best = n.StableID
+		}
+	}
+
+	if cur != "" && curIsCand {
+		if curLat, ok := latency[cur]; ok {
+			if best != cur && latency[best] < curLat*2/3 {
+				return best, 0
+			}
+			return cur, 0
+		}
+		if curMisses+1 < autoExitMaxMisses {
+			return cur, curMisses + 1
+		}
+	}
+	return best, 0
+}
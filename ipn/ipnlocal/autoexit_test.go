@@ -0,0 +1,155 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine/wgcfg"
+)
+
+func TestExitNodeCandidates(t *testing.T) {
+	online, offline := true, false
+	exitRoutes := []netaddr.IPPrefix{ipv4Default, ipv6Default}
+	nm := &netmap.NetworkMap{
+		Peers: []*tailcfg.Node{
+			{StableID: "c", AllowedIPs: exitRoutes},
+			{StableID: "a", AllowedIPs: exitRoutes, Online: &online},
+			{StableID: "b", AllowedIPs: exitRoutes, Online: &offline},
+			{StableID: "d", AllowedIPs: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.4/32")}},
+			{StableID: "", AllowedIPs: exitRoutes},
+		},
+	}
+	var got []tailcfg.StableNodeID
+	for _, n := range exitNodeCandidates(nm) {
+		got = append(got, n.StableID)
+	}
+	want := []tailcfg.StableNodeID{"a", "c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestPickAutoExitNode(t *testing.T) {
+	cands := []*tailcfg.Node{{StableID: "a"}, {StableID: "b"}, {StableID: "c"}}
+	ms := time.Millisecond
+	tests := []struct {
+		name       string
+		latency    map[tailcfg.StableNodeID]time.Duration
+		cur        tailcfg.StableNodeID
+		curMisses  int
+		wantNext   tailcfg.StableNodeID
+		wantMisses int
+	}{
+		{
+			name:     "first_pick_fastest",
+			latency:  map[tailcfg.StableNodeID]time.Duration{"a": 30 * ms, "b": 10 * ms, "c": 20 * ms},
+			wantNext: "b",
+		},
+		{
+			name:     "keep_current_if_close",
+			latency:  map[tailcfg.StableNodeID]time.Duration{"a": 30 * ms, "b": 25 * ms},
+			cur:      "a",
+			wantNext: "a",
+		},
+		{
+			name:     "switch_if_much_faster",
+			latency:  map[tailcfg.StableNodeID]time.Duration{"a": 30 * ms, "b": 10 * ms},
+			cur:      "a",
+			wantNext: "b",
+		},
+		{
+			name:       "current_missed_once",
+			latency:    map[tailcfg.StableNodeID]time.Duration{"b": 10 * ms},
+			cur:        "a",
+			wantNext:   "a",
+			wantMisses: 1,
+		},
+		{
+			name:      "current_missed_twice",
+			latency:   map[tailcfg.StableNodeID]time.Duration{"b": 10 * ms},
+			cur:       "a",
+			curMisses: 1,
+			wantNext:  "b",
+		},
+		{
+			name:     "current_gone",
+			latency:  map[tailcfg.StableNodeID]time.Duration{"c": 50 * ms},
+			cur:      "z",
+			wantNext: "c",
+		},
+		{
+			name:      "none_responding",
+			cur:       "a",
+			curMisses: 1,
+			wantNext:  "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next, misses := pickAutoExitNode(cands, tt.latency, tt.cur, tt.curMisses)
+			if next != tt.wantNext || misses != tt.wantMisses {
+				t.Errorf("got (%q, %d); want (%q, %d)", next, misses, tt.wantNext, tt.wantMisses)
+			}
+		})
+	}
+}
+
+func TestAutoExitNodeRoutes(t *testing.T) {
+	b := &LocalBackend{
+		logf:  t.Logf,
+		prefs: &ipn.Prefs{WantRunning: true, AutoExitNode: true},
+	}
+	hasDefault := func() bool {
+		t.Helper()
+		b.mu.Lock()
+		prefs := b.reconfigPrefsLocked()
+		b.mu.Unlock()
+		for _, r := range b.routerConfig(&wgcfg.Config{}, prefs).Routes {
+			if r == ipv4Default || r == ipv6Default {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Until an exit node is picked, traffic isn't blackholed.
+	if hasDefault() {
+		t.Errorf("default routes with no exit node picked")
+	}
+
+	b.mu.Lock()
+	b.autoExitNodeID = "a"
+	b.mu.Unlock()
+	if !hasDefault() {
+		t.Errorf("no default routes with exit node picked")
+	}
+
+	// If the picked node stops responding and none replaces it,
+	// traffic goes direct again.
+	b.mu.Lock()
+	b.autoExitNodeID = ""
+	b.mu.Unlock()
+	if hasDefault() {
+		t.Errorf("default routes after losing the exit node")
+	}
+}
+
+func TestAutoExitNodeBeforeStart(t *testing.T) {
+	// The loop starts before Start sets prefs.
+	b := &LocalBackend{logf: t.Logf}
+	b.updateAutoExitNode()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if id := b.exitNodeIDLocked(); id != "" {
+		t.Errorf("exit node = %q before prefs are loaded", id)
+	}
+}
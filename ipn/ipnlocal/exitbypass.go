@@ -0,0 +1,234 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/util/dnsname"
+)
+
+const (
+	// dnsBypassLifetime is how long an address learned from a DNS
+	// answer for a Prefs.ExitNodeBypassDomains name keeps bypassing
+	// the exit node after it was last seen.
+	dnsBypassLifetime = time.Hour
+
+	// maxDNSBypassIPs bounds how many addresses learned from DNS
+	// answers bypass the exit node at once.
+	maxDNSBypassIPs = 4096
+
+	// dnsBypassReconfigWait is how long a DNS answer with new bypass
+	// addresses is held while the router is reconfigured for them.
+	dnsBypassReconfigWait = 2 * time.Second
+)
+
+// exitNodeBypassDomains returns the DNS suffixes in
+// prefs.ExitNodeBypassDomains, skipping invalid ones.
+func exitNodeBypassDomains(prefs *ipn.Prefs) (ret []dnsname.FQDN) {
+	for _, s := range prefs.ExitNodeBypassDomains {
+		fqdn, err := dnsname.ToFQDN(s)
+		if err != nil {
+			continue
+		}
+		ret = append(ret, fqdn)
+	}
+	return ret
+}
+
+// sameStrings reports whether a and b have the same elements in the
+// same order.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// noteDNSBypassAnswer is the wgengine.DNSAnswerWatcher callback. It
+// records that ips, which MagicDNS just returned for name (one of the
+// exit node bypass domains), should bypass the exit node. If any are
+// new, it reconfigures the router and waits, up to
+// dnsBypassReconfigWait, for that to finish, so the client doesn't get
+// the answer before its route.
+func (b *LocalBackend) noteDNSBypassAnswer(name dnsname.FQDN, ips []netaddr.IP) {
+	now := time.Now()
+	added := 0
+	b.mu.Lock()
+	if b.dnsBypassIPs == nil {
+		b.dnsBypassIPs = map[netaddr.IP]time.Time{}
+	}
+	for _, ip := range ips {
+		if _, ok := b.dnsBypassIPs[ip]; !ok {
+			if len(b.dnsBypassIPs) >= maxDNSBypassIPs {
+				continue
+			}
+			added++
+		}
+		b.dnsBypassIPs[ip] = now
+	}
+	if added == 0 {
+		b.mu.Unlock()
+		return
+	}
+	b.pruneDNSBypassIPsLocked(now)
+	done := b.queueBypassReconfigLocked()
+	b.mu.Unlock()
+
+	b.logf("[v1] exit node bypass: %d new address(es) for %v", added, name)
+	t := time.NewTimer(dnsBypassReconfigWait)
+	defer t.Stop()
+	select {
+	case <-done:
+	case <-t.C:
+		b.logf("exit node bypass: reconfig for %v not done after %v; answering anyway", name, dnsBypassReconfigWait)
+	}
+}
+
+// queueBypassReconfigLocked arranges for bypassReconfigLoop to
+// reconfigure the router with the current exit node bypass set, and
+// returns a channel that's closed once it has. Reconfigs queued while
+// one is running are coalesced into a single next one.
+//
+// b.mu must be held.
+func (b *LocalBackend) queueBypassReconfigLocked() <-chan struct{} {
+	if b.bypassReconfigDone == nil {
+		b.bypassReconfigDone = make(chan struct{})
+	}
+	if !b.bypassReconfigBusy {
+		b.bypassReconfigBusy = true
+		go b.bypassReconfigLoop()
+	}
+	return b.bypassReconfigDone
+}
+
+// bypassReconfigLoop runs the reconfigs queued by
+// queueBypassReconfigLocked until none are left.
+func (b *LocalBackend) bypassReconfigLoop() {
+	for {
+		b.mu.Lock()
+		done := b.bypassReconfigDone
+		b.bypassReconfigDone = nil
+		if done == nil {
+			b.bypassReconfigBusy = false
+			b.mu.Unlock()
+			return
+		}
+		b.mu.Unlock()
+
+		b.authReconfig()
+		close(done)
+	}
+}
+
+// pruneDNSBypassIPs is called by b.dnsBypassPruneTimer to remove
+// expired dnsBypassIPs, so their routes are removed even if nothing
+// else reconfigures the router.
+func (b *LocalBackend) pruneDNSBypassIPs() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dnsBypassPruneTimer = nil
+	if b.pruneDNSBypassIPsLocked(time.Now()) {
+		b.queueBypassReconfigLocked()
+	}
+}
+
+// pruneDNSBypassIPsLocked removes the dnsBypassIPs that expired by now,
+// reporting whether there were any, and if any remain, makes sure
+// b.dnsBypassPruneTimer is set.
+//
+// b.mu must be held.
+func (b *LocalBackend) pruneDNSBypassIPsLocked(now time.Time) (pruned bool) {
+	var next time.Time
+	for ip, seen := range b.dnsBypassIPs {
+		expiry := seen.Add(dnsBypassLifetime)
+		if !now.Before(expiry) {
+			delete(b.dnsBypassIPs, ip)
+			pruned = true
+			continue
+		}
+		if next.IsZero() || expiry.Before(next) {
+			next = expiry
+		}
+	}
+	if !next.IsZero() && b.dnsBypassPruneTimer == nil {
+		b.dnsBypassPruneTimer = time.AfterFunc(next.Sub(now), b.pruneDNSBypassIPs)
+	}
+	return pruned
+}
+
+// exitNodeBypassSet returns the destinations that should bypass the
+// exit node: prefs.ExitNodeBypassPrefixes, plus recently seen
+// addresses of prefs.ExitNodeBypassDomains. It returns nil if there
+// are none.
+func (b *LocalBackend) exitNodeBypassSet(prefs *ipn.Prefs) *netaddr.IPSet {
+	var sb netaddr.IPSetBuilder
+	n := 0
+	for _, pfx := range prefs.ExitNodeBypassPrefixes {
+		sb.AddPrefix(pfx)
+		n++
+	}
+
+	b.mu.Lock()
+	b.pruneDNSBypassIPsLocked(time.Now())
+	if len(prefs.ExitNodeBypassDomains) > 0 {
+		for ip := range b.dnsBypassIPs {
+			sb.Add(ip)
+			n++
+		}
+	}
+	b.mu.Unlock()
+
+	if n == 0 {
+		return nil
+	}
+	s, err := sb.IPSet()
+	if err != nil {
+		b.logf("computing exit node bypass set: %v", err)
+		return nil
+	}
+	return s
+}
+
+// applyExitNodeBypass returns routes and localRoutes adjusted so that
+// traffic to bypass is routed directly rather than via the exit node.
+//
+// The Linux router implements router.Config.LocalRoutes as throw
+// routes, so there bypass is added to localRoutes. Elsewhere, like
+// shrinkDefaultRoute does for the packet filter, each route overlapping
+// bypass is split into the prefixes that remain after removing it.
+// That includes Windows, whose router only exempts LocalRoutes from
+// its firewall rules without routing them. Routes within the Tailscale
+// ranges are never changed.
+func applyExitNodeBypass(routes, localRoutes []netaddr.IPPrefix, bypass *netaddr.IPSet, goos string) (newRoutes, newLocalRoutes []netaddr.IPPrefix) {
+	switch goos {
+	case "linux":
+		return routes, append(localRoutes, bypass.Prefixes()...)
+	}
+	for _, r := range routes {
+		if tsaddr.IsTailscaleIP(r.IP()) {
+			newRoutes = append(newRoutes, r)
+			continue
+		}
+		var sb netaddr.IPSetBuilder
+		sb.AddPrefix(r)
+		sb.RemoveSet(bypass)
+		s, err := sb.IPSet()
+		if err != nil {
+			newRoutes = append(newRoutes, r)
+			continue
+		}
+		newRoutes = append(newRoutes, s.Prefixes()...)
+	}
+	return newRoutes, localRoutes
+}
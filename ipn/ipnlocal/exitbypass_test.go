@@ -0,0 +1,162 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/wgengine"
+)
+
+func TestApplyExitNodeBypass(t *testing.T) {
+	pp := netaddr.MustParseIPPrefix
+	var sb netaddr.IPSetBuilder
+	sb.AddPrefix(pp("128.0.0.0/1"))
+	sb.AddPrefix(pp("8000::/1"))
+	sb.AddPrefix(pp("96.0.0.0/3")) // includes 100.64.0.0/10
+	bypass, err := sb.IPSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := []netaddr.IPPrefix{pp("0.0.0.0/0"), pp("::/0"), pp("100.64.0.1/32")}
+	local := []netaddr.IPPrefix{pp("192.168.0.0/24")}
+
+	tests := []struct {
+		goos      string
+		wantRoute []netaddr.IPPrefix
+		wantLocal []netaddr.IPPrefix
+	}{
+		{
+			goos:      "linux",
+			wantRoute: routes,
+			wantLocal: []netaddr.IPPrefix{pp("192.168.0.0/24"), pp("96.0.0.0/3"), pp("128.0.0.0/1"), pp("8000::/1")},
+		},
+		{
+			// The Windows router doesn't route LocalRoutes.
+			goos:      "windows",
+			wantRoute: []netaddr.IPPrefix{pp("0.0.0.0/2"), pp("64.0.0.0/3"), pp("::/1"), pp("100.64.0.1/32")},
+			wantLocal: local,
+		},
+		{
+			goos:      "darwin",
+			wantRoute: []netaddr.IPPrefix{pp("0.0.0.0/2"), pp("64.0.0.0/3"), pp("::/1"), pp("100.64.0.1/32")},
+			wantLocal: local,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.goos, func(t *testing.T) {
+			gotRoute, gotLocal := applyExitNodeBypass(routes, append([]netaddr.IPPrefix(nil), local...), bypass, tt.goos)
+			if !reflect.DeepEqual(gotRoute, tt.wantRoute) {
+				t.Errorf("routes = %v; want %v", gotRoute, tt.wantRoute)
+			}
+			if !reflect.DeepEqual(gotLocal, tt.wantLocal) {
+				t.Errorf("local routes = %v; want %v", gotLocal, tt.wantLocal)
+			}
+		})
+	}
+}
+
+func TestExitNodeBypassSet(t *testing.T) {
+	dnsIP := netaddr.MustParseIP("203.0.113.7")
+	staleIP := netaddr.MustParseIP("203.0.113.8")
+	b := &LocalBackend{
+		logf: t.Logf,
+		dnsBypassIPs: map[netaddr.IP]time.Time{
+			dnsIP:   time.Now(),
+			staleIP: time.Now().Add(-2 * dnsBypassLifetime),
+		},
+	}
+
+	if s := b.exitNodeBypassSet(&ipn.Prefs{}); s != nil {
+		t.Errorf("without bypass prefs, got %v; want nil", s.Prefixes())
+	}
+
+	s := b.exitNodeBypassSet(&ipn.Prefs{
+		ExitNodeBypassPrefixes: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("52.0.0.0/8")},
+		ExitNodeBypassDomains:  []string{"example.com"},
+	})
+	if s == nil {
+		t.Fatal("got nil set")
+	}
+	for ip, want := range map[string]bool{
+		"52.1.2.3":    true,
+		"53.1.2.3":    false,
+		"203.0.113.7": true,
+		"203.0.113.8": false,
+	} {
+		if got := s.Contains(netaddr.MustParseIP(ip)); got != want {
+			t.Errorf("Contains(%v) = %v; want %v", ip, got, want)
+		}
+	}
+	if _, ok := b.dnsBypassIPs[staleIP]; ok {
+		t.Errorf("stale DNS bypass address not pruned")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.dnsBypassPruneTimer == nil {
+		t.Errorf("no timer to prune the remaining DNS bypass address")
+	} else {
+		b.dnsBypassPruneTimer.Stop()
+	}
+}
+
+func TestBypassReconfigCoalesced(t *testing.T) {
+	b := &LocalBackend{logf: t.Logf}
+
+	b.mu.Lock()
+	d1 := b.queueBypassReconfigLocked()
+	d2 := b.queueBypassReconfigLocked()
+	b.mu.Unlock()
+	if d1 != d2 {
+		t.Errorf("reconfigs queued together weren't coalesced")
+	}
+	select {
+	case <-d1:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued reconfig never ran")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.bypassReconfigDone != nil {
+		t.Errorf("reconfig still queued after it ran")
+	}
+}
+
+func TestDNSBypassIPsResetOnDomainChange(t *testing.T) {
+	e, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewLocalBackend(t.Logf, "logid", &ipn.MemoryStore{}, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+	b.prefs = ipn.NewPrefs()
+	b.prefs.ExitNodeBypassDomains = []string{"example.com"}
+	b.hostinfo = &tailcfg.Hostinfo{}
+	ip := netaddr.MustParseIP("203.0.113.7")
+	b.dnsBypassIPs = map[netaddr.IP]time.Time{ip: time.Now()}
+
+	p := b.prefs.Clone()
+	p.ShieldsUp = true
+	b.SetPrefs(p)
+	if _, ok := b.dnsBypassIPs[ip]; !ok {
+		t.Errorf("DNS bypass address dropped by unrelated prefs change")
+	}
+
+	p = p.Clone()
+	p.ExitNodeBypassDomains = []string{"example.net"}
+	b.SetPrefs(p)
+	if len(b.dnsBypassIPs) != 0 {
+		t.Errorf("DNS bypass addresses kept after the domains changed: %v", b.dnsBypassIPs)
+	}
+}
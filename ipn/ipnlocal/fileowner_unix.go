@@ -0,0 +1,22 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package ipnlocal
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the user and group IDs of the owner of the file
+// with info fi, or -1 if they're unknown.
+func fileOwner(fi os.FileInfo) (uid, gid int) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return -1, -1
+	}
+	return int(st.Uid), int(st.Gid)
+}
@@ -0,0 +1,13 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import "os"
+
+// fileOwner returns -1 for the user and group IDs of the file with
+// info fi, as Windows files don't have them.
+func fileOwner(fi os.FileInfo) (uid, gid int) {
+	return -1, -1
+}
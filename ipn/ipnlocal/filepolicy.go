@@ -0,0 +1,390 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"tailscale.com/util/dirtar"
+)
+
+// fileReceivePolicy is the part of the prefs that controls which
+// Taildrop files are accepted and what happens to them once received.
+type fileReceivePolicy struct {
+	autoAcceptDir string
+	maxInboxSize  int64
+	maxFileSize   int64
+	allowSenders  []string
+	denySenders   []string
+}
+
+func (b *LocalBackend) fileReceivePolicy() fileReceivePolicy {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p := b.prefs
+	if p == nil {
+		return fileReceivePolicy{}
+	}
+	pol := fileReceivePolicy{
+		autoAcceptDir: p.FileAutoAcceptDir,
+		maxInboxSize:  p.FileMaxInboxSize,
+		maxFileSize:   p.FileMaxSize,
+		allowSenders:  p.FileAllowSenders,
+		denySenders:   p.FileDenySenders,
+	}
+	if !filepath.IsAbs(pol.autoAcceptDir) {
+		pol.autoAcceptDir = ""
+	}
+	return pol
+}
+
+// matchLogin reports whether login is one of logins, or is in the
+// domain of one of the form "@example.com".
+func matchLogin(logins []string, login string) bool {
+	if login == "" {
+		return false
+	}
+	for _, l := range logins {
+		if strings.HasPrefix(l, "@") {
+			if len(login) > len(l) && strings.EqualFold(login[len(login)-len(l):], l) {
+				return true
+			}
+			continue
+		}
+		if strings.EqualFold(l, login) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	errFileTooLarge = errors.New("file too large")
+	errInboxFull    = errors.New("not enough room in inbox")
+)
+
+// limitBody returns a reader of body, the rest of a put of which start
+// bytes were already received, that fails with errFileTooLarge or
+// errInboxFull once pol's limits are exceeded. If length, the declared
+// length of body, already exceeds them, it returns that error instead.
+// A negative length means it's unknown.
+//
+// The put's share of the inbox is held until it calls done, which it
+// must once it's finished reading body.
+func (s *peerAPIServer) limitBody(pol fileReceivePolicy, body io.Reader, start, length int64) (_ io.Reader, done func(), _ error) {
+	if pol.maxFileSize > 0 {
+		n := pol.maxFileSize - start
+		if n < 0 || length > n {
+			return nil, nil, errFileTooLarge
+		}
+		body = &limitedReader{r: body, n: n, err: errFileTooLarge}
+	}
+	if pol.maxInboxSize == 0 || s.directFileMode {
+		return body, func() {}, nil
+	}
+	q := &s.inbox
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.puts == 0 {
+		// This counts partially received files too, including
+		// the first start bytes of this one.
+		used, err := dirtar.Size(s.rootDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		q.used = used
+	}
+	if n := pol.maxInboxSize - q.used; n < 0 || length > n {
+		return nil, nil, errInboxFull
+	}
+	q.puts++
+	qr := &quotaReader{r: body, q: q, max: pol.maxInboxSize}
+	if length > 0 {
+		// Reserve it all now, so that concurrent puts can't
+		// take it.
+		q.used += length
+		qr.reserved = length
+	}
+	return qr, qr.done, nil
+}
+
+// inboxQuota is how much of the inbox is used while puts are in
+// progress, so that concurrent puts share its free space rather than
+// each being allowed all of it.
+type inboxQuota struct {
+	mu   sync.Mutex
+	puts int   // puts in progress
+	used int64 // bytes on disk or reserved by puts; valid while puts > 0
+}
+
+// quotaReader reads from r, counting what it reads against q's limit
+// of max bytes, except for what it had reserved.
+type quotaReader struct {
+	r        io.Reader
+	q        *inboxQuota
+	max      int64
+	reserved int64 // bytes counted in q.used but not read yet
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if int64(n) <= r.reserved {
+		r.reserved -= int64(n)
+		return n, err
+	}
+	extra := int64(n) - r.reserved
+	r.reserved = 0
+	r.q.mu.Lock()
+	defer r.q.mu.Unlock()
+	free := r.max - r.q.used
+	if free < 0 {
+		free = 0
+	}
+	if extra > free {
+		r.q.used += free
+		return n - int(extra-free), errInboxFull
+	}
+	r.q.used += extra
+	return n, err
+}
+
+// done ends the put, releasing what it reserved but didn't read.
+func (r *quotaReader) done() {
+	r.q.mu.Lock()
+	defer r.q.mu.Unlock()
+	r.q.used -= r.reserved
+	r.reserved = 0
+	r.q.puts--
+}
+
+// limitedReader reads from r, failing with err if it has more than n
+// bytes.
+type limitedReader struct {
+	r   io.Reader
+	n   int64 // bytes remaining
+	err error
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	// Read up to one more byte than allowed to tell whether there's
+	// too much.
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.n {
+		n = int(l.n)
+		l.n = 0
+		return n, l.err
+	}
+	l.n -= int64(n)
+	return n, err
+}
+
+// autoAccept moves the just received file or directory baseName out of
+// the inbox into pol's auto-accept directory, if it has one. Failures
+// are logged and leave it waiting in the inbox.
+func (h *peerAPIHandler) autoAccept(pol fileReceivePolicy, baseName string) {
+	if pol.autoAcceptDir == "" || h.ps.directFileMode {
+		return
+	}
+	if _, err := moveIntoDir(filepath.Join(h.ps.rootDir, baseName), pol.autoAcceptDir); err != nil {
+		h.logf("auto-accept failed: %v", redactErr(err))
+		return
+	}
+	h.logf("auto-accepted put from %v/%v", h.remoteAddr.IP(), h.peerNode.ComputedName)
+}
+
+// moveIntoDir moves the file or directory src into dir, under a name
+// like "foo (1).txt" if dir already has one named like src, and
+// returns its new path. It never replaces anything already in dir,
+// even if it's created concurrently, and if it has to copy src, it
+// does so to a temporary name in dir first, so it never appears in dir
+// partially written. What's moved gets dir's owner and normalized
+// modes first (see setOwnerAndModes).
+func moveIntoDir(src, dir string) (string, error) {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return "", err
+	}
+	if err := setOwnerAndModes(src, dir); err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return moveFileIntoDir(src, dir)
+	}
+	// Renaming a directory can't replace a file or a non-empty
+	// directory, so whatever is created at dst after unusedName
+	// checked it can't be lost.
+	dst, err := unusedName(dir, filepath.Base(src))
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return dst, nil
+	}
+
+	// Probably on different filesystems, so copy it.
+	tmp, err := ioutil.TempDir(dir, ".taildrop-")
+	if err != nil {
+		return "", err
+	}
+	pr, pw := io.Pipe()
+	go func() { pw.CloseWithError(dirtar.Write(pw, src)) }()
+	err = dirtar.Extract(pr, tmp, nil)
+	pr.Close()
+	if err == nil {
+		err = setOwnerAndModes(tmp, dir)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	return dst, os.RemoveAll(src)
+}
+
+// moveFileIntoDir is moveIntoDir for the regular file src. The file is
+// hard linked to its new name, which unlike a rename fails if the name
+// is taken.
+func moveFileIntoDir(src, dir string) (string, error) {
+	name := filepath.Base(src)
+	dst, err := linkUnused(src, dir, name)
+	if err == nil {
+		return dst, os.Remove(src)
+	}
+
+	// Probably on different filesystems, so copy it.
+	tmp, err := copyToTemp(src, dir)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+	if err := setOwnerAndModes(tmp, dir); err != nil {
+		return "", err
+	}
+	if dst, err = linkUnused(tmp, dir, name); err != nil {
+		return "", err
+	}
+	return dst, os.Remove(src)
+}
+
+// setOwnerAndModes readies the received file or directory tree at
+// path to be moved into dir. If we're root, it's chowned to dir's
+// owner, as otherwise its user couldn't change or delete it. Its modes
+// are normalized (see normalizedMode), as the sender's might not let
+// the user read it.
+func setOwnerAndModes(path, dir string) error {
+	uid, gid := -1, -1
+	if os.Getuid() == 0 {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		uid, gid = fileOwner(fi)
+	}
+	return filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if uid != -1 {
+			if err := os.Lchown(p, uid, gid); err != nil {
+				return err
+			}
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		return os.Chmod(p, normalizedMode(fi.Mode()))
+	})
+}
+
+// normalizedMode returns the permissions of a received file or
+// directory whose mode was m: writable by its owner and readable by
+// everyone, and executable if it's a directory or was executable.
+func normalizedMode(m os.FileMode) os.FileMode {
+	if m.IsDir() || m&0111 != 0 {
+		return 0755
+	}
+	return 0644
+}
+
+// copyToTemp copies the file src to a new temporary file in dir and
+// returns its path.
+func copyToTemp(src, dir string) (string, error) {
+	sf, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer sf.Close()
+	f, err := ioutil.TempFile(dir, ".taildrop-")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, sf)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// linkUnused hard links the file src to the first name like name in
+// dir that doesn't exist yet, and returns its path.
+func linkUnused(src, dir, name string) (string, error) {
+	for i := 0; i < maxUnusedNames; i++ {
+		p := filepath.Join(dir, numberedName(name, i))
+		err := os.Link(src, p)
+		if err == nil {
+			return p, nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("too many files named like %q", name)
+}
+
+// maxUnusedNames is how many names like a received file's
+// unusedName and linkUnused try.
+const maxUnusedNames = 1000
+
+// numberedName returns name for i == 0, and otherwise name with i
+// inserted before its extension, like "foo (1).txt".
+func numberedName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+}
+
+// unusedName returns the path of a file named like name in dir that
+// doesn't exist yet.
+func unusedName(dir, name string) (string, error) {
+	for i := 0; i < maxUnusedNames; i++ {
+		p := filepath.Join(dir, numberedName(name, i))
+		_, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("too many files named like %q", name)
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMatchLogin(t *testing.T) {
+	logins := []string{"alice@example.com", "@corp.example"}
+	tests := []struct {
+		login string
+		want  bool
+	}{
+		{"alice@example.com", true},
+		{"Alice@Example.com", true},
+		{"bob@example.com", false},
+		{"bob@corp.example", true},
+		{"bob@notcorp.example", false},
+		{"@corp.example", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := matchLogin(logins, tt.login); got != tt.want {
+			t.Errorf("matchLogin(%q) = %v; want %v", tt.login, got, tt.want)
+		}
+	}
+}
+
+func TestLimitedReader(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		n       int64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"x", 0, true},
+		{"hello", 5, false},
+		{"hello!", 5, true},
+	} {
+		got, err := ioutil.ReadAll(&limitedReader{r: strings.NewReader(tt.in), n: tt.n, err: errFileTooLarge})
+		if tt.wantErr {
+			if err != errFileTooLarge || int64(len(got)) != tt.n {
+				t.Errorf("reading %q with limit %d = %q, %v; want error after %d bytes", tt.in, tt.n, got, err, tt.n)
+			}
+			continue
+		}
+		if err != nil || string(got) != tt.in {
+			t.Errorf("reading %q with limit %d = %q, %v", tt.in, tt.n, got, err)
+		}
+	}
+}
+
+func TestMoveIntoDir(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	write := func(path, s string) {
+		t.Helper()
+		if err := ioutil.WriteFile(path, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(dst, "a.txt"), "old")
+	write(filepath.Join(src, "a.txt"), "new")
+	if err := os.Mkdir(filepath.Join(src, "d"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	write(filepath.Join(src, "d", "f"), "in dir")
+	write(filepath.Join(src, "d", "run.sh"), "#!/bin/sh")
+	// Modes as a sender might have set them.
+	if err := os.Chmod(filepath.Join(src, "a.txt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, "d", "run.sh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	// As root, moved files should get the directory's owner.
+	wantUID := -1
+	if os.Getuid() == 0 {
+		wantUID = 12345
+		if err := os.Chown(dst, wantUID, wantUID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := moveIntoDir(filepath.Join(src, "a.txt"), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dst, "a (1).txt"); got != want {
+		t.Errorf("moved to %q; want %q", got, want)
+	}
+	if _, err := moveIntoDir(filepath.Join(src, "d"), dst); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"a.txt": "old", "a (1).txt": "new", "d/f": "in dir"} {
+		if b, err := ioutil.ReadFile(filepath.Join(dst, name)); err != nil || string(b) != want {
+			t.Errorf("%s = %q, %v; want %q", name, b, err, want)
+		}
+	}
+	for name, want := range map[string]os.FileMode{"a (1).txt": 0644, "d": 0755, "d/f": 0644, "d/run.sh": 0755} {
+		fi, err := os.Stat(filepath.Join(dst, name))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if got := fi.Mode().Perm(); got != want {
+			t.Errorf("%s mode = %v; want %v", name, got, want)
+		}
+		if uid, _ := fileOwner(fi); wantUID != -1 && uid != wantUID {
+			t.Errorf("%s owner = %d; want %d", name, uid, wantUID)
+		}
+	}
+	if des, _ := os.ReadDir(src); len(des) != 0 {
+		t.Errorf("%d entries left in source dir", len(des))
+	}
+}
+
+func TestLimitBodyConcurrent(t *testing.T) {
+	ps := &peerAPIServer{rootDir: t.TempDir()}
+	pol := fileReceivePolicy{maxInboxSize: 10}
+
+	// The first put reserves its declared length, so a second one
+	// that would only fit alone is refused.
+	body1, done1, err := ps.limitBody(pol, strings.NewReader("123456"), 0, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ps.limitBody(pol, strings.NewReader("123456"), 0, 6); err != errInboxFull {
+		t.Fatalf("second put: err = %v; want errInboxFull", err)
+	}
+	// One of unknown length gets what's left.
+	body2, done2, err := ps.limitBody(pol, strings.NewReader("123456"), 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(body2); err != errInboxFull || string(got) != "1234" {
+		t.Errorf("unknown length put read %q, %v; want 4 bytes and errInboxFull", got, err)
+	}
+	done2()
+	if got, err := ioutil.ReadAll(body1); err != nil || string(got) != "123456" {
+		t.Errorf("first put read %q, %v", got, err)
+	}
+	done1()
+
+	// With no puts in progress, use is measured on disk again.
+	if ps.inbox.puts != 0 {
+		t.Errorf("%d puts still in progress", ps.inbox.puts)
+	}
+	if _, done, err := ps.limitBody(pol, strings.NewReader("123456"), 0, 6); err != nil {
+		t.Errorf("put after others finished: %v", err)
+	} else {
+		done()
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"tailscale.com/ipn/hooks"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+// SetHooks sets the runner of the operator's event hooks, which are
+// fired on state changes, network map changes and received files. It
+// should be called before Start.
+func (b *LocalBackend) SetHooks(r *hooks.Runner) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.hooks = r
+}
+
+// fireHook fires ev at the event hooks, if any.
+func (b *LocalBackend) fireHook(ev hooks.Event) {
+	b.mu.Lock()
+	r := b.hooks
+	b.mu.Unlock()
+	if r != nil {
+		r.Fire(ev)
+	}
+}
+
+// fireNetMapHooksLocked fires the event hooks for the change from
+// network map old, which may be nil, to nm. Peers that are new in nm,
+// or whose status was unknown, fire peer-online if they're online.
+//
+// b.mu must be held.
+func (b *LocalBackend) fireNetMapHooksLocked(old, nm *netmap.NetworkMap) {
+	if b.hooks == nil || nm == nil {
+		return
+	}
+	b.hooks.Fire(hooks.Event{Type: hooks.EventNetMap})
+	if old == nil {
+		return
+	}
+	wasOnline := map[tailcfg.StableNodeID]bool{}
+	for _, p := range old.Peers {
+		if p.Online != nil {
+			wasOnline[p.StableID] = *p.Online
+		}
+	}
+	for _, p := range nm.Peers {
+		if p.Online == nil {
+			continue
+		}
+		was, known := wasOnline[p.StableID]
+		if known && was == *p.Online {
+			continue
+		}
+		if !known && !*p.Online {
+			// A new peer, or one whose status was
+			// unknown, that's offline hasn't gone offline.
+			continue
+		}
+		typ := hooks.EventPeerOffline
+		if *p.Online {
+			typ = hooks.EventPeerOnline
+		}
+		b.hooks.Fire(hooks.Event{
+			Type: typ,
+			Peer: &hooks.Peer{ID: p.StableID, Name: p.Name, Addresses: p.Addresses},
+		})
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+
+	"tailscale.com/ipn/hooks"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+func TestFireNetMapHooks(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev hooks.Event
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Error(err)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, fmt.Sprintf("%s %s", ev.Type, ev.Peer.ID))
+	}))
+	defer ts.Close()
+	c, err := hooks.ParseConfig([]byte(fmt.Sprintf(`{"Hooks": [{"URL": %q, "Debounce": "0s", "Events": ["peer-online", "peer-offline"]}]}`, ts.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := hooks.NewRunner(t.Logf, c)
+	b := &LocalBackend{hooks: r}
+
+	online, offline := true, false
+	peer := func(id string, on *bool) *tailcfg.Node {
+		return &tailcfg.Node{StableID: tailcfg.StableNodeID(id), Online: on}
+	}
+	old := &netmap.NetworkMap{Peers: []*tailcfg.Node{
+		peer("stays-online", &online),
+		peer("goes-offline", &online),
+		peer("comes-online", &offline),
+		peer("unknown-online", nil),
+	}}
+	nm := &netmap.NetworkMap{Peers: []*tailcfg.Node{
+		peer("stays-online", &online),
+		peer("goes-offline", &offline),
+		peer("comes-online", &online),
+		peer("unknown-online", &online),
+		peer("new-online", &online),
+		peer("new-offline", &offline),
+	}}
+	b.mu.Lock()
+	b.fireNetMapHooksLocked(old, nm)
+	b.mu.Unlock()
+	r.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Strings(got)
+	want := []string{
+		"peer-offline goes-offline",
+		"peer-online comes-online",
+		"peer-online new-online",
+		"peer-online unknown-online",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("hooks ran for %q; want %q", got, want)
+	}
+}
@@ -7,6 +7,7 @@ package ipnlocal
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -30,6 +31,7 @@ import (
 	"tailscale.com/control/controlclient"
 	"tailscale.com/health"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/hooks"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/ipn/policy"
 	"tailscale.com/net/dns"
@@ -53,6 +55,7 @@ import (
 	"tailscale.com/version/distro"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/magicsock"
 	"tailscale.com/wgengine/router"
 	"tailscale.com/wgengine/wgcfg"
 	"tailscale.com/wgengine/wgcfg/nmcfg"
@@ -94,6 +97,7 @@ type LocalBackend struct {
 	gotPortPollRes        chan struct{}    // closed upon first readPoller result
 	serverURL             string           // tailcontrol URL
 	newDecompressor       func() (controlclient.Decompressor, error)
+	autoExitKick          chan struct{} // wakes autoExitNodeLoop
 
 	filterHash string
 
@@ -102,6 +106,8 @@ type LocalBackend struct {
 	httpTestClient *http.Client // for controlclient. nil by default, used by tests.
 	ccGen          clientGen    // function for producing controlclient; lazily populated
 	notify         func(ipn.Notify)
+	notifyWatchers map[chan *ipn.Notify]bool // for WatchNotifications
+	hooks          *hooks.Runner             // or nil if no event hooks are configured
 	cc             controlclient.Client
 	stateKey       ipn.StateKey // computed in part from user-provided value
 	userID         string       // current controlling user ID (for Windows, primarily)
@@ -125,7 +131,16 @@ type LocalBackend struct {
 	prevIfState      *interfaces.State
 	peerAPIServer    *peerAPIServer // or nil
 	peerAPIListeners []*peerAPIListener
+	sshPort          uint16
+	sshHandler       func(net.Conn) // or nil if SSH is disabled
+	sshListeners     []*sshListener
+	serveKey         string         // addresses and rules serveServers were started for
+	serveServers     []*http.Server // for the rules in prefs.Serve
+	serveCerts       map[string]*tls.Certificate
 	incomingFiles    map[*incomingFile]bool
+	fileTransfers    []*fileTransfer // active and recently finished, oldest first
+	lastTransferID   int64
+	transferNotify   bool // whether a FileTransfers notify is scheduled
 	// directFileRoot, if non-empty, means to write received files
 	// directly to this directory, without staging them in an
 	// intermediate buffered directory for "pick-up" later. If
@@ -136,6 +151,16 @@ type LocalBackend struct {
 	// double-copying files by writing them to the right location
 	// immediately.
 	directFileRoot string
+	// autoExitNodeID is the exit node picked by autoExitNodeLoop
+	// when prefs.AutoExitNode is set, or empty if none is usable.
+	autoExitNodeID tailcfg.StableNodeID
+	autoExitMisses int // consecutive ping rounds autoExitNodeID missed
+	// dnsBypassIPs are addresses from DNS answers for
+	// prefs.ExitNodeBypassDomains, with when each was last seen.
+	dnsBypassIPs        map[netaddr.IP]time.Time
+	dnsBypassPruneTimer *time.Timer   // removes expired dnsBypassIPs, or nil
+	bypassReconfigDone  chan struct{} // closed by the queued bypass reconfig, or nil if none is queued
+	bypassReconfigBusy  bool          // bypassReconfigLoop is running
 
 	// statusLock must be held before calling statusChanged.Wait() or
 	// statusChanged.Broadcast().
@@ -177,8 +202,13 @@ func NewLocalBackend(logf logger.Logf, logid string, store ipn.StateStore, e wge
 		state:          ipn.NoState,
 		portpoll:       portpoll,
 		gotPortPollRes: make(chan struct{}),
+		autoExitKick:   make(chan struct{}, 1),
 	}
 	b.statusChanged = sync.NewCond(&b.statusLock)
+	go b.autoExitNodeLoop()
+	if w, ok := e.(wgengine.DNSAnswerWatcher); ok {
+		w.SetDNSAnswerWatcher(b.noteDNSBypassAnswer)
+	}
 
 	linkMon := e.GetLinkMonitor()
 	b.prevIfState = linkMon.InterfaceState()
@@ -266,6 +296,10 @@ func (b *LocalBackend) onHealthChange(sys health.Subsystem, err error) {
 func (b *LocalBackend) Shutdown() {
 	b.mu.Lock()
 	cc := b.cc
+	if b.dnsBypassPruneTimer != nil {
+		b.dnsBypassPruneTimer.Stop()
+		b.dnsBypassPruneTimer = nil
+	}
 	b.mu.Unlock()
 
 	b.unregisterLinkMon()
@@ -282,7 +316,13 @@ func (b *LocalBackend) Shutdown() {
 func (b *LocalBackend) Prefs() *ipn.Prefs {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	p := b.prefs.Clone()
+	return prefsWithoutPrivateKeys(b.prefs)
+}
+
+// prefsWithoutPrivateKeys returns a copy of p with the private keys
+// in its Persist removed.
+func prefsWithoutPrivateKeys(p *ipn.Prefs) *ipn.Prefs {
+	p = p.Clone()
 	if p != nil && p.Persist != nil {
 		p.Persist.LegacyFrontendPrivateMachineKey = wgkey.Private{}
 		p.Persist.PrivateNodeKey = wgkey.Private{}
@@ -327,6 +367,7 @@ func (b *LocalBackend) updateStatus(sb *ipnstate.StatusBuilder, extraLocked func
 			s.MagicDNSSuffix = b.netMap.MagicDNSSuffix()
 			s.CertDomains = append([]string(nil), b.netMap.DNS.CertDomains...)
 		}
+		s.AutoExitNode = b.prefs != nil && b.prefs.AutoExitNode
 	})
 	sb.MutateSelfStatus(func(ss *ipnstate.PeerStatus) {
 		if b.netMap != nil && b.netMap.SelfNode != nil {
@@ -369,6 +410,10 @@ func (b *LocalBackend) populatePeerStatusLocked(sb *ipnstate.StatusBuilder) {
 				tailscaleIPs = append(tailscaleIPs, addr.IP())
 			}
 		}
+		var peerAPIURL []string
+		if u := peerAPIBase(b.netMap, p); u != "" {
+			peerAPIURL = []string{u}
+		}
 		sb.AddPeer(key.Public(p.Key), &ipnstate.PeerStatus{
 			InNetworkMap:       true,
 			ID:                 p.StableID,
@@ -382,7 +427,8 @@ func (b *LocalBackend) populatePeerStatusLocked(sb *ipnstate.StatusBuilder) {
 			Created:            p.Created,
 			LastSeen:           lastSeen,
 			ShareeNode:         p.Hostinfo.ShareeNode,
-			ExitNode:           p.StableID != "" && p.StableID == b.prefs.ExitNodeID,
+			ExitNode:           p.StableID != "" && p.StableID == b.exitNodeIDLocked(),
+			PeerAPIURL:         peerAPIURL,
 		})
 	}
 }
@@ -414,6 +460,32 @@ func (b *LocalBackend) WhoIs(ipp netaddr.IPPort) (n *tailcfg.Node, u tailcfg.Use
 	return n, u, true
 }
 
+// WhoIsPeer is like WhoIs, but only identifies peers. Connections from
+// this node's own Tailscale IPs, which any local process can make,
+// aren't attributed to the node's owner. Servers that authorize their
+// clients by tailnet identity must use it rather than WhoIs.
+func (b *LocalBackend) WhoIsPeer(ipp netaddr.IPPort) (n *tailcfg.Node, u tailcfg.UserProfile, ok bool) {
+	n, u, ok = b.WhoIs(ipp)
+	if !ok {
+		return nil, u, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.netMap == nil || b.netMap.SelfNode == nil {
+		return n, u, true
+	}
+	self := b.netMap.SelfNode
+	if n.ID == self.ID {
+		return nil, tailcfg.UserProfile{}, false
+	}
+	for _, a := range self.Addresses {
+		if a.IP() == ipp.IP() {
+			return nil, tailcfg.UserProfile{}, false
+		}
+	}
+	return n, u, true
+}
+
 // SetDecompressor sets a decompression function, which must be a zstd
 // reader.
 //
@@ -530,6 +602,7 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 		b.updateFilter(st.NetMap, prefs)
 		b.e.SetNetworkMap(st.NetMap)
 		b.e.SetDERPMap(st.NetMap.DERPMap)
+		b.kickAutoExitNode()
 
 		b.send(ipn.Notify{NetMap: st.NetMap})
 	}
@@ -1114,9 +1187,17 @@ func (b *LocalBackend) send(n ipn.Notify) {
 	b.mu.Lock()
 	notifyFunc := b.notify
 	apiSrv := b.peerAPIServer
+	hookRunner := b.hooks
+	var watchers []chan *ipn.Notify
+	for ch := range b.notifyWatchers {
+		watchers = append(watchers, ch)
+	}
 	b.mu.Unlock()
 
-	if notifyFunc == nil {
+	if n.State != nil && hookRunner != nil {
+		hookRunner.Fire(hooks.Event{Type: hooks.EventState, State: n.State.String()})
+	}
+	if notifyFunc == nil && len(watchers) == 0 {
 		return
 	}
 
@@ -1125,7 +1206,130 @@ func (b *LocalBackend) send(n ipn.Notify) {
 	}
 
 	n.Version = version.Long
-	notifyFunc(n)
+	if notifyFunc != nil {
+		notifyFunc(n)
+	}
+	for _, ch := range watchers {
+		select {
+		case ch <- &n:
+		default:
+			// Watcher isn't keeping up; drop the message
+			// rather than block the backend.
+		}
+	}
+}
+
+// WatchNotifications calls fn with each Notify sent by the backend,
+// filtered according to mask, until ctx is done or fn returns false.
+// It's used by the LocalAPI watch-ipn-bus endpoint and, unlike
+// SetNotifyCallback, supports any number of concurrent watchers.
+//
+// fn must not modify the Notify, which may be shared with other
+// watchers. Messages are dropped for watchers that fall too far
+// behind.
+func (b *LocalBackend) WatchNotifications(ctx context.Context, mask ipn.NotifyWatchOpt, fn func(roNotify *ipn.Notify) (keepGoing bool)) {
+	ch := make(chan *ipn.Notify, 128)
+
+	var ini *ipn.Notify
+	b.mu.Lock()
+	if mask&(ipn.NotifyInitialState|ipn.NotifyInitialPrefs|ipn.NotifyInitialNetMap) != 0 {
+		ini = &ipn.Notify{Version: version.Long}
+		if mask&ipn.NotifyInitialState != 0 {
+			state := b.state
+			ini.State = &state
+			if b.authURLSticky != "" {
+				url := b.authURLSticky
+				ini.BrowseToURL = &url
+			}
+		}
+		if mask&ipn.NotifyInitialPrefs != 0 && b.prefs != nil {
+			ini.Prefs = b.prefs.Clone()
+		}
+		if mask&ipn.NotifyInitialNetMap != 0 {
+			ini.NetMap = b.netMap
+		}
+	}
+	if b.notifyWatchers == nil {
+		b.notifyWatchers = map[chan *ipn.Notify]bool{}
+	}
+	b.notifyWatchers[ch] = true
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		delete(b.notifyWatchers, ch)
+		b.mu.Unlock()
+	}()
+
+	if ini != nil {
+		if n := filterNotify(ini, mask); n != nil && !fn(n) {
+			return
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-ch:
+			if n = filterNotify(n, mask); n != nil && !fn(n) {
+				return
+			}
+		}
+	}
+}
+
+// filterNotify returns n as seen by a watcher with the given mask, or
+// nil if the watcher shouldn't see it at all. It doesn't modify n.
+func filterNotify(n *ipn.Notify, mask ipn.NotifyWatchOpt) *ipn.Notify {
+	if mask&ipn.NotifyWatchEngineUpdates == 0 && n.Engine != nil {
+		n2 := *n
+		n2.Engine = nil
+		if isEmptyNotify(&n2) {
+			return nil
+		}
+		n = &n2
+	}
+	if mask&ipn.NotifyNoPrivateKeys != 0 && n.Prefs != nil && n.Prefs.Persist != nil {
+		n2 := *n
+		n2.Prefs = prefsWithoutPrivateKeys(n.Prefs)
+		n = &n2
+	}
+	if n.NetMap == nil {
+		return n
+	}
+	switch {
+	case mask&ipn.NotifyNoNetMap != 0:
+		n2 := *n
+		n2.NetMap = nil
+		if isEmptyNotify(&n2) {
+			return nil
+		}
+		n = &n2
+	case mask&ipn.NotifyNoPrivateKeys != 0 && !n.NetMap.PrivateKey.IsZero():
+		nm := *n.NetMap
+		nm.PrivateKey = wgkey.Private{}
+		n2 := *n
+		n2.NetMap = &nm
+		n = &n2
+	}
+	return n
+}
+
+// isEmptyNotify reports whether n carries nothing but the Version and
+// FilesWaiting fields that send adds to every message.
+func isEmptyNotify(n *ipn.Notify) bool {
+	return n.ErrMessage == nil &&
+		n.LoginFinished == nil &&
+		n.State == nil &&
+		n.Prefs == nil &&
+		n.NetMap == nil &&
+		n.Engine == nil &&
+		n.BrowseToURL == nil &&
+		n.BackendLogID == nil &&
+		n.PingResult == nil &&
+		n.IncomingFiles == nil &&
+		n.FileTransfers == nil &&
+		n.LocalTCPPort == nil
 }
 
 func (b *LocalBackend) sendFileNotify() {
@@ -1134,7 +1338,7 @@ func (b *LocalBackend) sendFileNotify() {
 	b.mu.Lock()
 	notifyFunc := b.notify
 	apiSrv := b.peerAPIServer
-	if notifyFunc == nil || apiSrv == nil {
+	if (notifyFunc == nil && len(b.notifyWatchers) == 0) || apiSrv == nil {
 		b.mu.Unlock()
 		return
 	}
@@ -1435,6 +1639,24 @@ func (b *LocalBackend) Ping(ipStr string, useTSMP bool) {
 	})
 }
 
+// PingWait pings ip like Ping, but returns the result to the caller
+// instead of sending it to watchers of b.
+func (b *LocalBackend) PingWait(ctx context.Context, ip netaddr.IP, useTSMP bool) (*ipnstate.PingResult, error) {
+	ch := make(chan *ipnstate.PingResult, 1)
+	b.e.Ping(ip, useTSMP, func(pr *ipnstate.PingResult) {
+		select {
+		case ch <- pr:
+		default:
+		}
+	})
+	select {
+	case pr := <-ch:
+		return pr, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 // parseWgStatusLocked returns an EngineStatus based on s.
 //
 // b.mu must be held; mostly because the caller is about to anyway, and doing so
@@ -1491,6 +1713,12 @@ func (b *LocalBackend) EditPrefs(mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
 	p0 := b.prefs.Clone()
 	p1 := b.prefs.Clone()
 	p1.ApplyEdits(mp)
+	if mp.ServeSet {
+		if err := ipn.CheckServeRules(p1.Serve); err != nil {
+			b.mu.Unlock()
+			return nil, err
+		}
+	}
 	if p1.Equals(p0) {
 		b.mu.Unlock()
 		return p1, nil
@@ -1523,6 +1751,11 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) {
 	oldp := b.prefs
 	newp.Persist = oldp.Persist // caller isn't allowed to override this
 	b.prefs = newp
+	if !sameStrings(oldp.ExitNodeBypassDomains, newp.ExitNodeBypassDomains) {
+		// Addresses learned for domains that may no longer be
+		// listed would otherwise keep bypassing the exit node.
+		b.dnsBypassIPs = nil
+	}
 	b.inServerMode = newp.ForceDaemon
 	// We do this to avoid holding the lock while doing everything else.
 	newp = b.prefs.Clone()
@@ -1584,10 +1817,36 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) {
 	} else {
 		b.authReconfig()
 	}
+	// authReconfig doesn't get that far if only Serve changed.
+	b.initServeListeners()
+	if oldp.AutoExitNode != newp.AutoExitNode {
+		b.kickAutoExitNode()
+	}
 
 	b.send(ipn.Notify{Prefs: newp})
 }
 
+// setEndpointPolicy tells magicsock which endpoints prefs says to
+// advertise in addition to, or exclude from, the discovered ones.
+func (b *LocalBackend) setEndpointPolicy(prefs *ipn.Prefs) {
+	if prefs == nil {
+		return
+	}
+	ig, ok := b.e.(wgengine.InternalsGetter)
+	if !ok {
+		return
+	}
+	_, mc, ok := ig.GetInternals()
+	if !ok {
+		return
+	}
+	mc.SetEndpointPolicy(magicsock.EndpointPolicy{
+		Static:            prefs.StaticEndpoints,
+		ExcludeInterfaces: prefs.ExcludeEndpointInterfaces,
+		ExcludePrefixes:   prefs.ExcludeEndpointPrefixes,
+	})
+}
+
 func (b *LocalBackend) getPeerAPIPortForTSMPPing(ip netaddr.IP) (port uint16, ok bool) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -1671,12 +1930,14 @@ func (b *LocalBackend) blockEngineUpdates(block bool) {
 func (b *LocalBackend) authReconfig() {
 	b.mu.Lock()
 	blocked := b.blocked
-	uc := b.prefs
+	uc := b.reconfigPrefsLocked()
 	nm := b.netMap
 	hasPAC := b.prevIfState.HasPAC()
 	disableSubnetsIfPAC := nm != nil && nm.Debug != nil && nm.Debug.DisableSubnetsIfPAC.EqualBool(true)
 	b.mu.Unlock()
 
+	b.setEndpointPolicy(uc)
+
 	if blocked {
 		b.logf("authReconfig: blocked, skipping.")
 		return
@@ -1838,6 +2099,10 @@ func (b *LocalBackend) authReconfig() {
 		}
 	}
 
+	if !uc.ExitNodeID.IsZero() {
+		dcfg.WatchDomains = exitNodeBypassDomains(uc)
+	}
+
 	err = b.e.Reconfig(cfg, rcfg, &dcfg, nm.Debug)
 	if err == wgengine.ErrNoChanges {
 		return
@@ -1845,6 +2110,8 @@ func (b *LocalBackend) authReconfig() {
 	b.logf("[v1] authReconfig: ra=%v dns=%v 0x%02x: %v", uc.RouteAll, uc.CorpDNS, flags, err)
 
 	b.initPeerAPIListener()
+	b.initSSHListeners()
+	b.initServeListeners()
 }
 
 func parseResolver(cfg tailcfg.DNSResolver) (netaddr.IPPort, error) {
@@ -2088,7 +2355,9 @@ func (b *LocalBackend) routerConfig(cfg *wgcfg.Config, prefs *ipn.Prefs) *router
 	// blackhole routes appropriately if we're missing some. This is
 	// likely to break some functionality, but if the user expressed a
 	// preference for routing remotely, we want to avoid leaking
-	// traffic at the expense of functionality.
+	// traffic at the expense of functionality. With
+	// Prefs.AutoExitNode, prefs.ExitNodeID is only set once an exit
+	// node has been picked; see reconfigPrefsLocked.
 	if prefs.ExitNodeID != "" || !prefs.ExitNodeIP.IsZero() {
 		var default4, default6 bool
 		for _, route := range rs.Routes {
@@ -2122,6 +2391,9 @@ func (b *LocalBackend) routerConfig(cfg *wgcfg.Config, prefs *ipn.Prefs) *router
 				rs.Routes = append(rs.Routes, ips.Prefixes()...)
 			}
 		}
+		if bypass := b.exitNodeBypassSet(prefs); bypass != nil {
+			rs.Routes, rs.LocalRoutes = applyExitNodeBypass(rs.Routes, rs.LocalRoutes, bypass, runtime.GOOS)
+		}
 	}
 
 	rs.Routes = append(rs.Routes, netaddr.IPPrefixFrom(tsaddr.TailscaleServiceIP(), 32))
@@ -2178,6 +2450,8 @@ func (b *LocalBackend) enterState(newState ipn.State) {
 	} else if oldState == ipn.Running {
 		// Transitioning away from running.
 		b.closePeerAPIListenersLocked()
+		b.closeSSHListenersLocked()
+		b.closeServeListenersLocked()
 	}
 	b.mu.Unlock()
 
@@ -2217,6 +2491,7 @@ func (b *LocalBackend) enterState(newState ipn.State) {
 			addrs = append(addrs, addr.IP().String())
 		}
 		systemd.Status("Connected; %s; %s", activeLogin, strings.Join(addrs, " "))
+		b.initServeListeners()
 	default:
 		b.logf("[unexpected] unknown newState %#v", newState)
 	}
@@ -2448,6 +2723,7 @@ func (b *LocalBackend) setNetMapLocked(nm *netmap.NetworkMap) {
 			login = "<missing-profile>"
 		}
 	}
+	b.fireNetMapHooksLocked(b.netMap, nm)
 	b.netMap = nm
 	if login != b.activeLogin {
 		b.logf("active login: %v", login)
@@ -2603,6 +2879,26 @@ func (b *LocalBackend) FileTargets() ([]*apitype.FileTarget, error) {
 	return ret, nil
 }
 
+// FilePeer returns the node with the given stable ID and the base URL
+// of its peer API, for sending it files. Unlike FileTargets, it
+// includes other users' nodes, which decide for themselves whether to
+// accept files from this node's user.
+func (b *LocalBackend) FilePeer(id tailcfg.StableNodeID) (peerAPIURL string, n *tailcfg.Node, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	nm := b.netMap
+	if b.state != ipn.Running || nm == nil || !b.capFileSharing {
+		return "", nil, false
+	}
+	for _, p := range nm.Peers {
+		if p.StableID == id {
+			u := peerAPIBase(nm, p)
+			return u, p, u != ""
+		}
+	}
+	return "", nil, false
+}
+
 // SetDNS adds a DNS record for the given domain name & TXT record
 // value.
 //
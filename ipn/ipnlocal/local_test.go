@@ -5,6 +5,7 @@
 package ipnlocal
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"reflect"
@@ -18,6 +19,8 @@ import (
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
+	"tailscale.com/types/persist"
+	"tailscale.com/types/wgkey"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/wgcfg"
 )
@@ -493,3 +496,150 @@ func TestFileTargets(t *testing.T) {
 	}
 	// (other cases handled by TestPeerAPIBase above)
 }
+
+func TestWatchNotifications(t *testing.T) {
+	priv, err := wgkey.NewPrivate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &LocalBackend{
+		state:  ipn.Running,
+		netMap: &netmap.NetworkMap{Name: "foo.example.ts.net.", PrivateKey: priv},
+		prefs: &ipn.Prefs{Persist: &persist.Persist{
+			PrivateNodeKey:                  priv,
+			OldPrivateNodeKey:               priv,
+			LegacyFrontendPrivateMachineKey: priv,
+		}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	got := make(chan *ipn.Notify, 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mask := ipn.NotifyInitialState | ipn.NotifyInitialPrefs | ipn.NotifyInitialNetMap | ipn.NotifyNoPrivateKeys
+		b.WatchNotifications(ctx, mask, func(n *ipn.Notify) bool {
+			got <- n
+			return true
+		})
+	}()
+
+	n := <-got
+	if n.State == nil || *n.State != ipn.Running {
+		t.Errorf("initial State = %v; want Running", n.State)
+	}
+	if n.NetMap == nil || n.NetMap.Name != "foo.example.ts.net." {
+		t.Fatalf("initial NetMap = %v", n.NetMap)
+	}
+	if !n.NetMap.PrivateKey.IsZero() {
+		t.Errorf("private key sent despite NotifyNoPrivateKeys")
+	}
+	if b.netMap.PrivateKey.IsZero() {
+		t.Errorf("backend's netmap was modified")
+	}
+	checkNoPrefsKeys := func(p *ipn.Prefs) {
+		t.Helper()
+		if p == nil || p.Persist == nil {
+			t.Fatalf("Prefs = %v; want Prefs with Persist", p)
+		}
+		if !p.Persist.PrivateNodeKey.IsZero() || !p.Persist.OldPrivateNodeKey.IsZero() || !p.Persist.LegacyFrontendPrivateMachineKey.IsZero() {
+			t.Errorf("Persist private keys sent despite NotifyNoPrivateKeys")
+		}
+	}
+	checkNoPrefsKeys(n.Prefs)
+	if b.prefs.Persist.PrivateNodeKey.IsZero() {
+		t.Errorf("backend's prefs were modified")
+	}
+
+	b.send(ipn.Notify{Prefs: b.prefs.Clone()})
+	n = <-got
+	checkNoPrefsKeys(n.Prefs)
+
+	// Engine-only updates aren't wanted, so the first message seen
+	// should be the state change, without the engine status.
+	b.send(ipn.Notify{Engine: &ipn.EngineStatus{NumLive: 1}})
+	stopped := ipn.Stopped
+	b.send(ipn.Notify{State: &stopped, Engine: &ipn.EngineStatus{NumLive: 2}})
+	n = <-got
+	if n.State == nil || *n.State != ipn.Stopped || n.Engine != nil {
+		t.Errorf("got %v; want state=Stopped without engine status", n)
+	}
+
+	cancel()
+	<-done
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.notifyWatchers) != 0 {
+		t.Errorf("%d watchers remain registered", len(b.notifyWatchers))
+	}
+}
+
+func TestFilterNotify(t *testing.T) {
+	nm := &netmap.NetworkMap{}
+	running := ipn.Running
+	tests := []struct {
+		name    string
+		n       ipn.Notify
+		mask    ipn.NotifyWatchOpt
+		wantNil bool
+	}{
+		{"engine-only", ipn.Notify{Engine: &ipn.EngineStatus{}}, 0, true},
+		{"engine-wanted", ipn.Notify{Engine: &ipn.EngineStatus{}}, ipn.NotifyWatchEngineUpdates, false},
+		{"netmap-only", ipn.Notify{NetMap: nm}, ipn.NotifyNoNetMap, true},
+		{"netmap-and-state", ipn.Notify{NetMap: nm, State: &running}, ipn.NotifyNoNetMap, false},
+		{"netmap-wanted", ipn.Notify{NetMap: nm}, 0, false},
+	}
+	for _, tt := range tests {
+		got := filterNotify(&tt.n, tt.mask)
+		if (got == nil) != tt.wantNil {
+			t.Errorf("%s: filterNotify = %v; want nil %v", tt.name, got, tt.wantNil)
+			continue
+		}
+		if got != nil && tt.mask&ipn.NotifyNoNetMap != 0 && got.NetMap != nil {
+			t.Errorf("%s: NetMap sent despite NotifyNoNetMap", tt.name)
+		}
+	}
+}
+
+func TestWhoIsPeer(t *testing.T) {
+	b := &LocalBackend{logf: t.Logf}
+	b.mu.Lock()
+	b.setNetMapLocked(&netmap.NetworkMap{
+		SelfNode: &tailcfg.Node{
+			ID:        1,
+			User:      10,
+			Addresses: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.1/32"), netaddr.MustParseIPPrefix("fd7a:115c:a1e0::1/128")},
+		},
+		Peers: []*tailcfg.Node{{
+			ID:        2,
+			User:      20,
+			Addresses: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.2/32")},
+		}},
+		UserProfiles: map[tailcfg.UserID]tailcfg.UserProfile{
+			10: {LoginName: "owner@example.com"},
+			20: {LoginName: "peer@example.com"},
+		},
+	})
+	b.mu.Unlock()
+
+	tests := []struct {
+		addr      string
+		wantWhoIs string // login from WhoIs, or empty if none
+		wantPeer  string // login from WhoIsPeer, or empty if none
+	}{
+		{"100.64.0.2:1234", "peer@example.com", "peer@example.com"},
+		{"100.64.0.1:1234", "owner@example.com", ""},
+		{"[fd7a:115c:a1e0::1]:1234", "owner@example.com", ""},
+		{"100.64.0.3:0", "", ""},
+	}
+	for _, tt := range tests {
+		ipp := netaddr.MustParseIPPort(tt.addr)
+		if _, u, _ := b.WhoIs(ipp); u.LoginName != tt.wantWhoIs {
+			t.Errorf("WhoIs(%v) = %q; want %q", ipp, u.LoginName, tt.wantWhoIs)
+		}
+		if _, u, _ := b.WhoIsPeer(ipp); u.LoginName != tt.wantPeer {
+			t.Errorf("WhoIsPeer(%v) = %q; want %q", ipp, u.LoginName, tt.wantPeer)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/health"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/metrics"
+)
+
+// peerIdleAfter is how long after last sending to a peer its path
+// is reported as idle.
+const peerIdleAfter = 2 * time.Minute
+
+// WriteMetrics writes tailscaled's metrics to w in the Prometheus text
+// exposition format.
+//
+// The metrics named tailscaled_* are stable: their names, types and
+// labels won't change incompatibly. Other metrics describe the Go
+// runtime and may.
+func (b *LocalBackend) WriteMetrics(w io.Writer) {
+	st := b.Status()
+	now := time.Now()
+
+	var rx, tx, handshake []metrics.Sample
+	paths := map[string]float64{"direct": 0, "derp": 0, "idle": 0}
+	for _, k := range st.Peers() {
+		ps := st.Peer[k]
+		labels := []metrics.Label{
+			{Name: "node", Value: string(ps.ID)},
+			{Name: "name", Value: peerMetricName(ps)},
+		}
+		rx = append(rx, metrics.Sample{Labels: labels, Value: float64(ps.RxBytes)})
+		tx = append(tx, metrics.Sample{Labels: labels, Value: float64(ps.TxBytes)})
+		var hs float64
+		if !ps.LastHandshake.IsZero() {
+			hs = float64(ps.LastHandshake.Unix())
+		}
+		handshake = append(handshake, metrics.Sample{Labels: labels, Value: hs})
+		paths[peerPathType(ps, now)]++
+	}
+	metrics.WriteFamily(w, "tailscaled_peer_rx_bytes", "counter", "Bytes received from the peer.", rx)
+	metrics.WriteFamily(w, "tailscaled_peer_tx_bytes", "counter", "Bytes sent to the peer.", tx)
+	metrics.WriteFamily(w, "tailscaled_peer_last_handshake_seconds", "gauge", "Unix time of the last WireGuard handshake with the peer, or 0 if none.", handshake)
+	metrics.WriteFamily(w, "tailscaled_magicsock_paths", "gauge", "Number of peers by the type of path used to reach them.", labelledSamples("type", paths))
+
+	regionCodes := map[int]string{}
+	if dm := b.DERPMap(); dm != nil {
+		for rid, r := range dm.Regions {
+			regionCodes[rid] = r.RegionCode
+		}
+	}
+	var connected, lastFrame []metrics.Sample
+	for _, rs := range health.DERPRegionStates() {
+		labels := []metrics.Label{
+			{Name: "region", Value: strconv.Itoa(rs.RegionID)},
+			{Name: "region_code", Value: regionCodes[rs.RegionID]},
+			{Name: "home", Value: strconv.FormatBool(rs.Home)},
+		}
+		connected = append(connected, metrics.Sample{Labels: labels, Value: boolMetric(rs.Connected)})
+		var lf float64
+		if !rs.LastFrame.IsZero() {
+			lf = float64(rs.LastFrame.Unix())
+		}
+		lastFrame = append(lastFrame, metrics.Sample{Labels: labels, Value: lf})
+	}
+	metrics.WriteFamily(w, "tailscaled_derp_region_connected", "gauge", "Whether there's a connection to the DERP region.", connected)
+	metrics.WriteFamily(w, "tailscaled_derp_region_last_frame_seconds", "gauge", "Unix time a frame was last received from the DERP region, or 0 if never.", lastFrame)
+
+	healthErrs := map[string]float64{}
+	for sys, err := range health.SubsystemErrors() {
+		healthErrs[string(sys)] = boolMetric(err != nil)
+	}
+	metrics.WriteFamily(w, "tailscaled_health_errors", "gauge", "Whether the subsystem is unhealthy.", labelledSamples("subsystem", healthErrs))
+
+	metrics.WritePrometheus(w)
+}
+
+// peerMetricName returns the name to label ps's metrics with: its
+// MagicDNS name if it has one, else its hostname.
+func peerMetricName(ps *ipnstate.PeerStatus) string {
+	if ps.DNSName != "" {
+		return strings.TrimSuffix(ps.DNSName, ".")
+	}
+	return ps.HostName
+}
+
+// peerPathType returns how packets to ps currently travel: "direct"
+// over UDP, via "derp", or "idle" if none have been sent recently.
+func peerPathType(ps *ipnstate.PeerStatus, now time.Time) string {
+	switch {
+	case ps.LastWrite.IsZero() || now.Sub(ps.LastWrite) >= peerIdleAfter:
+		return "idle"
+	case ps.CurAddr != "":
+		return "direct"
+	default:
+		return "derp"
+	}
+}
+
+// labelledSamples returns a sample for each of vals, labelled label
+// with its key, ordered by key.
+func labelledSamples(label string, vals map[string]float64) []metrics.Sample {
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ret := make([]metrics.Sample, 0, len(keys))
+	for _, k := range keys {
+		ret = append(ret, metrics.Sample{
+			Labels: []metrics.Label{{Name: label, Value: k}},
+			Value:  vals[k],
+		})
+	}
+	return ret
+}
+
+func boolMetric(v bool) float64 {
+	if v {
+		return 1
+	}
+	return 0
+}
@@ -6,12 +6,17 @@ package ipnlocal
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"hash/crc32"
 	"html"
 	"io"
 	"io/fs"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
@@ -30,10 +35,12 @@ import (
 	"inet.af/netaddr"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/hooks"
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
+	"tailscale.com/util/dirtar"
 	"tailscale.com/wgengine"
 )
 
@@ -53,6 +60,8 @@ type peerAPIServer struct {
 	// In directFileMode, the peerapi doesn't do the final rename
 	// from "foo.jpg.partial" to "foo.jpg".
 	directFileMode bool
+
+	inbox inboxQuota // use of the inbox by puts in progress
 }
 
 const (
@@ -87,14 +96,24 @@ func validFilenameRune(r rune) bool {
 }
 
 func (s *peerAPIServer) diskPath(baseName string) (fullPath string, ok bool) {
-	if !utf8.ValidString(baseName) {
+	if !validFilename(baseName) {
 		return "", false
 	}
+	return filepath.Join(s.rootDir, baseName), true
+}
+
+// validFilename reports whether baseName is acceptable as the name of
+// a received file or directory, or of an element of the path of a file
+// within a received directory.
+func validFilename(baseName string) bool {
+	if !utf8.ValidString(baseName) {
+		return false
+	}
 	if strings.TrimSpace(baseName) != baseName {
-		return "", false
+		return false
 	}
 	if len(baseName) > 255 {
-		return "", false
+		return false
 	}
 	// TODO: validate unicode normalization form too? Varies by platform.
 	clean := path.Clean(baseName)
@@ -102,14 +121,14 @@ func (s *peerAPIServer) diskPath(baseName string) (fullPath string, ok bool) {
 		clean == "." || clean == ".." ||
 		strings.HasSuffix(clean, deletedSuffix) ||
 		strings.HasSuffix(clean, partialSuffix) {
-		return "", false
+		return false
 	}
 	for _, r := range baseName {
 		if !validFilenameRune(r) {
-			return "", false
+			return false
 		}
 	}
-	return filepath.Join(s.rootDir, baseName), true
+	return true
 }
 
 // hasFilesWaiting reports whether any files are buffered in the
@@ -147,7 +166,7 @@ func (s *peerAPIServer) hasFilesWaiting() bool {
 				defer tryDeleteAgain(filepath.Join(s.rootDir, strings.TrimSuffix(name, deletedSuffix)))
 				continue
 			}
-			if de.Type().IsRegular() {
+			if de.Type().IsRegular() || de.IsDir() {
 				_, err := os.Stat(filepath.Join(s.rootDir, name+deletedSuffix))
 				if os.IsNotExist(err) {
 					return true
@@ -211,6 +230,17 @@ func (s *peerAPIServer) WaitingFiles() (ret []apitype.WaitingFile, err error) {
 					Size: fi.Size(),
 				})
 			}
+			if de.IsDir() {
+				size, err := dirtar.Size(filepath.Join(s.rootDir, name))
+				if err != nil {
+					continue
+				}
+				ret = append(ret, apitype.WaitingFile{
+					Name:  name,
+					Size:  size,
+					IsDir: true,
+				})
+			}
 		}
 		if err == io.EOF {
 			break
@@ -267,9 +297,13 @@ func (s *peerAPIServer) DeleteFile(baseName string) error {
 	}
 	var bo *backoff.Backoff
 	logf := s.b.logf
+	remove := os.Remove
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		remove = os.RemoveAll
+	}
 	t0 := time.Now()
 	for {
-		err := os.Remove(path)
+		err := remove(path)
 		if err != nil && !os.IsNotExist(err) {
 			err = redactErr(err)
 			// Put a retry loop around deletes on Windows. Windows
@@ -320,6 +354,8 @@ func touchFile(path string) error {
 	return f.Close()
 }
 
+// OpenFile opens the waiting file baseName. If it's a directory, rc is
+// a tar archive of it, written by dirtar.Write, and size is -1.
 func (s *peerAPIServer) OpenFile(baseName string) (rc io.ReadCloser, size int64, err error) {
 	if s.rootDir == "" {
 		return nil, 0, errors.New("peerapi disabled; no storage configured")
@@ -344,6 +380,12 @@ func (s *peerAPIServer) OpenFile(baseName string) (rc io.ReadCloser, size int64,
 		f.Close()
 		return nil, 0, redactErr(err)
 	}
+	if fi.IsDir() {
+		f.Close()
+		pr, pw := io.Pipe()
+		go func() { pw.CloseWithError(dirtar.Write(pw, path)) }()
+		return pr, -1, nil
+	}
 	return f, fi.Size(), nil
 }
 
@@ -523,7 +565,8 @@ type incomingFile struct {
 	size        int64     // or -1 if unknown; never 0
 	w           io.Writer // underlying writer
 	ph          *peerAPIHandler
-	partialPath string // non-empty in direct mode
+	partialPath string        // non-empty in direct mode
+	xfer        *fileTransfer // progress for LocalBackend.FileTransfers
 
 	mu         sync.Mutex
 	copied     int64
@@ -550,6 +593,9 @@ func (f *incomingFile) Write(p []byte) (n int, err error) {
 		}
 	}()
 	if n > 0 {
+		if f.xfer != nil {
+			f.xfer.add(int64(n))
+		}
 		f.mu.Lock()
 		defer f.mu.Unlock()
 		f.copied += int64(n)
@@ -576,7 +622,12 @@ func (f *incomingFile) PartialFile() ipn.PartialFile {
 }
 
 func (h *peerAPIHandler) handlePeerPut(w http.ResponseWriter, r *http.Request) {
-	if !h.isSelf {
+	pol := h.ps.b.fileReceivePolicy()
+	if matchLogin(pol.denySenders, h.peerUser.LoginName) {
+		http.Error(w, "sender not accepted", http.StatusForbidden)
+		return
+	}
+	if !h.isSelf && !matchLogin(pol.allowSenders, h.peerUser.LoginName) {
 		http.Error(w, "not owner", http.StatusForbidden)
 		return
 	}
@@ -584,8 +635,8 @@ func (h *peerAPIHandler) handlePeerPut(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "file sharing not enabled by Tailscale admin", http.StatusForbidden)
 		return
 	}
-	if r.Method != "PUT" {
-		http.Error(w, "expected method PUT", http.StatusMethodNotAllowed)
+	if r.Method != "PUT" && r.Method != "GET" {
+		http.Error(w, "expected method PUT or GET", http.StatusMethodNotAllowed)
 		return
 	}
 	if h.ps.rootDir == "" {
@@ -598,6 +649,10 @@ func (h *peerAPIHandler) handlePeerPut(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "misconfigured internals", 500)
 		return
 	}
+	// A trailing slash means the body is a tar archive of a
+	// directory tree named by the rest of the path.
+	isDir := strings.HasSuffix(suffix, "/")
+	suffix = strings.TrimSuffix(suffix, "/")
 	if suffix == "" {
 		http.Error(w, "empty filename", 400)
 		return
@@ -616,51 +671,121 @@ func (h *peerAPIHandler) handlePeerPut(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad filename", 400)
 		return
 	}
-	t0 := time.Now()
+	if isDir {
+		if r.Method != "PUT" {
+			http.Error(w, "expected method PUT", http.StatusMethodNotAllowed)
+			return
+		}
+		h.handlePeerPutDir(w, r, pol, baseName, dstFile)
+		return
+	}
+	h.ps.removeStalePartials()
 	// TODO(bradfitz): prevent same filename being sent by two peers at once
 	partialFile := dstFile + partialSuffix
-	f, err := os.Create(partialFile)
+	if r.Method == "GET" {
+		h.servePartialFile(w, partialFile)
+		return
+	}
+	start, err := parseContentRangeStart(r.Header.Get("Content-Range"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	body, done, err := h.ps.limitBody(pol, r.Body, start, r.ContentLength)
+	if err != nil {
+		h.writeLimitError(w, err)
+		return
+	}
+	defer done()
+	t0 := time.Now()
+	var f *os.File
+	if start == 0 {
+		f, err = os.Create(partialFile)
+	} else {
+		f, err = openPartialFileAt(partialFile, start)
+	}
+	if err == errResumeTooFar {
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
 	if err != nil {
 		h.logf("put Create error: %v", redactErr(err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	var success bool
+	// On failure, the partial file is removed, unless the transfer
+	// was cut off, in which case it's kept for the sender to resume.
+	var success, keepPartial bool
 	defer func() {
-		if !success {
+		if !success && !keepPartial {
 			os.Remove(partialFile)
 		}
 	}()
-	var finalSize int64
+
+	var dst io.Writer = f
+	var sum hash.Hash
+	wantSum := r.Header.Get(apitype.FileSHA256Header)
+	if wantSum != "" {
+		sum = sha256.New()
+		if _, err := io.Copy(sum, io.NewSectionReader(f, 0, start)); err != nil {
+			err = redactErr(err)
+			f.Close()
+			h.logf("put hash error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		dst = io.MultiWriter(f, sum)
+	}
+
+	finalSize := start
 	var inFile *incomingFile
 	if r.ContentLength != 0 {
 		inFile = &incomingFile{
 			name:    baseName,
 			started: time.Now(),
 			size:    r.ContentLength,
-			w:       f,
+			w:       dst,
 			ph:      h,
+			copied:  start,
+		}
+		if r.ContentLength > 0 {
+			inFile.size += start
 		}
 		if h.ps.directFileMode {
 			inFile.partialPath = partialFile
 		}
+		inFile.xfer = h.ps.b.startFileTransfer(ipn.FileReceive, baseName, h.peerNode.ComputedName, inFile.size, start)
+		defer func() { inFile.xfer.finish(putResult(success, keepPartial)) }()
 		h.ps.b.registerIncomingFile(inFile, true)
 		defer h.ps.b.registerIncomingFile(inFile, false)
-		n, err := io.Copy(inFile, r.Body)
+		n, err := io.Copy(inFile, body)
+		if errors.Is(err, errFileTooLarge) || errors.Is(err, errInboxFull) {
+			f.Close()
+			h.writeLimitError(w, err)
+			return
+		}
 		if err != nil {
 			err = redactErr(err)
 			f.Close()
-			h.logf("put Copy error: %v", err)
+			keepPartial = true
+			h.logf("put Copy error after %s: %v", approxSize(start+n), err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		finalSize = n
+		finalSize += n
 	}
 	if err := redactErr(f.Close()); err != nil {
 		h.logf("put Close error: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if sum != nil {
+		if got := hex.EncodeToString(sum.Sum(nil)); !strings.EqualFold(got, wantSum) {
+			h.logf("put of %s from %v/%v failed SHA-256 verification", approxSize(finalSize), h.remoteAddr.IP(), h.peerNode.ComputedName)
+			http.Error(w, "SHA-256 mismatch; received file discarded", http.StatusBadRequest)
+			return
+		}
+	}
 	if h.ps.directFileMode {
 		if inFile != nil { // non-zero length; TODO: notify even for zero length
 			inFile.markAndNotifyDone()
@@ -682,7 +807,256 @@ func (h *peerAPIHandler) handlePeerPut(w http.ResponseWriter, r *http.Request) {
 	success = true
 	io.WriteString(w, "{}\n")
 	h.ps.knownEmpty.Set(false)
+	h.autoAccept(pol, baseName)
 	h.ps.b.sendFileNotify()
+	h.ps.b.fireHook(hooks.Event{
+		Type: hooks.EventFile,
+		File: &hooks.File{Name: baseName, Size: finalSize, From: h.peerNode.ComputedName},
+	})
+}
+
+// putResult returns the result of a put to record in its
+// fileTransfer: nil if it succeeded.
+func putResult(success, interrupted bool) error {
+	switch {
+	case success:
+		return nil
+	case interrupted:
+		return errors.New("interrupted")
+	default:
+		return errors.New("failed")
+	}
+}
+
+// writeLimitError writes the response for a put refused by
+// peerAPIServer.limitBody with err.
+func (h *peerAPIHandler) writeLimitError(w http.ResponseWriter, err error) {
+	switch err {
+	case errFileTooLarge:
+		h.logf("put rejected: %v", err)
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errInboxFull:
+		h.logf("put rejected: %v", err)
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+	default:
+		err = redactErr(err)
+		h.logf("put limit check error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handlePeerPutDir handles a PUT of the directory tree baseName, sent
+// as a tar archive written by dirtar.Write. The tree is extracted next
+// to its final location, dstDir, and only moved there once complete,
+// so it's never seen partially received.
+func (h *peerAPIHandler) handlePeerPutDir(w http.ResponseWriter, r *http.Request, pol fileReceivePolicy, baseName, dstDir string) {
+	if h.ps.directFileMode {
+		http.Error(w, "directories not supported by this receiver", http.StatusBadRequest)
+		return
+	}
+	body, done, err := h.ps.limitBody(pol, r.Body, 0, r.ContentLength)
+	if err != nil {
+		h.writeLimitError(w, err)
+		return
+	}
+	defer done()
+	t0 := time.Now()
+	partialDir := dstDir + partialSuffix
+	if err := os.RemoveAll(partialDir); err != nil {
+		h.logf("put dir RemoveAll error: %v", redactErr(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := os.Mkdir(partialDir, 0700); err != nil {
+		h.logf("put dir Mkdir error: %v", redactErr(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var success bool
+	defer func() {
+		if !success {
+			os.RemoveAll(partialDir)
+		}
+	}()
+
+	inFile := &incomingFile{
+		name:    baseName,
+		started: time.Now(),
+		size:    r.ContentLength,
+		w:       ioutil.Discard,
+		ph:      h,
+	}
+	inFile.xfer = h.ps.b.startFileTransfer(ipn.FileReceive, baseName, h.peerNode.ComputedName, inFile.size, 0)
+	defer func() { inFile.xfer.finish(putResult(success, false)) }()
+	h.ps.b.registerIncomingFile(inFile, true)
+	defer h.ps.b.registerIncomingFile(inFile, false)
+	if err := dirtar.Extract(io.TeeReader(body, inFile), partialDir, validFilename); err != nil {
+		if errors.Is(err, errFileTooLarge) || errors.Is(err, errInboxFull) {
+			h.writeLimitError(w, err)
+			return
+		}
+		if errors.Is(err, dirtar.ErrUnsafePath) {
+			h.logf("put dir rejected: unsafe path in archive")
+			http.Error(w, "unsafe path in archive", http.StatusBadRequest)
+			return
+		}
+		err = redactErr(err)
+		h.logf("put dir extract error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := os.RemoveAll(dstDir); err != nil {
+		h.logf("put dir RemoveAll error: %v", redactErr(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := os.Rename(partialDir, dstDir); err != nil {
+		err = redactErr(err)
+		h.logf("put dir final rename: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	size, _ := dirtar.Size(dstDir)
+
+	d := time.Since(t0).Round(time.Second / 10)
+	h.logf("got put of directory of %s in %v from %v/%v", approxSize(size), d, h.remoteAddr.IP(), h.peerNode.ComputedName)
+
+	success = true
+	io.WriteString(w, "{}\n")
+	h.ps.knownEmpty.Set(false)
+	h.autoAccept(pol, baseName)
+	h.ps.b.sendFileNotify()
+	h.ps.b.fireHook(hooks.Event{
+		Type: hooks.EventFile,
+		File: &hooks.File{Name: baseName, Size: size, From: h.peerNode.ComputedName},
+	})
+}
+
+// partialChunkSize is the size of the chunks of a partially received
+// file whose hashes are reported to senders wanting to resume it.
+var partialChunkSize int64 = 16 << 20
+
+// stalePartialAge is how long a partial file left by an interrupted
+// transfer is kept, since it was last written, for its sender to
+// resume.
+const stalePartialAge = 24 * time.Hour
+
+// removeStalePartials removes the partial files in the inbox that
+// haven't been written to for stalePartialAge, so transfers that are
+// never resumed don't use up disk space.
+func (s *peerAPIServer) removeStalePartials() {
+	if s.rootDir == "" || s.directFileMode {
+		return
+	}
+	des, err := os.ReadDir(s.rootDir)
+	if err != nil {
+		return
+	}
+	for _, de := range des {
+		name := de.Name()
+		if !strings.HasSuffix(name, partialSuffix) || !de.Type().IsRegular() {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil || time.Since(fi.ModTime()) < stalePartialAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.rootDir, name)); err != nil {
+			s.b.logf("removing stale partial file: %v", redactErr(err))
+		}
+	}
+}
+
+// errResumeTooFar is returned by openPartialFileAt when asked to resume
+// a transfer after more bytes than have been received.
+var errResumeTooFar = errors.New("resume offset is past the end of the partial file")
+
+// servePartialFile serves the apitype.PartialFile describing what's
+// been received of the partial file at path, which needn't exist.
+func (h *peerAPIHandler) servePartialFile(w http.ResponseWriter, path string) {
+	res := apitype.PartialFile{
+		ChunkSize:   partialChunkSize,
+		ChunkHashes: []string{},
+	}
+	f, err := os.Open(path)
+	if err == nil {
+		res.ChunkHashes, err = hashChunks(f, partialChunkSize)
+		f.Close()
+		res.Offset = int64(len(res.ChunkHashes)) * partialChunkSize
+	}
+	if err != nil && !os.IsNotExist(err) {
+		err = redactErr(err)
+		h.logf("put partial state: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// hashChunks returns the hex SHA-256 hashes of each complete
+// chunkSize-byte chunk of r.
+func hashChunks(r io.Reader, chunkSize int64) ([]string, error) {
+	hashes := []string{}
+	for {
+		s := sha256.New()
+		n, err := io.CopyN(s, r, chunkSize)
+		if n == chunkSize {
+			hashes = append(hashes, hex.EncodeToString(s.Sum(nil)))
+		}
+		if err == io.EOF {
+			return hashes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// openPartialFileAt opens the partial file at path to continue writing
+// it after its first start bytes, discarding any bytes after those.
+func openPartialFileAt(path string, start int64) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil, errResumeTooFar
+	}
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err == nil && fi.Size() < start {
+		err = errResumeTooFar
+	}
+	if err == nil {
+		err = f.Truncate(start)
+	}
+	if err == nil {
+		_, err = f.Seek(start, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// parseContentRangeStart returns the offset of the first byte of a PUT
+// body from its Content-Range header, which is of the form
+// "bytes START-END/TOTAL" (TOTAL may be "*"), or 0 if there's no header.
+func parseContentRangeStart(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	rest := strings.TrimPrefix(s, "bytes ")
+	dash := strings.IndexByte(rest, '-')
+	if rest == s || dash < 0 || !strings.Contains(rest, "/") {
+		return 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	start, err := strconv.ParseInt(rest[:dash], 10, 64)
+	if err != nil || start < 0 {
+		return 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	return start, nil
 }
 
 func approxSize(n int64) string {
@@ -5,7 +5,11 @@
 package ipnlocal
 
 import (
+	"archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/fs"
@@ -18,7 +22,10 @@ import (
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
 	"tailscale.com/tailcfg"
 )
 
@@ -571,3 +578,252 @@ func TestDeletedMarkers(t *testing.T) {
 	}
 
 }
+
+func TestResumePeerPut(t *testing.T) {
+	defer func(old int64) { partialChunkSize = old }(partialChunkSize)
+	partialChunkSize = 4
+
+	rootDir := t.TempDir()
+	var e peerAPITestEnv
+	e.ph = &peerAPIHandler{
+		isSelf:   true,
+		peerNode: &tailcfg.Node{ComputedName: "some-peer-name"},
+		ps: &peerAPIServer{
+			b:       &LocalBackend{logf: e.logf, capFileSharing: true},
+			rootDir: rootDir,
+		},
+	}
+	do := func(req *http.Request) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		e.ph.ServeHTTP(rr, req)
+		return rr
+	}
+	sha := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+
+	// Nothing received yet.
+	rr := do(httptest.NewRequest("GET", "/v0/put/foo", nil))
+	if got := rr.Body.String(); !strings.Contains(got, `"Offset":0`) {
+		t.Errorf("initial state = %s", got)
+	}
+
+	// An interrupted transfer left 10 bytes, of which two whole
+	// chunks count.
+	if err := ioutil.WriteFile(filepath.Join(rootDir, "foo.partial"), []byte("abcdefghXX"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rr = do(httptest.NewRequest("GET", "/v0/put/foo", nil))
+	var pf apitype.PartialFile
+	if err := json.Unmarshal(rr.Body.Bytes(), &pf); err != nil {
+		t.Fatal(err)
+	}
+	if pf.Offset != 8 || pf.ChunkSize != 4 || len(pf.ChunkHashes) != 2 || pf.ChunkHashes[1] != sha("efgh") {
+		t.Errorf("partial state = %+v", pf)
+	}
+
+	req := httptest.NewRequest("PUT", "/v0/put/foo", strings.NewReader("ijkl"))
+	req.Header.Set("Content-Range", "bytes 100-103/104")
+	if rr := do(req); rr.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("resume past end: got %v; want 416", rr.Code)
+	}
+
+	req = httptest.NewRequest("PUT", "/v0/put/foo", strings.NewReader("ijkl"))
+	req.Header.Set("Content-Range", "bytes 8-11/12")
+	req.Header.Set(apitype.FileSHA256Header, sha("abcdefghijkl"))
+	if rr := do(req); rr.Code != 200 {
+		t.Fatalf("resume: %v, %s", rr.Code, rr.Body.Bytes())
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(rootDir, "foo")); err != nil || string(got) != "abcdefghijkl" {
+		t.Errorf("resumed file = %q, %v", got, err)
+	}
+
+	req = httptest.NewRequest("PUT", "/v0/put/bar", strings.NewReader("corrupt"))
+	req.Header.Set(apitype.FileSHA256Header, sha("original"))
+	if rr := do(req); rr.Code != 400 || !strings.Contains(rr.Body.String(), "SHA-256 mismatch") {
+		t.Errorf("bad hash: got %v, %s", rr.Code, rr.Body.Bytes())
+	}
+	for _, name := range []string{"bar", "bar.partial"} {
+		if _, err := os.Stat(filepath.Join(rootDir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s exists after failed verification", name)
+		}
+	}
+}
+
+func TestRemoveStalePartials(t *testing.T) {
+	rootDir := t.TempDir()
+	ps := &peerAPIServer{
+		b:       &LocalBackend{logf: t.Logf},
+		rootDir: rootDir,
+	}
+	for _, name := range []string{"old.partial", "new.partial", "old"} {
+		if err := ioutil.WriteFile(filepath.Join(rootDir, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-stalePartialAge - time.Minute)
+	for _, name := range []string{"old.partial", "old"} {
+		if err := os.Chtimes(filepath.Join(rootDir, name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ps.removeStalePartials()
+	for name, wantExist := range map[string]bool{"old.partial": false, "new.partial": true, "old": true} {
+		_, err := os.Stat(filepath.Join(rootDir, name))
+		if exist := err == nil; exist != wantExist {
+			t.Errorf("%s exists = %v; want %v", name, exist, wantExist)
+		}
+	}
+}
+
+func TestParseContentRangeStart(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"bytes 0-9/10", 0, false},
+		{"bytes 1024-2047/*", 1024, false},
+		{"bytes 5-9", 0, true},
+		{"items 5-9/10", 0, true},
+		{"bytes -5-9/10", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseContentRangeStart(tt.in)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("parseContentRangeStart(%q) = %v, %v; want %v, err %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestPeerPutDir(t *testing.T) {
+	rootDir := t.TempDir()
+	var e peerAPITestEnv
+	e.ph = &peerAPIHandler{
+		isSelf:   true,
+		peerNode: &tailcfg.Node{ComputedName: "some-peer-name"},
+		ps: &peerAPIServer{
+			b:       &LocalBackend{logf: e.logf, capFileSharing: true},
+			rootDir: rootDir,
+		},
+	}
+	tarOf := func(files map[string]string) *bytes.Buffer {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for name, contents := range files {
+			tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))})
+			io.WriteString(tw, contents)
+		}
+		tw.Close()
+		return &buf
+	}
+
+	rr := httptest.NewRecorder()
+	e.ph.ServeHTTP(rr, httptest.NewRequest("PUT", "/v0/put/foo/", tarOf(map[string]string{
+		"a.txt":     "hello",
+		"sub/b.txt": "world!",
+	})))
+	if rr.Code != 200 {
+		t.Fatalf("put dir: %v, %s", rr.Code, rr.Body.Bytes())
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(rootDir, "foo", "sub", "b.txt")); err != nil || string(got) != "world!" {
+		t.Errorf("sub/b.txt = %q, %v", got, err)
+	}
+	wfs, err := e.ph.ps.WaitingFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wfs) != 1 || wfs[0].Name != "foo" || !wfs[0].IsDir || wfs[0].Size != 11 {
+		t.Errorf("WaitingFiles = %+v", wfs)
+	}
+	if err := e.ph.ps.DeleteFile("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(rootDir, "foo")); !os.IsNotExist(err) {
+		t.Errorf("directory exists after DeleteFile")
+	}
+
+	rr = httptest.NewRecorder()
+	e.ph.ServeHTTP(rr, httptest.NewRequest("PUT", "/v0/put/evil/", tarOf(map[string]string{
+		"../escaped.txt": "gotcha",
+	})))
+	if rr.Code != 400 || !strings.Contains(rr.Body.String(), "unsafe path") {
+		t.Errorf("unsafe put: %v, %s", rr.Code, rr.Body.Bytes())
+	}
+	for _, name := range []string{"escaped.txt", "evil", "evil.partial"} {
+		if _, err := os.Stat(filepath.Join(rootDir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s exists after rejected put", name)
+		}
+	}
+}
+
+func TestPeerPutPolicy(t *testing.T) {
+	rootDir := t.TempDir()
+	acceptDir := t.TempDir()
+	prefs := &ipn.Prefs{
+		FileMaxSize:      10,
+		FileMaxInboxSize: 15,
+		FileAllowSenders: []string{"@example.com"},
+		FileDenySenders:  []string{"mallory@example.com"},
+	}
+	b := &LocalBackend{logf: t.Logf, capFileSharing: true, prefs: prefs}
+	put := func(login string, isSelf bool, name, body string) *httptest.ResponseRecorder {
+		h := &peerAPIHandler{
+			isSelf:   isSelf,
+			peerNode: &tailcfg.Node{ComputedName: "some-peer-name"},
+			peerUser: tailcfg.UserProfile{LoginName: login},
+			ps:       &peerAPIServer{b: b, rootDir: rootDir},
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("PUT", "/v0/put/"+name, strings.NewReader(body)))
+		return rr
+	}
+
+	tests := []struct {
+		login  string
+		isSelf bool
+		name   string
+		body   string
+		want   int
+	}{
+		{"me@other.com", true, "self", "12345", 200},
+		{"alice@example.com", false, "allowed", "12345", 200},
+		{"bob@elsewhere.com", false, "stranger", "x", http.StatusForbidden},
+		{"mallory@example.com", false, "denied", "x", http.StatusForbidden},
+		{"me@other.com", true, "big", "0123456789a", http.StatusRequestEntityTooLarge},
+		{"me@other.com", true, "overflow", "123456", http.StatusInsufficientStorage},
+	}
+	for _, tt := range tests {
+		if rr := put(tt.login, tt.isSelf, tt.name, tt.body); rr.Code != tt.want {
+			t.Errorf("put of %q from %s: %v, %s; want %v", tt.name, tt.login, rr.Code, rr.Body.Bytes(), tt.want)
+		}
+	}
+	wfs, err := (&peerAPIServer{b: b, rootDir: rootDir}).WaitingFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wfs) != 2 {
+		t.Errorf("WaitingFiles = %+v; want self and allowed", wfs)
+	}
+
+	// With an auto-accept directory, files skip the inbox and don't
+	// overwrite what's there.
+	b.prefs = prefs.Clone()
+	b.prefs.FileAutoAcceptDir = acceptDir
+	b.prefs.FileMaxInboxSize = 0
+	for i := 0; i < 2; i++ {
+		if rr := put("me@other.com", true, "note.txt", "hi"); rr.Code != 200 {
+			t.Fatalf("put: %v, %s", rr.Code, rr.Body.Bytes())
+		}
+	}
+	for _, name := range []string{"note.txt", "note (1).txt"} {
+		if got, err := ioutil.ReadFile(filepath.Join(acceptDir, name)); err != nil || string(got) != "hi" {
+			t.Errorf("%s = %q, %v", name, got, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(rootDir, "note.txt")); !os.IsNotExist(err) {
+		t.Errorf("auto-accepted file still in inbox")
+	}
+}
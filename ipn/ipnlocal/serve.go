@@ -0,0 +1,327 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/wgengine"
+)
+
+// Headers that Prefs.Serve reverse proxies set on requests to identify
+// the tailnet user making them. Any values the client sent are removed.
+const (
+	serveUserLoginHeader = "Tailscale-User-Login"
+	serveUserNameHeader  = "Tailscale-User-Name"
+)
+
+// initServeListeners starts serving the rules in b.prefs.Serve on the
+// node's current Tailscale IPs, replacing any servers for a previous
+// configuration. It does nothing unless b is Running; enterState stops
+// the servers when b leaves that state.
+//
+// In netstack mode a single listener on 127.0.0.1 serves all of the
+// node's Tailscale IPs.
+func (b *LocalBackend) initServeListeners() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.netMap == nil || b.state != ipn.Running {
+		return
+	}
+	var rules []ipn.ServeRule
+	if b.prefs != nil {
+		rules = b.prefs.Serve
+	}
+	key := fmt.Sprint(b.netMap.Addresses, rules)
+	if key == b.serveKey {
+		return
+	}
+	b.closeServeListenersLocked()
+	b.serveKey = key
+	if len(rules) == 0 {
+		return
+	}
+
+	byPort := map[uint16][]ipn.ServeRule{}
+	var ports []int
+	for _, r := range rules {
+		if err := r.Check(); err != nil {
+			b.logf("serve: ignoring rule %v: %v", r, err)
+			continue
+		}
+		if len(byPort[r.Port]) == 0 {
+			ports = append(ports, int(r.Port))
+		}
+		byPort[r.Port] = append(byPort[r.Port], r)
+	}
+	sort.Ints(ports)
+
+	var ips []netaddr.IP
+	if wgengine.IsNetstack(b.e) {
+		ips = []netaddr.IP{netaddr.IPv4(127, 0, 0, 1)}
+	} else {
+		for _, a := range b.netMap.Addresses {
+			ips = append(ips, a.IP())
+		}
+	}
+	for _, port := range ports {
+		rules := byPort[uint16(port)]
+		h, err := b.serveHandler(rules)
+		if err != nil {
+			b.logf("serve: port %d: %v", port, err)
+			continue
+		}
+		for _, ip := range ips {
+			addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				b.logf("serve: listen(%q): %v", addr, err)
+				continue
+			}
+			if rules[0].TLS {
+				ln = tls.NewListener(ln, &tls.Config{GetCertificate: b.getServeCert})
+			}
+			srv := &http.Server{Handler: h}
+			b.serveServers = append(b.serveServers, srv)
+			b.logf("serve: listening on %v (tls=%v)", addr, rules[0].TLS)
+			go srv.Serve(ln)
+		}
+	}
+}
+
+// closeServeListenersLocked stops serving Prefs.Serve rules.
+//
+// b.mu must be held.
+func (b *LocalBackend) closeServeListenersLocked() {
+	for _, srv := range b.serveServers {
+		srv.Close()
+	}
+	b.serveServers = nil
+	b.serveKey = ""
+	b.serveCerts = nil
+}
+
+// serveHandler returns the HTTP handler for rules, which are all for
+// the same port.
+func (b *LocalBackend) serveHandler(rules []ipn.ServeRule) (http.Handler, error) {
+	mux := http.NewServeMux()
+	seen := map[string]bool{}
+	for _, r := range rules {
+		if seen[r.Path] {
+			return nil, fmt.Errorf("more than one rule for path %q", r.Path)
+		}
+		seen[r.Path] = true
+		prefix := strings.TrimSuffix(r.Path, "/")
+		if r.Dir != "" {
+			mux.Handle(r.Path, http.StripPrefix(prefix, http.FileServer(http.Dir(r.Dir))))
+			continue
+		}
+		target, err := url.Parse(r.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		mux.Handle(r.Path, b.serveProxy(target, prefix, r.TLS))
+	}
+	return mux, nil
+}
+
+// serveProxy returns a reverse proxy to target for requests whose paths
+// start with prefix, which is replaced by target's path.
+func (b *LocalBackend) serveProxy(target *url.URL, prefix string, isTLS bool) http.Handler {
+	return &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			rest := strings.TrimPrefix(r.URL.Path, prefix)
+			if !strings.HasPrefix(rest, "/") {
+				rest = "/" + rest
+			}
+			r.URL.Scheme = target.Scheme
+			r.URL.Host = target.Host
+			r.URL.Path = strings.TrimSuffix(target.Path, "/") + rest
+			r.URL.RawPath = ""
+			if target.RawQuery != "" {
+				if r.URL.RawQuery == "" {
+					r.URL.RawQuery = target.RawQuery
+				} else {
+					r.URL.RawQuery = target.RawQuery + "&" + r.URL.RawQuery
+				}
+			}
+			if isTLS {
+				r.Header.Set("X-Forwarded-Proto", "https")
+			} else {
+				r.Header.Set("X-Forwarded-Proto", "http")
+			}
+			b.setServeUserHeaders(r)
+		},
+	}
+}
+
+// setServeUserHeaders sets the identity headers on r, which was
+// received from the tailnet, according to WhoIsPeer.
+func (b *LocalBackend) setServeUserHeaders(r *http.Request) {
+	r.Header.Del(serveUserLoginHeader)
+	r.Header.Del(serveUserNameHeader)
+	ipp, err := netaddr.ParseIPPort(r.RemoteAddr)
+	if err != nil {
+		return
+	}
+	_, u, ok := b.WhoIsPeer(ipp)
+	if !ok {
+		return
+	}
+	r.Header.Set(serveUserLoginHeader, u.LoginName)
+	r.Header.Set(serveUserNameHeader, u.DisplayName)
+}
+
+// getServeCert is the tls.Config.GetCertificate func for TLS Prefs.Serve
+// rules.
+//
+// It uses the certificate and key for the node's DNS name in the
+// "certs" directory of tailscaled's state directory (NAME.crt and
+// NAME.key) if present, so operators can provide a certificate that
+// clients trust. Otherwise it uses a self-signed certificate that's
+// generated once and kept in the state store.
+func (b *LocalBackend) getServeCert(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.netMap == nil {
+		return nil, errors.New("no network map")
+	}
+	name := strings.TrimSuffix(b.netMap.Name, ".")
+	if c, ok := b.serveCerts[name]; ok {
+		return c, nil
+	}
+	c, err := b.loadServeCertLocked(name)
+	if err != nil {
+		return nil, err
+	}
+	if b.serveCerts == nil {
+		b.serveCerts = map[string]*tls.Certificate{}
+	}
+	b.serveCerts[name] = c
+	return c, nil
+}
+
+// loadServeCertLocked returns the certificate for the node's DNS name,
+// as described at getServeCert.
+//
+// b.mu must be held.
+func (b *LocalBackend) loadServeCertLocked(name string) (*tls.Certificate, error) {
+	if dir := tailscaleVarRoot(); dir != "" && name != "" {
+		base := filepath.Join(dir, "certs", name)
+		c, err := tls.LoadX509KeyPair(base+".crt", base+".key")
+		if err == nil {
+			return &c, nil
+		}
+		if !os.IsNotExist(err) {
+			b.logf("serve: loading certificate for %s: %v", name, err)
+		}
+	}
+
+	pemText, err := b.store.ReadState(ipn.ServeCertStateKey)
+	if err == nil {
+		if c, err := parseServeCert(pemText, name); err == nil {
+			return c, nil
+		}
+	} else if err != ipn.ErrStateNotExist {
+		return nil, fmt.Errorf("error reading %v key of %v: %w", ipn.ServeCertStateKey, b.store, err)
+	}
+
+	b.logf("serve: generating self-signed certificate for %q", name)
+	pemText, err = b.selfSignedServeCertLocked(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.store.WriteState(ipn.ServeCertStateKey, pemText); err != nil {
+		return nil, fmt.Errorf("writing serve certificate: %w", err)
+	}
+	return parseServeCert(pemText, name)
+}
+
+// parseServeCert parses a PEM-encoded certificate and key, returning an
+// error if the certificate has expired or isn't for name.
+func parseServeCert(pemText []byte, name string) (*tls.Certificate, error) {
+	c, err := tls.X509KeyPair(pemText, pemText)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return nil, errors.New("certificate expired")
+	}
+	if name != "" {
+		if err := leaf.VerifyHostname(name); err != nil {
+			return nil, err
+		}
+	}
+	c.Leaf = leaf
+	return &c, nil
+}
+
+// selfSignedServeCertLocked returns a new PEM-encoded self-signed
+// certificate and private key for name and the node's Tailscale IPs.
+//
+// b.mu must be held.
+func (b *LocalBackend) selfSignedServeCertLocked(name string) ([]byte, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if name != "" {
+		tmpl.DNSNames = []string{name}
+	}
+	for _, a := range b.netMap.Addresses {
+		tmpl.IPAddresses = append(tmpl.IPAddresses, a.IP().IPAddr().IP)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	pemText := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pemText = append(pemText, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+	return pemText, nil
+}
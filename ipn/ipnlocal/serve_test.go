@@ -0,0 +1,129 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+func TestServeHandler(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s?%s login=%q name=%q proto=%s",
+			r.URL.Path, r.URL.RawQuery,
+			r.Header.Get(serveUserLoginHeader), r.Header.Get(serveUserNameHeader),
+			r.Header.Get("X-Forwarded-Proto"))
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "hello.txt"), []byte("static file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	self := &tailcfg.Node{
+		ID:        1,
+		User:      2,
+		Addresses: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.1/32")},
+	}
+	peer := &tailcfg.Node{ID: 2, User: 1}
+	b := &LocalBackend{
+		logf: t.Logf,
+		nodeByAddr: map[netaddr.IP]*tailcfg.Node{
+			netaddr.MustParseIP("100.64.0.1"): self,
+			netaddr.MustParseIP("100.64.0.2"): peer,
+		},
+		netMap: &netmap.NetworkMap{
+			SelfNode: self,
+			UserProfiles: map[tailcfg.UserID]tailcfg.UserProfile{
+				1: {LoginName: "alice@example.com", DisplayName: "Alice"},
+				2: {LoginName: "owner@example.com", DisplayName: "Owner"},
+			},
+		},
+	}
+	h, err := b.serveHandler([]ipn.ServeRule{
+		{Port: 443, TLS: true, Path: "/", Proxy: backend.URL},
+		{Port: 443, TLS: true, Path: "/api/", Proxy: backend.URL + "/v1"},
+		{Port: 443, TLS: true, Path: "/static/", Dir: dir},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remote string
+		path   string
+		header string // value of a spoofed login header, if any
+		want   string
+	}{
+		{"100.64.0.2:1234", "/foo?x=1", "", `/foo?x=1 login="alice@example.com" name="Alice" proto=https`},
+		{"100.64.0.2:1234", "/api/users", "", `/v1/users? login="alice@example.com" name="Alice" proto=https`},
+		{"100.64.0.2:1234", "/api/", "", `/v1/? login="alice@example.com" name="Alice" proto=https`},
+		{"100.64.0.3:0", "/", "mallory@example.com", `/? login="" name="" proto=https`},
+		// A local process connecting from the node's own IP isn't
+		// its owner.
+		{"100.64.0.1:1234", "/", "", `/? login="" name="" proto=https`},
+		{"100.64.0.2:1234", "/static/hello.txt", "", "static file"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "https://node.example.ts.net"+tt.path, nil)
+		r.RemoteAddr = tt.remote
+		if tt.header != "" {
+			r.Header.Set(serveUserLoginHeader, tt.header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if got := rec.Body.String(); got != tt.want {
+			t.Errorf("GET %s from %s = %q; want %q", tt.path, tt.remote, got, tt.want)
+		}
+	}
+}
+
+func TestServeListenersOnlyWhenRunning(t *testing.T) {
+	b := &LocalBackend{
+		logf:   t.Logf,
+		state:  ipn.Stopped,
+		netMap: &netmap.NetworkMap{},
+		prefs: &ipn.Prefs{Serve: []ipn.ServeRule{
+			{Port: 8080, Path: "/", Proxy: "http://127.0.0.1:3000"},
+		}},
+	}
+	b.initServeListeners()
+	if b.serveKey != "" || len(b.serveServers) != 0 {
+		t.Errorf("serving while Stopped")
+	}
+}
+
+func TestSelfSignedServeCert(t *testing.T) {
+	b := &LocalBackend{
+		netMap: &netmap.NetworkMap{
+			Name:      "node.example.ts.net.",
+			Addresses: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.1/32")},
+		},
+	}
+	pemText, err := b.selfSignedServeCertLocked("node.example.ts.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := parseServeCert(pemText, "node.example.ts.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Leaf.VerifyHostname("100.64.0.1"); err != nil {
+		t.Errorf("certificate not valid for Tailscale IP: %v", err)
+	}
+	if _, err := parseServeCert(pemText, "other.example.ts.net"); err == nil {
+		t.Errorf("certificate accepted for another name")
+	}
+}
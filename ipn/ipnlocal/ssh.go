@@ -0,0 +1,140 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"strconv"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/wgengine"
+)
+
+// sshListener is a listener for the SSH server on one of the node's
+// Tailscale IPs.
+type sshListener struct {
+	ip netaddr.IP
+	ln net.Listener
+}
+
+// SetSSHHandler configures b to accept TCP connections on port of the
+// node's Tailscale IPs and pass them to h, an SSH server that
+// authenticates its clients with WhoIsPeer. It must be called before b
+// is started, if at all.
+func (b *LocalBackend) SetSSHHandler(port uint16, h func(net.Conn)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sshPort = port
+	b.sshHandler = h
+}
+
+// SSHHostKey returns the PEM-encoded private host key of the SSH
+// server, generating an ed25519 key and saving it in the state store
+// the first time.
+func (b *LocalBackend) SSHHostKey() ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	pemText, err := b.store.ReadState(ipn.SSHHostKeyStateKey)
+	if err == nil {
+		if blk, _ := pem.Decode(pemText); blk == nil {
+			return nil, fmt.Errorf("invalid PEM in %v key of %v", ipn.SSHHostKeyStateKey, b.store)
+		}
+		return pemText, nil
+	}
+	if err != ipn.ErrStateNotExist {
+		return nil, fmt.Errorf("error reading %v key of %v: %w", ipn.SSHHostKeyStateKey, b.store, err)
+	}
+
+	b.logf("generating new SSH host key")
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	pemText = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := b.store.WriteState(ipn.SSHHostKeyStateKey, pemText); err != nil {
+		return nil, fmt.Errorf("writing SSH host key: %w", err)
+	}
+	return pemText, nil
+}
+
+// initSSHListeners starts listening for SSH connections on the node's
+// current Tailscale IPs, if SetSSHHandler was called.
+//
+// In netstack mode, the Tailscale IPs aren't the host's, so there's
+// nothing to listen on: the handler must also be registered with
+// netstack.Impl.SetTCPHandler, which passes it the connections.
+// Listening on 127.0.0.1 instead would clash with the host's own SSH
+// server.
+func (b *LocalBackend) initSSHListeners() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.sshHandler == nil || b.netMap == nil || wgengine.IsNetstack(b.e) {
+		return
+	}
+	if len(b.netMap.Addresses) == len(b.sshListeners) {
+		allSame := true
+		for i, sl := range b.sshListeners {
+			if sl.ip != b.netMap.Addresses[i].IP() {
+				allSame = false
+				break
+			}
+		}
+		if allSame {
+			return
+		}
+	}
+
+	b.closeSSHListenersLocked()
+
+	port := strconv.Itoa(int(b.sshPort))
+	for _, a := range b.netMap.Addresses {
+		sl := &sshListener{ip: a.IP()}
+		addr := net.JoinHostPort(a.IP().String(), port)
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			// Not added to b.sshListeners, so the next
+			// authReconfig tries again.
+			b.logf("ssh: listen(%q): %v", addr, err)
+			continue
+		}
+		sl.ln = ln
+		b.sshListeners = append(b.sshListeners, sl)
+		b.logf("ssh: listening on %v", addr)
+		go b.serveSSH(ln, b.sshHandler)
+	}
+}
+
+func (b *LocalBackend) serveSSH(ln net.Listener, h func(net.Conn)) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			// Closed by closeSSHListenersLocked.
+			return
+		}
+		go h(c)
+	}
+}
+
+// closeSSHListenersLocked closes any existing SSH listeners.
+//
+// b.mu must be held.
+func (b *LocalBackend) closeSSHListenersLocked() {
+	for _, sl := range b.sshListeners {
+		sl.ln.Close()
+	}
+	b.sshListeners = nil
+}
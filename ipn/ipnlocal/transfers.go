@@ -0,0 +1,221 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+const (
+	// maxFinishedTransfers is how many finished file transfers are
+	// remembered for FileTransfers.
+	maxFinishedTransfers = 20
+
+	// transferNotifyInterval is the most often that FileTransfers
+	// are sent on the IPN bus while transfers progress.
+	transferNotifyInterval = 500 * time.Millisecond
+
+	// transferRateInterval is how often a transfer's rate is
+	// re-estimated.
+	transferRateInterval = time.Second
+)
+
+// fileTransfer is a Taildrop file transfer tracked by a LocalBackend.
+type fileTransfer struct {
+	b *LocalBackend
+
+	offset int64 // bytes transferred before, when resuming
+
+	mu    sync.Mutex
+	ft    ipn.FileTransfer
+	rateT time.Time // start of the current rate sample
+	rateN int64     // ft.Bytes at rateT
+}
+
+// startFileTransfer registers a new active transfer in direction dir
+// of the file name to or from the node named peer, with size bytes in
+// total (or -1 if unknown) of which offset were transferred before.
+func (b *LocalBackend) startFileTransfer(dir, name, peer string, size, offset int64) *fileTransfer {
+	now := time.Now()
+	t := &fileTransfer{
+		b:      b,
+		offset: offset,
+		ft: ipn.FileTransfer{
+			Direction: dir,
+			Name:      name,
+			Peer:      peer,
+			State:     ipn.FileTransferActive,
+			Started:   now,
+			Updated:   now,
+			Size:      size,
+			Bytes:     offset,
+		},
+		rateT: now,
+		rateN: offset,
+	}
+	b.mu.Lock()
+	b.lastTransferID++
+	t.ft.ID = strconv.FormatInt(b.lastTransferID, 10)
+	b.fileTransfers = append(b.fileTransfers, t)
+	b.mu.Unlock()
+	b.scheduleTransferNotify()
+	return t
+}
+
+// add records that n more bytes were transferred.
+func (t *fileTransfer) add(n int64) {
+	t.mu.Lock()
+	now := time.Now()
+	t.ft.Bytes += n
+	t.ft.Updated = now
+	if d := now.Sub(t.rateT); d >= transferRateInterval {
+		rate := float64(t.ft.Bytes-t.rateN) / d.Seconds()
+		if t.ft.Rate == 0 {
+			t.ft.Rate = rate
+		} else {
+			// Smooth it out a bit.
+			t.ft.Rate = (t.ft.Rate + rate) / 2
+		}
+		t.rateT, t.rateN = now, t.ft.Bytes
+	}
+	t.mu.Unlock()
+	t.b.scheduleTransferNotify()
+}
+
+// finish marks the transfer done, or failed with err if it's non-nil.
+// Only the first call has any effect.
+func (t *fileTransfer) finish(err error) {
+	t.mu.Lock()
+	if t.ft.State != ipn.FileTransferActive {
+		t.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	t.ft.Updated = now
+	if err != nil {
+		t.ft.State = ipn.FileTransferFailed
+		t.ft.Error = err.Error()
+	} else {
+		t.ft.State = ipn.FileTransferDone
+	}
+	// Report the average rate of the whole transfer from now on.
+	if d := now.Sub(t.ft.Started); d > 0 {
+		t.ft.Rate = float64(t.ft.Bytes-t.offset) / d.Seconds()
+	}
+	t.mu.Unlock()
+
+	b := t.b
+	b.mu.Lock()
+	b.pruneFileTransfersLocked()
+	b.mu.Unlock()
+	b.scheduleTransferNotify()
+}
+
+func (t *fileTransfer) isActive() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ft.State == ipn.FileTransferActive
+}
+
+// snapshot returns the transfer's current state, with its ETA.
+func (t *fileTransfer) snapshot() ipn.FileTransfer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ft := t.ft
+	if ft.State == ipn.FileTransferActive && ft.Rate > 0 && ft.Size >= ft.Bytes {
+		secs := float64(ft.Size-ft.Bytes) / ft.Rate
+		ft.ETA = time.Duration(secs * float64(time.Second)).Round(time.Second)
+	}
+	return ft
+}
+
+// pruneFileTransfersLocked forgets the oldest finished transfers
+// beyond maxFinishedTransfers.
+//
+// b.mu must be held.
+func (b *LocalBackend) pruneFileTransfersLocked() {
+	finished := 0
+	for _, t := range b.fileTransfers {
+		if !t.isActive() {
+			finished++
+		}
+	}
+	if finished <= maxFinishedTransfers {
+		return
+	}
+	drop := finished - maxFinishedTransfers
+	kept := b.fileTransfers[:0]
+	for _, t := range b.fileTransfers {
+		if drop > 0 && !t.isActive() {
+			drop--
+			continue
+		}
+		kept = append(kept, t)
+	}
+	for i := len(kept); i < len(b.fileTransfers); i++ {
+		b.fileTransfers[i] = nil
+	}
+	b.fileTransfers = kept
+}
+
+// scheduleTransferNotify arranges for the FileTransfers to be sent on
+// the IPN bus soon, if they aren't already going to be.
+func (b *LocalBackend) scheduleTransferNotify() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.transferNotify {
+		return
+	}
+	b.transferNotify = true
+	time.AfterFunc(transferNotifyInterval, func() {
+		b.mu.Lock()
+		b.transferNotify = false
+		b.mu.Unlock()
+		b.send(ipn.Notify{FileTransfers: b.FileTransfers()})
+	})
+}
+
+// FileTransfers returns the Taildrop file transfers in progress and
+// the most recently finished ones, in both directions, oldest first.
+func (b *LocalBackend) FileTransfers() []ipn.FileTransfer {
+	b.mu.Lock()
+	ts := append([]*fileTransfer(nil), b.fileTransfers...)
+	b.mu.Unlock()
+	ret := make([]ipn.FileTransfer, 0, len(ts))
+	for _, t := range ts {
+		ret = append(ret, t.snapshot())
+	}
+	return ret
+}
+
+// TrackFileSend registers the sending of the file name to the node
+// named peer, with size bytes in total (or -1 if unknown) of which the
+// first offset were already sent. It returns r wrapped to count the
+// bytes sent as they're read, and a func to call with the transfer's
+// result, which must be called once it's over.
+func (b *LocalBackend) TrackFileSend(r io.Reader, name, peer string, size, offset int64) (body io.Reader, finish func(error)) {
+	t := b.startFileTransfer(ipn.FileSend, name, peer, size, offset)
+	return &countingReader{r: r, t: t}, t.finish
+}
+
+// countingReader is an io.Reader that records the bytes read from r as
+// transferred by t.
+type countingReader struct {
+	r io.Reader
+	t *fileTransfer
+}
+
+func (c *countingReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	if n > 0 {
+		c.t.add(int64(n))
+	}
+	return n, err
+}
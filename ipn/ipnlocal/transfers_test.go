@@ -0,0 +1,73 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+func TestFileTransfers(t *testing.T) {
+	b := new(LocalBackend)
+
+	body, finish := b.TrackFileSend(strings.NewReader("hello"), "foo.txt", "peer", 10, 5)
+	if _, err := ioutil.ReadAll(body); err != nil {
+		t.Fatal(err)
+	}
+	fts := b.FileTransfers()
+	if len(fts) != 1 {
+		t.Fatalf("got %d transfers; want 1", len(fts))
+	}
+	ft := fts[0]
+	if ft.Direction != ipn.FileSend || ft.Name != "foo.txt" || ft.Peer != "peer" || ft.State != ipn.FileTransferActive {
+		t.Errorf("got %+v", ft)
+	}
+	if ft.Bytes != 10 || ft.Size != 10 {
+		t.Errorf("got %d/%d bytes; want 10/10", ft.Bytes, ft.Size)
+	}
+
+	finish(errors.New("boom"))
+	finish(nil) // no effect
+	ft = b.FileTransfers()[0]
+	if ft.State != ipn.FileTransferFailed || ft.Error != "boom" {
+		t.Errorf("after finish: state %q, error %q; want failed, boom", ft.State, ft.Error)
+	}
+
+	// Only the latest finished transfers are kept, but active
+	// ones are never dropped.
+	active := b.startFileTransfer(ipn.FileReceive, "active", "peer", -1, 0)
+	for i := 0; i < maxFinishedTransfers+5; i++ {
+		b.startFileTransfer(ipn.FileReceive, "done", "peer", 0, 0).finish(nil)
+	}
+	fts = b.FileTransfers()
+	if len(fts) != maxFinishedTransfers+1 {
+		t.Fatalf("got %d transfers; want %d", len(fts), maxFinishedTransfers+1)
+	}
+	if fts[0].Name != "active" {
+		t.Errorf("oldest transfer is %q; want the active one", fts[0].Name)
+	}
+	active.finish(nil)
+}
+
+func TestFileTransferETA(t *testing.T) {
+	tr := &fileTransfer{ft: ipn.FileTransfer{
+		State: ipn.FileTransferActive,
+		Size:  1000,
+		Bytes: 400,
+		Rate:  100,
+	}}
+	if got, want := tr.snapshot().ETA, 6*time.Second; got != want {
+		t.Errorf("ETA = %v; want %v", got, want)
+	}
+	tr.ft.Size = -1
+	if got := tr.snapshot().ETA; got != 0 {
+		t.Errorf("ETA of unknown size = %v; want 0", got)
+	}
+}
@@ -85,6 +85,11 @@ type Options struct {
 	// DebugMux, if non-nil, specifies an HTTP ServeMux in which
 	// to register a debug handler.
 	DebugMux *http.ServeMux
+
+	// OnLocalBackend, if non-nil, is called with the LocalBackend
+	// once it's created, before it's started. It's used to set up
+	// optional services, like the SSH server.
+	OnLocalBackend func(*ipnlocal.LocalBackend)
 }
 
 // server is an IPN backend and its set of 0 or more active connections
@@ -292,6 +297,9 @@ func (s *server) serveConn(ctx context.Context, c net.Conn, logf logger.Logf) {
 	if isReadonlyConn(ci, s.b.OperatorUserID(), logf) {
 		ctx = ipn.ReadonlyContextOf(ctx)
 	}
+	if isUnprivilegedConn(ci) {
+		ctx = ipn.UnprivilegedContextOf(ctx)
+	}
 
 	for ctx.Err() == nil {
 		msg, err := ipn.ReadMsg(br)
@@ -359,6 +367,21 @@ func isReadonlyConn(ci connIdentity, operatorUID string, logf logger.Logf) bool
 	return ro
 }
 
+// isUnprivilegedConn reports whether ci isn't from root while
+// tailscaled runs as root, so mustn't make the prefs changes that
+// ipn.Prefs.CheckUnprivilegedChange rejects, even if it may otherwise
+// change prefs.
+func isUnprivilegedConn(ci connIdentity) bool {
+	if runtime.GOOS == "windows" || os.Getuid() != 0 || !safesocket.PlatformUsesPeerCreds() {
+		return false
+	}
+	if ci.Creds == nil {
+		return true
+	}
+	uid, ok := ci.Creds.UserID()
+	return !ok || uid != "0"
+}
+
 func isLocalAdmin(uid string) (bool, error) {
 	u, err := user.LookupId(uid)
 	if err != nil {
@@ -682,10 +705,18 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 		return smallzstd.NewDecoder(nil)
 	})
 
+	if opts.OnLocalBackend != nil {
+		opts.OnLocalBackend(b)
+	}
+
 	if opts.DebugMux != nil {
 		opts.DebugMux.HandleFunc("/debug/ipn", func(w http.ResponseWriter, r *http.Request) {
 			serveHTMLStatus(w, b)
 		})
+		opts.DebugMux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			b.WriteMetrics(w)
+		})
 	}
 
 	server.b = b
@@ -924,6 +955,7 @@ func (psc *protoSwitchConn) Close() error {
 func (s *server) localhostHandler(ci connIdentity) http.Handler {
 	lah := localapi.NewHandler(s.b, s.logf, s.backendLogID)
 	lah.PermitRead, lah.PermitWrite = s.localAPIPermissions(ci)
+	lah.Unprivileged = isUnprivilegedConn(ci)
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasPrefix(r.URL.Path, "/localapi/") {
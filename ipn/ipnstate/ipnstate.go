@@ -52,6 +52,11 @@ type Status struct {
 	// trailing periods, and without any "_acme-challenge." prefix.
 	CertDomains []string
 
+	// AutoExitNode is whether the exit node is picked automatically
+	// (ipn.Prefs.AutoExitNode). The picked peer, if any, has
+	// ExitNode set.
+	AutoExitNode bool `json:",omitempty"`
+
 	Peer map[key.Public]*PeerStatus
 	User map[tailcfg.UserID]tailcfg.UserProfile
 }
@@ -87,6 +92,14 @@ type PeerStatus struct {
 	CurAddr string // one of Addrs, or unique if roaming
 	Relay   string // DERP region
 
+	// StaticAddrs are the Addrs that were explicitly configured
+	// rather than discovered. Only set for Status.Self.
+	StaticAddrs []string `json:",omitempty"`
+	// ExcludedAddrs are discovered endpoints that aren't advertised
+	// because they matched a configured exclusion. Only set for
+	// Status.Self.
+	ExcludedAddrs []string `json:",omitempty"`
+
 	RxBytes       int64
 	TxBytes       int64
 	Created       time.Time // time registered with tailcontrol
@@ -116,6 +129,49 @@ type PeerStatus struct {
 	// InEngine means that this peer is tracked by the wireguard engine.
 	// In theory, all of InNetworkMap and InMagicSock and InEngine should all be true.
 	InEngine bool
+
+	// PathStats is magicsock's recent history of the network path
+	// to this peer, if it's a discovery-capable peer.
+	PathStats *PeerPathStats `json:",omitempty"`
+}
+
+// PeerPathStats is recent latency, loss and path change history for
+// the network path to a peer, as measured by magicsock's disco pings.
+type PeerPathStats struct {
+	// Latency are the most recent disco pong round trip times,
+	// oldest first.
+	Latency []PeerLatencySample `json:",omitempty"`
+
+	// PingsSent is the number of disco pings sent to the peer.
+	PingsSent int64
+	// PongsReceived is the number of pings that got a pong reply.
+	PongsReceived int64
+	// PingsLost is the number of pings that timed out without a pong.
+	PingsLost int64
+	// LossFraction is PingsLost as a fraction of the pings whose fate
+	// is known (PongsReceived+PingsLost), in the range [0,1].
+	LossFraction float64
+
+	// PathChanges are the most recent changes in the path used to
+	// send to the peer, oldest first.
+	PathChanges []PeerPathChange `json:",omitempty"`
+}
+
+// PeerLatencySample is one disco ping round trip to a peer.
+type PeerLatencySample struct {
+	At             time.Time
+	Addr           string // endpoint pinged; "derp-N" for DERP region N
+	LatencySeconds float64
+}
+
+// PeerPathChange is a change in the path used to send to a peer.
+type PeerPathChange struct {
+	At time.Time
+	// From and To are "derp-N" for DERP region N, an "ip:port" for
+	// a direct path, or both separated by "+" while a direct path
+	// is being tried alongside DERP. Empty means no path.
+	From, To string
+	Reason   string `json:",omitempty"` // why it changed, if known
 }
 
 type StatusBuilder struct {
@@ -277,6 +333,12 @@ func (sb *StatusBuilder) AddPeer(peer key.Public, st *PeerStatus) {
 	if st.ShareeNode {
 		e.ShareeNode = true
 	}
+	if v := st.PeerAPIURL; len(v) > 0 {
+		e.PeerAPIURL = v
+	}
+	if st.PathStats != nil {
+		e.PathStats = st.PathStats
+	}
 }
 
 type StatusUpdater interface {
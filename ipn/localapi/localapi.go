@@ -6,6 +6,7 @@
 package localapi
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
@@ -54,6 +55,11 @@ type Handler struct {
 	// PermitWrite is whether mutating HTTP handlers are allowed.
 	PermitWrite bool
 
+	// Unprivileged is whether the caller isn't root while tailscaled
+	// is, so can't make the prefs changes that
+	// ipn.Prefs.CheckUnprivilegedChange rejects.
+	Unprivileged bool
+
 	b            *ipnlocal.LocalBackend
 	logf         logger.Logf
 	backendLogID string
@@ -88,6 +94,8 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.serveWhoIs(w, r)
 	case "/localapi/v0/goroutines":
 		h.serveGoroutines(w, r)
+	case "/localapi/v0/metrics":
+		h.serveMetrics(w, r)
 	case "/localapi/v0/status":
 		h.serveStatus(w, r)
 	case "/localapi/v0/logout":
@@ -100,10 +108,20 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.serveBugReport(w, r)
 	case "/localapi/v0/file-targets":
 		h.serveFileTargets(w, r)
+	case "/localapi/v0/file-transfers":
+		h.serveFileTransfers(w, r)
 	case "/localapi/v0/set-dns":
 		h.serveSetDNS(w, r)
 	case "/localapi/v0/derpmap":
 		h.serveDERPMap(w, r)
+	case "/localapi/v0/ping":
+		h.servePing(w, r)
+	case "/localapi/v0/start":
+		h.serveStart(w, r)
+	case "/localapi/v0/login-interactive":
+		h.serveLoginInteractive(w, r)
+	case "/localapi/v0/watch-ipn-bus":
+		h.serveWatchIPNBus(w, r)
 	case "/":
 		io.WriteString(w, "tailscaled\n")
 	default:
@@ -144,7 +162,13 @@ func (h *Handler) serveWhoIs(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing 'addr' parameter", 400)
 		return
 	}
-	n, u, ok := b.WhoIs(ipp)
+	whoIs := b.WhoIs
+	if defBool(r.FormValue("peer"), false) {
+		// Only peers: not this node, nor local processes
+		// connecting from its own Tailscale IPs.
+		whoIs = b.WhoIsPeer
+	}
+	n, u, ok := whoIs(ipp)
 	if !ok {
 		http.Error(w, "no match for IP:port", 404)
 		return
@@ -175,6 +199,15 @@ func (h *Handler) serveGoroutines(w http.ResponseWriter, r *http.Request) {
 	w.Write(buf)
 }
 
+func (h *Handler) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "metrics access denied", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	h.b.WriteMetrics(w)
+}
+
 func (h *Handler) serveCheckIPForwarding(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitRead {
 		http.Error(w, "IP forwarding check access denied", http.StatusForbidden)
@@ -243,6 +276,15 @@ func (h *Handler) servePrefs(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), 400)
 			return
 		}
+		if h.Unprivileged {
+			old := h.b.Prefs()
+			newp := old.Clone()
+			newp.ApplyEdits(mp)
+			if err := old.CheckUnprivilegedChange(newp); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
 		var err error
 		prefs, err = h.b.EditPrefs(mp)
 		if err != nil {
@@ -300,7 +342,12 @@ func (h *Handler) serveFiles(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer rc.Close()
-	w.Header().Set("Content-Length", fmt.Sprint(size))
+	if size == -1 {
+		// A directory, as a tar archive.
+		w.Header().Set("Content-Type", "application/x-tar")
+	} else {
+		w.Header().Set("Content-Length", fmt.Sprint(size))
+	}
 	io.Copy(w, rc)
 }
 
@@ -340,12 +387,11 @@ func (h *Handler) serveFilePut(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "file access denied", http.StatusForbidden)
 		return
 	}
-	if r.Method != "PUT" {
+	if r.Method != "PUT" && r.Method != "GET" {
 		http.Error(w, "want PUT to put file", 400)
 		return
 	}
-	fts, err := h.b.FileTargets()
-	if err != nil {
+	if _, err := h.b.FileTargets(); err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
@@ -358,34 +404,89 @@ func (h *Handler) serveFilePut(w http.ResponseWriter, r *http.Request) {
 	}
 	stableID, filenameEscaped := tailcfg.StableNodeID(upath[:slash]), upath[slash+1:]
 
-	var ft *apitype.FileTarget
-	for _, x := range fts {
-		if x.Node.StableID == stableID {
-			ft = x
-			break
-		}
-	}
-	if ft == nil {
+	peerAPIURL, node, ok := h.b.FilePeer(stableID)
+	if !ok {
 		http.Error(w, "node not found", 404)
 		return
 	}
-	dstURL, err := url.Parse(ft.PeerAPIURL)
+	dstURL, err := url.Parse(peerAPIURL)
 	if err != nil {
 		http.Error(w, "bogus peer URL", 500)
 		return
 	}
-	outReq, err := http.NewRequestWithContext(r.Context(), "PUT", "http://peer/v0/put/"+filenameEscaped, r.Body)
+	rp := httputil.NewSingleHostReverseProxy(dstURL)
+	rp.Transport = getDialPeerTransport(h.b)
+
+	// GET asks the peer what it has of a partially received file.
+	if r.Method == "GET" {
+		outReq, err := http.NewRequestWithContext(r.Context(), "GET", "http://peer/v0/put/"+filenameEscaped, nil)
+		if err != nil {
+			http.Error(w, "bogus outreq", 500)
+			return
+		}
+		rp.ServeHTTP(w, outReq)
+		return
+	}
+
+	name, err := url.PathUnescape(strings.TrimSuffix(filenameEscaped, "/"))
+	if err != nil {
+		http.Error(w, "bad filename", 400)
+		return
+	}
+	offset, size := putRange(r.Header.Get("Content-Range"), r.ContentLength)
+	body, finish := h.b.TrackFileSend(r.Body, name, node.ComputedName, size, offset)
+	defer finish(errors.New("canceled")) // if the proxy didn't get to finish it
+	rp.ModifyResponse = func(res *http.Response) error {
+		if res.StatusCode == 200 {
+			finish(nil)
+		} else {
+			finish(errors.New(res.Status))
+		}
+		return nil
+	}
+	rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		finish(err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+
+	outReq, err := http.NewRequestWithContext(r.Context(), "PUT", "http://peer/v0/put/"+filenameEscaped, body)
 	if err != nil {
 		http.Error(w, "bogus outreq", 500)
 		return
 	}
 	outReq.ContentLength = r.ContentLength
-
-	rp := httputil.NewSingleHostReverseProxy(dstURL)
-	rp.Transport = getDialPeerTransport(h.b)
+	for _, k := range []string{"Content-Range", apitype.FileSHA256Header} {
+		if v := r.Header.Get(k); v != "" {
+			outReq.Header.Set(k, v)
+		}
+	}
 	rp.ServeHTTP(w, outReq)
 }
 
+// putRange returns the offset of the bytes in a file put with the
+// given Content-Range header and Content-Length, and the size of the
+// whole file, or -1 if unknown.
+func putRange(contentRange string, contentLength int64) (offset, size int64) {
+	var end int64
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &offset, &end, &size); err == nil {
+		return offset, size
+	}
+	return 0, contentLength
+}
+
+func (h *Handler) serveFileTransfers(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.b.FileTransfers())
+}
+
 func (h *Handler) serveSetDNS(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitWrite {
 		http.Error(w, "access denied", http.StatusForbidden)
@@ -416,6 +517,130 @@ func (h *Handler) serveDERPMap(w http.ResponseWriter, r *http.Request) {
 	e.Encode(h.b.DERPMap())
 }
 
+// pingTimeout is the longest servePing waits for a reply.
+const pingTimeout = 30 * time.Second
+
+func (h *Handler) servePing(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "ping access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	ip, err := netaddr.ParseIP(r.FormValue("ip"))
+	if err != nil {
+		http.Error(w, "invalid 'ip' parameter", 400)
+		return
+	}
+	var useTSMP bool
+	switch t := r.FormValue("type"); t {
+	case "", "disco":
+	case "TSMP":
+		useTSMP = true
+	default:
+		http.Error(w, fmt.Sprintf("invalid 'type' parameter %q", t), 400)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), pingTimeout)
+	defer cancel()
+	res, err := h.b.PingWait(ctx, ip, useTSMP)
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *Handler) serveStart(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "start access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	var opts ipn.Options
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if h.Unprivileged {
+		old := h.b.Prefs()
+		for _, newp := range []*ipn.Prefs{opts.Prefs, opts.UpdatePrefs} {
+			if newp == nil {
+				continue
+			}
+			if err := old.CheckUnprivilegedChange(newp); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+	}
+	if err := h.b.Start(opts); err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) serveLoginInteractive(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "login access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	h.b.StartLoginInteractive()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveWatchIPNBus streams the backend's ipn.Notify messages to the
+// client as newline-delimited JSON until the client goes away.
+//
+// The optional "mask" parameter is an ipn.NotifyWatchOpt bitmask, in
+// decimal. Callers without write access never see private keys.
+func (h *Handler) serveWatchIPNBus(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "watch ipn bus access denied", http.StatusForbidden)
+		return
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "not a flusher", http.StatusInternalServerError)
+		return
+	}
+	var mask ipn.NotifyWatchOpt
+	if s := r.FormValue("mask"); s != "" {
+		v, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, "bad mask", http.StatusBadRequest)
+			return
+		}
+		mask = ipn.NotifyWatchOpt(v)
+	}
+	if !h.PermitWrite {
+		mask |= ipn.NotifyNoPrivateKeys
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	enc := json.NewEncoder(w)
+	h.b.WatchNotifications(r.Context(), mask, func(roNotify *ipn.Notify) (keepGoing bool) {
+		if err := enc.Encode(roNotify); err != nil {
+			return false
+		}
+		f.Flush()
+		return true
+	})
+}
+
 var dialPeerTransportOnce struct {
 	sync.Once
 	v *http.Transport
@@ -0,0 +1,63 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/wgengine"
+)
+
+func TestStartUnprivileged(t *testing.T) {
+	e, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ipnlocal.NewLocalBackend(t.Logf, "logid", &ipn.MemoryStore{}, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+	h := NewHandler(b, t.Logf, "logid")
+	h.PermitRead = true
+	h.PermitWrite = true
+	h.Unprivileged = true
+
+	autoAccept := ipn.NewPrefs()
+	autoAccept.FileAutoAcceptDir = "/root/incoming"
+	serveDir := ipn.NewPrefs()
+	serveDir.Serve = []ipn.ServeRule{{Port: 80, Path: "/", Dir: "/etc"}}
+	tests := []struct {
+		name string
+		opts ipn.Options
+	}{
+		{"prefs_auto_accept", ipn.Options{Prefs: autoAccept}},
+		{"prefs_serve_dir", ipn.Options{Prefs: serveDir}},
+		{"update_prefs_auto_accept", ipn.Options{UpdatePrefs: autoAccept}},
+		{"update_prefs_serve_dir", ipn.Options{UpdatePrefs: serveDir}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("POST", "/localapi/v0/start", bytes.NewReader(body)))
+			if rec.Code != http.StatusForbidden {
+				t.Errorf("status = %d, body %q; want %d", rec.Code, rec.Body, http.StatusForbidden)
+			}
+			if p := b.Prefs(); p != nil {
+				t.Errorf("prefs changed to %v", p)
+			}
+		})
+	}
+}
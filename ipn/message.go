@@ -39,6 +39,25 @@ func ReadonlyContextOf(ctx context.Context) context.Context {
 	return context.WithValue(ctx, readOnlyContextKey{}, readOnlyContextKey{})
 }
 
+type unprivilegedContextKey struct{}
+
+// IsUnprivilegedContext reports whether ctx is an unprivileged context:
+// one for a caller that may change prefs but isn't root while
+// tailscaled is, such as Prefs.OperatorUser. Such callers can't make
+// the changes that Prefs.CheckUnprivilegedChange rejects.
+func IsUnprivilegedContext(ctx context.Context) bool {
+	return ctx.Value(unprivilegedContextKey{}) != nil
+}
+
+// UnprivilegedContextOf returns ctx wrapped with a context value that
+// will make IsUnprivilegedContext report true.
+func UnprivilegedContextOf(ctx context.Context) context.Context {
+	if IsUnprivilegedContext(ctx) {
+		return ctx
+	}
+	return context.WithValue(ctx, unprivilegedContextKey{}, unprivilegedContextKey{})
+}
+
 var jsonEscapedZero = []byte(`\u0000`)
 
 type NoArgs struct{}
@@ -191,6 +210,9 @@ func (bs *BackendServer) GotCommand(ctx context.Context, cmd *Command) error {
 		return errors.New("Quit command received")
 	} else if c := cmd.Start; c != nil {
 		opts := c.Opts
+		if !bs.permitPrefs(ctx, opts.Prefs) || !bs.permitPrefs(ctx, opts.UpdatePrefs) {
+			return nil
+		}
 		return bs.b.Start(opts)
 	} else if c := cmd.StartLoginInteractive; c != nil {
 		bs.b.StartLoginInteractive()
@@ -202,6 +224,9 @@ func (bs *BackendServer) GotCommand(ctx context.Context, cmd *Command) error {
 		bs.b.Logout()
 		return nil
 	} else if c := cmd.SetPrefs; c != nil {
+		if !bs.permitPrefs(ctx, c.New) {
+			return nil
+		}
 		bs.b.SetPrefs(c.New)
 		return nil
 	} else if c := cmd.FakeExpireAfter; c != nil {
@@ -211,6 +236,27 @@ func (bs *BackendServer) GotCommand(ctx context.Context, cmd *Command) error {
 	return fmt.Errorf("BackendServer.Do: no command specified")
 }
 
+// permitPrefs reports whether the caller of ctx may change the
+// backend's prefs to newp, which may be nil. If not, it tells the
+// client why.
+func (bs *BackendServer) permitPrefs(ctx context.Context, newp *Prefs) bool {
+	if newp == nil || !IsUnprivilegedContext(ctx) {
+		return true
+	}
+	var err error
+	if pb, ok := bs.b.(interface{ Prefs() *Prefs }); ok {
+		err = pb.Prefs().CheckUnprivilegedChange(newp)
+	} else {
+		err = errors.New(ErrMsgPermissionDenied)
+	}
+	if err != nil {
+		msg := err.Error()
+		bs.send(Notify{ErrMessage: &msg})
+		return false
+	}
+	return true
+}
+
 type BackendClient struct {
 	logf           logger.Logf
 	sendCommandMsg func(jsonb []byte)
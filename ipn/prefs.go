@@ -90,10 +90,27 @@ type Prefs struct {
 	ExitNodeID tailcfg.StableNodeID
 	ExitNodeIP netaddr.IP
 
+	// AutoExitNode specifies that ipnlocal.LocalBackend should pick
+	// the exit node itself, from the peers that offer exit node
+	// services, preferring the online one with the lowest measured
+	// latency and failing over when it stops responding.
+	// ExitNodeID and ExitNodeIP should be zero when it's set.
+	AutoExitNode bool
+
 	// ExitNodeAllowLANAccess indicates whether locally accessible subnets should be
 	// routed directly or via the exit node.
 	ExitNodeAllowLANAccess bool
 
+	// ExitNodeBypassPrefixes are destination IP ranges that are
+	// routed directly rather than via the exit node, if any.
+	ExitNodeBypassPrefixes []netaddr.IPPrefix `json:",omitempty"`
+
+	// ExitNodeBypassDomains are DNS names (and their subdomains)
+	// whose addresses are routed directly rather than via the exit
+	// node, if any. The addresses are learned from the answers that
+	// MagicDNS forwards, so this requires CorpDNS.
+	ExitNodeBypassDomains []string `json:",omitempty"`
+
 	// CorpDNS specifies whether to install the Tailscale network's
 	// DNS configuration, if it exists.
 	CorpDNS bool
@@ -153,6 +170,55 @@ type Prefs struct {
 	// for Linux/etc, which always operate in daemon mode.
 	ForceDaemon bool `json:"ForceDaemon,omitempty"`
 
+	// StaticEndpoints are UDP endpoints (public IP:port) that this
+	// node always advertises to peers in addition to the ones it
+	// discovers, such as the address of a static 1:1 NAT in front
+	// of it.
+	StaticEndpoints []netaddr.IPPort `json:",omitempty"`
+
+	// ExcludeEndpointInterfaces are names of local network
+	// interfaces (or path.Match patterns like "veth*") whose
+	// addresses aren't advertised to peers as endpoints.
+	ExcludeEndpointInterfaces []string `json:",omitempty"`
+
+	// ExcludeEndpointPrefixes are IP ranges within which discovered
+	// endpoints aren't advertised to peers. They don't apply to
+	// StaticEndpoints.
+	ExcludeEndpointPrefixes []netaddr.IPPrefix `json:",omitempty"`
+
+	// Serve are the rules for the HTTP and HTTPS services that
+	// tailscaled provides on the node's Tailscale IPs, such as
+	// reverse proxies to local web apps.
+	Serve []ServeRule `json:",omitempty"`
+
+	// FileAutoAcceptDir, if non-empty, is the absolute path of a
+	// directory that received Taildrop files are moved into as soon
+	// as they're complete, rather than waiting in the inbox for
+	// "tailscale file get". The files are owned by the user
+	// tailscaled runs as, so if that's root, only root may set it
+	// (see CheckUnprivilegedChange).
+	FileAutoAcceptDir string `json:",omitempty"`
+
+	// FileMaxInboxSize, if non-zero, is the most bytes of Taildrop
+	// files, including partially received ones, that may be waiting
+	// in the inbox. Files that would exceed it are refused.
+	FileMaxInboxSize int64 `json:",omitempty"`
+
+	// FileMaxSize, if non-zero, is the size in bytes of the largest
+	// Taildrop file (or directory tree) that's accepted.
+	FileMaxSize int64 `json:",omitempty"`
+
+	// FileAllowSenders, if non-empty, are the tailnet login names
+	// (such as "alice@example.com", or "@example.com" for a whole
+	// domain) of the other users whose Taildrop files are accepted.
+	// Files from this node's own user are always accepted.
+	FileAllowSenders []string `json:",omitempty"`
+
+	// FileDenySenders are login names, in the same form as
+	// FileAllowSenders, of other users whose Taildrop files are
+	// refused even if FileAllowSenders allows them.
+	FileDenySenders []string `json:",omitempty"`
+
 	// The following block of options only have an effect on Linux.
 
 	// AdvertiseRoutes specifies CIDR prefixes to advertise into the
@@ -192,26 +258,62 @@ type Prefs struct {
 type MaskedPrefs struct {
 	Prefs
 
-	ControlURLSet             bool `json:",omitempty"`
-	RouteAllSet               bool `json:",omitempty"`
-	AllowSingleHostsSet       bool `json:",omitempty"`
-	ExitNodeIDSet             bool `json:",omitempty"`
-	ExitNodeIPSet             bool `json:",omitempty"`
-	ExitNodeAllowLANAccessSet bool `json:",omitempty"`
-	CorpDNSSet                bool `json:",omitempty"`
-	WantRunningSet            bool `json:",omitempty"`
-	LoggedOutSet              bool `json:",omitempty"`
-	ShieldsUpSet              bool `json:",omitempty"`
-	AdvertiseTagsSet          bool `json:",omitempty"`
-	HostnameSet               bool `json:",omitempty"`
-	OSVersionSet              bool `json:",omitempty"`
-	DeviceModelSet            bool `json:",omitempty"`
-	NotepadURLsSet            bool `json:",omitempty"`
-	ForceDaemonSet            bool `json:",omitempty"`
-	AdvertiseRoutesSet        bool `json:",omitempty"`
-	NoSNATSet                 bool `json:",omitempty"`
-	NetfilterModeSet          bool `json:",omitempty"`
-	OperatorUserSet           bool `json:",omitempty"`
+	ControlURLSet                bool `json:",omitempty"`
+	RouteAllSet                  bool `json:",omitempty"`
+	AllowSingleHostsSet          bool `json:",omitempty"`
+	ExitNodeIDSet                bool `json:",omitempty"`
+	ExitNodeIPSet                bool `json:",omitempty"`
+	AutoExitNodeSet              bool `json:",omitempty"`
+	ExitNodeAllowLANAccessSet    bool `json:",omitempty"`
+	ExitNodeBypassPrefixesSet    bool `json:",omitempty"`
+	ExitNodeBypassDomainsSet     bool `json:",omitempty"`
+	CorpDNSSet                   bool `json:",omitempty"`
+	WantRunningSet               bool `json:",omitempty"`
+	LoggedOutSet                 bool `json:",omitempty"`
+	ShieldsUpSet                 bool `json:",omitempty"`
+	AdvertiseTagsSet             bool `json:",omitempty"`
+	HostnameSet                  bool `json:",omitempty"`
+	OSVersionSet                 bool `json:",omitempty"`
+	DeviceModelSet               bool `json:",omitempty"`
+	NotepadURLsSet               bool `json:",omitempty"`
+	ForceDaemonSet               bool `json:",omitempty"`
+	StaticEndpointsSet           bool `json:",omitempty"`
+	ExcludeEndpointInterfacesSet bool `json:",omitempty"`
+	ExcludeEndpointPrefixesSet   bool `json:",omitempty"`
+	ServeSet                     bool `json:",omitempty"`
+	FileAutoAcceptDirSet         bool `json:",omitempty"`
+	FileMaxInboxSizeSet          bool `json:",omitempty"`
+	FileMaxSizeSet               bool `json:",omitempty"`
+	FileAllowSendersSet          bool `json:",omitempty"`
+	FileDenySendersSet           bool `json:",omitempty"`
+	AdvertiseRoutesSet           bool `json:",omitempty"`
+	NoSNATSet                    bool `json:",omitempty"`
+	NetfilterModeSet             bool `json:",omitempty"`
+	OperatorUserSet              bool `json:",omitempty"`
+}
+
+// CheckUnprivilegedChange returns an error if changing prefs from p,
+// which may be nil, to p2 needs root. That's the case for changes that
+// would let a caller that isn't root (see IsUnprivilegedContext) use
+// tailscaled's privileges to access files on behalf of peers: adding
+// directories for Serve rules to serve, and setting the
+// FileAutoAcceptDir that received files are written to.
+func (p *Prefs) CheckUnprivilegedChange(p2 *Prefs) error {
+	var oldDirs map[string]bool
+	var oldAcceptDir string
+	if p != nil {
+		oldDirs = serveDirs(p.Serve)
+		oldAcceptDir = p.FileAutoAcceptDir
+	}
+	if p2.FileAutoAcceptDir != "" && p2.FileAutoAcceptDir != oldAcceptDir {
+		return fmt.Errorf("only root can auto-accept files into %q", p2.FileAutoAcceptDir)
+	}
+	for dir := range serveDirs(p2.Serve) {
+		if !oldDirs[dir] {
+			return fmt.Errorf("only root can serve directory %q", dir)
+		}
+	}
+	return nil
 }
 
 // ApplyEdits mutates p, assigning fields from m.Prefs for each MaskedPrefs
@@ -282,11 +384,16 @@ func (p *Prefs) pretty(goos string) string {
 	if p.ShieldsUp {
 		sb.WriteString("shields=true ")
 	}
-	if !p.ExitNodeIP.IsZero() {
+	if p.AutoExitNode {
+		fmt.Fprintf(&sb, "exit=auto lan=%t ", p.ExitNodeAllowLANAccess)
+	} else if !p.ExitNodeIP.IsZero() {
 		fmt.Fprintf(&sb, "exit=%v lan=%t ", p.ExitNodeIP, p.ExitNodeAllowLANAccess)
 	} else if !p.ExitNodeID.IsZero() {
 		fmt.Fprintf(&sb, "exit=%v lan=%t ", p.ExitNodeID, p.ExitNodeAllowLANAccess)
 	}
+	if len(p.ExitNodeBypassPrefixes) > 0 || len(p.ExitNodeBypassDomains) > 0 {
+		fmt.Fprintf(&sb, "bypass=%v,%v ", p.ExitNodeBypassPrefixes, p.ExitNodeBypassDomains)
+	}
 	if len(p.AdvertiseRoutes) > 0 || goos == "linux" {
 		fmt.Fprintf(&sb, "routes=%v ", p.AdvertiseRoutes)
 	}
@@ -296,6 +403,18 @@ func (p *Prefs) pretty(goos string) string {
 	if len(p.AdvertiseTags) > 0 {
 		fmt.Fprintf(&sb, "tags=%s ", strings.Join(p.AdvertiseTags, ","))
 	}
+	if len(p.StaticEndpoints) > 0 {
+		fmt.Fprintf(&sb, "staticeps=%v ", p.StaticEndpoints)
+	}
+	if len(p.ExcludeEndpointInterfaces) > 0 || len(p.ExcludeEndpointPrefixes) > 0 {
+		fmt.Fprintf(&sb, "epexclude=%v,%v ", p.ExcludeEndpointInterfaces, p.ExcludeEndpointPrefixes)
+	}
+	if len(p.Serve) > 0 {
+		fmt.Fprintf(&sb, "serve=%v ", p.Serve)
+	}
+	if p.FileAutoAcceptDir != "" || p.FileMaxInboxSize != 0 || p.FileMaxSize != 0 || len(p.FileAllowSenders) > 0 || len(p.FileDenySenders) > 0 {
+		fmt.Fprintf(&sb, "files=%q,%d,%d,%v,%v ", p.FileAutoAcceptDir, p.FileMaxInboxSize, p.FileMaxSize, p.FileAllowSenders, p.FileDenySenders)
+	}
 	if goos == "linux" {
 		fmt.Fprintf(&sb, "nf=%v ", p.NetfilterMode)
 	}
@@ -339,7 +458,10 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 		p.AllowSingleHosts == p2.AllowSingleHosts &&
 		p.ExitNodeID == p2.ExitNodeID &&
 		p.ExitNodeIP == p2.ExitNodeIP &&
+		p.AutoExitNode == p2.AutoExitNode &&
 		p.ExitNodeAllowLANAccess == p2.ExitNodeAllowLANAccess &&
+		compareIPNets(p.ExitNodeBypassPrefixes, p2.ExitNodeBypassPrefixes) &&
+		compareStrings(p.ExitNodeBypassDomains, p2.ExitNodeBypassDomains) &&
 		p.CorpDNS == p2.CorpDNS &&
 		p.WantRunning == p2.WantRunning &&
 		p.LoggedOut == p2.LoggedOut &&
@@ -354,6 +476,15 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 		p.ForceDaemon == p2.ForceDaemon &&
 		compareIPNets(p.AdvertiseRoutes, p2.AdvertiseRoutes) &&
 		compareStrings(p.AdvertiseTags, p2.AdvertiseTags) &&
+		compareIPPorts(p.StaticEndpoints, p2.StaticEndpoints) &&
+		compareStrings(p.ExcludeEndpointInterfaces, p2.ExcludeEndpointInterfaces) &&
+		compareIPNets(p.ExcludeEndpointPrefixes, p2.ExcludeEndpointPrefixes) &&
+		compareServeRules(p.Serve, p2.Serve) &&
+		p.FileAutoAcceptDir == p2.FileAutoAcceptDir &&
+		p.FileMaxInboxSize == p2.FileMaxInboxSize &&
+		p.FileMaxSize == p2.FileMaxSize &&
+		compareStrings(p.FileAllowSenders, p2.FileAllowSenders) &&
+		compareStrings(p.FileDenySenders, p2.FileDenySenders) &&
 		p.Persist.Equals(p2.Persist)
 }
 
@@ -369,6 +500,18 @@ func compareIPNets(a, b []netaddr.IPPrefix) bool {
 	return true
 }
 
+func compareIPPorts(a, b []netaddr.IPPort) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func compareStrings(a, b []string) bool {
 	if len(a) != len(b) {
 		return false
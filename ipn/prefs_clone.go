@@ -21,7 +21,15 @@ func (src *Prefs) Clone() *Prefs {
 	}
 	dst := new(Prefs)
 	*dst = *src
+	dst.ExitNodeBypassPrefixes = append(src.ExitNodeBypassPrefixes[:0:0], src.ExitNodeBypassPrefixes...)
+	dst.ExitNodeBypassDomains = append(src.ExitNodeBypassDomains[:0:0], src.ExitNodeBypassDomains...)
 	dst.AdvertiseTags = append(src.AdvertiseTags[:0:0], src.AdvertiseTags...)
+	dst.StaticEndpoints = append(src.StaticEndpoints[:0:0], src.StaticEndpoints...)
+	dst.ExcludeEndpointInterfaces = append(src.ExcludeEndpointInterfaces[:0:0], src.ExcludeEndpointInterfaces...)
+	dst.ExcludeEndpointPrefixes = append(src.ExcludeEndpointPrefixes[:0:0], src.ExcludeEndpointPrefixes...)
+	dst.Serve = append(src.Serve[:0:0], src.Serve...)
+	dst.FileAllowSenders = append(src.FileAllowSenders[:0:0], src.FileAllowSenders...)
+	dst.FileDenySenders = append(src.FileDenySenders[:0:0], src.FileDenySenders...)
 	dst.AdvertiseRoutes = append(src.AdvertiseRoutes[:0:0], src.AdvertiseRoutes...)
 	if dst.Persist != nil {
 		dst.Persist = new(persist.Persist)
@@ -33,25 +41,37 @@ func (src *Prefs) Clone() *Prefs {
 // A compilation failure here means this code must be regenerated, with command:
 //   tailscale.com/cmd/cloner -type Prefs
 var _PrefsNeedsRegeneration = Prefs(struct {
-	ControlURL             string
-	RouteAll               bool
-	AllowSingleHosts       bool
-	ExitNodeID             tailcfg.StableNodeID
-	ExitNodeIP             netaddr.IP
-	ExitNodeAllowLANAccess bool
-	CorpDNS                bool
-	WantRunning            bool
-	LoggedOut              bool
-	ShieldsUp              bool
-	AdvertiseTags          []string
-	Hostname               string
-	OSVersion              string
-	DeviceModel            string
-	NotepadURLs            bool
-	ForceDaemon            bool
-	AdvertiseRoutes        []netaddr.IPPrefix
-	NoSNAT                 bool
-	NetfilterMode          preftype.NetfilterMode
-	OperatorUser           string
-	Persist                *persist.Persist
+	ControlURL                string
+	RouteAll                  bool
+	AllowSingleHosts          bool
+	ExitNodeID                tailcfg.StableNodeID
+	ExitNodeIP                netaddr.IP
+	AutoExitNode              bool
+	ExitNodeAllowLANAccess    bool
+	ExitNodeBypassPrefixes    []netaddr.IPPrefix
+	ExitNodeBypassDomains     []string
+	CorpDNS                   bool
+	WantRunning               bool
+	LoggedOut                 bool
+	ShieldsUp                 bool
+	AdvertiseTags             []string
+	Hostname                  string
+	OSVersion                 string
+	DeviceModel               string
+	NotepadURLs               bool
+	ForceDaemon               bool
+	StaticEndpoints           []netaddr.IPPort
+	ExcludeEndpointInterfaces []string
+	ExcludeEndpointPrefixes   []netaddr.IPPrefix
+	Serve                     []ServeRule
+	FileAutoAcceptDir         string
+	FileMaxInboxSize          int64
+	FileMaxSize               int64
+	FileAllowSenders          []string
+	FileDenySenders           []string
+	AdvertiseRoutes           []netaddr.IPPrefix
+	NoSNAT                    bool
+	NetfilterMode             preftype.NetfilterMode
+	OperatorUser              string
+	Persist                   *persist.Persist
 }{})
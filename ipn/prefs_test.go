@@ -39,7 +39,10 @@ func TestPrefsEqual(t *testing.T) {
 		"AllowSingleHosts",
 		"ExitNodeID",
 		"ExitNodeIP",
+		"AutoExitNode",
 		"ExitNodeAllowLANAccess",
+		"ExitNodeBypassPrefixes",
+		"ExitNodeBypassDomains",
 		"CorpDNS",
 		"WantRunning",
 		"LoggedOut",
@@ -50,6 +53,15 @@ func TestPrefsEqual(t *testing.T) {
 		"DeviceModel",
 		"NotepadURLs",
 		"ForceDaemon",
+		"StaticEndpoints",
+		"ExcludeEndpointInterfaces",
+		"ExcludeEndpointPrefixes",
+		"Serve",
+		"FileAutoAcceptDir",
+		"FileMaxInboxSize",
+		"FileMaxSize",
+		"FileAllowSenders",
+		"FileDenySenders",
 		"AdvertiseRoutes",
 		"NoSNAT",
 		"NetfilterMode",
@@ -146,6 +158,17 @@ func TestPrefsEqual(t *testing.T) {
 			true,
 		},
 
+		{
+			&Prefs{},
+			&Prefs{AutoExitNode: true},
+			false,
+		},
+		{
+			&Prefs{AutoExitNode: true},
+			&Prefs{AutoExitNode: true},
+			true,
+		},
+
 		{
 			&Prefs{},
 			&Prefs{ExitNodeAllowLANAccess: true},
@@ -156,6 +179,46 @@ func TestPrefsEqual(t *testing.T) {
 			&Prefs{ExitNodeAllowLANAccess: true},
 			true,
 		},
+		{
+			&Prefs{ExitNodeBypassPrefixes: nets("52.0.0.0/8")},
+			&Prefs{ExitNodeBypassPrefixes: nets("52.0.0.0/8")},
+			true,
+		},
+		{
+			&Prefs{ExitNodeBypassPrefixes: nets("52.0.0.0/8")},
+			&Prefs{ExitNodeBypassPrefixes: nets("53.0.0.0/8")},
+			false,
+		},
+		{
+			&Prefs{ExitNodeBypassDomains: []string{"zoom.us"}},
+			&Prefs{ExitNodeBypassDomains: []string{"meet.google.com"}},
+			false,
+		},
+		{
+			&Prefs{Serve: []ServeRule{{Port: 443, TLS: true, Path: "/", Proxy: "http://127.0.0.1:3000"}}},
+			&Prefs{Serve: []ServeRule{{Port: 443, TLS: true, Path: "/", Proxy: "http://127.0.0.1:3000"}}},
+			true,
+		},
+		{
+			&Prefs{Serve: []ServeRule{{Port: 443, TLS: true, Path: "/", Proxy: "http://127.0.0.1:3000"}}},
+			&Prefs{Serve: []ServeRule{{Port: 443, TLS: true, Path: "/", Proxy: "http://127.0.0.1:3001"}}},
+			false,
+		},
+		{
+			&Prefs{FileAutoAcceptDir: "/srv/incoming", FileMaxSize: 1 << 30},
+			&Prefs{FileAutoAcceptDir: "/srv/incoming", FileMaxSize: 1 << 30},
+			true,
+		},
+		{
+			&Prefs{FileMaxInboxSize: 1 << 30},
+			&Prefs{FileMaxInboxSize: 2 << 30},
+			false,
+		},
+		{
+			&Prefs{FileAllowSenders: []string{"@example.com"}},
+			&Prefs{FileAllowSenders: []string{"@example.com"}, FileDenySenders: []string{"mallory@example.com"}},
+			false,
+		},
 
 		{
 			&Prefs{CorpDNS: true},
@@ -434,6 +497,14 @@ func TestPrefsPretty(t *testing.T) {
 			"linux",
 			`Prefs{ra=false mesh=false dns=false want=false exit=myNodeABC lan=true routes=[] nf=off Persist=nil}`,
 		},
+		{
+			Prefs{
+				AutoExitNode:           true,
+				ExitNodeAllowLANAccess: true,
+			},
+			"linux",
+			`Prefs{ra=false mesh=false dns=false want=false exit=auto lan=true routes=[] nf=off Persist=nil}`,
+		},
 		{
 			Prefs{
 				ExitNodeAllowLANAccess: true,
@@ -601,6 +672,36 @@ func TestPrefsApplyEdits(t *testing.T) {
 	}
 }
 
+func TestCheckUnprivilegedChange(t *testing.T) {
+	proxy := ServeRule{Port: 443, TLS: true, Path: "/", Proxy: "http://127.0.0.1:3000"}
+	www := ServeRule{Port: 80, Path: "/", Dir: "/var/www"}
+	tests := []struct {
+		name    string
+		old     *Prefs
+		new     *Prefs
+		wantErr bool
+	}{
+		{"nil_old", nil, &Prefs{}, false},
+		{"add_proxy", &Prefs{}, &Prefs{Serve: []ServeRule{proxy}}, false},
+		{"add_dir", &Prefs{}, &Prefs{Serve: []ServeRule{www}}, true},
+		{"add_dir_nil_old", nil, &Prefs{Serve: []ServeRule{www}}, true},
+		{"keep_dir", &Prefs{Serve: []ServeRule{www}}, &Prefs{Serve: []ServeRule{proxy, www}}, false},
+		{"move_dir", &Prefs{Serve: []ServeRule{www}}, &Prefs{Serve: []ServeRule{{Port: 8080, Path: "/www/", Dir: "/var/www/"}}}, false},
+		{"remove_dir", &Prefs{Serve: []ServeRule{www}}, &Prefs{}, false},
+		{"change_dir", &Prefs{Serve: []ServeRule{www}}, &Prefs{Serve: []ServeRule{{Port: 80, Path: "/", Dir: "/etc"}}}, true},
+		{"set_accept_dir", &Prefs{}, &Prefs{FileAutoAcceptDir: "/etc/cron.d"}, true},
+		{"change_accept_dir", &Prefs{FileAutoAcceptDir: "/srv/inbox"}, &Prefs{FileAutoAcceptDir: "/etc/cron.d"}, true},
+		{"keep_accept_dir", &Prefs{FileAutoAcceptDir: "/srv/inbox"}, &Prefs{FileAutoAcceptDir: "/srv/inbox", WantRunning: true}, false},
+		{"clear_accept_dir", &Prefs{FileAutoAcceptDir: "/srv/inbox"}, &Prefs{}, false},
+	}
+	for _, tt := range tests {
+		err := tt.old.CheckUnprivilegedChange(tt.new)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v; want error: %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
 func TestMaskedPrefsPretty(t *testing.T) {
 	tests := []struct {
 		m    *MaskedPrefs
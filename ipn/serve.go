@@ -0,0 +1,134 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// ServeRule is one entry of Prefs.Serve: it makes tailscaled accept
+// HTTP requests for a URL path on a TCP port of the node's Tailscale
+// IPs and handle them with a local service or directory.
+type ServeRule struct {
+	// Port is the TCP port on the node's Tailscale IPs.
+	Port uint16
+
+	// TLS is whether connections to Port use TLS, terminated by
+	// tailscaled. All rules for a Port must agree on TLS.
+	TLS bool `json:",omitempty"`
+
+	// Path is the URL path prefix this rule handles, such as "/"
+	// or "/api/". The longest matching Path of a Port's rules
+	// handles each request.
+	Path string
+
+	// Proxy, if non-empty, is the URL of a local HTTP server to
+	// reverse-proxy requests to, such as "http://127.0.0.1:3000".
+	// Path is stripped from request paths and replaced with the
+	// URL's path.
+	Proxy string `json:",omitempty"`
+
+	// Dir, if non-empty, is the absolute path of a local directory
+	// to serve static files from. They're read with tailscaled's
+	// privileges, so if it runs as root, only root can add Dir rules
+	// (see Prefs.CheckUnprivilegedChange).
+	Dir string `json:",omitempty"`
+}
+
+func (r ServeRule) String() string {
+	scheme := "http"
+	if r.TLS {
+		scheme = "https"
+	}
+	target := r.Proxy
+	if r.Dir != "" {
+		target = r.Dir
+	}
+	return fmt.Sprintf("%s:%d%s -> %s", scheme, r.Port, r.Path, target)
+}
+
+// Check reports whether r is a valid rule.
+func (r ServeRule) Check() error {
+	if r.Port == 0 {
+		return errors.New("serve rule has no port")
+	}
+	if !strings.HasPrefix(r.Path, "/") {
+		return fmt.Errorf("serve path %q must start with /", r.Path)
+	}
+	switch {
+	case r.Proxy != "" && r.Dir != "":
+		return errors.New("serve rule has both a proxy and a directory")
+	case r.Proxy != "":
+		u, err := url.Parse(r.Proxy)
+		if err != nil {
+			return fmt.Errorf("serve proxy: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("serve proxy %q must be an http or https URL", r.Proxy)
+		}
+		if u.Host == "" {
+			return fmt.Errorf("serve proxy %q has no host", r.Proxy)
+		}
+	case r.Dir != "":
+		if !filepath.IsAbs(r.Dir) {
+			return fmt.Errorf("serve directory %q must be an absolute path", r.Dir)
+		}
+	default:
+		return errors.New("serve rule has neither a proxy nor a directory")
+	}
+	return nil
+}
+
+// CheckServeRules reports whether rules are valid together.
+func CheckServeRules(rules []ServeRule) error {
+	type portPath struct {
+		port uint16
+		path string
+	}
+	tls := map[uint16]bool{}
+	seen := map[portPath]bool{}
+	for _, r := range rules {
+		if err := r.Check(); err != nil {
+			return err
+		}
+		if t, ok := tls[r.Port]; ok && t != r.TLS {
+			return fmt.Errorf("port %d has rules both with and without TLS", r.Port)
+		}
+		tls[r.Port] = r.TLS
+		pp := portPath{r.Port, r.Path}
+		if seen[pp] {
+			return fmt.Errorf("port %d has more than one rule for path %q", r.Port, r.Path)
+		}
+		seen[pp] = true
+	}
+	return nil
+}
+
+func compareServeRules(a, b []ServeRule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// serveDirs returns the set of directories rules serve.
+func serveDirs(rules []ServeRule) map[string]bool {
+	dirs := map[string]bool{}
+	for _, r := range rules {
+		if r.Dir != "" {
+			dirs[filepath.Clean(r.Dir)] = true
+		}
+	}
+	return dirs
+}
@@ -0,0 +1,40 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import "testing"
+
+func TestCheckServeRules(t *testing.T) {
+	proxy := func(port uint16, tls bool, path string) ServeRule {
+		return ServeRule{Port: port, TLS: tls, Path: path, Proxy: "http://127.0.0.1:3000"}
+	}
+	tests := []struct {
+		name    string
+		rules   []ServeRule
+		wantErr bool
+	}{
+		{"empty", nil, false},
+		{"proxy", []ServeRule{proxy(443, true, "/")}, false},
+		{"dir", []ServeRule{{Port: 80, Path: "/static/", Dir: "/var/www"}}, false},
+		{"two_paths", []ServeRule{proxy(443, true, "/"), proxy(443, true, "/api/")}, false},
+		{"two_ports", []ServeRule{proxy(443, true, "/"), proxy(80, false, "/")}, false},
+		{"no_port", []ServeRule{proxy(0, false, "/")}, true},
+		{"relative_path", []ServeRule{proxy(443, true, "api")}, true},
+		{"no_target", []ServeRule{{Port: 443, Path: "/"}}, true},
+		{"both_targets", []ServeRule{{Port: 443, Path: "/", Proxy: "http://127.0.0.1:1", Dir: "/tmp"}}, true},
+		{"relative_dir", []ServeRule{{Port: 443, Path: "/", Dir: "www"}}, true},
+		{"bad_scheme", []ServeRule{{Port: 443, Path: "/", Proxy: "ftp://127.0.0.1"}}, true},
+		{"mixed_tls", []ServeRule{proxy(443, true, "/"), proxy(443, false, "/api/")}, true},
+		{"dup_path", []ServeRule{proxy(443, true, "/"), proxy(443, true, "/")}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckServeRules(tt.rules)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CheckServeRules = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
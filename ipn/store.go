@@ -44,6 +44,16 @@ const (
 	// the server should start with the Prefs JSON loaded from
 	// StateKey "user-1234".
 	ServerModeStartKey = StateKey("server-mode-start-key")
+
+	// SSHHostKeyStateKey is the key under which tailscaled's SSH
+	// server stores its host private key, PEM encoded.
+	SSHHostKeyStateKey = StateKey("_ssh-host-key")
+
+	// ServeCertStateKey is the key under which tailscaled stores the
+	// self-signed TLS certificate and private key, PEM encoded, that
+	// it uses for Prefs.Serve rules when no certificate for the
+	// node's name has been provided.
+	ServeCertStateKey = StateKey("_serve-cert")
 )
 
 // StateStore persists state, and produces it back on request.
@@ -0,0 +1,120 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logsink
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// File is a sink that appends log entries to a file, unchanged, as
+// JSON lines. Once the file reaches its maximum size, it's rotated:
+// renamed with a ".1" suffix, after older files are renamed from ".1"
+// to ".2" and so on, up to the maximum number of files to keep.
+type File struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	closed bool
+}
+
+// NewFile returns a File sink that writes to the file path, creating
+// it if necessary. It's rotated once it's over maxSize bytes and at
+// most maxFiles old files are kept. If maxSize is 0, it's never
+// rotated.
+func NewFile(path string, maxSize int64, maxFiles int) (*File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	w := &File{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := w.openLocked(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *File) openLocked() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.size = f, fi.Size()
+	return nil
+}
+
+// Write appends the log entry b.
+func (w *File) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	if w.f == nil {
+		// A previous rotation failed to reopen the file.
+		if err := w.openLocked(); err != nil {
+			return 0, err
+		}
+	}
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(b)) > w.maxSize {
+		if err := w.rotateLocked(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.f.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// rotateLocked renames the current file out of the way and opens a new
+// one.
+func (w *File) rotateLocked() error {
+	w.f.Close()
+	w.f = nil
+	if w.maxFiles < 1 {
+		os.Remove(w.path)
+	} else {
+		os.Remove(w.oldName(w.maxFiles))
+		for i := w.maxFiles - 1; i >= 1; i-- {
+			os.Rename(w.oldName(i), w.oldName(i+1))
+		}
+		if err := os.Rename(w.path, w.oldName(1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return w.openLocked()
+}
+
+// oldName returns the path of the i'th most recently rotated file.
+func (w *File) oldName(i int) string {
+	return fmt.Sprintf("%s.%d", w.path, i)
+}
+
+// Close closes the file.
+func (w *File) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logsink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// journalSocket is the path of the systemd journal's native protocol
+// socket.
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalFieldPrefix is prepended to the names of a log entry's fields
+// in the journal, so they can't collide with the journal's own.
+const journalFieldPrefix = "TS_"
+
+// Journal is a sink that sends log entries to the systemd journal
+// using its native protocol. An entry's text is the journal entry's
+// MESSAGE, and its other fields become journal fields named like
+// TS_FIELD_NAME. Entries too large for a datagram are sent in a
+// memfd, on Linux.
+//
+// See https://systemd.io/JOURNAL_NATIVE_PROTOCOL/.
+type Journal struct {
+	identifier string
+	conn       net.Conn
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// NewJournal returns a Journal sink that marks its entries with the
+// SYSLOG_IDENTIFIER identifier, such as "tailscaled".
+func NewJournal(identifier string) (*Journal, error) {
+	c, err := net.Dial("unixgram", journalSocket)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{identifier: identifier, conn: c}, nil
+}
+
+// Write sends the log entry b.
+func (j *Journal) Write(b []byte) (int, error) {
+	e := parseEntry(b)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.buf.Reset()
+	j.encode(&j.buf, e)
+	_, err := j.conn.Write(j.buf.Bytes())
+	if err != nil && journalEntryTooLarge(err) {
+		err = sendJournalMemfd(j.conn, j.buf.Bytes())
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// encode writes e to buf in the journal's native protocol.
+func (j *Journal) encode(buf *bytes.Buffer, e entry) {
+	msg := e.text
+	if msg == "" && len(e.fields) > 0 {
+		msg = e.message()
+	}
+	writeJournalField(buf, "MESSAGE", strings.TrimRight(msg, "\n"))
+	writeJournalField(buf, "PRIORITY", "6") // info
+	writeJournalField(buf, "SYSLOG_IDENTIFIER", j.identifier)
+	writeJournalField(buf, "SYSLOG_PID", strconv.Itoa(os.Getpid()))
+
+	keys := make([]string, 0, len(e.fields))
+	for k := range e.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		raw := e.fields[k]
+		v := string(raw)
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			v = s
+		}
+		writeJournalField(buf, journalFieldName(k), v)
+	}
+}
+
+// maxJournalFieldName is the longest a journal field name may be.
+const maxJournalFieldName = 64
+
+// journalFieldName returns the journal field name for the log entry
+// field name: upper case, with characters journal field names can't
+// have replaced by underscores, and cut to maxJournalFieldName
+// characters.
+func journalFieldName(name string) string {
+	if max := maxJournalFieldName - len(journalFieldPrefix); len(name) > max {
+		name = name[:max]
+	}
+	return journalFieldPrefix + strings.Map(func(r rune) rune {
+		switch {
+		case 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '_':
+			return r
+		case 'a' <= r && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, name)
+}
+
+// writeJournalField writes the field name with value to buf. Values
+// with newlines are length-prefixed, as the protocol requires.
+func writeJournalField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	var n [8]byte
+	binary.LittleEndian.PutUint64(n[:], uint64(len(value)))
+	buf.Write(n[:])
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// Close closes the connection to the journal.
+func (j *Journal) Close() error {
+	return j.conn.Close()
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logsink
+
+import (
+	"errors"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// journalEntryTooLarge reports whether err, from sending a journal
+// entry as a datagram, means it needs to be sent with sendJournalMemfd.
+func journalEntryTooLarge(err error) bool {
+	return errors.Is(err, unix.EMSGSIZE) || errors.Is(err, unix.ENOBUFS)
+}
+
+// sendJournalMemfd sends the encoded journal entry data over c in a
+// sealed memfd, which the native protocol accepts for entries too
+// large for a datagram.
+func sendJournalMemfd(c net.Conn, data []byte) error {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return errors.New("journal connection isn't a unix socket")
+	}
+	fd, err := unix.MemfdCreate("tailscale-journal", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), "tailscale-journal")
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if _, err := unix.FcntlInt(f.Fd(), unix.F_ADD_SEALS, unix.F_SEAL_SHRINK|unix.F_SEAL_GROW|unix.F_SEAL_WRITE|unix.F_SEAL_SEAL); err != nil {
+		return err
+	}
+	// Not uc.WriteMsgUnix, which refuses to send on a connected
+	// datagram socket.
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sendErr error
+	err = rc.Write(func(s uintptr) bool {
+		sendErr = unix.Sendmsg(int(s), nil, unix.UnixRights(int(f.Fd())), nil, 0)
+		return sendErr != unix.EAGAIN
+	})
+	if err != nil {
+		return err
+	}
+	return sendErr
+}
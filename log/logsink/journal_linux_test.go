@@ -0,0 +1,65 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logsink
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestJournalLargeEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socket")
+	ln, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unixgram not supported: %v", err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := &Journal{identifier: "tailscaled", conn: c}
+	defer j.Close()
+
+	// Bigger than the largest datagram the socket can send.
+	text := strings.Repeat("x", 4<<20)
+	if _, err := j.Write([]byte(`{"text": "` + text + `"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	oob := make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := ln.ReadMsgUnix(nil, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("got %d byte datagram; want a memfd", n)
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("control messages = %v, %v", msgs, err)
+	}
+	fds, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		t.Fatalf("fds = %v, %v", fds, err)
+	}
+	f := os.NewFile(uintptr(fds[0]), "memfd")
+	defer f.Close()
+	got, err := ioutil.ReadAll(io.NewSectionReader(f, 0, 1<<30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(got, []byte("MESSAGE="+text+"\n")) {
+		t.Errorf("memfd doesn't start with the MESSAGE field")
+	}
+}
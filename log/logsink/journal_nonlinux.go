@@ -0,0 +1,18 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package logsink
+
+import (
+	"errors"
+	"net"
+)
+
+func journalEntryTooLarge(err error) bool { return false }
+
+func sendJournalMemfd(c net.Conn, data []byte) error {
+	return errors.New("journal memfds not supported on this platform")
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package logsink contains local destinations for logtail log
+// entries: size-rotated files, syslog and the systemd journal.
+//
+// Each sink is an io.Writer to which logtail.Logger writes its log
+// entries, one JSON object per line, as they'd be uploaded. Sinks are
+// safe for concurrent use.
+package logsink
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// entry is a decoded log entry.
+type entry struct {
+	time   time.Time // client time; zero if unknown
+	text   string    // the "text" field, if any
+	fields map[string]json.RawMessage
+}
+
+// parseEntry decodes the JSON log entry b. If b isn't a JSON object,
+// it's all text.
+func parseEntry(b []byte) entry {
+	var e entry
+	if err := json.Unmarshal(b, &e.fields); err != nil {
+		e.fields = nil
+		e.text = string(trimNewline(b))
+		return e
+	}
+	if raw, ok := e.fields["logtail"]; ok {
+		var meta struct {
+			ClientTime time.Time `json:"client_time"`
+		}
+		if json.Unmarshal(raw, &meta) == nil {
+			e.time = meta.ClientTime
+		}
+		delete(e.fields, "logtail")
+	}
+	if raw, ok := e.fields["text"]; ok {
+		if json.Unmarshal(raw, &e.text) == nil {
+			delete(e.fields, "text")
+		}
+	}
+	return e
+}
+
+// message returns the text of e, or if it has other fields, e as a
+// JSON object without its logtail metadata.
+func (e entry) message() string {
+	if len(e.fields) == 0 {
+		return e.text
+	}
+	obj := make(map[string]json.RawMessage, len(e.fields)+1)
+	for k, v := range e.fields {
+		obj[k] = v
+	}
+	if e.text != "" {
+		obj["text"], _ = json.Marshal(e.text)
+	}
+	j, _ := json.Marshal(obj)
+	return string(j)
+}
+
+func trimNewline(b []byte) []byte {
+	for len(b) > 0 && (b[len(b)-1] == '\n' || b[len(b)-1] == '\r') {
+		b = b[:len(b)-1]
+	}
+	return b
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logsink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseEntry(t *testing.T) {
+	tests := []struct {
+		in       string
+		wantText string
+		wantMsg  string
+		wantTime time.Time
+	}{
+		{
+			in:       `{"logtail": {"client_time": "2021-06-01T10:00:00Z"}, "text": "hello\n"}` + "\n",
+			wantText: "hello\n",
+			wantMsg:  "hello\n",
+			wantTime: time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			in:      `{"logtail": {"client_time": "2021-06-01T10:00:00Z"}, "v": 1, "text": "hi"}`,
+			wantMsg: `{"text":"hi","v":1}`,
+		},
+		{
+			in:       "not json\n",
+			wantText: "not json",
+			wantMsg:  "not json",
+		},
+	}
+	for _, tt := range tests {
+		e := parseEntry([]byte(tt.in))
+		if tt.wantText != "" && e.text != tt.wantText {
+			t.Errorf("parseEntry(%q).text = %q; want %q", tt.in, e.text, tt.wantText)
+		}
+		if got := e.message(); got != tt.wantMsg {
+			t.Errorf("parseEntry(%q).message() = %q; want %q", tt.in, got, tt.wantMsg)
+		}
+		if !tt.wantTime.IsZero() && !e.time.Equal(tt.wantTime) {
+			t.Errorf("parseEntry(%q).time = %v; want %v", tt.in, e.time, tt.wantTime)
+		}
+	}
+}
+
+func TestFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logsink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sub", "test.log.json")
+
+	f, err := NewFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("x\n")); err != os.ErrClosed {
+		t.Errorf("Write after Close = %v; want os.ErrClosed", err)
+	}
+
+	want := map[string]string{
+		path:        "dddddd\n",
+		path + ".1": "cccccc\n",
+		path + ".2": "bbbbbb\n",
+	}
+	for p, w := range want {
+		got, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(got) != w {
+			t.Errorf("%s = %q; want %q", filepath.Base(p), got, w)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 exists; want only 2 old files", filepath.Base(path))
+	}
+}
+
+func TestJournalEncode(t *testing.T) {
+	j := &Journal{identifier: "tailscaled"}
+	var buf bytes.Buffer
+	j.encode(&buf, parseEntry([]byte(`{"text": "two\nlines", "peer-id": "abc", "n": 3}`)))
+
+	var want bytes.Buffer
+	want.WriteString("MESSAGE\n")
+	var n [8]byte
+	binary.LittleEndian.PutUint64(n[:], uint64(len("two\nlines")))
+	want.Write(n[:])
+	want.WriteString("two\nlines\n")
+	want.WriteString("PRIORITY=6\n")
+	want.WriteString("SYSLOG_IDENTIFIER=tailscaled\n")
+	want.WriteString("SYSLOG_PID=" + strconv.Itoa(os.Getpid()) + "\n")
+	want.WriteString("TS_N=3\n")
+	want.WriteString("TS_PEER_ID=abc\n")
+	if !bytes.Equal(buf.Bytes(), want.Bytes()) {
+		t.Errorf("encode =\n%q\nwant\n%q", buf.Bytes(), want.Bytes())
+	}
+}
+
+func TestJournalFieldName(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"peer-id", "TS_PEER_ID"},
+		{"Count2", "TS_COUNT2"},
+		{strings.Repeat("a", 100), "TS_" + strings.Repeat("A", 61)},
+	}
+	for _, tt := range tests {
+		if got := journalFieldName(tt.in); got != tt.want {
+			t.Errorf("journalFieldName(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSyslog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logsink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "log")
+
+	ln, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unixgram not supported: %v", err)
+	}
+	defer ln.Close()
+
+	now := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	s := &Syslog{tag: "tailscaled", path: path, now: func() time.Time { return now }}
+	defer s.Close()
+	if _, err := s.Write([]byte(`{"text": "hello\n"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	ln.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1024)
+	n, err := ln.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "<30>Jun  1 10:00:00 tailscaled[" + strconv.Itoa(os.Getpid()) + "]: hello\n"
+	if got := string(b[:n]); got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	s.Close()
+	if _, err := s.Write([]byte("x\n")); err == nil || !strings.Contains(err.Error(), "closed") {
+		t.Errorf("Write after Close = %v; want closed error", err)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logsink
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syslogSockets are the paths of the local syslog socket on various
+// platforms.
+var syslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// syslogPriority is the facility (daemon) and severity (info) of the
+// messages sent by Syslog.
+const syslogPriority = 3<<3 | 6
+
+// Syslog is a sink that sends log entries to the local syslog daemon
+// over its unix socket. Entries with fields other than text are sent
+// as JSON objects.
+type Syslog struct {
+	tag  string
+	path string // socket path, or empty to try syslogSockets
+
+	now func() time.Time
+
+	mu     sync.Mutex
+	conn   net.Conn
+	closed bool
+}
+
+// NewSyslog returns a Syslog sink that tags its messages with tag,
+// such as "tailscaled".
+func NewSyslog(tag string) (*Syslog, error) {
+	s := &Syslog{tag: tag, now: time.Now}
+	if err := s.connectLocked(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Syslog) connectLocked() error {
+	paths := syslogSockets
+	if s.path != "" {
+		paths = []string{s.path}
+	}
+	var firstErr error
+	for _, p := range paths {
+		for _, network := range []string{"unixgram", "unix"} {
+			c, err := net.Dial(network, p)
+			if err == nil {
+				s.conn = c
+				return nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if firstErr == nil {
+		firstErr = errors.New("no syslog socket")
+	}
+	return fmt.Errorf("connecting to syslog: %w", firstErr)
+}
+
+// Write sends the log entry b.
+func (s *Syslog) Write(b []byte) (int, error) {
+	e := parseEntry(b)
+	t := e.time
+	if t.IsZero() {
+		t = s.now()
+	}
+	msg := strings.TrimRight(e.message(), "\n")
+	line := fmt.Sprintf("<%d>%s %s[%d]: %s\n", syslogPriority, t.Format(time.Stamp), s.tag, os.Getpid(), msg)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, net.ErrClosed
+	}
+	// Reconnect once, in case the syslog daemon restarted.
+	for i := 0; ; i++ {
+		if s.conn == nil {
+			if err := s.connectLocked(); err != nil {
+				return 0, err
+			}
+		}
+		_, err := s.conn.Write([]byte(line))
+		if err == nil {
+			return len(b), nil
+		}
+		s.conn.Close()
+		s.conn = nil
+		if i > 0 {
+			return 0, err
+		}
+	}
+}
+
+// Close closes the connection to syslog.
+func (s *Syslog) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
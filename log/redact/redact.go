@@ -0,0 +1,210 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package redact pseudonymizes IP addresses, domain names and email
+// addresses in logs.
+//
+// Each is replaced by a keyed hash of its value, like
+// "ip4-5c1f30a2d2b4", so the same value is always replaced by the same
+// pseudonym in one install's logs, and they can still be correlated,
+// without revealing it to whoever reads the logs.
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Key is the secret key for the pseudonyms of a Redactor. It should be
+// random and kept by the program across runs, so pseudonyms stay
+// stable.
+type Key [32]byte
+
+// NewKey returns a new random Key.
+func NewKey() (Key, error) {
+	var k Key
+	if _, err := rand.Read(k[:]); err != nil {
+		return Key{}, err
+	}
+	return k, nil
+}
+
+// IsZero reports whether k is the zero value.
+func (k Key) IsZero() bool { return k == Key{} }
+
+func (k Key) MarshalText() ([]byte, error) {
+	b := make([]byte, hex.EncodedLen(len(k)))
+	hex.Encode(b, k[:])
+	return b, nil
+}
+
+func (k *Key) UnmarshalText(s []byte) error {
+	if hex.DecodedLen(len(s)) != len(k) {
+		return fmt.Errorf("redact.Key.UnmarshalText: invalid hex length: %d", len(s))
+	}
+	if _, err := hex.Decode(k[:], s); err != nil {
+		return fmt.Errorf("redact.Key.UnmarshalText: %v", err)
+	}
+	return nil
+}
+
+// sensitive matches things that might be redacted, in submatches in
+// this order: email addresses, IPv4 addresses, IPv6 addresses (with
+// optional zones) and domain names. Candidates are further checked by
+// Redactor.Redact.
+var sensitive = regexp.MustCompile(
+	`([a-zA-Z0-9._%+-]+@[a-zA-Z0-9-]+(?:\.[a-zA-Z0-9-]+)*\.[a-zA-Z]{2,63})` +
+		`|([0-9]{1,3}(?:\.[0-9]{1,3}){3})` +
+		`|([0-9a-fA-F]{0,4}(?::[0-9a-fA-F]{0,4}){2,7}(?:(?:\.[0-9]{1,3}){3})?(?:%[a-zA-Z0-9_.-]+)?)` +
+		`|((?:[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z]{2,63}\.?)`)
+
+// redactTLDs are the top-level domains of the domain names that are
+// redacted. Only some are, so that the likes of Go identifiers
+// ("magicsock.Conn") and file names ("tailscaled.state") are left
+// alone.
+var redactTLDs = map[string]bool{
+	"arpa": true, "biz": true, "ca": true, "cloud": true, "co": true,
+	"com": true, "corp": true, "de": true, "dev": true, "edu": true,
+	"eu": true, "fr": true, "gov": true, "home": true, "info": true,
+	"internal": true, "io": true, "jp": true, "lan": true, "local": true,
+	"localdomain": true, "net": true, "nl": true, "org": true, "uk": true,
+	"us": true,
+}
+
+// keepDomains are domains whose names, and their subdomains' names,
+// aren't redacted: the servers of the Tailscale service itself, and
+// those in Go import paths in stack traces.
+var keepDomains = []string{
+	"tailscale.com", "tailscale.io",
+	"golang.org", "github.com", "golang.zx2c4.com", "inet.af",
+	"gvisor.dev", "go4.org", "nhooyr.io",
+}
+
+// A Redactor pseudonymizes IP addresses, domain names and email
+// addresses in logs. Loopback and unspecified IP addresses are left as
+// is.
+type Redactor struct {
+	key Key
+}
+
+// New returns a Redactor whose pseudonyms are hashes keyed with key.
+func New(key Key) *Redactor {
+	return &Redactor{key: key}
+}
+
+// Redact returns b with the sensitive values in it replaced by their
+// pseudonyms. Pseudonyms contain only letters, digits and hyphens, so
+// if b is JSON, so is the result. If nothing in b is redacted, b is
+// returned as is.
+func (r *Redactor) Redact(b []byte) []byte {
+	matches := sensitive.FindAllSubmatchIndex(b, -1)
+	if matches == nil {
+		return b
+	}
+	var out []byte
+	last := 0
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		if !isBoundary(b, start, end) {
+			continue
+		}
+		var p string
+		switch {
+		case m[2] >= 0:
+			p = r.pseudonym("email", strings.ToLower(string(b[start:end])))
+		case m[4] >= 0, m[6] >= 0:
+			p = r.ip(string(b[start:end]))
+		case m[8] >= 0:
+			p = r.domain(string(b[start:end]))
+		}
+		if p == "" {
+			continue
+		}
+		if out == nil {
+			out = make([]byte, 0, len(b))
+		}
+		out = append(out, b[last:start]...)
+		out = append(out, p...)
+		last = end
+	}
+	if out == nil {
+		return b
+	}
+	return append(out, b[last:]...)
+}
+
+// isBoundary reports whether b[start:end] is a whole word, rather
+// than part of a longer identifier, number or name.
+func isBoundary(b []byte, start, end int) bool {
+	if start > 0 {
+		switch c := b[start-1]; {
+		case isWordChar(c), c == '.', c == '-':
+			return false
+		}
+	}
+	if end < len(b) {
+		switch c := b[end]; {
+		case isWordChar(c), c == '-', c == '@':
+			return false
+		case c == '.' && end+1 < len(b) && isWordChar(b[end+1]):
+			return false
+		}
+	}
+	return true
+}
+
+func isWordChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_'
+}
+
+// ip returns the pseudonym of the IP address s, or the empty string if
+// s isn't one that's redacted.
+func (r *Redactor) ip(s string) string {
+	addr, zone := s, ""
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		addr, zone = s[:i], s[i:]
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+		return ""
+	}
+	if !strings.Contains(addr, ":") {
+		return r.pseudonym("ip4", ip.String())
+	}
+	return r.pseudonym("ip6", ip.String()+zone)
+}
+
+// domain returns the pseudonym of the domain name s, or the empty
+// string if s isn't one that's redacted. A trailing dot is kept.
+func (r *Redactor) domain(s string) string {
+	name := strings.ToLower(strings.TrimSuffix(s, "."))
+	if !redactTLDs[name[strings.LastIndexByte(name, '.')+1:]] {
+		return ""
+	}
+	for _, d := range keepDomains {
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return ""
+		}
+	}
+	p := r.pseudonym("host", name)
+	if strings.HasSuffix(s, ".") {
+		p += "."
+	}
+	return p
+}
+
+// pseudonym returns the pseudonym of the value v of the given kind.
+func (r *Redactor) pseudonym(kind, v string) string {
+	h := hmac.New(sha256.New, r.key[:])
+	h.Write([]byte(kind))
+	h.Write([]byte{0})
+	h.Write([]byte(v))
+	return kind + "-" + hex.EncodeToString(h.Sum(nil)[:6])
+}
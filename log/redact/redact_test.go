@@ -0,0 +1,94 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package redact
+
+import (
+	"encoding/json"
+	"regexp"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	r := New(Key{1, 2, 3})
+	p := func(kind, v string) string { return r.pseudonym(kind, v) }
+
+	tests := []struct {
+		in, want string
+	}{
+		{"nothing to see here", "nothing to see here"},
+		{"endpoints: 203.0.113.5:41641 192.168.1.10:41641", "endpoints: " + p("ip4", "203.0.113.5") + ":41641 " + p("ip4", "192.168.1.10") + ":41641"},
+		{"addr=[2001:db8::1]:41641", "addr=[" + p("ip6", "2001:db8::1") + "]:41641"},
+		{"via fe80::1%eth0", "via " + p("ip6", "fe80::1%eth0")},
+		{"mapped ::ffff:10.0.0.1 ok", "mapped " + p("ip6", "10.0.0.1") + " ok"},
+		{"same 2001:DB8:0::1", "same " + p("ip6", "2001:db8::1")},
+		{"local 127.0.0.1:8080 and [::1]:53 and 0.0.0.0", "local 127.0.0.1:8080 and [::1]:53 and 0.0.0.0"},
+		{"route 100.64.0.0/10", "route " + p("ip4", "100.64.0.0") + "/10"},
+		{"login alice@Example.com ok", "login " + p("email", "alice@example.com") + " ok"},
+		{"dns: resolving Laptop.alice.example.ts.net.", "dns: resolving " + p("host", "laptop.alice.example.ts.net") + "."},
+		{"printer.lan is up.", p("host", "printer.lan") + " is up."},
+		{"control: controlplane.tailscale.com, log.tailscale.io", "control: controlplane.tailscale.com, log.tailscale.io"},
+		{"magicsock.Conn: read tailscaled.state at 12:34:56.789", "magicsock.Conn: read tailscaled.state at 12:34:56.789"},
+		{"version 1.2.3.4.5 and mac aa:bb:cc:dd:ee:ff", "version 1.2.3.4.5 and mac aa:bb:cc:dd:ee:ff"},
+		{"golang.org/x/net@v0.0.0 github.com/foo/bar", "golang.org/x/net@v0.0.0 github.com/foo/bar"},
+		{"gvisor.dev/gvisor go4.org/mem nhooyr.io/websocket inet.af/netaddr golang.zx2c4.com/wireguard", "gvisor.dev/gvisor go4.org/mem nhooyr.io/websocket inet.af/netaddr golang.zx2c4.com/wireguard"},
+	}
+	for _, tt := range tests {
+		if got := string(r.Redact([]byte(tt.in))); got != tt.want {
+			t.Errorf("Redact(%q)\n got: %q\nwant: %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRedactPseudonyms(t *testing.T) {
+	r1 := New(Key{1})
+	r2 := New(Key{2})
+	a := string(r1.Redact([]byte("1.2.3.4")))
+	if !regexp.MustCompile(`^ip4-[0-9a-f]{12}$`).MatchString(a) {
+		t.Errorf("pseudonym = %q", a)
+	}
+	if b := string(r1.Redact([]byte("1.2.3.4"))); b != a {
+		t.Errorf("same key: %q != %q", b, a)
+	}
+	if b := string(r2.Redact([]byte("1.2.3.4"))); b == a {
+		t.Errorf("different keys, same pseudonym %q", a)
+	}
+	if b := string(r1.Redact([]byte("1.2.3.5"))); b == a {
+		t.Errorf("different addresses, same pseudonym %q", a)
+	}
+}
+
+func TestRedactJSON(t *testing.T) {
+	r := New(Key{1})
+	in := `{"text": "peer 10.1.2.3 (bob@example.com)", "addrs": ["fd7a:115c:a1e0::1", "host.example.org"]}`
+	out := r.Redact([]byte(in))
+	var v map[string]interface{}
+	if err := json.Unmarshal(out, &v); err != nil {
+		t.Fatalf("redacted JSON %s: %v", out, err)
+	}
+	if regexp.MustCompile(`10\.1\.2\.3|bob|fd7a|example`).Match(out) {
+		t.Errorf("not redacted: %s", out)
+	}
+}
+
+func TestKeyText(t *testing.T) {
+	k, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.IsZero() {
+		t.Fatal("NewKey returned zero key")
+	}
+	b, err := json.Marshal(struct{ K Key }{k})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v struct{ K Key }
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.K != k {
+		t.Errorf("round trip: got %x; want %x", v.K, k)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -29,6 +30,7 @@ import (
 
 	"golang.org/x/term"
 	"tailscale.com/atomicfile"
+	"tailscale.com/log/redact"
 	"tailscale.com/logtail"
 	"tailscale.com/logtail/filch"
 	"tailscale.com/net/netns"
@@ -66,6 +68,7 @@ type Config struct {
 	Collection string
 	PrivateID  logtail.PrivateID
 	PublicID   logtail.PublicID
+	RedactKey  redact.Key // keys the pseudonyms of private data in logs
 }
 
 // Policy is a logger and its public ID.
@@ -74,6 +77,8 @@ type Policy struct {
 	Logtail *logtail.Logger
 	// PublicID is the logger's instance identifier.
 	PublicID logtail.PublicID
+
+	sinks []io.Writer // local log sinks, closed on Shutdown
 }
 
 // ToBytes returns the JSON representation of c.
@@ -329,6 +334,11 @@ func tryFixLogStateLocation(dir, cmdname string) {
 	}
 }
 
+// defaultLogBufferMaxSize is the default maximum size of the logs
+// buffered on disk while they can't be uploaded, after which the oldest
+// are dropped.
+const defaultLogBufferMaxSize = 50 << 20
+
 // New returns a new log policy (a logger and its instance ID) for a
 // given collection name.
 func New(collection string) *Policy {
@@ -400,6 +410,12 @@ func New(collection string) *Policy {
 			log.Fatalf("logpolicy: NewPrivateID() should never fail")
 		}
 	}
+	if newc.RedactKey.IsZero() {
+		newc.RedactKey, err = redact.NewKey()
+		if err != nil {
+			log.Fatalf("logpolicy: redact.NewKey() should never fail")
+		}
+	}
 	newc.PublicID = newc.PrivateID.Public()
 	if newc != *oldc {
 		if err := newc.save(cfgPath); err != nil {
@@ -428,9 +444,39 @@ func New(collection string) *Policy {
 		c.HTTPC = &http.Client{Transport: newLogtailTransport(u.Host)}
 	}
 
-	filchBuf, filchErr := filch.New(filepath.Join(dir, cmdName), filch.Options{})
-	if filchBuf != nil {
-		c.Buffer = filchBuf
+	// IP addresses, domain names and email addresses in uploaded
+	// logs are pseudonymized, unless TS_DEBUG_LOG_NO_REDACT is set.
+	// This is on by default because uploaded logs leave the machine
+	// and are kept by the log server, whose operators needn't see
+	// who the node talks to. Logs written to stderr and the local
+	// sinks aren't redacted, so they stay readable where they're
+	// written, including without uploading.
+	noRedact, _ := strconv.ParseBool(os.Getenv("TS_DEBUG_LOG_NO_REDACT"))
+	if !noRedact {
+		c.Redact = redact.New(newc.RedactKey).Redact
+	}
+
+	sinks, upload := newSinks(dir, cmdName, earlyLogf)
+	c.Sinks = sinks
+	if hasJournalSink(sinks) && runningUnderSystemd() {
+		// journald would otherwise get every line twice, once
+		// natively and once from our stderr.
+		c.Stderr = ioutil.Discard
+	}
+
+	var filchErr error
+	if upload {
+		var filchBuf *filch.Filch
+		filchBuf, filchErr = filch.New(filepath.Join(dir, cmdName), filch.Options{
+			// TS_LOG_BUFFER_MAX_SIZE=0 disables the limit.
+			MaxSize: int64(logSettingInt("TS_LOG_BUFFER_MAX_SIZE", "LogBufferMaxSize", defaultLogBufferMaxSize)),
+		})
+		if filchBuf != nil {
+			c.Buffer = filchBuf
+		}
+	} else {
+		// Only log locally: nothing to buffer for upload.
+		c.NoUpload = true
 	}
 	lw := logtail.NewLogger(c, log.Printf)
 	log.SetFlags(0) // other logflags are set on console, not here
@@ -441,6 +487,9 @@ func New(collection string) *Policy {
 		goVersion(),
 		os.Args)
 	log.Printf("LogID: %v", newc.PublicID)
+	if noRedact {
+		log.Printf("logpolicy: log redaction disabled by TS_DEBUG_LOG_NO_REDACT")
+	}
 	if filchErr != nil {
 		log.Printf("filch failed: %v", filchErr)
 	}
@@ -451,6 +500,7 @@ func New(collection string) *Policy {
 	return &Policy{
 		Logtail:  lw,
 		PublicID: newc.PublicID,
+		sinks:    sinks,
 	}
 }
 
@@ -473,11 +523,17 @@ func (p *Policy) Close() {
 // Shutdown gracefully shuts down the logger, finishing any current
 // log upload if it can be done before ctx is canceled.
 func (p *Policy) Shutdown(ctx context.Context) error {
+	var err error
 	if p.Logtail != nil {
 		log.Printf("flushing log.")
-		return p.Logtail.Shutdown(ctx)
+		err = p.Logtail.Shutdown(ctx)
 	}
-	return nil
+	for _, s := range p.sinks {
+		if c, ok := s.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	return err
 }
 
 // newLogtailTransport returns the HTTP Transport we use for uploading
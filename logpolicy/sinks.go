@@ -0,0 +1,125 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logpolicy
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"tailscale.com/log/logsink"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/winutil"
+)
+
+const (
+	// defaultLogFileMaxSize is the default size at which the log file
+	// sink is rotated.
+	defaultLogFileMaxSize = 10 << 20
+
+	// defaultLogFileMaxFiles is the default number of rotated log
+	// files the log file sink keeps.
+	defaultLogFileMaxFiles = 5
+)
+
+// getLogSetting returns the value of the environment variable env or,
+// if it's unset on Windows, of the registry value regName.
+func getLogSetting(env, regName string) string {
+	if val, ok := os.LookupEnv(env); ok {
+		return val
+	}
+	if runtime.GOOS == "windows" {
+		return winutil.GetRegString(regName, "")
+	}
+	return ""
+}
+
+// newSinks returns the local log sinks selected by TS_LOG_SINKS (the
+// LogSinks registry value on Windows), and whether logs should be
+// uploaded to logtail. TS_LOG_SINKS is a comma-separated list of
+// "logtail" (the default if it's empty), "file", "syslog" and
+// "journal". The file sink writes JSON log entries to TS_LOG_FILE, or
+// cmdName.log.json in dir, and rotates it once it's
+// TS_LOG_FILE_MAX_SIZE bytes, keeping TS_LOG_FILE_MAX_FILES old ones.
+//
+// Sinks that can't be created are logged to logf and skipped. If that
+// leaves nowhere for logs to go, the file sink is used instead or, if
+// that can't be created either, logs are uploaded, so they're never
+// only written to stderr.
+func newSinks(dir, cmdName string, logf logger.Logf) (sinks []io.Writer, upload bool) {
+	val := getLogSetting("TS_LOG_SINKS", "LogSinks")
+	if val == "" {
+		return nil, true
+	}
+	for _, name := range strings.Split(val, ",") {
+		var sink io.Writer
+		var err error
+		switch name = strings.TrimSpace(name); name {
+		case "":
+			continue
+		case "logtail":
+			upload = true
+			continue
+		case "file":
+			sink, err = newFileSink(dir, cmdName)
+		case "syslog":
+			sink, err = logsink.NewSyslog(cmdName)
+		case "journal":
+			sink, err = logsink.NewJournal(cmdName)
+		default:
+			logf("logpolicy: unknown log sink %q", name)
+			continue
+		}
+		if err != nil {
+			logf("logpolicy: %s log sink: %v", name, err)
+			continue
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 0 && !upload {
+		sink, err := newFileSink(dir, cmdName)
+		if err != nil {
+			logf("logpolicy: no usable log sink in %q; uploading logs instead (file log sink: %v)", val, err)
+			return nil, true
+		}
+		logf("logpolicy: no usable log sink in %q; using file log sink instead", val)
+		sinks = append(sinks, sink)
+	}
+	return sinks, upload
+}
+
+// newFileSink returns the file log sink described by newSinks.
+func newFileSink(dir, cmdName string) (*logsink.File, error) {
+	path := getLogSetting("TS_LOG_FILE", "LogFile")
+	if path == "" {
+		path = filepath.Join(dir, cmdName+".log.json")
+	}
+	return logsink.NewFile(path,
+		int64(logSettingInt("TS_LOG_FILE_MAX_SIZE", "LogFileMaxSize", defaultLogFileMaxSize)),
+		logSettingInt("TS_LOG_FILE_MAX_FILES", "LogFileMaxFiles", defaultLogFileMaxFiles))
+}
+
+// logSettingInt returns the non-negative integer log setting named
+// env and regName (see getLogSetting), or def if it's unset or
+// invalid.
+func logSettingInt(env, regName string, def int) int {
+	if n, err := strconv.Atoi(getLogSetting(env, regName)); err == nil && n >= 0 {
+		return n
+	}
+	return def
+}
+
+// hasJournalSink reports whether sinks includes the systemd journal.
+func hasJournalSink(sinks []io.Writer) bool {
+	for _, s := range sinks {
+		if _, ok := s.(*logsink.Journal); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -9,6 +9,7 @@ package filch
 import (
 	"bufio"
 	"bytes"
+	"expvar"
 	"fmt"
 	"io"
 	"os"
@@ -17,8 +18,19 @@ import (
 
 var stderrFD = 2 // a variable for testing
 
+var (
+	metricDroppedLines = expvar.NewInt("counter_filch_dropped_lines")
+	metricDroppedBytes = expvar.NewInt("counter_filch_dropped_bytes")
+)
+
 type Options struct {
 	ReplaceStderr bool // dup over fd 2 so everything written to stderr comes here
+
+	// MaxSize, if non-zero, is the approximate maximum number of
+	// bytes of logs to buffer. Once the file being written to
+	// reaches half of it, the files are swapped, and whatever
+	// hadn't been read yet of the other, older file is dropped.
+	MaxSize int64
 }
 
 // A Filch uses two alternating files as a simplistic ring buffer.
@@ -29,7 +41,14 @@ type Filch struct {
 	cur       *os.File
 	alt       *os.File
 	altscan   *bufio.Scanner
+	altRead   int64 // bytes of alt returned by altscan
 	recovered int64
+	maxSize   int64
+
+	// droppedLines and droppedBytes are the logs dropped since
+	// TryReadLine last reported dropped logs.
+	droppedLines int64
+	droppedBytes int64
 }
 
 // TryReadline implements the logtail.Buffer interface.
@@ -37,34 +56,53 @@ func (f *Filch) TryReadLine() ([]byte, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	if f.droppedLines > 0 {
+		b := []byte(fmt.Sprintf("filch: %d lines dropped (%d bytes), over the buffer size limit\n", f.droppedLines, f.droppedBytes))
+		f.droppedLines, f.droppedBytes = 0, 0
+		return b, nil
+	}
+
 	if f.altscan != nil {
 		if b, err := f.scan(); b != nil || err != nil {
 			return b, err
 		}
 	}
 
+	if err := f.swapLocked(); err != nil {
+		return nil, err
+	}
+	return f.scan()
+}
+
+// swapLocked makes the file being written to the one to read from, and
+// the other, which must be empty, the one to write to.
+func (f *Filch) swapLocked() error {
 	f.cur, f.alt = f.alt, f.cur
 	if f.OrigStderr != nil {
 		if err := dup2Stderr(f.cur); err != nil {
-			return nil, err
+			return err
 		}
 	}
 	if _, err := f.alt.Seek(0, io.SeekStart); err != nil {
-		return nil, err
+		return err
 	}
 	f.altscan = bufio.NewScanner(f.alt)
 	f.altscan.Split(splitLines)
-	return f.scan()
+	f.altRead = 0
+	return nil
 }
 
 func (f *Filch) scan() ([]byte, error) {
 	if f.altscan.Scan() {
-		return f.altscan.Bytes(), nil
+		b := f.altscan.Bytes()
+		f.altRead += int64(len(b))
+		return b, nil
 	}
 	err := f.altscan.Err()
 	err2 := f.alt.Truncate(0)
 	_, err3 := f.alt.Seek(0, io.SeekStart)
 	f.altscan = nil
+	f.altRead = 0
 	if err != nil {
 		return nil, err
 	}
@@ -86,9 +124,69 @@ func (f *Filch) Write(b []byte) (int, error) {
 		bnl := make([]byte, len(b)+1)
 		copy(bnl, b)
 		bnl[len(bnl)-1] = '\n'
-		return f.cur.Write(bnl)
+		b = bnl
+	}
+	n, err := f.cur.Write(b)
+	if err != nil || f.maxSize <= 0 {
+		return n, err
+	}
+	return n, f.rotateIfFullLocked()
+}
+
+// rotateIfFullLocked swaps the files if the one being written to has
+// reached half of the maximum size, first dropping whatever is left to
+// read of the other one.
+func (f *Filch) rotateIfFullLocked() error {
+	fi, err := f.cur.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < f.maxSize/2 {
+		return nil
+	}
+	if f.altscan != nil {
+		// Count the lines left without advancing altscan, as the
+		// last line it returned may still be in use.
+		afi, err := f.alt.Stat()
+		if err != nil {
+			return err
+		}
+		if left := afi.Size() - f.altRead; left > 0 {
+			lines, err := countLines(io.NewSectionReader(f.alt, f.altRead, left))
+			if err != nil {
+				return err
+			}
+			f.noteDropped(lines, left)
+		}
 	}
-	return f.cur.Write(b)
+	if err := f.alt.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.alt.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return f.swapLocked()
+}
+
+// skipLocked drops lines from the start of what's left to read until
+// at least n bytes have been dropped. It must only be used before the
+// Filch is returned by New, as it invalidates the last line returned
+// by TryReadLine.
+func (f *Filch) skipLocked(n int64) {
+	var lines, dropped int64
+	for dropped < n && f.altscan.Scan() {
+		lines++
+		dropped += int64(len(f.altscan.Bytes()))
+	}
+	f.altRead += dropped
+	f.noteDropped(lines, dropped)
+}
+
+func (f *Filch) noteDropped(lines, n int64) {
+	f.droppedLines += lines
+	f.droppedBytes += n
+	metricDroppedLines.Add(lines)
+	metricDroppedBytes.Add(n)
 }
 
 // Close closes the Filch, releasing all os resources.
@@ -151,6 +249,7 @@ func New(filePrefix string, opts Options) (f *Filch, err error) {
 
 	f = &Filch{
 		OrigStderr: os.Stderr, // temporary, for past logs recovery
+		maxSize:    opts.MaxSize,
 	}
 
 	// Neither, either, or both files may exist and contain logs from
@@ -189,6 +288,17 @@ func New(filePrefix string, opts Options) (f *Filch, err error) {
 	if f.recovered > 0 {
 		f.altscan = bufio.NewScanner(f.alt)
 		f.altscan.Split(splitLines)
+		if f.maxSize > 0 {
+			// Logs from before there was a limit, or from before
+			// it was lowered, can be over it.
+			fi, err := f.alt.Stat()
+			if err != nil {
+				return nil, err
+			}
+			if over := fi.Size() - f.maxSize/2; over > 0 {
+				f.skipLocked(over)
+			}
+		}
 	}
 
 	f.OrigStderr = nil
@@ -229,6 +339,31 @@ func moveContents(dst, src *os.File) (err error) {
 	return nil
 }
 
+// countLines returns the number of lines read from r, including a
+// final line without a newline.
+func countLines(r io.Reader) (int64, error) {
+	var lines int64
+	last := byte('\n')
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			lines += int64(bytes.Count(buf[:n], []byte{'\n'}))
+			last = buf[n-1]
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if last != '\n' {
+		lines++
+	}
+	return lines, nil
+}
+
 func splitLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	if atEOF && len(data) == 0 {
 		return 0, nil, nil
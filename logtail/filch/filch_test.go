@@ -128,6 +128,63 @@ func TestRecover(t *testing.T) {
 	})
 }
 
+func TestMaxSize(t *testing.T) {
+	line := func(i int) string { return fmt.Sprintf("line-%05d", i) } // 11 bytes with newline
+	droppedBytes := metricDroppedBytes.Value()
+
+	t.Run("write", func(t *testing.T) {
+		filePrefix := t.TempDir()
+		f := newFilchTest(t, filePrefix, Options{MaxSize: 100})
+		for i := 1; i <= 5; i++ {
+			f.write(t, line(i))
+		}
+		// The files were swapped, but nothing was read yet, so
+		// the next swap drops lines 1-5.
+		for i := 6; i <= 10; i++ {
+			f.write(t, line(i))
+		}
+		f.read(t, "filch: 5 lines dropped (55 bytes), over the buffer size limit")
+		for i := 6; i <= 10; i++ {
+			f.read(t, line(i))
+		}
+		f.readEOF(t)
+
+		// Partially read lines are dropped from where reading
+		// stopped.
+		for i := 11; i <= 15; i++ {
+			f.write(t, line(i))
+		}
+		f.read(t, line(11))
+		for i := 16; i <= 20; i++ {
+			f.write(t, line(i))
+		}
+		f.read(t, "filch: 4 lines dropped (44 bytes), over the buffer size limit")
+		f.read(t, line(16))
+		f.close(t)
+	})
+
+	t.Run("recover", func(t *testing.T) {
+		filePrefix := t.TempDir()
+		f := newFilchTest(t, filePrefix, Options{})
+		for i := 1; i <= 10; i++ {
+			f.write(t, line(i))
+		}
+		f.close(t)
+
+		// Only the newest half of the new limit is kept.
+		f = newFilchTest(t, filePrefix, Options{MaxSize: 50})
+		f.read(t, "filch: 8 lines dropped (88 bytes), over the buffer size limit")
+		f.read(t, line(9))
+		f.read(t, line(10))
+		f.readEOF(t)
+		f.close(t)
+	})
+
+	if got, want := metricDroppedBytes.Value()-droppedBytes, int64(55+44+88); got != want {
+		t.Errorf("dropped bytes metric = %d; want %d", got, want)
+	}
+}
+
 func TestFilchStderr(t *testing.T) {
 	if runtime.GOOS == "windows" {
 		// TODO(bradfitz): this is broken on Windows but not
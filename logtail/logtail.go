@@ -45,10 +45,18 @@ type Config struct {
 	StderrLevel    int              // max verbosity level to write to stderr; 0 means the non-verbose messages only
 	Buffer         Buffer           // temp storage, if nil a MemoryBuffer
 	NewZstdEncoder func() Encoder   // if set, used to compress logs for transmission
+	Sinks          []io.Writer      // if set, each log entry, a line of JSON, is also written to these
+	NoUpload       bool             // if true, logs are only written to Stderr and Sinks, not uploaded
 
 	// DrainLogs, if non-nil, disables automatic uploading of new logs,
 	// so that logs are only uploaded when a token is sent to DrainLogs.
 	DrainLogs <-chan struct{}
+
+	// Redact, if non-nil, is applied to the text or JSON of each log
+	// entry that's uploaded, before it's encoded, to hide private
+	// data. It must return valid JSON for valid JSON. Logs written to
+	// Stderr and Sinks, which stay on the machine, aren't redacted.
+	Redact func([]byte) []byte
 }
 
 func NewLogger(cfg Config, logf tslogger.Logf) *Logger {
@@ -82,6 +90,9 @@ func NewLogger(cfg Config, logf tslogger.Logf) *Logger {
 		sent:           make(chan struct{}, 1),
 		sentinel:       make(chan int32, 16),
 		drainLogs:      cfg.DrainLogs,
+		sinks:          cfg.Sinks,
+		noUpload:       cfg.NoUpload,
+		redact:         cfg.Redact,
 		timeNow:        cfg.TimeNow,
 		bo:             backoff.NewBackoff("logtail", logf, 30*time.Second),
 
@@ -95,7 +106,11 @@ func NewLogger(cfg Config, logf tslogger.Logf) *Logger {
 	ctx, cancel := context.WithCancel(context.Background())
 	l.uploadCancel = cancel
 
-	go l.uploading(ctx)
+	if l.noUpload {
+		close(l.shutdownDone)
+	} else {
+		go l.uploading(ctx)
+	}
 	l.Write([]byte("logtail started"))
 	return l
 }
@@ -113,6 +128,9 @@ type Logger struct {
 	buffer         Buffer
 	sent           chan struct{}   // signal to speed up drain
 	drainLogs      <-chan struct{} // if non-nil, external signal to attempt a drain
+	sinks          []io.Writer
+	noUpload       bool
+	redact         func([]byte) []byte
 	sentinel       chan int32
 	timeNow        func() time.Time
 	bo             *backoff.Backoff
@@ -230,6 +248,9 @@ func (l *Logger) drainPending() (res []byte) {
 			// outside of the logtail logger. Encode it.
 			// Do not add a client time, as it could have been
 			// been written a long time ago.
+			if l.redact != nil {
+				b = l.redact(b)
+			}
 			b = l.encodeText(b, true)
 		}
 
@@ -523,7 +544,24 @@ func (l *Logger) Write(buf []byte) (int, error) {
 			l.stderr.Write(withNL)
 		}
 	}
-	b := l.encode(buf)
+	var b []byte
+	if len(l.sinks) > 0 {
+		b = l.encode(buf)
+		for _, s := range l.sinks {
+			// There's nowhere better to report a failing sink.
+			s.Write(b)
+		}
+	}
+	if l.noUpload {
+		return len(buf), nil
+	}
+	if l.redact != nil {
+		// Only what's uploaded is redacted, so that local logs
+		// stay useful for debugging on the machine itself.
+		b = l.encode(l.redact(buf))
+	} else if b == nil {
+		b = l.encode(buf)
+	}
 	_, err := l.send(b)
 	return len(buf), err
 }
@@ -5,6 +5,7 @@
 package logtail
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"io"
@@ -253,6 +254,40 @@ func TestLoggerWriteLength(t *testing.T) {
 	}
 }
 
+func TestLoggerRedact(t *testing.T) {
+	var local bytes.Buffer
+	lg := &Logger{
+		stderr:         ioutil.Discard,
+		timeNow:        time.Now,
+		skipClientTime: true,
+		buffer:         NewMemoryBuffer(10),
+		sinks:          []io.Writer{&local},
+		redact: func(b []byte) []byte {
+			return []byte(strings.ReplaceAll(string(b), "secret", "xxx"))
+		},
+	}
+	tests := []struct {
+		in, wantLocal, wantUpload string
+	}{
+		{"a secret\n", `{"text": "a secret\n"}` + "\n", `{"text": "a xxx\n"}` + "\n"},
+		{`{"text": "a secret", "secret": 1}`, `{"secret":1,"text":"a secret"}` + "\n", `{"text":"a xxx","xxx":1}` + "\n"},
+	}
+	for _, tt := range tests {
+		local.Reset()
+		lg.Write([]byte(tt.in))
+		if got := local.String(); got != tt.wantLocal {
+			t.Errorf("Write(%q) to sink = %q; want %q", tt.in, got, tt.wantLocal)
+		}
+		got, err := lg.buffer.TryReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.wantUpload {
+			t.Errorf("Write(%q) for upload = %q; want %q", tt.in, got, tt.wantUpload)
+		}
+	}
+}
+
 func TestParseAndRemoveLogLevel(t *testing.T) {
 	tests := []struct {
 		log       string
@@ -0,0 +1,244 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are Histogram bucket upper bounds suitable for
+// latencies measured in seconds, from 1ms to 10s.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// ExponentialBuckets returns n Histogram bucket upper bounds, the
+// first of which is start and each following one factor times the
+// previous one.
+func ExponentialBuckets(start, factor float64, n int) []float64 {
+	if start <= 0 || factor <= 1 || n < 1 {
+		panic("metrics: invalid ExponentialBuckets arguments")
+	}
+	ret := make([]float64, n)
+	for i := range ret {
+		ret[i] = start
+		start *= factor
+	}
+	return ret
+}
+
+// Histogram is a distribution of observed values, counted in buckets
+// by the values' upper bounds. It satisfies the expvar.Var interface.
+//
+// Semantically, this is mapped by tsweb's Prometheus exporter as a
+// Prometheus histogram: a cumulative count of the values in each
+// bucket, plus their sum and count.
+type Histogram struct {
+	// Help, if non-empty, describes the histogram.
+	Help string
+
+	buckets []float64 // upper bounds, ascending; +Inf is implicit
+
+	mu     sync.Mutex
+	counts []uint64 // values in each bucket (not cumulative), then in +Inf
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram returns a Histogram with the given bucket upper bounds,
+// which must be in ascending order. A final bucket for all larger
+// values is added implicitly.
+func NewHistogram(buckets []float64) *Histogram {
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			panic("metrics: Histogram buckets not in ascending order")
+		}
+	}
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+// Observe adds v to the histogram.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v) // first upper bound >= v
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.initLocked()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// histogramSnapshot is the state of a Histogram at some point.
+type histogramSnapshot struct {
+	Buckets    []float64 `json:"buckets"`
+	Cumulative []uint64  `json:"cumulative"` // per bucket, then +Inf
+	Sum        float64   `json:"sum"`
+	Count      uint64    `json:"count"`
+}
+
+// initLocked makes a zero Histogram usable, as one with only the
+// implicit +Inf bucket.
+func (h *Histogram) initLocked() {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(h.buckets)+1)
+	}
+}
+
+func (h *Histogram) snapshot() histogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.initLocked()
+	s := histogramSnapshot{
+		Buckets:    h.buckets,
+		Cumulative: make([]uint64, len(h.counts)),
+		Sum:        h.sum,
+		Count:      h.count,
+	}
+	var n uint64
+	for i, c := range h.counts {
+		n += c
+		s.Cumulative[i] = n
+	}
+	return s
+}
+
+// String returns the histogram as JSON, for expvar.
+func (h *Histogram) String() string {
+	s := h.snapshot()
+	if math.IsInf(s.Sum, 0) || math.IsNaN(s.Sum) {
+		s.Sum = 0 // not representable in JSON
+	}
+	j, _ := json.Marshal(s)
+	return string(j)
+}
+
+// LabelVec is like LabelMap, but with any number of labels. It's a set
+// of *expvar.Int, one for each combination of label values used. It
+// satisfies the expvar.Var interface.
+//
+// Semantically, this is mapped by tsweb's Prometheus exporter as a
+// collection of variables with the same name, each with its own
+// values for the labels.
+type LabelVec struct {
+	// Labels are the names of the labels.
+	Labels []string
+	// Help, if non-empty, describes the variables.
+	Help string
+
+	vec
+}
+
+// Get returns a direct pointer to the expvar.Int for the label values,
+// which must be given in the order of v.Labels, creating it if
+// necessary.
+func (v *LabelVec) Get(values ...string) *expvar.Int {
+	return v.get(v.Labels, values, func() expvar.Var { return new(expvar.Int) }).(*expvar.Int)
+}
+
+// HistogramVec is a set of Histograms with the same buckets, one for
+// each combination of label values used. It satisfies the expvar.Var
+// interface.
+type HistogramVec struct {
+	// Labels are the names of the labels.
+	Labels []string
+	// Buckets are the histograms' bucket upper bounds, as for
+	// NewHistogram. If nil, DefaultBuckets are used.
+	Buckets []float64
+	// Help, if non-empty, describes the histograms.
+	Help string
+
+	vec
+}
+
+// Get returns the Histogram for the label values, which must be given
+// in the order of v.Labels, creating it if necessary.
+func (v *HistogramVec) Get(values ...string) *Histogram {
+	return v.get(v.Labels, values, func() expvar.Var {
+		b := v.Buckets
+		if b == nil {
+			b = DefaultBuckets
+		}
+		return NewHistogram(b)
+	}).(*Histogram)
+}
+
+// vec is the storage of LabelVec and HistogramVec.
+type vec struct {
+	mu sync.Mutex
+	m  map[string]*vecEntry // by label values joined with vecSep
+}
+
+// vecSep separates label values in vec keys. It can't appear in
+// valid UTF-8 label values.
+const vecSep = "\xff"
+
+type vecEntry struct {
+	values []string
+	v      expvar.Var
+}
+
+func (v *vec) get(labels, values []string, newVar func() expvar.Var) expvar.Var {
+	if len(values) != len(labels) {
+		panic(fmt.Sprintf("metrics: got %d label values for %d labels", len(values), len(labels)))
+	}
+	k := strings.Join(values, vecSep)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if e, ok := v.m[k]; ok {
+		return e.v
+	}
+	if v.m == nil {
+		v.m = map[string]*vecEntry{}
+	}
+	e := &vecEntry{values: append([]string(nil), values...), v: newVar()}
+	v.m[k] = e
+	return e.v
+}
+
+// do calls f for each set of label values and its variable, ordered
+// by the label values.
+func (v *vec) do(f func(values []string, v expvar.Var)) {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.m))
+	for k := range v.m {
+		keys = append(keys, k)
+	}
+	entries := make([]*vecEntry, 0, len(keys))
+	sort.Strings(keys)
+	for _, k := range keys {
+		entries = append(entries, v.m[k])
+	}
+	v.mu.Unlock()
+	for _, e := range entries {
+		f(e.values, e.v)
+	}
+}
+
+// String returns the variables as a JSON object keyed by their
+// comma-separated label values, for expvar.
+func (v *vec) String() string {
+	var b strings.Builder
+	b.WriteString("{")
+	first := true
+	v.do(func(values []string, v expvar.Var) {
+		if !first {
+			b.WriteString(",")
+		}
+		first = false
+		k, _ := json.Marshal(strings.Join(values, ","))
+		b.Write(k)
+		b.WriteString(":")
+		b.WriteString(v.String())
+	})
+	b.WriteString("}")
+	return b.String()
+}
@@ -29,8 +29,12 @@ type Set struct {
 // collection of variables with the same name, with a varying label
 // value. Use this to export things that are intuitively breakdowns
 // into different buckets.
+//
+// See LabelVec for breakdowns by more than one label.
 type LabelMap struct {
 	Label string
+	// Help, if non-empty, describes the variables.
+	Help string
 	expvar.Map
 }
 
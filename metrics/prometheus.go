@@ -0,0 +1,227 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// WritePrometheus writes the process's expvar values to w in the
+// Prometheus text exposition format. See tsweb.VarzHandler for how
+// they're mapped to Prometheus types.
+func WritePrometheus(w io.Writer) {
+	var dump func(prefix string, kv expvar.KeyValue)
+	dump = func(prefix string, kv expvar.KeyValue) {
+		name := prefix + kv.Key
+
+		var typ string
+		switch {
+		case strings.HasPrefix(kv.Key, "gauge_"):
+			typ = "gauge"
+			name = prefix + strings.TrimPrefix(kv.Key, "gauge_")
+
+		case strings.HasPrefix(kv.Key, "counter_"):
+			typ = "counter"
+			name = prefix + strings.TrimPrefix(kv.Key, "counter_")
+		}
+
+		switch v := kv.Value.(type) {
+		case *expvar.Int:
+			if typ == "" {
+				typ = "counter"
+			}
+			fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", name, typ, name, v.Value())
+			return
+		case *Set:
+			v.Do(func(kv expvar.KeyValue) {
+				dump(name+"_", kv)
+			})
+			return
+		case *Histogram:
+			writeHeader(w, name, "histogram", v.Help)
+			writeHistogram(w, name, nil, v)
+			return
+		case *HistogramVec:
+			writeHeader(w, name, "histogram", v.Help)
+			v.do(func(values []string, h expvar.Var) {
+				writeHistogram(w, name, vecLabels(v.Labels, values), h.(*Histogram))
+			})
+			return
+		case *LabelVec:
+			if typ == "" {
+				typ = "counter"
+			}
+			writeHeader(w, name, typ, v.Help)
+			v.do(func(values []string, n expvar.Var) {
+				io.WriteString(w, name)
+				writeLabels(w, vecLabels(v.Labels, values))
+				fmt.Fprintf(w, " %v\n", n.(*expvar.Int).Value())
+			})
+			return
+		}
+
+		if typ == "" {
+			var funcRet string
+			if f, ok := kv.Value.(expvar.Func); ok {
+				v := f()
+				if ms, ok := v.(runtime.MemStats); ok && name == "memstats" {
+					writeMemstats(w, &ms)
+					return
+				}
+				funcRet = fmt.Sprintf(" returning %T", v)
+			}
+			fmt.Fprintf(w, "# skipping expvar %q (Go type %T%s) with undeclared Prometheus type\n", name, kv.Value, funcRet)
+			return
+		}
+
+		switch v := kv.Value.(type) {
+		case expvar.Func:
+			val := v()
+			switch val.(type) {
+			case int64, int:
+				fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", name, typ, name, val)
+			default:
+				fmt.Fprintf(w, "# skipping expvar func %q returning unknown type %T\n", name, val)
+			}
+
+		case *LabelMap:
+			writeHeader(w, name, typ, v.Help)
+			// IntMap uses expvar.Map on the inside, which presorts
+			// keys. The output ordering is deterministic.
+			v.Do(func(kv expvar.KeyValue) {
+				io.WriteString(w, name)
+				writeLabels(w, []Label{{v.Label, kv.Key}})
+				fmt.Fprintf(w, " %v\n", kv.Value)
+			})
+		}
+	}
+	expvar.Do(func(kv expvar.KeyValue) {
+		dump("", kv)
+	})
+}
+
+func writeMemstats(w io.Writer, ms *runtime.MemStats) {
+	out := func(name, typ string, v uint64, help string) {
+		if help != "" {
+			fmt.Fprintf(w, "# HELP memstats_%s %s\n", name, help)
+		}
+		fmt.Fprintf(w, "# TYPE memstats_%s %s\nmemstats_%s %v\n", name, typ, name, v)
+	}
+	g := func(name string, v uint64, help string) { out(name, "gauge", v, help) }
+	c := func(name string, v uint64, help string) { out(name, "counter", v, help) }
+	g("heap_alloc", ms.HeapAlloc, "current bytes of allocated heap objects (up/down smoothly)")
+	c("total_alloc", ms.TotalAlloc, "cumulative bytes allocated for heap objects")
+	g("sys", ms.Sys, "total bytes of memory obtained from the OS")
+	c("mallocs", ms.Mallocs, "cumulative count of heap objects allocated")
+	c("frees", ms.Frees, "cumulative count of heap objects freed")
+	c("num_gc", uint64(ms.NumGC), "number of completed GC cycles")
+}
+
+// Label is a Prometheus label name and value.
+type Label struct {
+	Name, Value string
+}
+
+// Sample is one value of a metric, distinguished from the metric's
+// other values by its labels.
+type Sample struct {
+	Labels []Label
+	Value  float64
+}
+
+// WriteFamily writes the metric name, of Prometheus type typ
+// ("counter" or "gauge"), to w in the Prometheus text exposition
+// format, with help as its description. Nothing is written if there
+// are no samples.
+func WriteFamily(w io.Writer, name, typ, help string, samples []Sample) {
+	if len(samples) == 0 {
+		return
+	}
+	writeHeader(w, name, typ, help)
+	for _, s := range samples {
+		io.WriteString(w, name)
+		writeLabels(w, s.Labels)
+		fmt.Fprintf(w, " %s\n", formatValue(s.Value))
+	}
+}
+
+// writeHeader writes the HELP, if non-empty, and TYPE lines of a
+// metric.
+func writeHeader(w io.Writer, name, typ, help string) {
+	if help != "" {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, helpEscaper.Replace(help))
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// writeHistogram writes the samples of the histogram h, whose metric
+// is name, with labels.
+func writeHistogram(w io.Writer, name string, labels []Label, h *Histogram) {
+	s := h.snapshot()
+	bucketLabels := append(labels[:len(labels):len(labels)], Label{Name: "le"})
+	for i, n := range s.Cumulative {
+		le := "+Inf"
+		if i < len(s.Buckets) {
+			le = formatValue(s.Buckets[i])
+		}
+		bucketLabels[len(labels)].Value = le
+		io.WriteString(w, name+"_bucket")
+		writeLabels(w, bucketLabels)
+		fmt.Fprintf(w, " %d\n", n)
+	}
+	io.WriteString(w, name+"_sum")
+	writeLabels(w, labels)
+	fmt.Fprintf(w, " %s\n", formatValue(s.Sum))
+	io.WriteString(w, name+"_count")
+	writeLabels(w, labels)
+	fmt.Fprintf(w, " %d\n", s.Count)
+}
+
+// vecLabels pairs the label names of a LabelVec or HistogramVec with
+// values.
+func vecLabels(names, values []string) []Label {
+	ret := make([]Label, len(names))
+	for i, n := range names {
+		ret[i] = Label{n, values[i]}
+	}
+	return ret
+}
+
+// formatValue formats v, without an exponent if it's an integer that
+// a float64 represents exactly, like counts of bytes.
+func formatValue(v float64) string {
+	if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+		return strconv.FormatInt(int64(v), 10)
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeLabels(w io.Writer, labels []Label) {
+	if len(labels) == 0 {
+		return
+	}
+	io.WriteString(w, "{")
+	for i, l := range labels {
+		if i > 0 {
+			io.WriteString(w, ",")
+		}
+		fmt.Fprintf(w, "%s=\"%s\"", l.Name, labelValueEscaper.Replace(l.Value))
+	}
+	io.WriteString(w, "}")
+}
+
+// labelValueEscaper escapes label values as the text exposition
+// format requires, which isn't quite how Go quotes strings.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// helpEscaper escapes HELP text as the text exposition format
+// requires.
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
@@ -0,0 +1,102 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"expvar"
+	"strings"
+	"testing"
+)
+
+func TestWriteFamily(t *testing.T) {
+	var buf strings.Builder
+	WriteFamily(&buf, "empty", "gauge", "Not written.", nil)
+	WriteFamily(&buf, "peer_rx_bytes", "counter", "Bytes received.", []Sample{
+		{Labels: []Label{{"node", "n1"}, {"name", `a"b\c`}}, Value: 1 << 40},
+		{Labels: []Label{{"node", "n2"}, {"name", "line\nbreak"}}, Value: 0.5},
+	})
+	WriteFamily(&buf, "up", "gauge", "", []Sample{{Value: 1}})
+	got := buf.String()
+	want := `# HELP peer_rx_bytes Bytes received.
+# TYPE peer_rx_bytes counter
+peer_rx_bytes{node="n1",name="a\"b\\c"} 1099511627776
+peer_rx_bytes{node="n2",name="line\nbreak"} 0.5
+# TYPE up gauge
+up 1
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestWritePrometheusLabelMap(t *testing.T) {
+	m := &LabelMap{Label: "reason"}
+	m.Get("no rules matched").Add(2)
+	m.Get("multicast").Add(1)
+	expvar.Publish("counter_test_drops", m)
+
+	var buf strings.Builder
+	WritePrometheus(&buf)
+	want := `# TYPE test_drops counter
+test_drops{reason="multicast"} 1
+test_drops{reason="no rules matched"} 2
+`
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("output doesn't contain:\n%s\ngot:\n%s", want, buf.String())
+	}
+}
+
+func TestWritePrometheusHistogram(t *testing.T) {
+	v := &HistogramVec{
+		Labels:  []string{"queue"},
+		Buckets: []float64{0.1, 1},
+		Help:    "Time queued.",
+	}
+	h := v.Get("data")
+	for _, d := range []float64{0.05, 0.1, 0.5, 3} {
+		h.Observe(d)
+	}
+	v.Get("disco").Observe(0.01)
+	lv := &LabelVec{Labels: []string{"kind", "reason"}}
+	lv.Get("disco", "gone").Add(3)
+	set := new(Set)
+	set.Set("queue_seconds", v)
+	set.Set("counter_drops", lv)
+	expvar.Publish("test_hist", set)
+
+	var buf strings.Builder
+	WritePrometheus(&buf)
+	want := `# TYPE test_hist_drops counter
+test_hist_drops{kind="disco",reason="gone"} 3
+# HELP test_hist_queue_seconds Time queued.
+# TYPE test_hist_queue_seconds histogram
+test_hist_queue_seconds_bucket{queue="data",le="0.1"} 2
+test_hist_queue_seconds_bucket{queue="data",le="1"} 3
+test_hist_queue_seconds_bucket{queue="data",le="+Inf"} 4
+test_hist_queue_seconds_sum{queue="data"} 3.65
+test_hist_queue_seconds_count{queue="data"} 4
+test_hist_queue_seconds_bucket{queue="disco",le="0.1"} 1
+test_hist_queue_seconds_bucket{queue="disco",le="1"} 1
+test_hist_queue_seconds_bucket{queue="disco",le="+Inf"} 1
+test_hist_queue_seconds_sum{queue="disco"} 0.01
+test_hist_queue_seconds_count{queue="disco"} 1
+`
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("output doesn't contain:\n%s\ngot:\n%s", want, buf.String())
+	}
+}
+
+func TestExponentialBuckets(t *testing.T) {
+	got := ExponentialBuckets(1, 2, 4)
+	want := []float64{1, 2, 4, 8}
+	if len(got) != len(want) {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got %v; want %v", got, want)
+		}
+	}
+}
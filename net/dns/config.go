@@ -36,6 +36,12 @@ type Config struct {
 	// it to resolve, you also need to add appropriate routes to
 	// Routes.
 	Hosts map[dnsname.FQDN][]netaddr.IP
+	// WatchDomains are DNS suffixes whose forwarded A and AAAA
+	// answers are reported to the Manager's answer watcher (see
+	// Manager.SetAnswerWatcher). Setting any forces queries through
+	// quad-100 when there are DefaultResolvers, so the answers can be
+	// seen.
+	WatchDomains []dnsname.FQDN
 }
 
 // needsAnyResolvers reports whether c requires a resolver to be set
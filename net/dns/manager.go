@@ -77,6 +77,7 @@ func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig
 	// authoritative suffixes, even if we don't propagate MagicDNS to
 	// the OS.
 	rcfg.Hosts = cfg.Hosts
+	rcfg.WatchDomains = cfg.WatchDomains
 	routes := map[dnsname.FQDN][]netaddr.IPPort{} // assigned conditionally to rcfg.Routes below.
 	for suffix, resolvers := range cfg.Routes {
 		if len(resolvers) == 0 {
@@ -95,7 +96,7 @@ func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig
 		// case where cfg is entirely zero, in which case these
 		// configs clear all Tailscale DNS settings.
 		return rcfg, ocfg, nil
-	case cfg.hasDefaultResolversOnly():
+	case cfg.hasDefaultResolversOnly() && len(cfg.WatchDomains) == 0:
 		// Trivial CorpDNS configuration, just override the OS
 		// resolver.
 		ocfg.Nameservers = toIPsOnly(cfg.DefaultResolvers)
@@ -182,6 +183,15 @@ func toIPPorts(ips []netaddr.IP) (ret []netaddr.IPPort) {
 	return ret
 }
 
+// SetAnswerWatcher sets the func to call with the addresses in
+// forwarded answers for names within Config.WatchDomains. It's called
+// before the answer is returned to the client, so it may block briefly
+// to act on the answer first, but no longer than a client would wait.
+// A nil fn removes the watcher.
+func (m *Manager) SetAnswerWatcher(fn func(name dnsname.FQDN, ips []netaddr.IP)) {
+	m.resolver.SetAnswerWatcher(fn)
+}
+
 func (m *Manager) EnqueueRequest(bs []byte, from netaddr.IPPort) error {
 	return m.resolver.EnqueueRequest(bs, from)
 }
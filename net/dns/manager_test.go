@@ -113,6 +113,22 @@ func TestManager(t *testing.T) {
 				SearchDomains: fqdns("tailscale.com", "universe.tf"),
 			},
 		},
+		{
+			name: "corp-watch",
+			in: Config{
+				DefaultResolvers: mustIPPs("1.1.1.1:53", "9.9.9.9:53"),
+				SearchDomains:    fqdns("tailscale.com", "universe.tf"),
+				WatchDomains:     fqdns("zoom.us"),
+			},
+			os: OSConfig{
+				Nameservers:   mustIPs("100.100.100.100"),
+				SearchDomains: fqdns("tailscale.com", "universe.tf"),
+			},
+			rs: resolver.Config{
+				Routes:       upstreams(".", "1.1.1.1:53", "9.9.9.9:53"),
+				WatchDomains: fqdns("zoom.us."),
+			},
+		},
 		{
 			name: "corp-magic",
 			in: Config{
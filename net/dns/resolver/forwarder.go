@@ -161,6 +161,10 @@ type forwarder struct {
 	// routes are per-suffix resolvers to use, with
 	// the most specific routes first.
 	routes []route
+	// watchDomains are the suffixes whose answers are passed to
+	// answerWatcher, if non-nil.
+	watchDomains  []dnsname.FQDN
+	answerWatcher func(dnsname.FQDN, []netaddr.IP)
 }
 
 func init() {
@@ -189,6 +193,34 @@ func (f *forwarder) setRoutes(routes []route) {
 	f.routes = routes
 }
 
+func (f *forwarder) setWatchDomains(domains []dnsname.FQDN) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.watchDomains = domains
+}
+
+func (f *forwarder) setAnswerWatcher(fn func(dnsname.FQDN, []netaddr.IP)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.answerWatcher = fn
+}
+
+// watcherFor returns the answer watcher to notify about answers for
+// domain, or nil if domain isn't watched.
+func (f *forwarder) watcherFor(domain dnsname.FQDN) func(dnsname.FQDN, []netaddr.IP) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.answerWatcher == nil {
+		return nil
+	}
+	for _, suffix := range f.watchDomains {
+		if suffix.Contains(domain) {
+			return f.answerWatcher
+		}
+	}
+	return nil
+}
+
 var stdNetPacketListener packetListener = new(net.ListenConfig)
 
 type packetListener interface {
@@ -349,6 +381,11 @@ func (f *forwarder) forward(query packet) error {
 
 	select {
 	case v := <-resc:
+		if watcher := f.watcherFor(domain); watcher != nil {
+			if ips := answerIPs(v); len(ips) > 0 {
+				watcher(domain, ips)
+			}
+		}
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
@@ -388,6 +425,43 @@ func nameFromQuery(bs []byte) (dnsname.FQDN, error) {
 	return dnsname.ToFQDN(rawNameToLower(n))
 }
 
+// answerIPs returns the addresses in the A and AAAA records of the
+// answer section of the DNS response bs.
+func answerIPs(bs []byte) (ips []netaddr.IP) {
+	var parser dns.Parser
+	hdr, err := parser.Start(bs)
+	if err != nil || !hdr.Response || hdr.RCode != dns.RCodeSuccess {
+		return nil
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil
+	}
+	for {
+		h, err := parser.AnswerHeader()
+		if err != nil {
+			return ips
+		}
+		switch h.Type {
+		case dns.TypeA:
+			r, err := parser.AResource()
+			if err != nil {
+				return ips
+			}
+			ips = append(ips, netaddr.IPv4(r.A[0], r.A[1], r.A[2], r.A[3]))
+		case dns.TypeAAAA:
+			r, err := parser.AAAAResource()
+			if err != nil {
+				return ips
+			}
+			ips = append(ips, netaddr.IPFrom16(r.AAAA))
+		default:
+			if err := parser.SkipAnswer(); err != nil {
+				return ips
+			}
+		}
+	}
+}
+
 // closePool is a dynamic set of io.Closers to close as a group.
 // It's intended to be Closed at most once.
 //
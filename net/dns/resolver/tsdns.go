@@ -9,6 +9,7 @@ package resolver
 import (
 	"encoding/hex"
 	"errors"
+	"expvar"
 	"runtime"
 	"sort"
 	"strings"
@@ -18,6 +19,7 @@ import (
 
 	dns "golang.org/x/net/dns/dnsmessage"
 	"inet.af/netaddr"
+	"tailscale.com/metrics"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/dnsname"
 	"tailscale.com/wgengine/monitor"
@@ -55,6 +57,16 @@ var (
 	errNotOurName = errors.New("not a Tailscale DNS name")
 )
 
+// queryCounts counts the DNS queries handled by all Resolvers, by
+// what became of them: "local" if answered by the resolver, "forwarded"
+// if forwarded upstream, "error" if neither worked, or "dropped" if
+// the request queue was full.
+var queryCounts = &metrics.LabelMap{Label: "result"}
+
+func init() {
+	expvar.Publish("counter_tailscaled_dns_queries", queryCounts)
+}
+
 type packet struct {
 	bs   []byte
 	addr netaddr.IPPort // src for a request, dst for a response
@@ -77,6 +89,9 @@ type Config struct {
 	// LocalDomains is a list of DNS name suffixes that should not be
 	// routed to upstream resolvers.
 	LocalDomains []dnsname.FQDN
+	// WatchDomains are DNS suffixes whose forwarded A and AAAA
+	// answers are reported to the func set by SetAnswerWatcher.
+	WatchDomains []dnsname.FQDN
 }
 
 // Resolver is a DNS resolver for nodes on the Tailscale network,
@@ -159,6 +174,7 @@ func (r *Resolver) SetConfig(cfg Config) error {
 	})
 
 	r.forwarder.setRoutes(routes)
+	r.forwarder.setWatchDomains(cfg.WatchDomains)
 
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -168,6 +184,14 @@ func (r *Resolver) SetConfig(cfg Config) error {
 	return nil
 }
 
+// SetAnswerWatcher sets the func to call with the addresses in
+// forwarded answers for names within Config.WatchDomains. The answer
+// is held until fn returns, so it may block briefly to act on the
+// answer before the client can. A nil fn removes the watcher.
+func (r *Resolver) SetAnswerWatcher(fn func(name dnsname.FQDN, ips []netaddr.IP)) {
+	r.forwarder.setAnswerWatcher(fn)
+}
+
 // Close shuts down the resolver and ensures poll goroutines have exited.
 // The Resolver cannot be used again after Close is called.
 func (r *Resolver) Close() {
@@ -193,6 +217,7 @@ func (r *Resolver) EnqueueRequest(bs []byte, from netaddr.IPPort) error {
 	}
 	if n := atomic.AddInt32(&r.activeQueriesAtomic, 1); n > maxActiveQueries() {
 		atomic.AddInt32(&r.activeQueriesAtomic, -1)
+		queryCounts.Get("dropped").Add(1)
 		return errFullQueue
 	}
 	go r.handleQuery(packet{bs, from})
@@ -307,15 +332,18 @@ func (r *Resolver) handleQuery(pkt packet) {
 		err = r.forwarder.forward(pkt)
 		if err == nil {
 			// forward will send response into r.responses, nothing to do.
+			queryCounts.Get("forwarded").Add(1)
 			return
 		}
 	}
 	if err != nil {
+		queryCounts.Get("error").Add(1)
 		select {
 		case <-r.closed:
 		case r.errors <- err:
 		}
 	} else {
+		queryCounts.Get("local").Add(1)
 		select {
 		case <-r.closed:
 		case r.responses <- packet{out, pkt.addr}:
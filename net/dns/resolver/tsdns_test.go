@@ -11,9 +11,11 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 
 	dns "golang.org/x/net/dns/dnsmessage"
@@ -665,6 +667,52 @@ func TestDelegateSplitRoute(t *testing.T) {
 	}
 }
 
+func TestAnswerWatcher(t *testing.T) {
+	server := serveDNS(t, "127.0.0.1:0",
+		"test.site.", resolveToIP(testipv4, testipv6, "dns.test.site."),
+		"test.other.", resolveToIP(testipv4, testipv6, "dns.other."))
+	defer server.Shutdown()
+
+	r := newResolver(t)
+	defer r.Close()
+
+	var (
+		mu  sync.Mutex
+		got = map[dnsname.FQDN][]netaddr.IP{}
+	)
+	r.SetAnswerWatcher(func(name dnsname.FQDN, ips []netaddr.IP) {
+		mu.Lock()
+		defer mu.Unlock()
+		got[name] = append(got[name], ips...)
+	})
+
+	cfg := dnsCfg
+	cfg.Routes = map[dnsname.FQDN][]netaddr.IPPort{
+		".": {netaddr.MustParseIPPort(server.PacketConn.LocalAddr().String())},
+	}
+	cfg.WatchDomains = []dnsname.FQDN{"site."}
+	r.SetConfig(cfg)
+
+	for _, q := range [][]byte{
+		dnspacket("test.site.", dns.TypeA, noEdns),
+		dnspacket("test.site.", dns.TypeAAAA, noEdns),
+		dnspacket("test.other.", dns.TypeA, noEdns),
+	} {
+		if _, err := syncRespond(r, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[dnsname.FQDN][]netaddr.IP{
+		"test.site.": {testipv4, testipv6},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("watched answers = %v; want %v", got, want)
+	}
+}
+
 func TestDelegateCollision(t *testing.T) {
 	server := serveDNS(t, "127.0.0.1:0",
 		"test.site.", resolveToIP(testipv4, testipv6, "dns.test.site."))
@@ -349,6 +349,17 @@ func (q *Parsed) ICMP4Header() ICMP4Header {
 	}
 }
 
+func (q *Parsed) ICMP6Header() ICMP6Header {
+	if q.IPVersion != 6 {
+		panic("IP6Header called on non-IPv6 Parsed")
+	}
+	return ICMP6Header{
+		IP6Header: q.IP6Header(),
+		Type:      ICMP6Type(q.b[q.subofs+0]),
+		Code:      ICMP6Code(q.b[q.subofs+1]),
+	}
+}
+
 func (q *Parsed) UDP4Header() UDP4Header {
 	if q.IPVersion != 4 {
 		panic("IP4Header called on non-IPv4 Parsed")
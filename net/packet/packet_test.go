@@ -560,3 +560,46 @@ func BenchmarkString(b *testing.B) {
 		})
 	}
 }
+
+func TestICMP6EchoResponse(t *testing.T) {
+	req := ICMP6Header{
+		IP6Header: IP6Header{
+			Src: netaddr.MustParseIP("fd7a:115c:a1e0::1"),
+			Dst: netaddr.MustParseIP("fd7a:115c:a1e0::2"),
+		},
+		Type: ICMP6EchoRequest,
+	}
+	payload := []byte("\x12\x34\x00\x01ping")
+
+	var p Parsed
+	p.Decode(Generate(req, payload))
+	if !p.IsEchoRequest() {
+		t.Fatalf("decoded %v is not an echo request", p)
+	}
+	if !bytes.Equal(p.Payload(), payload) {
+		t.Errorf("payload = %q; want %q", p.Payload(), payload)
+	}
+
+	h := p.ICMP6Header()
+	h.ToResponse()
+	resp := Generate(&h, p.Payload())
+	var r Parsed
+	r.Decode(resp)
+	if !r.IsEchoResponse() {
+		t.Fatalf("decoded %v is not an echo response", r)
+	}
+	if r.Src.IP() != req.Dst || r.Dst.IP() != req.Src {
+		t.Errorf("response is %v > %v; want %v > %v", r.Src, r.Dst, req.Dst, req.Src)
+	}
+	if !bytes.Equal(r.Payload(), payload) {
+		t.Errorf("response payload = %q; want %q", r.Payload(), payload)
+	}
+
+	// The checksum over the pseudo header and ICMPv6 message,
+	// including the checksum field, must come out as zero.
+	pseudo := append([]byte(nil), resp...)
+	r.IP6Header().marshalPseudo(pseudo)
+	if got := ip4Checksum(pseudo); got != 0 {
+		t.Errorf("checksum verification = %#04x; want 0", got)
+	}
+}
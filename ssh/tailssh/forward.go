@@ -0,0 +1,150 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin
+
+package tailssh
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"inet.af/netaddr"
+)
+
+// resolveForwardHost returns the addresses of host, the host part of
+// a port forwarding request. For remote forwards (listen true), an
+// empty host or an unspecified address means all interfaces, which the
+// listener binds dual-stack, so both unspecified addresses are
+// returned; other hosts must be IP addresses or "localhost", as the
+// listener resolves names again itself.
+func resolveForwardHost(host string, listen bool) ([]netaddr.IP, error) {
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	if ip, err := netaddr.ParseIP(host); err == nil {
+		if listen && ip.IsUnspecified() {
+			return []netaddr.IP{netaddr.IPv4(0, 0, 0, 0), netaddr.IPv6Unspecified()}, nil
+		}
+		return []netaddr.IP{ip}, nil
+	}
+	if listen && host != "localhost" {
+		return nil, fmt.Errorf("%q is not an IP address", host)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var ips []netaddr.IP
+	for _, a := range addrs {
+		if ip, ok := netaddr.FromStdIP(a.IP); ok {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses for %q", host)
+	}
+	return ips, nil
+}
+
+// authorizeForward returns the addresses of host if the client of ctx
+// may forward to or from them on port, according to allowed. If host
+// resolves to several addresses, all of them must be allowed.
+func (s *Server) authorizeForward(ctx ssh.Context, kind, host string, port uint32, allowed func(*identity, string, netaddr.IPPort) bool) ([]netaddr.IP, bool) {
+	id, err := s.identify(ctx.RemoteAddr())
+	if err != nil {
+		s.logf("ssh: rejected %s forward to %s:%d: %v", kind, host, port, err)
+		return nil, false
+	}
+	if port > 0xffff {
+		return nil, false
+	}
+	ips, err := resolveForwardHost(host, kind == "remote")
+	if err != nil {
+		s.logf("ssh: rejected %s forward for %v to %s:%d: %v", kind, id, host, port, err)
+		return nil, false
+	}
+	for _, ip := range ips {
+		ipp := netaddr.IPPortFrom(ip, uint16(port))
+		if !allowed(id, ctx.User(), ipp) {
+			s.logf("ssh: rejected %s forward for %v as %q to %v: not allowed by policy", kind, id, ctx.User(), ipp)
+			return nil, false
+		}
+	}
+	s.logf("ssh: %s forward for %v as %q to %s:%d", kind, id, ctx.User(), host, port)
+	return ips, true
+}
+
+// directTCPIPData is the extra data of a direct-tcpip channel request
+// (RFC 4254, section 7.2).
+type directTCPIPData struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// handleDirectTCPIP is the ssh.ChannelHandler for direct-tcpip
+// channels, for local port forwarding. Unlike ssh.DirectTCPIPHandler,
+// it dials the addresses it authorized, rather than resolving the
+// requested host again, by when it could resolve to another one.
+func (s *Server) handleDirectTCPIP(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+	var d directTCPIPData
+	if err := gossh.Unmarshal(newChan.ExtraData(), &d); err != nil {
+		newChan.Reject(gossh.ConnectionFailed, "error parsing forward data: "+err.Error())
+		return
+	}
+	ips, ok := s.authorizeForward(ctx, "local", d.DestAddr, d.DestPort, func(id *identity, localUser string, dst netaddr.IPPort) bool {
+		return s.policy.AllowsLocalForward(id.user, localUser, dst)
+	})
+	if !ok {
+		newChan.Reject(gossh.Prohibited, "port forwarding not allowed")
+		return
+	}
+	var dialer net.Dialer
+	var dconn net.Conn
+	var err error
+	for _, ip := range ips {
+		dconn, err = dialer.DialContext(ctx, "tcp", netaddr.IPPortFrom(ip, uint16(d.DestPort)).String())
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		newChan.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		dconn.Close()
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+	go func() {
+		defer ch.Close()
+		defer dconn.Close()
+		io.Copy(ch, dconn)
+	}()
+	go func() {
+		defer ch.Close()
+		defer dconn.Close()
+		io.Copy(dconn, ch)
+	}()
+}
+
+// allowRemoteForward is the ssh.ReversePortForwardingCallback for
+// tcpip-forward requests.
+func (s *Server) allowRemoteForward(ctx ssh.Context, host string, port uint32) bool {
+	_, ok := s.authorizeForward(ctx, "remote", host, port, func(id *identity, localUser string, bind netaddr.IPPort) bool {
+		return s.policy.AllowsRemoteForward(id.user, localUser, bind)
+	})
+	return ok
+}
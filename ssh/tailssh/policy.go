@@ -0,0 +1,267 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+)
+
+// Policy decides which local users a tailnet identity may log in as.
+//
+// It is usually loaded from a JSON file like:
+//
+//	{
+//	  "Rules": [
+//	    {"Users": ["alice@example.com"], "LocalUsers": ["alice", "root"],
+//	     "LocalForwards": ["10.0.0.0/8:*"], "RemoteForwards": ["127.0.0.1:8080"]},
+//	    {"Users": ["*"], "LocalUsers": ["guest"]}
+//	  ]
+//	}
+type Policy struct {
+	// Rules are the grants of the policy. A login is allowed if
+	// any rule allows it.
+	Rules []PolicyRule
+
+	// Recording, if non-nil, configures recording of sessions,
+	// with or without a PTY. SFTP is refused when it's set.
+	Recording *RecordingConfig `json:",omitempty"`
+}
+
+// RecordingConfig configures recording of sessions in asciinema v2
+// ("asciicast") format. Sessions without a PTY are recorded at 80x24,
+// with their standard output and error both as output.
+type RecordingConfig struct {
+	// Dir is the directory to write recordings to, one file per
+	// session, named after the tailnet user, their node and the
+	// session's start time. If empty, recordings aren't written
+	// to disk.
+	Dir string `json:",omitempty"`
+
+	// RecordInput is whether to record what the client types, as
+	// well as the session's output. Note that this includes
+	// passwords typed at prompts that don't echo.
+	RecordInput bool `json:",omitempty"`
+
+	// MaxSize is the maximum size in bytes of each recording.
+	// Once it's reached, the rest of the session isn't recorded.
+	// Zero means no limit.
+	MaxSize int64 `json:",omitempty"`
+
+	// UploadURL, if non-empty, is an HTTP(S) URL each recording is
+	// streamed to, as it's made, in the body of a POST request.
+	// A slow endpoint slows down the sessions being recorded, and
+	// one that stalls for 30 seconds fails the upload.
+	UploadURL string `json:",omitempty"`
+
+	// FailClosed is whether to end a session if its recording
+	// stops before it does, because MaxSize was reached or writing
+	// or uploading the recording failed. Otherwise the user is
+	// told, and the rest of the session isn't recorded.
+	FailClosed bool `json:",omitempty"`
+}
+
+// PolicyRule grants a set of tailnet identities access to a set of
+// local users.
+type PolicyRule struct {
+	// Users are the tailnet login names (like "alice@example.com")
+	// the rule applies to. "*" matches any tailnet user.
+	Users []string
+
+	// LocalUsers are the local account names the matched users may
+	// log in as. "*" matches any local user, and "=" matches the
+	// local part of the tailnet login name ("alice" for
+	// "alice@example.com").
+	LocalUsers []string
+
+	// LocalForwards are the destinations the matched users may
+	// connect to with local port forwarding ("ssh -L"), each of
+	// the form "ip:port" or "prefix:port" with a port of "*"
+	// meaning any port. A lone "*" allows any destination. Empty
+	// means none.
+	LocalForwards []string `json:",omitempty"`
+
+	// RemoteForwards are the addresses the matched users may
+	// listen on with remote port forwarding ("ssh -R"), in the same
+	// form as LocalForwards. Listening on all interfaces binds both
+	// IPv4 and IPv6, so needs both 0.0.0.0 and [::] allowed.
+	RemoteForwards []string `json:",omitempty"`
+
+	localFwd  []forwardPattern
+	remoteFwd []forwardPattern
+}
+
+// forwardPattern is a parsed entry of PolicyRule.LocalForwards or
+// PolicyRule.RemoteForwards.
+type forwardPattern struct {
+	prefix netaddr.IPPrefix // zero value means any address
+	port   uint16           // 0 means any port
+}
+
+func parseForwardPattern(s string) (forwardPattern, error) {
+	if s == "*" {
+		return forwardPattern{}, nil
+	}
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return forwardPattern{}, err
+	}
+	var fp forwardPattern
+	if strings.Contains(host, "/") {
+		fp.prefix, err = netaddr.ParseIPPrefix(host)
+	} else {
+		var ip netaddr.IP
+		ip, err = netaddr.ParseIP(host)
+		fp.prefix = netaddr.IPPrefixFrom(ip, ip.BitLen())
+	}
+	if err != nil {
+		return forwardPattern{}, err
+	}
+	if portStr != "*" {
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil || port == 0 {
+			return forwardPattern{}, fmt.Errorf("invalid port %q", portStr)
+		}
+		fp.port = uint16(port)
+	}
+	return fp, nil
+}
+
+func (fp forwardPattern) matches(ipp netaddr.IPPort) bool {
+	if fp.port != 0 && fp.port != ipp.Port() {
+		return false
+	}
+	return fp.prefix.IsZero() || fp.prefix.Contains(ipp.IP())
+}
+
+// LoadPolicy reads and parses the policy file at path.
+func LoadPolicy(path string) (*Policy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(b)
+}
+
+// ParsePolicy parses the JSON policy b.
+func ParsePolicy(b []byte) (*Policy, error) {
+	p := new(Policy)
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("parsing SSH policy: %w", err)
+	}
+	if rc := p.Recording; rc != nil {
+		if rc.MaxSize < 0 {
+			return nil, fmt.Errorf("SSH policy: negative Recording.MaxSize")
+		}
+		if rc.UploadURL != "" {
+			u, err := url.Parse(rc.UploadURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return nil, fmt.Errorf("SSH policy: invalid Recording.UploadURL %q", rc.UploadURL)
+			}
+		}
+		if rc.Dir == "" && rc.UploadURL == "" {
+			return nil, fmt.Errorf("SSH policy: Recording needs a Dir or UploadURL")
+		}
+	}
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if len(r.Users) == 0 || len(r.LocalUsers) == 0 {
+			return nil, fmt.Errorf("SSH policy rule %d: Users and LocalUsers must be non-empty", i)
+		}
+		for _, s := range r.LocalForwards {
+			fp, err := parseForwardPattern(s)
+			if err != nil {
+				return nil, fmt.Errorf("SSH policy rule %d: LocalForwards %q: %v", i, s, err)
+			}
+			r.localFwd = append(r.localFwd, fp)
+		}
+		for _, s := range r.RemoteForwards {
+			fp, err := parseForwardPattern(s)
+			if err != nil {
+				return nil, fmt.Errorf("SSH policy rule %d: RemoteForwards %q: %v", i, s, err)
+			}
+			r.remoteFwd = append(r.remoteFwd, fp)
+		}
+	}
+	return p, nil
+}
+
+// Allows reports whether the tailnet user u may log in as localUser.
+func (p *Policy) Allows(u tailcfg.UserProfile, localUser string) bool {
+	if p == nil || localUser == "" {
+		return false
+	}
+	for _, r := range p.Rules {
+		if r.matchesUser(u) && r.matchesLocalUser(u, localUser) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsLocalForward reports whether the tailnet user u, logged in as
+// localUser, may connect to dst with local port forwarding.
+func (p *Policy) AllowsLocalForward(u tailcfg.UserProfile, localUser string, dst netaddr.IPPort) bool {
+	return p.allowsForward(u, localUser, dst, func(r *PolicyRule) []forwardPattern { return r.localFwd })
+}
+
+// AllowsRemoteForward reports whether the tailnet user u, logged in
+// as localUser, may listen on bind with remote port forwarding.
+func (p *Policy) AllowsRemoteForward(u tailcfg.UserProfile, localUser string, bind netaddr.IPPort) bool {
+	return p.allowsForward(u, localUser, bind, func(r *PolicyRule) []forwardPattern { return r.remoteFwd })
+}
+
+func (p *Policy) allowsForward(u tailcfg.UserProfile, localUser string, ipp netaddr.IPPort, patterns func(*PolicyRule) []forwardPattern) bool {
+	if p == nil || localUser == "" {
+		return false
+	}
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if !r.matchesUser(u) || !r.matchesLocalUser(u, localUser) {
+			continue
+		}
+		for _, fp := range patterns(r) {
+			if fp.matches(ipp) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *PolicyRule) matchesUser(u tailcfg.UserProfile) bool {
+	for _, id := range r.Users {
+		if id == "*" || (u.LoginName != "" && strings.EqualFold(id, u.LoginName)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *PolicyRule) matchesLocalUser(u tailcfg.UserProfile, localUser string) bool {
+	for _, lu := range r.LocalUsers {
+		switch lu {
+		case "*":
+			return true
+		case "=":
+			if i := strings.Index(u.LoginName, "@"); i > 0 && u.LoginName[:i] == localUser {
+				return true
+			}
+		default:
+			if lu == localUser {
+				return true
+			}
+		}
+	}
+	return false
+}
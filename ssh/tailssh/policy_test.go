@@ -0,0 +1,118 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailssh
+
+import (
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+)
+
+func TestPolicyAllows(t *testing.T) {
+	pol, err := ParsePolicy([]byte(`{
+		"Rules": [
+			{"Users": ["alice@example.com"], "LocalUsers": ["alice", "root"]},
+			{"Users": ["*"], "LocalUsers": ["="]},
+			{"Users": ["ops@example.com"], "LocalUsers": ["*"]}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := tailcfg.UserProfile{LoginName: "alice@example.com"}
+	bob := tailcfg.UserProfile{LoginName: "bob@example.com"}
+	ops := tailcfg.UserProfile{LoginName: "Ops@example.com"}
+	tests := []struct {
+		user      tailcfg.UserProfile
+		localUser string
+		want      bool
+	}{
+		{alice, "alice", true},
+		{alice, "root", true},
+		{alice, "bob", false},
+		{bob, "bob", true},
+		{bob, "root", false},
+		{bob, "", false},
+		{ops, "anything", true},
+		{tailcfg.UserProfile{}, "root", false},
+	}
+	for _, tt := range tests {
+		if got := pol.Allows(tt.user, tt.localUser); got != tt.want {
+			t.Errorf("Allows(%q, %q) = %v; want %v", tt.user.LoginName, tt.localUser, got, tt.want)
+		}
+	}
+
+	var nilPolicy *Policy
+	if nilPolicy.Allows(alice, "alice") {
+		t.Errorf("nil policy allowed login")
+	}
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	for _, in := range []string{
+		`{"Rules": [{"Users": ["*"]}]}`,
+		`{"Rules": [{"LocalUsers": ["*"]}]}`,
+		`{"Rules": `,
+		`{"Rules": [{"Users": ["*"], "LocalUsers": ["*"], "LocalForwards": ["10.0.0.1"]}]}`,
+		`{"Rules": [{"Users": ["*"], "LocalUsers": ["*"], "RemoteForwards": ["127.0.0.1:0"]}]}`,
+		`{"Rules": [], "Recording": {}}`,
+		`{"Rules": [], "Recording": {"Dir": "/tmp", "MaxSize": -1}}`,
+		`{"Rules": [], "Recording": {"UploadURL": "ftp://example.com/"}}`,
+	} {
+		if _, err := ParsePolicy([]byte(in)); err == nil {
+			t.Errorf("ParsePolicy(%q) succeeded; want error", in)
+		}
+	}
+}
+
+func TestPolicyAllowsForward(t *testing.T) {
+	pol, err := ParsePolicy([]byte(`{
+		"Rules": [
+			{"Users": ["alice@example.com"], "LocalUsers": ["alice"],
+			 "LocalForwards": ["10.0.0.0/8:*", "[fd00::1]:443"],
+			 "RemoteForwards": ["127.0.0.1:8080"]},
+			{"Users": ["ops@example.com"], "LocalUsers": ["*"],
+			 "LocalForwards": ["*"]}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := tailcfg.UserProfile{LoginName: "alice@example.com"}
+	ops := tailcfg.UserProfile{LoginName: "ops@example.com"}
+	ipp := netaddr.MustParseIPPort
+	tests := []struct {
+		name      string
+		user      tailcfg.UserProfile
+		localUser string
+		remote    bool
+		addr      netaddr.IPPort
+		want      bool
+	}{
+		{"local_prefix", alice, "alice", false, ipp("10.1.2.3:22"), true},
+		{"local_outside_prefix", alice, "alice", false, ipp("192.168.1.1:22"), false},
+		{"local_ip6_port", alice, "alice", false, ipp("[fd00::1]:443"), true},
+		{"local_ip6_wrong_port", alice, "alice", false, ipp("[fd00::1]:80"), false},
+		{"local_other_local_user", alice, "root", false, ipp("10.1.2.3:22"), false},
+		{"local_any", ops, "root", false, ipp("8.8.8.8:53"), true},
+		{"remote_exact", alice, "alice", true, ipp("127.0.0.1:8080"), true},
+		{"remote_other_port", alice, "alice", true, ipp("127.0.0.1:8081"), false},
+		{"remote_none", ops, "root", true, ipp("127.0.0.1:8080"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got bool
+			if tt.remote {
+				got = pol.AllowsRemoteForward(tt.user, tt.localUser, tt.addr)
+			} else {
+				got = pol.AllowsLocalForward(tt.user, tt.localUser, tt.addr)
+			}
+			if got != tt.want {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,310 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin
+
+package tailssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"tailscale.com/types/logger"
+)
+
+// uploadWriteTimeout is how long a write to a recording's upload may
+// block before the upload is considered stalled and abandoned.
+const uploadWriteTimeout = 30 * time.Second
+
+// uploadClient is the HTTP client recordings are uploaded with. It has
+// no overall timeout, as an upload lasts as long as its session; a
+// stalled upload is caught by uploadWriteTimeout instead.
+var uploadClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+// castHeader is the first line of an asciinema v2 recording.
+// See https://github.com/asciinema/asciinema/blob/develop/doc/asciicast-v2.md.
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// recording is an asciinema v2 recording of one session being made.
+// Its methods are safe for concurrent use.
+type recording struct {
+	logf  logger.Logf
+	name  string
+	start time.Time
+	max   int64 // 0 means no limit
+
+	stopCh chan struct{} // closed when the recording stops before the session ends
+
+	mu       sync.Mutex
+	dsts     []io.Writer // the file and/or upload
+	closers  []io.Closer
+	upload   *io.PipeWriter // the upload's body, or nil if none
+	size     int64
+	full     bool              // max was reached
+	stopErr  error             // why the recording stopped, or nil
+	partial  map[string][]byte // incomplete UTF-8 sequence at the end of each stream
+	uploadCh chan error        // receives the upload's result; nil if none
+}
+
+// recordingName returns the file name of a recording of a session of
+// id starting at start.
+func recordingName(id *identity, start time.Time) string {
+	clean := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			switch {
+			case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9',
+				r == '@', r == '.', r == '-', r == '_':
+				return r
+			}
+			return '_'
+		}, s)
+	}
+	return fmt.Sprintf("%s_%s_%s.cast", clean(id.user.LoginName), clean(id.node.ComputedName), start.UTC().Format("20060102T150405.000Z"))
+}
+
+// startRecording starts recording a session of id as configured by
+// cfg, writing the header hdr.
+func startRecording(logf logger.Logf, cfg *RecordingConfig, id *identity, hdr castHeader) (*recording, error) {
+	start := time.Now()
+	r := &recording{
+		logf:    logf,
+		name:    recordingName(id, start),
+		start:   start,
+		max:     cfg.MaxSize,
+		stopCh:  make(chan struct{}),
+		partial: map[string][]byte{},
+	}
+	if cfg.Dir != "" {
+		f, err := os.OpenFile(filepath.Join(cfg.Dir, r.name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, err
+		}
+		r.dsts = append(r.dsts, f)
+		r.closers = append(r.closers, f)
+	}
+	if cfg.UploadURL != "" {
+		pr, pw := io.Pipe()
+		req, err := http.NewRequest("POST", cfg.UploadURL, pr)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-asciicast")
+		req.Header.Set("Tailscale-Recording-Name", r.name)
+		r.uploadCh = make(chan error, 1)
+		go func() {
+			res, err := uploadClient.Do(req)
+			if err == nil {
+				io.Copy(ioutil.Discard, res.Body)
+				res.Body.Close()
+				if res.StatusCode/100 != 2 {
+					err = fmt.Errorf("upload: %v", res.Status)
+				}
+			}
+			// Unblock any pending or future writes.
+			pr.CloseWithError(fmt.Errorf("upload failed: %v", err))
+			r.uploadCh <- err
+		}()
+		r.dsts = append(r.dsts, pw)
+		r.closers = append(r.closers, pw)
+		r.upload = pw
+	}
+
+	hdr.Version = 2
+	hdr.Timestamp = start.Unix()
+	j, err := json.Marshal(hdr)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writeLocked(append(j, '\n'))
+	return r, nil
+}
+
+// writeLocked writes line to each of r's destinations, unless that
+// would exceed r.max. Destinations that fail are dropped, and like
+// reaching r.max, stop the recording.
+//
+// r.mu must be held.
+func (r *recording) writeLocked(line []byte) {
+	if r.full {
+		return
+	}
+	if r.max > 0 && r.size+int64(len(line)) > r.max {
+		r.full = true
+		r.stopLocked(fmt.Errorf("reached size limit of %d bytes", r.max))
+		return
+	}
+	r.size += int64(len(line))
+	dsts := r.dsts[:0]
+	for _, w := range r.dsts {
+		var t *time.Timer
+		if w == io.Writer(r.upload) {
+			pw := r.upload
+			t = time.AfterFunc(uploadWriteTimeout, func() {
+				pw.CloseWithError(fmt.Errorf("upload stalled for %v", uploadWriteTimeout))
+			})
+		}
+		_, err := w.Write(line)
+		if t != nil {
+			t.Stop()
+		}
+		if err != nil {
+			r.stopLocked(err)
+			continue
+		}
+		dsts = append(dsts, w)
+	}
+	r.dsts = dsts
+}
+
+// stopLocked records that r stopped recording because of err, unless
+// it already had.
+//
+// r.mu must be held.
+func (r *recording) stopLocked(err error) {
+	r.logf("ssh: recording %s: %v; not recording rest of session", r.name, err)
+	if r.stopErr == nil {
+		r.stopErr = err
+		close(r.stopCh)
+	}
+}
+
+// stopped returns a channel that's closed if r stops recording before
+// the session ends, because it reached its size limit or writing or
+// uploading it failed. stopReason then returns why.
+func (r *recording) stopped() <-chan struct{} {
+	return r.stopCh
+}
+
+// stopReason returns why r stopped recording, or nil if it hasn't.
+func (r *recording) stopReason() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stopErr
+}
+
+// writeEvent records the event kind ("o" for output, "i" for input, "r"
+// for resize) with data.
+func (r *recording) writeEvent(kind string, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if kind == "o" || kind == "i" {
+		// Events are JSON strings, so a UTF-8 sequence split
+		// across reads is held back until it's complete.
+		data = append(r.partial[kind], data...)
+		data, r.partial[kind] = splitIncompleteUTF8(data)
+		r.partial[kind] = append([]byte(nil), r.partial[kind]...)
+		if len(data) == 0 {
+			return
+		}
+	}
+	elapsed := time.Since(r.start).Seconds()
+	j, err := json.Marshal([]interface{}{elapsed, kind, string(data)})
+	if err != nil {
+		return
+	}
+	r.writeLocked(append(j, '\n'))
+}
+
+// writer returns an io.Writer that records what's written to it as
+// events of kind. It never fails, so that a broken recording doesn't
+// break the session.
+func (r *recording) writer(kind string) io.Writer {
+	return eventWriter{r, kind}
+}
+
+type eventWriter struct {
+	r    *recording
+	kind string
+}
+
+func (w eventWriter) Write(p []byte) (int, error) {
+	w.r.writeEvent(w.kind, p)
+	return len(p), nil
+}
+
+// resize records that the terminal changed size.
+func (r *recording) resize(width, height int) {
+	r.writeEvent("r", []byte(fmt.Sprintf("%dx%d", width, height)))
+}
+
+// Close finishes the recording and waits for its upload, if any, to
+// complete.
+func (r *recording) Close() error {
+	r.mu.Lock()
+	closers := r.closers
+	r.closers = nil
+	r.mu.Unlock()
+	var firstErr error
+	for _, c := range closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if r.uploadCh != nil {
+		if err := <-r.uploadCh; err != nil && firstErr == nil {
+			firstErr = err
+		}
+		r.uploadCh = nil
+	}
+	return firstErr
+}
+
+// splitIncompleteUTF8 splits b into its longest prefix that doesn't
+// end with an incomplete UTF-8 sequence, and that sequence.
+func splitIncompleteUTF8(b []byte) (complete, rest []byte) {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if !utf8.RuneStart(b[i]) {
+			continue
+		}
+		if utf8.FullRune(b[i:]) {
+			break
+		}
+		return b[:i], b[i:]
+	}
+	return b, nil
+}
+
+// recordingEnv is the environment recorded in a cast header.
+func recordingEnv(env []string) map[string]string {
+	m := map[string]string{}
+	for _, kv := range env {
+		for _, k := range []string{"TERM", "SHELL"} {
+			if strings.HasPrefix(kv, k+"=") {
+				m[k] = kv[len(k)+1:]
+			}
+		}
+	}
+	return m
+}
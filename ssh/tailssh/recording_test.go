@@ -0,0 +1,339 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin
+
+package tailssh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+)
+
+func TestSplitIncompleteUTF8(t *testing.T) {
+	euro := "€" // 3 bytes
+	tests := []struct {
+		in, complete, rest string
+	}{
+		{"", "", ""},
+		{"abc", "abc", ""},
+		{"ab" + euro, "ab" + euro, ""},
+		{"ab" + euro[:1], "ab", euro[:1]},
+		{"ab" + euro[:2], "ab", euro[:2]},
+		{"\xff", "\xff", ""}, // invalid, but not incomplete
+	}
+	for _, tt := range tests {
+		complete, rest := splitIncompleteUTF8([]byte(tt.in))
+		if string(complete) != tt.complete || string(rest) != tt.rest {
+			t.Errorf("splitIncompleteUTF8(%q) = %q, %q; want %q, %q", tt.in, complete, rest, tt.complete, tt.rest)
+		}
+	}
+}
+
+var testIdentity = &identity{
+	addr: netaddr.MustParseIPPort("100.64.0.2:1234"),
+	node: &tailcfg.Node{ComputedName: "laptop"},
+	user: tailcfg.UserProfile{LoginName: "alice@example.com"},
+}
+
+// readCast parses an asciinema v2 recording into its header and events.
+func readCast(t *testing.T, b []byte) (hdr castHeader, events [][]interface{}) {
+	t.Helper()
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	if !sc.Scan() {
+		t.Fatal("empty recording")
+	}
+	if err := json.Unmarshal(sc.Bytes(), &hdr); err != nil {
+		t.Fatalf("header: %v", err)
+	}
+	for sc.Scan() {
+		var ev []interface{}
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			t.Fatalf("event %q: %v", sc.Bytes(), err)
+		}
+		if len(ev) != 3 {
+			t.Fatalf("event %q: want 3 elements", sc.Bytes())
+		}
+		events = append(events, ev)
+	}
+	return hdr, events
+}
+
+func TestRecording(t *testing.T) {
+	dir := t.TempDir()
+	rec, err := startRecording(t.Logf, &RecordingConfig{Dir: dir}, testIdentity, castHeader{Width: 80, Height: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := rec.writer("o")
+	out.Write([]byte("hello "))
+	out.Write([]byte("€"[:1]))
+	out.Write([]byte("€"[1:] + "\r\n"))
+	rec.writer("i").Write([]byte("ls\r"))
+	rec.resize(100, 40)
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(rec.name, "alice@example.com_laptop_") || !strings.HasSuffix(rec.name, ".cast") {
+		t.Errorf("recording name = %q", rec.name)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, rec.name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, events := readCast(t, b)
+	if hdr.Version != 2 || hdr.Width != 80 || hdr.Height != 24 || hdr.Timestamp == 0 {
+		t.Errorf("header = %+v", hdr)
+	}
+	var got []string
+	for _, ev := range events {
+		got = append(got, fmt.Sprintf("%s:%s", ev[1], ev[2]))
+	}
+	want := []string{"o:hello ", "o:€\r\n", "i:ls\r", "r:100x40"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("events = %q; want %q", got, want)
+	}
+}
+
+func TestRecordingMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	const max = 200
+	rec, err := startRecording(t.Logf, &RecordingConfig{Dir: dir, MaxSize: max}, testIdentity, castHeader{Width: 80, Height: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		rec.writer("o").Write([]byte("0123456789"))
+	}
+	rec.Close()
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, rec.name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) > max {
+		t.Errorf("recording is %d bytes; want at most %d", len(b), max)
+	}
+	if _, events := readCast(t, b); len(events) == 0 {
+		t.Errorf("no events recorded before the limit")
+	}
+}
+
+func TestRecordingUpload(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		body    []byte
+		gotName string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		body = b
+		gotName = r.Header.Get("Tailscale-Recording-Name")
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	rec, err := startRecording(t.Logf, &RecordingConfig{Dir: dir, UploadURL: ts.URL}, testIdentity, castHeader{Width: 80, Height: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.writer("o").Write([]byte("uploaded"))
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := ioutil.ReadFile(filepath.Join(dir, rec.name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !bytes.Equal(body, file) {
+		t.Errorf("uploaded %q; want same as file %q", body, file)
+	}
+	if gotName != rec.name {
+		t.Errorf("upload name = %q; want %q", gotName, rec.name)
+	}
+}
+
+func TestRecordingStopped(t *testing.T) {
+	rec, err := startRecording(t.Logf, &RecordingConfig{Dir: t.TempDir(), MaxSize: 200}, testIdentity, castHeader{Width: 80, Height: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.Close()
+	rec.writer("o").Write([]byte("short"))
+	select {
+	case <-rec.stopped():
+		t.Fatalf("stopped under the size limit: %v", rec.stopReason())
+	default:
+	}
+	rec.writer("o").Write(bytes.Repeat([]byte("x"), 200))
+	select {
+	case <-rec.stopped():
+	default:
+		t.Fatal("not stopped at the size limit")
+	}
+	if err := rec.stopReason(); err == nil || !strings.Contains(err.Error(), "size limit") {
+		t.Errorf("stopReason = %v", err)
+	}
+}
+
+func TestRecordingUploadFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Reply without reading the body, which net/http's
+		// server won't do for a body that's still streaming.
+		c, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		io.WriteString(c, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+	}))
+	defer ts.Close()
+
+	rec, err := startRecording(t.Logf, &RecordingConfig{UploadURL: ts.URL}, testIdentity, castHeader{Width: 80, Height: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.Close()
+	deadline := time.After(10 * time.Second)
+	for {
+		rec.writer("o").Write([]byte("lost"))
+		select {
+		case <-rec.stopped():
+			return
+		case <-deadline:
+			t.Fatal("recording not stopped after its upload failed")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// readRecording returns the only recording in dir.
+func readRecording(t *testing.T, dir string) []byte {
+	t.Helper()
+	// The recording is closed before the exit status is sent, but
+	// allow for slow filesystems.
+	var files []string
+	for i := 0; i < 50 && len(files) == 0; i++ {
+		files, _ = filepath.Glob(filepath.Join(dir, "*.cast"))
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(files) != 1 {
+		t.Fatalf("recordings = %q; want 1", files)
+	}
+	b, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRecordedSession(t *testing.T) {
+	dir := t.TempDir()
+	c := testClient(t, fmt.Sprintf(`{
+		"Rules": [{"Users": ["*"], "LocalUsers": ["="]}],
+		"Recording": {"Dir": %q}
+	}`, dir))
+	sess, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	if err := sess.RequestPty("xterm", 24, 80, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Run("echo recorded-output"); err != nil {
+		t.Fatal(err)
+	}
+
+	hdr, events := readCast(t, readRecording(t, dir))
+	if hdr.Width != 80 || hdr.Height != 24 || hdr.Env["TERM"] != "xterm" {
+		t.Errorf("header = %+v", hdr)
+	}
+	var out strings.Builder
+	for _, ev := range events {
+		if ev[1] == "o" {
+			out.WriteString(ev[2].(string))
+		}
+	}
+	if !strings.Contains(out.String(), "recorded-output") {
+		t.Errorf("recorded output %q lacks command output", out.String())
+	}
+}
+
+func TestRecordedExec(t *testing.T) {
+	dir := t.TempDir()
+	c := testClient(t, fmt.Sprintf(`{
+		"Rules": [{"Users": ["*"], "LocalUsers": ["="]}],
+		"Recording": {"Dir": %q, "RecordInput": true}
+	}`, dir))
+	sess, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	sess.Stdin = strings.NewReader("typed-input\n")
+	out, err := sess.Output("cat; echo recorded-output; echo recorded-error >&2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(out), "typed-input\nrecorded-output\n"; got != want {
+		t.Errorf("output = %q; want %q", got, want)
+	}
+
+	hdr, events := readCast(t, readRecording(t, dir))
+	if hdr.Width != 80 || hdr.Height != 24 {
+		t.Errorf("header = %+v", hdr)
+	}
+	var in, rout strings.Builder
+	for _, ev := range events {
+		switch ev[1] {
+		case "i":
+			in.WriteString(ev[2].(string))
+		case "o":
+			rout.WriteString(ev[2].(string))
+		}
+	}
+	if in.String() != "typed-input\n" {
+		t.Errorf("recorded input = %q", in.String())
+	}
+	for _, want := range []string{"typed-input", "recorded-output", "recorded-error"} {
+		if !strings.Contains(rout.String(), want) {
+			t.Errorf("recorded output %q lacks %q", rout.String(), want)
+		}
+	}
+}
+
+func TestSFTPRefusedWhenRecording(t *testing.T) {
+	dir := t.TempDir()
+	c := testClient(t, fmt.Sprintf(`{
+		"Rules": [{"Users": ["*"], "LocalUsers": ["="]}],
+		"Recording": {"Dir": %q}
+	}`, dir))
+	if sc, err := sftp.NewClient(c); err == nil {
+		sc.Close()
+		t.Fatal("sftp allowed in a recorded policy")
+	}
+}
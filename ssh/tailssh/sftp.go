@@ -0,0 +1,76 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin
+
+package tailssh
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/sftp"
+)
+
+// SFTPSubcommand is the argument with which a Server re-executes its
+// own binary to serve an SFTP session as the logged-in local user.
+// Binaries using a Server must call SFTPServerMain, and nothing else,
+// when run with it as their first argument.
+const SFTPSubcommand = "be-child-sftp"
+
+// SFTPServerMain serves SFTP on stdin and stdout until the client is
+// done.
+func SFTPServerMain() error {
+	srv, err := sftp.NewServer(stdio{os.Stdin, os.Stdout})
+	if err != nil {
+		return err
+	}
+	if err := srv.Serve(); err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// stdio is the process's stdin and stdout as an io.ReadWriteCloser.
+type stdio struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// handleSFTP is the handler for the "sftp" subsystem. It runs
+// SFTPServerMain in a child process, as the local user.
+//
+// SFTP is refused if the policy records sessions, as its binary
+// protocol can't be recorded as a terminal session.
+func (s *Server) handleSFTP(ss ssh.Session) {
+	id, lu, ok := s.authorizeSession(ss)
+	if !ok {
+		return
+	}
+	if s.policy.Recording != nil {
+		s.logf("ssh: rejected sftp session for %v: sessions are recorded", id)
+		fmt.Fprintf(ss.Stderr(), "tailssh: sftp is disabled as sessions are recorded\r\n")
+		ss.Exit(1)
+		return
+	}
+	s.logSession(ss, id, lu, "sftp", func() int {
+		exe, err := os.Executable()
+		if err != nil {
+			s.logf("ssh: sftp: %v", err)
+			return 1
+		}
+		cmd := exec.Command(exe, SFTPSubcommand)
+		cmd.Dir = lu.HomeDir
+		cmd.Env = lu.environ()
+		if err := lu.setCredential(cmd); err != nil {
+			s.logf("ssh: sftp: %v", err)
+			fmt.Fprintf(ss.Stderr(), "tailssh: sftp failed\r\n")
+			return 1
+		}
+		return s.runCmd(ss, cmd, nil)
+	})
+}
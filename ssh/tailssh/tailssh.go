@@ -0,0 +1,475 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin
+
+// Package tailssh is an SSH server that authorizes its clients by
+// their tailnet identity, rather than by keys or passwords, and runs
+// their sessions as the local users a Policy maps them to.
+package tailssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/kr/pty"
+	gossh "golang.org/x/crypto/ssh"
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+)
+
+// WhoIsFunc returns the tailnet node and user at the given address,
+// like LocalBackend.WhoIsPeer. It must not identify connections from
+// the server's own node, which any local process can make, as the
+// node's owner.
+type WhoIsFunc func(netaddr.IPPort) (n *tailcfg.Node, u tailcfg.UserProfile, ok bool)
+
+// Server is an SSH server for tailnet peers.
+type Server struct {
+	logf   logger.Logf
+	whoIs  WhoIsFunc
+	policy *Policy
+	srv    *ssh.Server
+
+	lastSessionID int64 // atomic
+}
+
+// NewServer returns a new Server that uses hostKey, a PEM-encoded
+// private key, as its host key. Clients are identified with whoIs and
+// may log in as the local users pol allows.
+func NewServer(logf logger.Logf, hostKey []byte, whoIs WhoIsFunc, pol *Policy) (*Server, error) {
+	signer, err := gossh.ParsePrivateKey(hostKey)
+	if err != nil {
+		return nil, fmt.Errorf("parsing SSH host key: %w", err)
+	}
+	if pol != nil && pol.Recording != nil && pol.Recording.Dir != "" {
+		if err := os.MkdirAll(pol.Recording.Dir, 0700); err != nil {
+			return nil, fmt.Errorf("creating recording directory: %w", err)
+		}
+	}
+	s := &Server{
+		logf:   logf,
+		whoIs:  whoIs,
+		policy: pol,
+	}
+	fwd := new(ssh.ForwardedTCPHandler)
+	s.srv = &ssh.Server{
+		Handler:                       s.handleSession,
+		ReversePortForwardingCallback: s.allowRemoteForward,
+		ChannelHandlers: map[string]ssh.ChannelHandler{
+			"session":      ssh.DefaultSessionHandler,
+			"direct-tcpip": s.handleDirectTCPIP,
+		},
+		RequestHandlers: map[string]ssh.RequestHandler{
+			"tcpip-forward":        fwd.HandleSSHRequest,
+			"cancel-tcpip-forward": fwd.HandleSSHRequest,
+		},
+		SubsystemHandlers: map[string]ssh.SubsystemHandler{
+			"sftp": s.handleSFTP,
+		},
+	}
+	s.srv.AddHostKey(signer)
+	return s, nil
+}
+
+// HandleConn serves the SSH connection c.
+func (s *Server) HandleConn(c net.Conn) {
+	s.srv.HandleConn(c)
+}
+
+// Serve accepts connections on ln and serves them until ln is closed.
+func (s *Server) Serve(ln net.Listener) error {
+	return s.srv.Serve(ln)
+}
+
+// identity is who is on the other end of a session.
+type identity struct {
+	addr netaddr.IPPort
+	node *tailcfg.Node
+	user tailcfg.UserProfile
+}
+
+func (id *identity) String() string {
+	return fmt.Sprintf("%s (%s) from %v", id.user.LoginName, id.node.ComputedName, id.addr)
+}
+
+// identify returns the tailnet identity at remote.
+func (s *Server) identify(remote net.Addr) (*identity, error) {
+	ta, ok := remote.(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected RemoteAddr %#v", remote)
+	}
+	ipp, ok := netaddr.FromStdAddr(ta.IP, ta.Port, "")
+	if !ok {
+		return nil, fmt.Errorf("bogus TCPAddr %#v", ta)
+	}
+	n, u, ok := s.whoIs(ipp)
+	if !ok {
+		return nil, fmt.Errorf("unknown peer %v", ipp)
+	}
+	return &identity{addr: ipp, node: n, user: u}, nil
+}
+
+// authorize returns the tailnet identity at remote and the local user
+// sshUser, if the policy allows the former to log in as the latter.
+func (s *Server) authorize(remote net.Addr, sshUser string) (*identity, *localUser, error) {
+	id, err := s.identify(remote)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !s.policy.Allows(id.user, sshUser) {
+		return id, nil, fmt.Errorf("%v may not log in as %q", id, sshUser)
+	}
+	lu, err := lookupLocalUser(sshUser)
+	if err != nil {
+		return id, nil, err
+	}
+	if os.Getuid() != 0 && lu.Uid != strconv.Itoa(os.Getuid()) {
+		return id, nil, fmt.Errorf("can't log in as %q without running as root", sshUser)
+	}
+	return id, lu, nil
+}
+
+// authorizeSession is authorize for the client of ss. If the client
+// isn't authorized, it tells the client and ends ss.
+func (s *Server) authorizeSession(ss ssh.Session) (_ *identity, _ *localUser, ok bool) {
+	id, lu, err := s.authorize(ss.RemoteAddr(), ss.User())
+	if err != nil {
+		s.logf("ssh: rejected session for %q: %v", ss.User(), err)
+		fmt.Fprintf(ss.Stderr(), "tailssh: access denied\r\n")
+		ss.Exit(1)
+		return nil, nil, false
+	}
+	return id, lu, true
+}
+
+func (s *Server) handleSession(ss ssh.Session) {
+	id, lu, ok := s.authorizeSession(ss)
+	if !ok {
+		return
+	}
+	s.logSession(ss, id, lu, ss.RawCommand(), func() int {
+		return s.runSession(ss, id, lu)
+	})
+}
+
+// logSession logs the start and end of the session ss, which runs
+// cmd as lu, around the call to run, and sends the exit code that run
+// returns to the client.
+func (s *Server) logSession(ss ssh.Session, id *identity, lu *localUser, cmd string, run func() int) {
+	sid := atomic.AddInt64(&s.lastSessionID, 1)
+	start := time.Now()
+	s.logf("ssh: session %d: %v as %q: started, command %q", sid, id, lu.Username, cmd)
+	code := run()
+	s.logf("ssh: session %d: %v as %q: ended after %v with exit code %d", sid, id, lu.Username, time.Since(start).Round(time.Second), code)
+	ss.Exit(code)
+}
+
+// runSession runs the shell, or the command, requested in ss by id as
+// lu and returns its exit code. The session is recorded, with or
+// without a PTY, if the policy says so.
+func (s *Server) runSession(ss ssh.Session, id *identity, lu *localUser) int {
+	cmd := lu.command(ss.RawCommand())
+	cmd.Env = lu.environ()
+	if err := lu.setCredential(cmd); err != nil {
+		s.logf("ssh: %v", err)
+		return 1
+	}
+	if ssh.AgentRequested(ss) {
+		sock, cleanup, err := lu.forwardAgent(ss)
+		if err != nil {
+			s.logf("ssh: agent forwarding: %v", err)
+			fmt.Fprintf(ss.Stderr(), "tailssh: agent forwarding failed\r\n")
+		} else {
+			defer cleanup()
+			cmd.Env = append(cmd.Env, "SSH_AUTH_SOCK="+sock)
+		}
+	}
+
+	ptyReq, winCh, isPty := ss.Pty()
+	if isPty {
+		cmd.Env = append(cmd.Env, "TERM="+ptyReq.Term)
+	}
+
+	var rec *recording
+	if rc := s.policy.Recording; rc != nil {
+		hdr := castHeader{
+			// Without a PTY there's no terminal size, so
+			// use the conventional one.
+			Width:  80,
+			Height: 24,
+			Title:  fmt.Sprintf("%s as %s", id.user.LoginName, lu.Username),
+			Env:    recordingEnv(cmd.Env),
+		}
+		if isPty {
+			hdr.Width, hdr.Height = ptyReq.Window.Width, ptyReq.Window.Height
+		}
+		var err error
+		rec, err = startRecording(s.logf, rc, id, hdr)
+		if err != nil {
+			// Audit requires a recording, so don't run
+			// the session without one.
+			s.logf("ssh: starting recording: %v", err)
+			fmt.Fprintf(ss.Stderr(), "tailssh: session recording failed\r\n")
+			return 1
+		}
+		defer func() {
+			if err := rec.Close(); err != nil {
+				s.logf("ssh: recording %s: %v", rec.name, err)
+			}
+		}()
+	}
+	if !isPty {
+		return s.runCmd(ss, cmd, rec)
+	}
+
+	var stdout io.Writer = ss
+	var stdin io.Reader = ss
+	if rec != nil {
+		stdout = io.MultiWriter(ss, rec.writer("o"))
+		stdin = s.recordedInput(ss, rec)
+	}
+
+	f, err := pty.StartWithSize(cmd, &pty.Winsize{
+		Rows: uint16(ptyReq.Window.Height),
+		Cols: uint16(ptyReq.Window.Width),
+	})
+	if err != nil {
+		s.logf("ssh: starting %v: %v", cmd.Path, err)
+		return 1
+	}
+	defer f.Close()
+
+	go func() {
+		for win := range winCh {
+			pty.Setsize(f, &pty.Winsize{Rows: uint16(win.Height), Cols: uint16(win.Width)})
+			if rec != nil {
+				rec.resize(win.Width, win.Height)
+			}
+		}
+	}()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ss.Context().Done():
+			// The client went away; don't leave its shell running.
+			cmd.Process.Kill()
+		case <-done:
+		}
+	}()
+	if rec != nil {
+		go s.watchRecording(ss, cmd, rec, done)
+	}
+	go io.Copy(f, stdin)
+	io.Copy(stdout, f)
+	return exitCode(cmd.Wait())
+}
+
+// watchRecording tells the client of ss if rec stops before done is
+// closed, and if the policy says to fail closed, ends the session by
+// killing cmd.
+func (s *Server) watchRecording(ss ssh.Session, cmd *exec.Cmd, rec *recording, done <-chan struct{}) {
+	select {
+	case <-rec.stopped():
+	case <-done:
+		return
+	}
+	err := rec.stopReason()
+	if s.policy.Recording.FailClosed {
+		s.logf("ssh: recording %s stopped: %v; ending session", rec.name, err)
+		fmt.Fprintf(ss.Stderr(), "\r\ntailssh: session recording failed; ending session\r\n")
+		cmd.Process.Kill()
+		return
+	}
+	s.logf("ssh: recording %s stopped: %v; session continues unrecorded", rec.name, err)
+	fmt.Fprintf(ss.Stderr(), "\r\ntailssh: session recording stopped; the rest of this session isn't recorded\r\n")
+}
+
+// recordedInput returns the input of ss, recorded in rec if the
+// policy says to record input.
+func (s *Server) recordedInput(ss ssh.Session, rec *recording) io.Reader {
+	if !s.policy.Recording.RecordInput {
+		return ss
+	}
+	return io.TeeReader(ss, rec.writer("i"))
+}
+
+// runCmd runs cmd with its standard input, output and error connected
+// to ss, without a PTY, and returns its exit code. If rec is non-nil,
+// the session is recorded in it, its output and errors both as
+// output events.
+func (s *Server) runCmd(ss ssh.Session, cmd *exec.Cmd, rec *recording) int {
+	var stdin io.Reader = ss
+	cmd.Stdout = ss
+	cmd.Stderr = ss.Stderr()
+	if rec != nil {
+		stdin = s.recordedInput(ss, rec)
+		cmd.Stdout = io.MultiWriter(ss, rec.writer("o"))
+		cmd.Stderr = io.MultiWriter(ss.Stderr(), rec.writer("o"))
+	}
+	// Not cmd.Stdin = ss, as then Wait would wait for the client to
+	// close its end of stdin even after cmd exited.
+	stdinPipe, err := cmd.StdinPipe()
+	if err != nil {
+		s.logf("ssh: %v", err)
+		return 1
+	}
+	if err := cmd.Start(); err != nil {
+		s.logf("ssh: starting %v: %v", cmd.Path, err)
+		return 1
+	}
+	go func() {
+		io.Copy(stdinPipe, stdin)
+		stdinPipe.Close()
+	}()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ss.Context().Done():
+			cmd.Process.Kill()
+		case <-done:
+		}
+	}()
+	if rec != nil {
+		go s.watchRecording(ss, cmd, rec, done)
+	}
+	return exitCode(cmd.Wait())
+}
+
+// exitCode returns the exit code of a process that returned err from
+// Wait.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && ee.ExitCode() >= 0 {
+		return ee.ExitCode()
+	}
+	return 1
+}
+
+// localUser is a local account that sessions run as.
+type localUser struct {
+	*user.User
+	shell string
+}
+
+func lookupLocalUser(name string) (*localUser, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return &localUser{User: u, shell: loginShell(u)}, nil
+}
+
+// command returns the command that runs rawCmd with lu's shell, or
+// the login shell itself if rawCmd is empty.
+func (lu *localUser) command(rawCmd string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if rawCmd == "" {
+		cmd = exec.Command(lu.shell, "-l")
+	} else {
+		cmd = exec.Command(lu.shell, "-c", rawCmd)
+	}
+	cmd.Dir = lu.HomeDir
+	return cmd
+}
+
+func (lu *localUser) environ() []string {
+	return []string{
+		"USER=" + lu.Username,
+		"LOGNAME=" + lu.Username,
+		"HOME=" + lu.HomeDir,
+		"SHELL=" + lu.shell,
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+	}
+}
+
+// isSelf reports whether lu is the user we're running as.
+func (lu *localUser) isSelf() bool {
+	return lu.Uid == strconv.Itoa(os.Getuid())
+}
+
+// ids returns lu's numeric user and primary group IDs.
+func (lu *localUser) ids() (uid, gid uint32, err error) {
+	u, err := strconv.ParseUint(lu.Uid, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad uid %q for %q", lu.Uid, lu.Username)
+	}
+	g, err := strconv.ParseUint(lu.Gid, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad gid %q for %q", lu.Gid, lu.Username)
+	}
+	return uint32(u), uint32(g), nil
+}
+
+// setCredential arranges for cmd to run as lu, if that's not who we
+// already are.
+func (lu *localUser) setCredential(cmd *exec.Cmd) error {
+	if lu.isSelf() {
+		return nil
+	}
+	uid, gid, err := lu.ids()
+	if err != nil {
+		return err
+	}
+	cred := &syscall.Credential{Uid: uid, Gid: gid}
+	gids, err := lu.GroupIds()
+	if err != nil {
+		return fmt.Errorf("groups of %q: %w", lu.Username, err)
+	}
+	for _, g := range gids {
+		if v, err := strconv.ParseUint(g, 10, 32); err == nil {
+			cred.Groups = append(cred.Groups, uint32(v))
+		}
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	return nil
+}
+
+// forwardAgent listens on a new Unix socket, owned by lu, whose
+// connections are forwarded to the SSH agent of the client of ss. It
+// returns the socket's path and a func to remove it.
+func (lu *localUser) forwardAgent(ss ssh.Session) (sock string, cleanup func(), err error) {
+	ln, err := ssh.NewAgentListener()
+	if err != nil {
+		return "", nil, err
+	}
+	sock = ln.Addr().String()
+	dir := filepath.Dir(sock)
+	cleanup = func() {
+		ln.Close()
+		os.RemoveAll(dir)
+	}
+	if !lu.isSelf() {
+		uid, gid, err := lu.ids()
+		if err == nil {
+			err = os.Chown(dir, int(uid), int(gid))
+		}
+		if err == nil {
+			err = os.Chown(sock, int(uid), int(gid))
+		}
+		if err != nil {
+			cleanup()
+			return "", nil, err
+		}
+	}
+	go ssh.ForwardAgentConnections(ln, ss)
+	return sock, cleanup, nil
+}
@@ -0,0 +1,339 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin
+
+package tailssh
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+)
+
+func TestMain(m *testing.M) {
+	// The server runs the test binary to serve SFTP.
+	if len(os.Args) > 1 && os.Args[1] == SFTPSubcommand {
+		if err := SFTPServerMain(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// testClient starts a Server with the policy polJSON, in which every
+// connection is from "$USER@example.com", and returns a client
+// connected to it as the current user.
+func testClient(t *testing.T, polJSON string) *gossh.Client {
+	t.Helper()
+	cur, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pol, err := ParsePolicy([]byte(polJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	whoIs := func(netaddr.IPPort) (*tailcfg.Node, tailcfg.UserProfile, bool) {
+		return &tailcfg.Node{ComputedName: "test"}, tailcfg.UserProfile{LoginName: cur.Username + "@example.com"}, true
+	}
+	srv, err := NewServer(t.Logf, hostKey, whoIs, pol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go srv.Serve(ln)
+
+	c, err := gossh.Dial("tcp", ln.Addr().String(), &gossh.ClientConfig{
+		User:            cur.Username,
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+const selfPolicy = `{"Rules": [{"Users": ["*"], "LocalUsers": ["="]}]}`
+
+func TestExec(t *testing.T) {
+	c := testClient(t, selfPolicy)
+	sess, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	sess.Stdin = strings.NewReader("from stdin\n")
+	out, err := sess.Output("cat; echo hello; exit 3")
+	if got, want := string(out), "from stdin\nhello\n"; got != want {
+		t.Errorf("output = %q; want %q", got, want)
+	}
+	var ee *gossh.ExitError
+	if !errors.As(err, &ee) || ee.ExitStatus() != 3 {
+		t.Errorf("err = %v; want exit status 3", err)
+	}
+}
+
+func TestLoginDenied(t *testing.T) {
+	c := testClient(t, `{"Rules": [{"Users": ["nobody@example.com"], "LocalUsers": ["*"]}]}`)
+	sess, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	out, err := sess.Output("echo hello")
+	if err == nil || len(out) > 0 {
+		t.Errorf("got (%q, %v); want no output and an error", out, err)
+	}
+}
+
+func TestSFTP(t *testing.T) {
+	c := testClient(t, selfPolicy)
+	sc, err := sftp.NewClient(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	path := filepath.Join(t.TempDir(), "file.txt")
+	f, err := sc.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(f, "hello over sftp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello over sftp" {
+		t.Errorf("file contents = %q", got)
+	}
+}
+
+// echoServer starts a TCP server on 127.0.0.1 that echoes the first
+// line it reads from each connection, and returns its address.
+func echoServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go echoLine(c)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func echoLine(c net.Conn) {
+	defer c.Close()
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		return
+	}
+	io.WriteString(c, line)
+}
+
+// roundTrip writes a line to c and returns the line it reads back.
+func roundTrip(t *testing.T, c net.Conn) string {
+	t.Helper()
+	defer c.Close()
+	if _, err := io.WriteString(c, "ping\n"); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return line
+}
+
+func TestLocalForward(t *testing.T) {
+	allowed := echoServer(t)
+	denied := echoServer(t)
+	c := testClient(t, fmt.Sprintf(`{"Rules": [{"Users": ["*"], "LocalUsers": ["="], "LocalForwards": [%q]}]}`, allowed))
+
+	conn, err := c.Dial("tcp", allowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := roundTrip(t, conn); got != "ping\n" {
+		t.Errorf("got %q; want ping", got)
+	}
+
+	if conn, err := c.Dial("tcp", denied); err == nil {
+		conn.Close()
+		t.Errorf("dial to %v succeeded; want policy denial", denied)
+	}
+}
+
+func TestRemoteForward(t *testing.T) {
+	c := testClient(t, `{"Rules": [{"Users": ["*"], "LocalUsers": ["="], "RemoteForwards": ["127.0.0.1:*"]}]}`)
+
+	ln, err := c.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		echoLine(c)
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := roundTrip(t, conn); got != "ping\n" {
+		t.Errorf("got %q; want ping", got)
+	}
+
+	if ln, err := c.Listen("tcp", "0.0.0.0:0"); err == nil {
+		ln.Close()
+		t.Errorf("listen on 0.0.0.0 succeeded; want policy denial")
+	}
+}
+
+func TestRemoteForwardAllInterfaces(t *testing.T) {
+	// Listeners on all interfaces are dual-stack, so IPv4 alone isn't
+	// enough.
+	c := testClient(t, `{"Rules": [{"Users": ["*"], "LocalUsers": ["="], "RemoteForwards": ["0.0.0.0:*"]}]}`)
+	if ln, err := c.Listen("tcp", "0.0.0.0:0"); err == nil {
+		ln.Close()
+		t.Errorf("listen on 0.0.0.0 with only IPv4 allowed succeeded; want policy denial")
+	}
+
+	c = testClient(t, `{"Rules": [{"Users": ["*"], "LocalUsers": ["="], "RemoteForwards": ["0.0.0.0:*", "[::]:*"]}]}`)
+	ln, err := c.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatalf("listen on 0.0.0.0 with both allowed: %v", err)
+	}
+	ln.Close()
+}
+
+func TestResolveForwardHost(t *testing.T) {
+	tests := []struct {
+		host   string
+		listen bool
+		want   string
+	}{
+		{"", false, "[0.0.0.0]"},
+		{"", true, "[0.0.0.0 ::]"},
+		{"::", true, "[0.0.0.0 ::]"},
+		{"10.0.0.1", true, "[10.0.0.1]"},
+		{"10.0.0.1", false, "[10.0.0.1]"},
+		{"example.com", true, "error"},
+	}
+	for _, tt := range tests {
+		ips, err := resolveForwardHost(tt.host, tt.listen)
+		got := fmt.Sprint(ips)
+		if err != nil {
+			got = "error"
+		}
+		if got != tt.want {
+			t.Errorf("resolveForwardHost(%q, %v) = %v; want %v", tt.host, tt.listen, got, tt.want)
+		}
+	}
+}
+
+func TestAgentForward(t *testing.T) {
+	c := testClient(t, selfPolicy)
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv, Comment: "test key"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.ForwardToAgent(c, keyring); err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	if err := agent.RequestAgentForwarding(sess); err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Start(`echo "$SSH_AUTH_SOCK"; sleep 10`); err != nil {
+		t.Fatal(err)
+	}
+	sock, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock = strings.TrimSpace(sock)
+	if sock == "" {
+		t.Fatal("SSH_AUTH_SOCK not set")
+	}
+
+	// We're the same user as the session, so we can use its socket
+	// directly.
+	ac, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	keys, err := agent.NewClient(ac).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Comment != "test key" {
+		t.Errorf("agent keys = %v; want the test key", keys)
+	}
+}
@@ -0,0 +1,26 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailssh
+
+import (
+	"os/exec"
+	"os/user"
+	"strings"
+)
+
+// loginShell returns u's login shell from Directory Services, or
+// /bin/sh if it can't be found.
+func loginShell(u *user.User) string {
+	out, err := exec.Command("dscl", ".", "-read", "/Users/"+u.Username, "UserShell").Output()
+	if err != nil {
+		return "/bin/sh"
+	}
+	// Output is of the form "UserShell: /bin/zsh".
+	f := strings.Fields(string(out))
+	if len(f) != 2 || f[0] != "UserShell:" {
+		return "/bin/sh"
+	}
+	return f[1]
+}
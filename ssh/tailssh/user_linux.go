@@ -0,0 +1,37 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailssh
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/user"
+	"strings"
+)
+
+// loginShell returns u's login shell from /etc/passwd, or /bin/sh if
+// it's not listed there.
+func loginShell(u *user.User) string {
+	f, err := os.Open("/etc/passwd")
+	if err != nil {
+		return "/bin/sh"
+	}
+	defer f.Close()
+	return shellFromPasswd(f, u.Username)
+}
+
+// shellFromPasswd returns the login shell of username in the
+// passwd(5) file r, or /bin/sh if it's not listed there.
+func shellFromPasswd(r io.Reader, username string) string {
+	bs := bufio.NewScanner(r)
+	for bs.Scan() {
+		f := strings.Split(bs.Text(), ":")
+		if len(f) == 7 && f[0] == username && f[6] != "" {
+			return f[6]
+		}
+	}
+	return "/bin/sh"
+}
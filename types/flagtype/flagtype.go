@@ -44,3 +44,37 @@ func (p portValue) Set(v string) error {
 	*p.n = uint16(n)
 	return nil
 }
+
+type portListValue struct{ ports *[]uint16 }
+
+// PortListValue returns a flag.Value for a comma-separated list of
+// port numbers, such as "22,80,443".
+func PortListValue(dst *[]uint16) flag.Value {
+	return portListValue{dst}
+}
+
+func (p portListValue) String() string {
+	if p.ports == nil {
+		return ""
+	}
+	var s []string
+	for _, n := range *p.ports {
+		s = append(s, fmt.Sprint(n))
+	}
+	return strings.Join(s, ",")
+}
+
+func (p portListValue) Set(v string) error {
+	var ports []uint16
+	if v != "" {
+		for _, f := range strings.Split(v, ",") {
+			var n uint16
+			if err := (portValue{&n}).Set(strings.TrimSpace(f)); err != nil {
+				return fmt.Errorf("port %q: %w", f, err)
+			}
+			ports = append(ports, n)
+		}
+	}
+	*p.ports = ports
+	return nil
+}
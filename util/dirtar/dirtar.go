@@ -0,0 +1,177 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dirtar sends directory trees as tar archives and safely
+// extracts them again, as used by Taildrop.
+//
+// Only directories and regular files are included, with their relative
+// paths and permission bits. Extraction rejects any path that would
+// escape the destination directory.
+package dirtar
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Write writes a tar archive of the contents of the directory dir to w.
+// Symlinks and other special files are skipped.
+func Write(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name:    filepath.ToSlash(rel),
+			Mode:    int64(fi.Mode().Perm()),
+			ModTime: fi.ModTime(),
+		}
+		if d.IsDir() {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+			return tw.WriteHeader(hdr)
+		}
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = fi.Size()
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.CopyN(tw, f, hdr.Size)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Extract extracts the tar archive read from r, as written by Write,
+// into the existing directory dir.
+//
+// Every path in the archive must be relative and stay within dir, and
+// if validName is non-nil, it must accept each of the path's elements.
+// Existing files aren't overwritten. Entries other than directories and
+// regular files are skipped. Directories are always left writable by
+// their owner, so the tree can be moved and deleted.
+func Extract(r io.Reader, dir string, validName func(string) bool) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name, err := cleanName(hdr.Name, validName)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(dir, filepath.FromSlash(name))
+		mode := fs.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dst, 0700); err != nil {
+				return err
+			}
+			if err := os.Chmod(dst, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+				return err
+			}
+			if err := extractFile(dst, mode, tr); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func extractFile(dst string, mode fs.FileMode, r io.Reader) error {
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ErrUnsafePath is returned by Extract for archives with paths that
+// aren't safe to extract.
+var ErrUnsafePath = errors.New("unsafe path in archive")
+
+// cleanName returns the slash-separated relative path of the archive
+// entry name, or an error if it's not safe to extract.
+func cleanName(name string, validName func(string) bool) (string, error) {
+	name = strings.TrimSuffix(name, "/")
+	if name == "" || strings.Contains(name, "\\") || strings.Contains(name, "\x00") {
+		return "", fmt.Errorf("%w: %q", ErrUnsafePath, name)
+	}
+	if path.IsAbs(name) || path.Clean(name) != name || filepath.IsAbs(filepath.FromSlash(name)) {
+		return "", fmt.Errorf("%w: %q", ErrUnsafePath, name)
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." || elem == "." || (len(elem) == 2 && elem[1] == ':') {
+			return "", fmt.Errorf("%w: %q", ErrUnsafePath, name)
+		}
+		if validName != nil && !validName(elem) {
+			return "", fmt.Errorf("%w: %q", ErrUnsafePath, name)
+		}
+	}
+	return name, nil
+}
+
+// Size returns the total size of the regular files in the tree at dir.
+func Size(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
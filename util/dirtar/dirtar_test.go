@@ -0,0 +1,109 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dirtar
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "sub", "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "sub", "run.sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" {
+		if err := os.Symlink("/etc/passwd", filepath.Join(src, "link")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	if err := Extract(&buf, dst, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(dst, "a.txt")); err != nil || string(b) != "hello" {
+		t.Errorf("a.txt = %q, %v", b, err)
+	}
+	if fi, err := os.Stat(filepath.Join(dst, "sub", "empty")); err != nil || !fi.IsDir() {
+		t.Errorf("empty directory not extracted: %v", err)
+	}
+	if runtime.GOOS != "windows" {
+		if fi, err := os.Stat(filepath.Join(dst, "sub", "run.sh")); err != nil || fi.Mode().Perm() != 0755 {
+			t.Errorf("run.sh not extracted with its mode: %v, %v", fi, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "link")); !os.IsNotExist(err) {
+		t.Errorf("symlink was sent")
+	}
+	if size, err := Size(dst); err != nil || size != int64(len("hello")+len("#!/bin/sh\n")) {
+		t.Errorf("Size = %v, %v", size, err)
+	}
+}
+
+func TestExtractUnsafe(t *testing.T) {
+	for _, name := range []string{
+		"../evil",
+		"a/../../evil",
+		"/etc/evil",
+		"a/./b",
+		`a\..\evil`,
+		"C:/evil",
+		"bad*name",
+	} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 1})
+		tw.Write([]byte("x"))
+		tw.Close()
+
+		dir := t.TempDir()
+		validName := func(s string) bool { return !strings.Contains(s, "*") }
+		err := Extract(&buf, filepath.Join(dir, "dst"), validName)
+		if !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("Extract of %q: err = %v; want unsafe path", name, err)
+		}
+		if des, _ := ioutil.ReadDir(dir); len(des) != 0 {
+			t.Errorf("Extract of %q wrote something", name)
+		}
+	}
+}
+
+func TestExtractNoOverwrite(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "a.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 1})
+	tw.Write([]byte("x"))
+	tw.Close()
+
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Extract(&buf, dir, nil); !os.IsExist(err) {
+		t.Errorf("Extract over existing file: err = %v; want exists", err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "a.txt")); string(b) != "keep" {
+		t.Errorf("existing file overwritten with %q", b)
+	}
+}
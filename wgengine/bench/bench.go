@@ -8,6 +8,7 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -19,6 +20,7 @@ import (
 
 	"inet.af/netaddr"
 	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/magicsock"
 )
 
 const PayloadSize = 1000
@@ -82,6 +84,12 @@ func main() {
 	case 101:
 		setupWGTest(nil, logf, traf, Addr1, Addr2)
 
+	// Same as 101, but with magicsock's batched UDP I/O
+	// (recvmmsg/sendmmsg, GSO/GRO) disabled, for comparison.
+	case 102:
+		os.Setenv("TS_DEBUG_DISABLE_UDP_BATCHING", "1")
+		setupWGTest(nil, logf, traf, Addr1, Addr2)
+
 	default:
 		log.Fatalf("provide a valid test number (0..n)")
 	}
@@ -90,6 +98,7 @@ func main() {
 	traf.Start(Addr1.IP(), Addr2.IP(), PayloadSize+ICMPMinSize, 0)
 
 	var cur, prev Snapshot
+	var curIO, prevIO magicsock.UDPIOStats
 	var pps int64
 	i := 0
 	for {
@@ -97,14 +106,14 @@ func main() {
 		time.Sleep(10 * time.Millisecond)
 
 		if (i % 100) == 0 {
-			prev = cur
-			cur = traf.Snap()
+			prev, prevIO = cur, curIO
+			cur, curIO = traf.Snap(), magicsock.GetUDPIOStats()
 			d := cur.Sub(prev)
 
 			if prev.WhenNsec == 0 {
 				logf("tx=%-6d rx=%-6d", d.TxPackets, d.RxPackets)
 			} else {
-				logf("%v @%7d pkt/s", d, pps)
+				logf("%v @%7d pkt/s%s", d, pps, ioStatsString(curIO.Sub(prevIO)))
 			}
 		}
 
@@ -112,6 +121,16 @@ func main() {
 	}
 }
 
+// ioStatsString formats magicsock's UDP packets-per-syscall counters,
+// or returns the empty string if the test didn't use magicsock.
+func ioStatsString(d magicsock.UDPIOStats) string {
+	if d.SendSyscalls == 0 && d.RecvSyscalls == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (udp %.2f tx pkt/syscall, %.2f rx pkt/syscall)",
+		d.SendPacketsPerSyscall(), d.RecvPacketsPerSyscall())
+}
+
 func newDebugMux() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
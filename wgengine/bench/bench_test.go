@@ -8,10 +8,12 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"testing"
 	"time"
 
 	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/magicsock"
 )
 
 func BenchmarkTrivialNoAlloc(b *testing.B) {
@@ -47,6 +49,16 @@ func BenchmarkWireGuardTest(b *testing.B) {
 	})
 }
 
+// BenchmarkWireGuardTestNoBatching is BenchmarkWireGuardTest with
+// magicsock's batched UDP I/O disabled, as a baseline.
+func BenchmarkWireGuardTestNoBatching(b *testing.B) {
+	os.Setenv("TS_DEBUG_DISABLE_UDP_BATCHING", "1")
+	defer os.Unsetenv("TS_DEBUG_DISABLE_UDP_BATCHING")
+	run(b, func(logf logger.Logf, traf *TrafficGen) {
+		setupWGTest(b, logf, traf, Addr1, Addr2)
+	})
+}
+
 type SetupFunc func(logger.Logf, *TrafficGen)
 
 func run(b *testing.B, setup SetupFunc) {
@@ -74,11 +86,13 @@ func runOnce(b *testing.B, setup SetupFunc, payload int) {
 
 	traf := NewTrafficGen(b.StartTimer)
 	setup(logf, traf)
+	startIO := magicsock.GetUDPIOStats()
 
 	logf("initialized. (n=%v)", b.N)
 	b.SetBytes(int64(payload))
 
 	traf.Start(Addr1.IP(), Addr2.IP(), payload, int64(b.N))
+	first := traf.Snap()
 
 	var cur, prev Snapshot
 	var pps int64
@@ -105,4 +119,13 @@ func runOnce(b *testing.B, setup SetupFunc, payload int) {
 	loss := float64(d.LostPackets) / float64(d.RxPackets)
 
 	b.ReportMetric(loss*100, "%lost")
+
+	total := cur.Sub(first)
+	if total.DurationNsec > 0 {
+		b.ReportMetric(float64(total.Bytes)*8*1e3/float64(total.DurationNsec), "Mbit/s")
+	}
+	if io := magicsock.GetUDPIOStats().Sub(startIO); io.SendSyscalls > 0 {
+		b.ReportMetric(io.SendPacketsPerSyscall(), "txpkt/syscall")
+		b.ReportMetric(io.RecvPacketsPerSyscall(), "rxpkt/syscall")
+	}
 }
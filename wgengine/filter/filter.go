@@ -6,6 +6,7 @@
 package filter
 
 import (
+	"expvar"
 	"fmt"
 	"os"
 	"sync"
@@ -13,6 +14,7 @@ import (
 
 	"golang.org/x/time/rate"
 	"inet.af/netaddr"
+	"tailscale.com/metrics"
 	"tailscale.com/net/flowtrack"
 	"tailscale.com/net/packet"
 	"tailscale.com/types/ipproto"
@@ -231,7 +233,18 @@ func init() {
 	dropBucket = rate.NewLimiter(rate.Every(time.Millisecond), 10)
 }
 
+// dropCounts counts the packets dropped by all Filters, by the reason
+// they were dropped for.
+var dropCounts = &metrics.LabelMap{Label: "reason"}
+
+func init() {
+	expvar.Publish("counter_tailscaled_filter_drops", dropCounts)
+}
+
 func (f *Filter) logRateLimit(runflags RunFlags, q *packet.Parsed, dir direction, r Response, why string) {
+	if r == Drop {
+		dropCounts.Get(why).Add(1)
+	}
 	if !f.loggingAllowed(q) {
 		return
 	}
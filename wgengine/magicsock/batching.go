@@ -0,0 +1,97 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"os"
+	"strconv"
+	"sync/atomic"
+
+	"inet.af/netaddr"
+)
+
+// udpBatchingDisabled reports whether batched UDP I/O
+// (recvmmsg/sendmmsg and UDP GSO/GRO) is disabled by the
+// TS_DEBUG_DISABLE_UDP_BATCHING environment variable.
+//
+// It's checked each time a socket is bound, rather than once at
+// startup, so benchmarks can compare both modes in one process.
+func udpBatchingDisabled() bool {
+	v, _ := strconv.ParseBool(os.Getenv("TS_DEBUG_DISABLE_UDP_BATCHING"))
+	return v
+}
+
+// batchReader is implemented by net.PacketConns that read several
+// datagrams per system call and hand them out one at a time.
+type batchReader interface {
+	ReadFromNetaddr(b []byte) (n int, ipp netaddr.IPPort, err error)
+}
+
+// Process-wide counters of UDP packets and the system calls used to
+// move them, for all magicsock UDP sockets. They're updated atomically.
+var (
+	udpRecvPackets  int64
+	udpRecvSyscalls int64
+	udpSendPackets  int64
+	udpSendSyscalls int64
+)
+
+// UDPIOStats are counters of UDP packets sent and received by
+// magicsock and the number of system calls it took to do so.
+type UDPIOStats struct {
+	RecvPackets  int64
+	RecvSyscalls int64
+	SendPackets  int64
+	SendSyscalls int64
+}
+
+// Sub returns the counters in s minus those in prev.
+func (s UDPIOStats) Sub(prev UDPIOStats) UDPIOStats {
+	return UDPIOStats{
+		RecvPackets:  s.RecvPackets - prev.RecvPackets,
+		RecvSyscalls: s.RecvSyscalls - prev.RecvSyscalls,
+		SendPackets:  s.SendPackets - prev.SendPackets,
+		SendSyscalls: s.SendSyscalls - prev.SendSyscalls,
+	}
+}
+
+// RecvPacketsPerSyscall returns the average number of packets
+// received per receive system call, or 0 if there were none.
+func (s UDPIOStats) RecvPacketsPerSyscall() float64 {
+	if s.RecvSyscalls == 0 {
+		return 0
+	}
+	return float64(s.RecvPackets) / float64(s.RecvSyscalls)
+}
+
+// SendPacketsPerSyscall returns the average number of packets
+// sent per send system call, or 0 if there were none.
+func (s UDPIOStats) SendPacketsPerSyscall() float64 {
+	if s.SendSyscalls == 0 {
+		return 0
+	}
+	return float64(s.SendPackets) / float64(s.SendSyscalls)
+}
+
+// GetUDPIOStats returns a snapshot of magicsock's process-wide UDP
+// I/O counters.
+func GetUDPIOStats() UDPIOStats {
+	return UDPIOStats{
+		RecvPackets:  atomic.LoadInt64(&udpRecvPackets),
+		RecvSyscalls: atomic.LoadInt64(&udpRecvSyscalls),
+		SendPackets:  atomic.LoadInt64(&udpSendPackets),
+		SendSyscalls: atomic.LoadInt64(&udpSendSyscalls),
+	}
+}
+
+func noteUDPRecv(packets int) {
+	atomic.AddInt64(&udpRecvPackets, int64(packets))
+	atomic.AddInt64(&udpRecvSyscalls, 1)
+}
+
+func noteUDPSend(packets int) {
+	atomic.AddInt64(&udpSendPackets, int64(packets))
+	atomic.AddInt64(&udpSendSyscalls, 1)
+}
@@ -0,0 +1,19 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package magicsock
+
+import (
+	"net"
+
+	"tailscale.com/types/logger"
+)
+
+// tryUpgradeToBatchingConn returns pconn unmodified. Batched UDP I/O
+// is only implemented on Linux.
+func tryUpgradeToBatchingConn(pconn net.PacketConn, network string, logf logger.Logf) net.PacketConn {
+	return pconn
+}
@@ -0,0 +1,385 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+	"inet.af/netaddr"
+	"tailscale.com/syncs"
+	"tailscale.com/types/logger"
+)
+
+const (
+	// udpSegment is the Linux UDP_SEGMENT socket option (Linux 4.18+),
+	// used as a control message to send a UDP GSO batch.
+	udpSegment = 103
+	// udpGRO is the Linux UDP_GRO socket option (Linux 5.0+).
+	udpGRO = 104
+
+	// maxGSOSegments is the kernel's UDP_MAX_SEGMENTS.
+	maxGSOSegments = 64
+	// maxGSOSize is the largest total payload of one GSO send.
+	maxGSOSize = 65507
+
+	// readBatchSize is the number of datagrams read per recvmmsg
+	// call, and readBufSize the size of each datagram's buffer.
+	// With GRO each "datagram" may be many coalesced ones, so the
+	// buffers are larger and there are fewer of them.
+	readBatchSize    = 32
+	readBufSize      = 9216
+	readBatchSizeGRO = 8
+	readBufSizeGRO   = 65535
+
+	// writeBatchSize is the maximum number of messages per sendmmsg.
+	writeBatchSize = 64
+)
+
+// batchConn is the common subset of *ipv4.PacketConn and
+// *ipv6.PacketConn used by linuxBatchingConn.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// linuxBatchingConn is a *net.UDPConn that reads with recvmmsg and
+// writes with sendmmsg, using UDP GRO and GSO when the kernel
+// supports them.
+//
+// Reads return one datagram at a time from the most recent batch.
+// Concurrent writes are combined: the first writer to arrive sends
+// everything queued behind it in one system call.
+type linuxBatchingConn struct {
+	*net.UDPConn
+	logf logger.Logf
+	xpc  batchConn
+
+	rmu   sync.Mutex
+	rmsgs []ipv4.Message
+	rq    []queuedRead // datagrams not yet returned from last batch
+
+	gso syncs.AtomicBool
+
+	wmu      sync.Mutex
+	flushing bool
+	wq       []*pendingWrite
+	wspare   []*pendingWrite // reused backing array for wq
+	wmsgs    []ipv4.Message  // only used by the flushing writer
+	wspans   [][2]int        // for each of wmsgs, its range of writes
+}
+
+type queuedRead struct {
+	b   []byte
+	ipp netaddr.IPPort
+}
+
+type pendingWrite struct {
+	b    []byte
+	addr *net.UDPAddr
+	err  error
+	done chan struct{}
+}
+
+var pendingWritePool = &sync.Pool{
+	New: func() interface{} { return &pendingWrite{done: make(chan struct{}, 1)} },
+}
+
+// tryUpgradeToBatchingConn returns pconn wrapped to do batched I/O,
+// if possible. Otherwise it returns pconn unmodified.
+func tryUpgradeToBatchingConn(pconn net.PacketConn, network string, logf logger.Logf) net.PacketConn {
+	if udpBatchingDisabled() {
+		return pconn
+	}
+	uc, ok := pconn.(*net.UDPConn)
+	if !ok {
+		return pconn
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return pconn
+	}
+	bc := &linuxBatchingConn{
+		UDPConn: uc,
+		logf:    logf,
+	}
+	switch network {
+	case "udp4":
+		bc.xpc = ipv4.NewPacketConn(uc)
+	case "udp6":
+		bc.xpc = ipv6.NewPacketConn(uc)
+	default:
+		return pconn
+	}
+
+	var gro, gso bool
+	rc.Control(func(fd uintptr) {
+		gro = unix.SetsockoptInt(int(fd), unix.IPPROTO_UDP, udpGRO, 1) == nil
+		_, err := unix.GetsockoptInt(int(fd), unix.IPPROTO_UDP, udpSegment)
+		gso = err == nil
+	})
+	bc.gso.Set(gso)
+
+	n, size := readBatchSize, readBufSize
+	if gro {
+		n, size = readBatchSizeGRO, readBufSizeGRO
+	}
+	bc.rmsgs = make([]ipv4.Message, n)
+	for i := range bc.rmsgs {
+		bc.rmsgs[i].Buffers = [][]byte{make([]byte, size)}
+		bc.rmsgs[i].OOB = make([]byte, unix.CmsgSpace(4))
+	}
+	bc.wmsgs = make([]ipv4.Message, 0, writeBatchSize)
+	logf("magicsock: %s batched UDP I/O enabled (gro=%v, gso=%v)", network, gro, gso)
+	return bc
+}
+
+// ReadFromNetaddr reads a single datagram into b, reading a new
+// batch from the kernel only once the previous one is used up.
+func (c *linuxBatchingConn) ReadFromNetaddr(b []byte) (n int, ipp netaddr.IPPort, err error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for len(c.rq) == 0 {
+		if err := c.readBatchLocked(); err != nil {
+			return 0, netaddr.IPPort{}, err
+		}
+	}
+	r := c.rq[0]
+	c.rq = c.rq[1:]
+	return copy(b, r.b), r.ipp, nil
+}
+
+// ReadFrom implements net.PacketConn.
+func (c *linuxBatchingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, ipp, err := c.ReadFromNetaddr(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, ipp.UDPAddr(), nil
+}
+
+func (c *linuxBatchingConn) readBatchLocked() error {
+	n, err := c.xpc.ReadBatch(c.rmsgs, 0)
+	if err != nil {
+		return err
+	}
+	c.rq = c.rq[:0]
+	var packets int
+	for i := 0; i < n; i++ {
+		msg := &c.rmsgs[i]
+		ua, ok := msg.Addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		ipp, ok := netaddr.FromStdAddr(ua.IP, ua.Port, ua.Zone)
+		if !ok {
+			continue
+		}
+		buf := msg.Buffers[0][:msg.N]
+		seg := groSegmentSize(msg.OOB[:msg.NN])
+		if seg <= 0 {
+			seg = len(buf)
+		}
+		for len(buf) > 0 {
+			m := seg
+			if m > len(buf) {
+				m = len(buf)
+			}
+			c.rq = append(c.rq, queuedRead{b: buf[:m], ipp: ipp})
+			buf = buf[m:]
+			packets++
+		}
+	}
+	noteUDPRecv(packets)
+	return nil
+}
+
+// groSegmentSize returns the segment size from a UDP_GRO control
+// message in oob, or 0 if there isn't one.
+func groSegmentSize(oob []byte) int {
+	if len(oob) == 0 {
+		return 0
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, m := range msgs {
+		if m.Header.Level == unix.SOL_UDP && m.Header.Type == udpGRO && len(m.Data) >= 4 {
+			return int(*(*int32)(unsafe.Pointer(&m.Data[0])))
+		}
+	}
+	return 0
+}
+
+// WriteTo implements net.PacketConn. Writes that arrive while
+// another is in progress are queued and sent together.
+func (c *linuxBatchingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return c.UDPConn.WriteTo(b, addr)
+	}
+	w := pendingWritePool.Get().(*pendingWrite)
+	w.b, w.addr, w.err = b, ua, nil
+
+	c.wmu.Lock()
+	c.wq = append(c.wq, w)
+	if !c.flushing {
+		c.flushing = true
+		for len(c.wq) > 0 {
+			batch := c.wq
+			c.wq = c.wspare[:0]
+			c.wmu.Unlock()
+			c.writeBatch(batch)
+			c.wmu.Lock()
+			for i := range batch {
+				batch[i] = nil
+			}
+			c.wspare = batch[:0]
+		}
+		c.flushing = false
+	}
+	c.wmu.Unlock()
+
+	<-w.done
+	err := w.err
+	w.b, w.addr, w.err = nil, nil, nil
+	pendingWritePool.Put(w)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeBatch sends ws, setting each write's err and signaling
+// its done channel.
+func (c *linuxBatchingConn) writeBatch(ws []*pendingWrite) {
+	for len(ws) > 0 {
+		n := c.buildMsgs(ws, c.gso.Get())
+		ws = ws[c.sendMsgs(ws[:n]):]
+	}
+}
+
+// buildMsgs fills c.wmsgs and c.wspans from a prefix of ws and returns
+// the number of writes used.
+//
+// With gso, consecutive writes to the same address of the same size
+// (the last may be shorter) are combined into one message.
+func (c *linuxBatchingConn) buildMsgs(ws []*pendingWrite, gso bool) int {
+	c.wmsgs = c.wmsgs[:0]
+	c.wspans = c.wspans[:0]
+	i := 0
+	for i < len(ws) && len(c.wmsgs) < writeBatchSize {
+		j := i + 1
+		if gso {
+			size, total := len(ws[i].b), len(ws[i].b)
+			for j < len(ws) && j-i < maxGSOSegments &&
+				sameUDPAddr(ws[j].addr, ws[i].addr) &&
+				len(ws[j].b) <= size &&
+				total+len(ws[j].b) <= maxGSOSize {
+				total += len(ws[j].b)
+				j++
+				if len(ws[j-1].b) < size {
+					break // a short segment must be last
+				}
+			}
+		}
+		k := len(c.wmsgs)
+		c.wmsgs = c.wmsgs[:k+1]
+		msg := &c.wmsgs[k]
+		msg.Addr = ws[i].addr
+		msg.Buffers = msg.Buffers[:0]
+		for _, w := range ws[i:j] {
+			msg.Buffers = append(msg.Buffers, w.b)
+		}
+		msg.OOB = msg.OOB[:0]
+		if j-i > 1 {
+			msg.OOB = appendUDPSegment(msg.OOB, uint16(len(ws[i].b)))
+		}
+		c.wspans = append(c.wspans, [2]int{i, j})
+		i = j
+	}
+	return i
+}
+
+// sendMsgs sends c.wmsgs, which were built from ws by buildMsgs.
+// It returns how many of ws it completed. That's fewer than len(ws)
+// only if GSO turned out not to work and the rest need resending
+// without it.
+func (c *linuxBatchingConn) sendMsgs(ws []*pendingWrite) (done int) {
+	ms := c.wmsgs
+	for start := 0; start < len(ms); {
+		n, err := c.xpc.WriteBatch(ms[start:], 0)
+		if err != nil {
+			noteUDPSend(0)
+			if len(ms[start].OOB) > 0 && errors.Is(err, unix.EIO) {
+				// EIO from a GSO send means the device can't
+				// offload it. Stop using GSO and let
+				// writeBatch resend from this message.
+				c.gso.Set(false)
+				c.logf("magicsock: disabling UDP GSO: %v", err)
+				done = c.wspans[start][0]
+				finishWrites(ws[:done], nil)
+				return done
+			}
+			span := c.wspans[start]
+			for _, w := range ws[span[0]:span[1]] {
+				w.err = err
+			}
+			start++
+			continue
+		}
+		var packets int
+		for _, m := range ms[start : start+n] {
+			packets += len(m.Buffers)
+		}
+		noteUDPSend(packets)
+		start += n
+	}
+	finishWrites(ws, nil)
+	return len(ws)
+}
+
+// finishWrites signals completion of ws, setting err on any
+// that don't already have an error.
+func finishWrites(ws []*pendingWrite, err error) {
+	for _, w := range ws {
+		if w.err == nil {
+			w.err = err
+		}
+		w.done <- struct{}{}
+	}
+}
+
+// appendUDPSegment appends a UDP_SEGMENT control message with the
+// given segment size to oob.
+func appendUDPSegment(oob []byte, size uint16) []byte {
+	n := len(oob)
+	space := unix.CmsgSpace(2)
+	if cap(oob)-n < space {
+		nb := make([]byte, n, n+space)
+		copy(nb, oob)
+		oob = nb
+	}
+	oob = oob[:n+space]
+	for i := n; i < len(oob); i++ {
+		oob[i] = 0
+	}
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[n]))
+	h.Level = unix.SOL_UDP
+	h.Type = udpSegment
+	h.SetLen(unix.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&oob[n+unix.CmsgLen(0)])) = size
+	return oob
+}
+
+func sameUDPAddr(a, b *net.UDPAddr) bool {
+	return a == b || (a.Port == b.Port && a.IP.Equal(b.IP) && a.Zone == b.Zone)
+}
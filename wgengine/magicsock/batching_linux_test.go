@@ -0,0 +1,127 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func newTestBatchingConn(t *testing.T) *linuxBatchingConn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	bc, ok := tryUpgradeToBatchingConn(pc, "udp4", t.Logf).(*linuxBatchingConn)
+	if !ok {
+		t.Fatal("didn't get a batching conn")
+	}
+	return bc
+}
+
+func TestBatchingConnRoundTrip(t *testing.T) {
+	const numWriters, perWriter = 8, 50
+
+	for _, gso := range []bool{false, true} {
+		t.Run(fmt.Sprintf("gso=%v", gso), func(t *testing.T) {
+			src := newTestBatchingConn(t)
+			dst := newTestBatchingConn(t)
+			if gso && !src.gso.Get() {
+				t.Skip("kernel lacks UDP GSO")
+			}
+			src.gso.Set(gso)
+			dstAddr := dst.LocalAddr()
+
+			before := GetUDPIOStats()
+			var wg sync.WaitGroup
+			for w := 0; w < numWriters; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < perWriter; i++ {
+						pkt := bytes.Repeat([]byte{byte(w)}, 1000)
+						pkt[0], pkt[1] = byte(w), byte(i)
+						if _, err := src.WriteTo(pkt, dstAddr); err != nil {
+							t.Errorf("WriteTo: %v", err)
+							return
+						}
+					}
+				}(w)
+			}
+
+			got := map[[2]byte]bool{}
+			buf := make([]byte, 2000)
+			dst.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for len(got) < numWriters*perWriter {
+				n, ipp, err := dst.ReadFromNetaddr(buf)
+				if err != nil {
+					// Loopback may drop under load; only fail
+					// if nothing came through.
+					if len(got) == 0 {
+						t.Fatalf("ReadFromNetaddr: %v", err)
+					}
+					t.Logf("got %d of %d packets: %v", len(got), numWriters*perWriter, err)
+					break
+				}
+				if n != 1000 {
+					t.Fatalf("read %d bytes; want 1000", n)
+				}
+				if ipp.Port() != uint16(src.LocalAddr().(*net.UDPAddr).Port) {
+					t.Fatalf("source %v; want port of %v", ipp, src.LocalAddr())
+				}
+				got[[2]byte{buf[0], buf[1]}] = true
+			}
+			wg.Wait()
+
+			d := GetUDPIOStats().Sub(before)
+			t.Logf("stats: %+v (%.2f sent/syscall, %.2f recv/syscall)", d, d.SendPacketsPerSyscall(), d.RecvPacketsPerSyscall())
+			if d.SendSyscalls > d.SendPackets {
+				t.Errorf("more send syscalls (%d) than packets (%d)", d.SendSyscalls, d.SendPackets)
+			}
+		})
+	}
+}
+
+func TestGROSegmentSize(t *testing.T) {
+	oob := make([]byte, unix.CmsgSpace(4))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = unix.SOL_UDP
+	h.Type = udpGRO
+	h.SetLen(unix.CmsgLen(4))
+	*(*int32)(unsafe.Pointer(&oob[unix.CmsgLen(0)])) = 1280
+	if got := groSegmentSize(oob); got != 1280 {
+		t.Errorf("groSegmentSize = %d; want 1280", got)
+	}
+	if got := groSegmentSize(nil); got != 0 {
+		t.Errorf("groSegmentSize(nil) = %d; want 0", got)
+	}
+}
+
+func TestAppendUDPSegment(t *testing.T) {
+	oob := appendUDPSegment(nil, 1400)
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages; want 1", len(msgs))
+	}
+	m := msgs[0]
+	if m.Header.Level != unix.SOL_UDP || m.Header.Type != udpSegment {
+		t.Fatalf("got level %d type %d", m.Header.Level, m.Header.Type)
+	}
+	if got := *(*uint16)(unsafe.Pointer(&m.Data[0])); got != 1400 {
+		t.Errorf("segment size = %d; want 1400", got)
+	}
+}
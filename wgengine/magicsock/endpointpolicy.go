@@ -0,0 +1,133 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"path"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/interfaces"
+	"tailscale.com/tailcfg"
+)
+
+// EndpointPolicy adjusts which endpoints a Conn advertises to peers.
+type EndpointPolicy struct {
+	// Static are endpoints to always advertise in addition to
+	// discovered ones, such as the public IP:port of a static 1:1
+	// NAT in front of this node. They're not subject to the
+	// exclusions below.
+	Static []netaddr.IPPort
+
+	// ExcludeInterfaces are names of local network interfaces whose
+	// addresses aren't advertised. Names may be path.Match patterns,
+	// such as "veth*".
+	ExcludeInterfaces []string
+
+	// ExcludePrefixes are IP ranges within which discovered
+	// endpoints (local, STUN or port mapped) aren't advertised.
+	ExcludePrefixes []netaddr.IPPrefix
+}
+
+// IsZero reports whether p doesn't change the advertised endpoints.
+func (p EndpointPolicy) IsZero() bool {
+	return len(p.Static) == 0 && len(p.ExcludeInterfaces) == 0 && len(p.ExcludePrefixes) == 0
+}
+
+// Equal reports whether p and p2 are the same, including order.
+func (p EndpointPolicy) Equal(p2 EndpointPolicy) bool {
+	if len(p.Static) != len(p2.Static) ||
+		len(p.ExcludeInterfaces) != len(p2.ExcludeInterfaces) ||
+		len(p.ExcludePrefixes) != len(p2.ExcludePrefixes) {
+		return false
+	}
+	for i := range p.Static {
+		if p.Static[i] != p2.Static[i] {
+			return false
+		}
+	}
+	for i := range p.ExcludeInterfaces {
+		if p.ExcludeInterfaces[i] != p2.ExcludeInterfaces[i] {
+			return false
+		}
+	}
+	for i := range p.ExcludePrefixes {
+		if p.ExcludePrefixes[i] != p2.ExcludePrefixes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// SetEndpointPolicy sets which endpoints c advertises beyond or
+// instead of the ones it discovers, and refreshes them if the policy
+// changed.
+func (c *Conn) SetEndpointPolicy(p EndpointPolicy) {
+	c.mu.Lock()
+	if c.endpointPolicy.Equal(p) {
+		c.mu.Unlock()
+		return
+	}
+	c.endpointPolicy = EndpointPolicy{
+		Static:            append([]netaddr.IPPort(nil), p.Static...),
+		ExcludeInterfaces: append([]string(nil), p.ExcludeInterfaces...),
+		ExcludePrefixes:   append([]netaddr.IPPrefix(nil), p.ExcludePrefixes...),
+	}
+	c.mu.Unlock()
+	c.logf("magicsock: endpoint policy: static=%v exclude-interfaces=%v exclude-prefixes=%v", p.Static, p.ExcludeInterfaces, p.ExcludePrefixes)
+	c.ReSTUN("endpoint-policy-change")
+}
+
+func (c *Conn) getEndpointPolicy() EndpointPolicy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.endpointPolicy
+}
+
+// endpointFilter decides which discovered endpoints to advertise,
+// according to an EndpointPolicy.
+type endpointFilter struct {
+	prefixes []netaddr.IPPrefix
+	ifaceIPs map[netaddr.IP]bool // addresses of excluded interfaces
+}
+
+// newEndpointFilter returns a filter for p's exclusions, looking up
+// the current addresses of any excluded interfaces.
+func newEndpointFilter(p EndpointPolicy) (*endpointFilter, error) {
+	f := &endpointFilter{prefixes: p.ExcludePrefixes}
+	if len(p.ExcludeInterfaces) == 0 {
+		return f, nil
+	}
+	f.ifaceIPs = map[netaddr.IP]bool{}
+	err := interfaces.ForeachInterfaceAddress(func(i interfaces.Interface, pfx netaddr.IPPrefix) {
+		if interfaceNameMatches(i.Name, p.ExcludeInterfaces) {
+			f.ifaceIPs[pfx.IP()] = true
+		}
+	})
+	return f, err
+}
+
+// interfaceNameMatches reports whether name matches any of patterns.
+func interfaceNameMatches(name string, patterns []string) bool {
+	for _, pat := range patterns {
+		if ok, _ := path.Match(pat, name); ok || pat == name {
+			return true
+		}
+	}
+	return false
+}
+
+// exclude reports whether ep shouldn't be advertised.
+func (f *endpointFilter) exclude(ep tailcfg.Endpoint) bool {
+	ip := ep.Addr.IP()
+	if f.ifaceIPs[ip] {
+		return true
+	}
+	for _, pfx := range f.prefixes {
+		if pfx.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
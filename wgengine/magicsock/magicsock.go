@@ -233,6 +233,13 @@ type Conn struct {
 	// when endpoints are refreshed.
 	onEndpointRefreshed map[*discoEndpoint]func()
 
+	// endpointPolicy adds to and filters the discovered endpoints.
+	endpointPolicy EndpointPolicy
+
+	// excludedEndpoints are the discovered endpoints that
+	// endpointPolicy kept out of lastEndpoints, for status.
+	excludedEndpoints []tailcfg.Endpoint
+
 	// peerSet is the set of peers that are currently configured in
 	// WireGuard. These are not used to filter inbound or outbound
 	// traffic at all, but only to track what state can be cleaned up
@@ -987,6 +994,22 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]tailcfg.Endpoint, erro
 		return nil, err
 	}
 
+	policy := c.getEndpointPolicy()
+	filter, err := newEndpointFilter(policy)
+	if err != nil {
+		c.logf("magicsock.Conn.determineEndpoints: listing excluded interfaces: %v", err)
+	}
+	var excluded []tailcfg.Endpoint
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.excludedEndpoints = excluded
+	}()
+
+	static := make(map[netaddr.IPPort]bool, len(policy.Static))
+	for _, ep := range policy.Static {
+		static[ep] = true
+	}
 	already := make(map[netaddr.IPPort]tailcfg.EndpointType) // endpoint -> how it was found
 	var eps []tailcfg.Endpoint                               // unique endpoints
 
@@ -1000,10 +1023,22 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]tailcfg.Endpoint, erro
 		}
 		if _, ok := already[ipp]; !ok {
 			already[ipp] = et
-			eps = append(eps, tailcfg.Endpoint{Addr: ipp, Type: et})
+			ep := tailcfg.Endpoint{Addr: ipp, Type: et}
+			if !static[ipp] && filter.exclude(ep) {
+				excluded = append(excluded, ep)
+				return
+			}
+			eps = append(eps, ep)
 		}
 	}
 
+	// Explicitly configured endpoints go first; they're what the
+	// user told us is reachable. They're advertised with an unknown
+	// type, as control has no type for them.
+	for _, ep := range policy.Static {
+		addAddr(ep, tailcfg.EndpointUnknownType)
+	}
+
 	// If we didn't have a portmap earlier, maybe it's done by now.
 	if !havePortmap {
 		portmapExt, havePortmap = c.portMapper.GetCachedMappingOrStartCreatingOne()
@@ -2695,7 +2730,7 @@ func (c *Conn) bindSocket(rucPtr **RebindingUDPConn, network string, curPortFate
 			continue
 		}
 		// Success.
-		ruc.pconn = pconn
+		ruc.pconn = tryUpgradeToBatchingConn(pconn, network, c.logf)
 		if network == "udp4" {
 			health.SetUDP4Unbound(false)
 		}
@@ -2851,6 +2886,16 @@ func (c *RebindingUDPConn) ReadFromNetaddr(b []byte) (n int, ipp netaddr.IPPort,
 	for {
 		pconn := c.currentConn()
 
+		// Batching conns hand out datagrams from their last
+		// batch read, and do their own syscall accounting.
+		if br, ok := pconn.(batchReader); ok {
+			n, ipp, err = br.ReadFromNetaddr(b)
+			if err != nil && pconn != c.currentConn() {
+				continue
+			}
+			return n, ipp, err
+		}
+
 		// Optimization: Treat *net.UDPConn specially.
 		// ReadFromUDP gets partially inlined, avoiding allocating a *net.UDPAddr,
 		// as long as pAddr itself doesn't escape.
@@ -2881,6 +2926,7 @@ func (c *RebindingUDPConn) ReadFromNetaddr(b []byte) (n int, ipp netaddr.IPPort,
 			if !ok {
 				return 0, netaddr.IPPort{}, errors.New("netaddr.FromStdAddr failed")
 			}
+			noteUDPRecv(1)
 		}
 		return n, ipp, err
 	}
@@ -2920,6 +2966,9 @@ func (c *RebindingUDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
 		c.mu.Unlock()
 
 		n, err := pconn.WriteTo(b, addr)
+		if _, ok := pconn.(batchReader); !ok {
+			noteUDPSend(1)
+		}
 		if err != nil {
 			c.mu.Lock()
 			pconn2 := c.pconn
@@ -3056,8 +3105,18 @@ func (c *Conn) UpdateStatus(sb *ipnstate.StatusBuilder) {
 	sb.MutateSelfStatus(func(ss *ipnstate.PeerStatus) {
 		ss.PublicKey = c.privateKey.Public()
 		ss.Addrs = make([]string, 0, len(c.lastEndpoints))
+		static := make(map[netaddr.IPPort]bool, len(c.endpointPolicy.Static))
+		for _, ep := range c.endpointPolicy.Static {
+			static[ep] = true
+		}
 		for _, ep := range c.lastEndpoints {
 			ss.Addrs = append(ss.Addrs, ep.Addr.String())
+			if static[ep.Addr] {
+				ss.StaticAddrs = append(ss.StaticAddrs, ep.Addr.String())
+			}
+		}
+		for _, ep := range c.excludedEndpoints {
+			ss.ExcludedAddrs = append(ss.ExcludedAddrs, ep.Addr.String())
 		}
 		ss.OS = version.OS()
 		if c.netMap != nil {
@@ -3149,6 +3208,8 @@ type discoEndpoint struct {
 	isCallMeMaybeEP    map[netaddr.IPPort]bool
 
 	pendingCLIPings []pendingCLIPing // any outstanding "tailscale ping" commands running
+
+	pathHistory pathHistory // latency, loss and path changes, for status
 }
 
 type pendingCLIPing struct {
@@ -3250,6 +3311,7 @@ func (de *discoEndpoint) deleteEndpointLocked(ep netaddr.IPPort) {
 	delete(de.endpointState, ep)
 	if de.bestAddr.IPPort == ep {
 		de.bestAddr = addrLatency{}
+		de.pathHistory.noteReason("endpoint " + ep.String() + " removed")
 	}
 }
 
@@ -3320,6 +3382,7 @@ func (de *discoEndpoint) addrForSendLocked(now time.Time) (udpAddr, derpAddr net
 		// and DERP.
 		derpAddr = de.derpAddr
 	}
+	de.pathHistory.notePath(now, sendPath{udpAddr, derpAddr})
 	return
 }
 
@@ -3447,6 +3510,7 @@ func (de *discoEndpoint) pingTimeout(txid stun.TxID) {
 	if debugDisco || de.bestAddr.IsZero() || time.Now().After(de.trustBestAddrUntil) {
 		de.c.logf("[v1] magicsock: disco: timeout waiting for pong %x from %v (%v, %v)", txid[:6], sp.to, de.publicKey.ShortString(), de.discoShort)
 	}
+	de.pathHistory.pingsLost++
 	de.removeSentPingLocked(txid, sp)
 }
 
@@ -3509,6 +3573,7 @@ func (de *discoEndpoint) startPingLocked(ep netaddr.IPPort, now time.Time, purpo
 	}
 
 	txid := stun.NewTxID()
+	de.pathHistory.pingsSent++
 	de.sentPing[txid] = sentPing{
 		to:      ep,
 		at:      now,
@@ -3566,11 +3631,15 @@ func (de *discoEndpoint) updateFromNode(n *tailcfg.Node) {
 	de.mu.Lock()
 	defer de.mu.Unlock()
 
+	oldDERP := de.derpAddr
 	if n.DERP == "" {
 		de.derpAddr = netaddr.IPPort{}
 	} else {
 		de.derpAddr, _ = netaddr.ParseIPPort(n.DERP)
 	}
+	if de.derpAddr != oldDERP && !oldDERP.IsZero() {
+		de.pathHistory.noteReason("peer's home DERP changed")
+	}
 
 	for _, st := range de.endpointState {
 		st.index = indexSentinelDeleted // assume deleted until updated in next loop
@@ -3645,6 +3714,7 @@ func (de *discoEndpoint) noteConnectivityChange() {
 	defer de.mu.Unlock()
 
 	de.trustBestAddrUntil = time.Time{}
+	de.pathHistory.noteReason("local network changed")
 }
 
 // handlePongConnLocked handles a Pong message (a reply to an earlier ping).
@@ -3664,6 +3734,7 @@ func (de *discoEndpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort)
 
 	now := time.Now()
 	latency := now.Sub(sp.at)
+	de.pathHistory.noteLatency(now, sp.to, latency)
 
 	if !isDerp {
 		st, ok := de.endpointState[sp.to]
@@ -3702,6 +3773,11 @@ func (de *discoEndpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort)
 		thisPong := addrLatency{sp.to, latency}
 		if betterAddr(thisPong, de.bestAddr) {
 			de.c.logf("magicsock: disco: node %v %v now using %v", de.publicKey.ShortString(), de.discoShort, sp.to)
+			if de.bestAddr.IsZero() {
+				de.pathHistory.noteReason(fmt.Sprintf("pong from %v in %v", sp.to, latency.Round(time.Millisecond)))
+			} else {
+				de.pathHistory.noteReason(fmt.Sprintf("pong from %v in %v beat %v", sp.to, latency.Round(time.Millisecond), de.bestAddr.latency.Round(time.Millisecond)))
+			}
 			de.bestAddr = thisPong
 		}
 		if de.bestAddr.IPPort == thisPong.IPPort {
@@ -3823,6 +3899,9 @@ func (de *discoEndpoint) populatePeerStatus(ps *ipnstate.PeerStatus) {
 	de.mu.Lock()
 	defer de.mu.Unlock()
 
+	ps.PathStats = new(ipnstate.PeerPathStats)
+	de.pathHistory.populate(ps.PathStats)
+
 	if de.lastSend.IsZero() {
 		return
 	}
@@ -3852,6 +3931,7 @@ func (de *discoEndpoint) stopAndReset() {
 	de.bestAddr = addrLatency{}
 	de.bestAddrAt = time.Time{}
 	de.trustBestAddrUntil = time.Time{}
+	de.pathHistory.noteReason("reset")
 	for _, es := range de.endpointState {
 		es.lastPing = time.Time{}
 	}
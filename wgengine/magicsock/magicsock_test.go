@@ -1386,6 +1386,10 @@ func TestReceiveFromAllocs(t *testing.T) {
 		maxAllocs = 2
 	}
 	t.Logf("allowing %d allocs for Go version %q", maxAllocs, runtime.Version())
+	// The alloc budget is for the one-datagram-per-syscall path;
+	// batched reads allocate per batch instead.
+	os.Setenv("TS_DEBUG_DISABLE_UDP_BATCHING", "1")
+	defer os.Unsetenv("TS_DEBUG_DISABLE_UDP_BATCHING")
 	roundTrip := setUpReceiveFrom(t)
 	avg := int(testing.AllocsPerRun(100, roundTrip))
 	if avg > maxAllocs {
@@ -1682,3 +1686,41 @@ func epStrings(eps []tailcfg.Endpoint) (ret []string) {
 	}
 	return
 }
+
+func TestEndpointFilter(t *testing.T) {
+	f := &endpointFilter{
+		prefixes: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("172.17.0.0/16")},
+		ifaceIPs: map[netaddr.IP]bool{netaddr.MustParseIP("10.9.8.7"): true},
+	}
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"172.17.0.2:41641", true},
+		{"172.18.0.2:41641", false},
+		{"10.9.8.7:41641", true},
+		{"10.9.8.6:41641", false},
+		{"[2001:db8::1]:41641", false},
+	}
+	for _, tt := range tests {
+		ep := tailcfg.Endpoint{Addr: netaddr.MustParseIPPort(tt.addr), Type: tailcfg.EndpointLocal}
+		if got := f.exclude(ep); got != tt.want {
+			t.Errorf("exclude(%v) = %v; want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		name     string
+		patterns []string
+		want     bool
+	}{
+		{"docker0", []string{"docker0"}, true},
+		{"veth1234", []string{"docker0", "veth*"}, true},
+		{"eth0", []string{"docker0", "veth*"}, false},
+		{"eth0", nil, false},
+	} {
+		if got := interfaceNameMatches(tt.name, tt.patterns); got != tt.want {
+			t.Errorf("interfaceNameMatches(%q, %q) = %v; want %v", tt.name, tt.patterns, got, tt.want)
+		}
+	}
+}
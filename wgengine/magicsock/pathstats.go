@@ -0,0 +1,128 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+)
+
+const (
+	// latencyHistoryCount is how many pong latencies we keep per peer
+	// for status reporting.
+	latencyHistoryCount = 32
+
+	// pathChangeHistoryCount is how many path changes we keep per
+	// peer for status reporting.
+	pathChangeHistoryCount = 16
+)
+
+// sendPath is the pair of addresses a discoEndpoint sends to, as
+// returned by addrForSendLocked.
+type sendPath struct {
+	udp, derp netaddr.IPPort
+}
+
+func (p sendPath) String() string {
+	switch {
+	case p.udp.IsZero() && p.derp.IsZero():
+		return ""
+	case p.derp.IsZero():
+		return ippDebugString(p.udp)
+	case p.udp.IsZero():
+		return ippDebugString(p.derp)
+	}
+	return ippDebugString(p.udp) + "+" + ippDebugString(p.derp)
+}
+
+// pathHistory is a discoEndpoint's record of ping latencies, loss and
+// path changes, for status reporting.
+//
+// All fields are guarded by discoEndpoint.mu.
+type pathHistory struct {
+	latency  [latencyHistoryCount]ipnstate.PeerLatencySample
+	nLatency int // total samples ever added; next goes at nLatency%len
+
+	changes  [pathChangeHistoryCount]ipnstate.PeerPathChange
+	nChanges int // total changes ever added; next goes at nChanges%len
+
+	pingsSent int64
+	pongsRecv int64
+	pingsLost int64
+
+	cur    sendPath // path used for the most recent send
+	reason string   // why the path may change next, if known
+}
+
+// noteReason records why the next change in path (if any) is happening.
+func (h *pathHistory) noteReason(why string) {
+	h.reason = why
+}
+
+// noteLatency records a pong from addr with the given round trip time.
+func (h *pathHistory) noteLatency(now time.Time, addr netaddr.IPPort, latency time.Duration) {
+	h.pongsRecv++
+	h.latency[h.nLatency%len(h.latency)] = ipnstate.PeerLatencySample{
+		At:             now,
+		Addr:           ippDebugString(addr),
+		LatencySeconds: latency.Seconds(),
+	}
+	h.nLatency++
+}
+
+// notePath records that p is the current send path, adding a path
+// change to the history if it differs from the previous one.
+func (h *pathHistory) notePath(now time.Time, p sendPath) {
+	why := h.reason
+	h.reason = ""
+	if p == h.cur {
+		return
+	}
+	if why == "" {
+		switch {
+		case h.cur.udp.IsZero() && !p.udp.IsZero():
+			why = "trying direct path"
+		case !p.udp.IsZero() && p.derp.IsZero():
+			why = "direct path confirmed"
+		case !h.cur.udp.IsZero() && !p.derp.IsZero():
+			why = "direct path unconfirmed"
+		}
+	}
+	h.changes[h.nChanges%len(h.changes)] = ipnstate.PeerPathChange{
+		At:     now,
+		From:   h.cur.String(),
+		To:     p.String(),
+		Reason: why,
+	}
+	h.nChanges++
+	h.cur = p
+}
+
+// populate fills in ps with a copy of h's history.
+func (h *pathHistory) populate(ps *ipnstate.PeerPathStats) {
+	ps.PingsSent = h.pingsSent
+	ps.PongsReceived = h.pongsRecv
+	ps.PingsLost = h.pingsLost
+	if known := h.pongsRecv + h.pingsLost; known > 0 {
+		ps.LossFraction = float64(h.pingsLost) / float64(known)
+	}
+	for i := ringStart(len(h.latency), h.nLatency); i < h.nLatency; i++ {
+		ps.Latency = append(ps.Latency, h.latency[i%len(h.latency)])
+	}
+	for i := ringStart(len(h.changes), h.nChanges); i < h.nChanges; i++ {
+		ps.PathChanges = append(ps.PathChanges, h.changes[i%len(h.changes)])
+	}
+}
+
+// ringStart returns the total count of the oldest element still in a
+// ring buffer of size n that has had total elements added.
+func ringStart(n, total int) int {
+	if total > n {
+		return total - n
+	}
+	return 0
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+)
+
+func TestPathHistory(t *testing.T) {
+	var h pathHistory
+	now := time.Unix(1000, 0)
+	udp := netaddr.MustParseIPPort("1.2.3.4:41641")
+	derp := netaddr.IPPortFrom(derpMagicIPAddr, 2)
+
+	h.notePath(now, sendPath{derp: derp})
+	h.notePath(now, sendPath{derp: derp}) // no change
+	h.notePath(now, sendPath{udp: udp, derp: derp})
+	h.noteReason("pong")
+	h.notePath(now, sendPath{udp: udp})
+	h.noteReason("stale reason")
+	h.notePath(now, sendPath{udp: udp}) // no change; clears reason
+	h.notePath(now, sendPath{udp: udp, derp: derp})
+
+	h.pingsSent = 4
+	h.noteLatency(now, udp, 10*time.Millisecond)
+	h.noteLatency(now, derp, 50*time.Millisecond)
+	h.pingsLost = 2
+
+	var ps ipnstate.PeerPathStats
+	h.populate(&ps)
+
+	wantChanges := []struct{ from, to, reason string }{
+		{"", "derp-2", ""},
+		{"derp-2", "1.2.3.4:41641+derp-2", "trying direct path"},
+		{"1.2.3.4:41641+derp-2", "1.2.3.4:41641", "pong"},
+		{"1.2.3.4:41641", "1.2.3.4:41641+derp-2", "direct path unconfirmed"},
+	}
+	if len(ps.PathChanges) != len(wantChanges) {
+		t.Fatalf("got %d path changes; want %d: %+v", len(ps.PathChanges), len(wantChanges), ps.PathChanges)
+	}
+	for i, want := range wantChanges {
+		got := ps.PathChanges[i]
+		if got.From != want.from || got.To != want.to || got.Reason != want.reason {
+			t.Errorf("change %d = %q -> %q (%q); want %q -> %q (%q)", i, got.From, got.To, got.Reason, want.from, want.to, want.reason)
+		}
+	}
+
+	if len(ps.Latency) != 2 || ps.Latency[1].Addr != "derp-2" || ps.Latency[0].LatencySeconds != 0.01 {
+		t.Errorf("unexpected latency samples: %+v", ps.Latency)
+	}
+	if ps.LossFraction != 0.5 {
+		t.Errorf("LossFraction = %v; want 0.5", ps.LossFraction)
+	}
+}
+
+func TestPathHistoryWraps(t *testing.T) {
+	var h pathHistory
+	now := time.Unix(1000, 0)
+	for i := 0; i < latencyHistoryCount+5; i++ {
+		h.noteLatency(now.Add(time.Duration(i)*time.Second), netaddr.MustParseIPPort("1.2.3.4:5"), time.Millisecond)
+	}
+	var ps ipnstate.PeerPathStats
+	h.populate(&ps)
+	if len(ps.Latency) != latencyHistoryCount {
+		t.Fatalf("got %d samples; want %d", len(ps.Latency), latencyHistoryCount)
+	}
+	for i := 1; i < len(ps.Latency); i++ {
+		if !ps.Latency[i].At.After(ps.Latency[i-1].At) {
+			t.Fatalf("samples out of order at %d: %v, %v", i, ps.Latency[i-1].At, ps.Latency[i].At)
+		}
+	}
+	if got, want := ps.Latency[0].At, now.Add(5*time.Second); !got.Equal(want) {
+		t.Errorf("oldest sample at %v; want %v", got, want)
+	}
+}
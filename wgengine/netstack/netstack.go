@@ -34,6 +34,7 @@ import (
 	"tailscale.com/net/packet"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tstun"
+	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
 	"tailscale.com/util/dnsname"
@@ -75,6 +76,16 @@ type Impl struct {
 	// TCP connections, so they can be unregistered when connections are
 	// closed.
 	connsOpenBySubnetIP map[netaddr.IP]int
+	// proxyProtoPorts are the destination ports of forwarded TCP
+	// connections that get a PROXY protocol v2 header.
+	proxyProtoPorts map[uint16]bool
+	whoIs           func(netaddr.IPPort) (*tailcfg.Node, tailcfg.UserProfile, bool)
+	// tcpHandlers are the in-process handlers of TCP connections to
+	// the node's Tailscale IPs, by destination port.
+	tcpHandlers map[uint16]func(net.Conn)
+
+	pingsInFlight int32 // atomic; number of forwardPing calls awaiting replies
+	noICMPSocket  int32 // atomic; 1 once opening an unprivileged ICMP socket has failed
 }
 
 const nicID = 1
@@ -437,6 +448,13 @@ func (ns *Impl) injectInbound(p *packet.Parsed, t *tstun.Wrapper) filter.Respons
 		// address. The real host OS interface will handle it.
 		return filter.Accept
 	}
+	if p.IsEchoRequest() && !ns.isLocalIP(p.Dst.IP()) {
+		// netstack would answer pings to subnet routes itself,
+		// whether or not the destination is up, so ping the
+		// real destination instead.
+		ns.forwardPing(p)
+		return filter.DropSilently
+	}
 	var pn tcpip.NetworkProtocolNumber
 	switch p.IPVersion {
 	case 4:
@@ -490,6 +508,10 @@ func (ns *Impl) acceptTCP(r *tcp.ForwarderRequest) {
 		return
 	}
 	if isTailscaleIP {
+		if h := ns.tcpHandler(reqDetails.LocalPort); h != nil {
+			h(c)
+			return
+		}
 		dialAddr = tcpip.Address(net.ParseIP("127.0.0.1")).To4()
 	}
 	ns.forwardTCP(c, &wq, dialAddr, reqDetails.LocalPort)
@@ -522,6 +544,12 @@ func (ns *Impl) forwardTCP(client *gonet.TCPConn, wq *waiter.Queue, dialAddr tcp
 		return
 	}
 	defer server.Close()
+	if ns.wantsProxyHeader(dialPort) {
+		if err := ns.writeProxyHeader(server, client); err != nil {
+			ns.logf("netstack: writing PROXY header to %s: %v", dialAddrStr, err)
+			return
+		}
+	}
 	backendLocalAddr := server.LocalAddr().(*net.TCPAddr)
 	backendLocalIPPort, _ := netaddr.FromStdAddr(backendLocalAddr.IP, backendLocalAddr.Port, backendLocalAddr.Zone)
 	clientRemoteIP, _ := netaddr.FromStdIP(client.RemoteAddr().(*net.TCPAddr).IP)
@@ -543,6 +571,85 @@ func (ns *Impl) forwardTCP(client *gonet.TCPConn, wq *waiter.Queue, dialAddr tcp
 	ns.logf("[v2] netstack: forwarder connection to %s closed", dialAddrStr)
 }
 
+// SetProxyProtocolPorts sets the destination ports of TCP connections
+// forwarded to local or subnet services that are preceded by a PROXY
+// protocol v2 header carrying the tailnet client's address and, if
+// SetWhoIsFunc was called, its identity.
+func (ns *Impl) SetProxyProtocolPorts(ports []uint16) {
+	m := make(map[uint16]bool, len(ports))
+	for _, p := range ports {
+		m[p] = true
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.proxyProtoPorts = m
+}
+
+// SetTCPHandler sets h to handle the TCP connections to port of the
+// node's Tailscale IPs in process, rather than forwarding them to a
+// local server on 127.0.0.1. The conns' RemoteAddr is the tailnet
+// client's address. A nil h removes the handler.
+func (ns *Impl) SetTCPHandler(port uint16, h func(net.Conn)) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if h == nil {
+		delete(ns.tcpHandlers, port)
+		return
+	}
+	if ns.tcpHandlers == nil {
+		ns.tcpHandlers = map[uint16]func(net.Conn){}
+	}
+	ns.tcpHandlers[port] = h
+}
+
+func (ns *Impl) tcpHandler(port uint16) func(net.Conn) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.tcpHandlers[port]
+}
+
+// SetWhoIsFunc sets the func used to look up the tailnet identity of
+// clients for PROXY protocol headers.
+func (ns *Impl) SetWhoIsFunc(whoIs func(netaddr.IPPort) (*tailcfg.Node, tailcfg.UserProfile, bool)) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.whoIs = whoIs
+}
+
+func (ns *Impl) wantsProxyHeader(port uint16) bool {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.proxyProtoPorts[port]
+}
+
+// writeProxyHeader writes to server a PROXY protocol v2 header
+// describing the tailnet connection client.
+func (ns *Impl) writeProxyHeader(server io.Writer, client net.Conn) error {
+	ra := client.RemoteAddr().(*net.TCPAddr)
+	la := client.LocalAddr().(*net.TCPAddr)
+	src, _ := netaddr.FromStdAddr(ra.IP, ra.Port, ra.Zone)
+	dst, _ := netaddr.FromStdAddr(la.IP, la.Port, la.Zone)
+
+	ns.mu.Lock()
+	whoIs := ns.whoIs
+	ns.mu.Unlock()
+	var tlvs []proxyTLV
+	if whoIs != nil {
+		if n, u, ok := whoIs(src); ok {
+			tlvs = append(tlvs,
+				proxyTLV{ProxyTLVLoginName, u.LoginName},
+				proxyTLV{ProxyTLVNodeName, n.Name},
+			)
+		}
+	}
+	hdr, err := appendProxyHeaderV2(nil, src, dst, tlvs...)
+	if err != nil {
+		return err
+	}
+	_, err = server.Write(hdr)
+	return err
+}
+
 func (ns *Impl) acceptUDP(r *udp.ForwarderRequest) {
 	reqDetails := r.ID()
 	if debugNetstack {
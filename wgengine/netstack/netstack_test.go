@@ -5,10 +5,12 @@
 package netstack
 
 import (
+	"bytes"
 	"reflect"
 	"testing"
 
 	"inet.af/netaddr"
+	"tailscale.com/net/packet"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/netmap"
 )
@@ -110,3 +112,78 @@ func TestDNSMapFromNetworkMap(t *testing.T) {
 		})
 	}
 }
+
+func TestEchoReply(t *testing.T) {
+	src := netaddr.MustParseIP("100.101.102.103")
+	dst := netaddr.MustParseIP("192.168.1.5")
+	payload := []byte("\x00\x07\x00\x01abcdef")
+	req := packet.Generate(packet.ICMP4Header{
+		IP4Header: packet.IP4Header{Src: src, Dst: dst},
+		Type:      packet.ICMP4EchoRequest,
+	}, payload)
+
+	var p packet.Parsed
+	p.Decode(req)
+	if !p.IsEchoRequest() {
+		t.Fatalf("request %v doesn't decode as an echo request", p)
+	}
+	var r packet.Parsed
+	r.Decode(echoReply(&p))
+	if !r.IsEchoResponse() {
+		t.Fatalf("reply %v isn't an echo response", r)
+	}
+	if r.Src.IP() != dst || r.Dst.IP() != src {
+		t.Errorf("reply is %v > %v; want %v > %v", r.Src, r.Dst, dst, src)
+	}
+	if !bytes.Equal(r.Payload(), payload) {
+		t.Errorf("reply payload = %q; want %q", r.Payload(), payload)
+	}
+}
+
+func TestAppendProxyHeaderV2(t *testing.T) {
+	ipp := netaddr.MustParseIPPort
+	tests := []struct {
+		name     string
+		src, dst netaddr.IPPort
+		tlvs     []proxyTLV
+		want     string
+	}{
+		{
+			name: "ipv4",
+			src:  ipp("100.64.1.2:4321"),
+			dst:  ipp("192.168.1.5:80"),
+			want: proxyV2Sig + "\x21\x11\x00\x0c" +
+				"\x64\x40\x01\x02" + "\xc0\xa8\x01\x05" + "\x10\xe1" + "\x00\x50",
+		},
+		{
+			name: "ipv4_tlvs",
+			src:  ipp("100.64.1.2:4321"),
+			dst:  ipp("192.168.1.5:80"),
+			tlvs: []proxyTLV{{ProxyTLVLoginName, "alice@example.com"}, {ProxyTLVNodeName, "laptop"}},
+			want: proxyV2Sig + "\x21\x11\x00\x29" +
+				"\x64\x40\x01\x02" + "\xc0\xa8\x01\x05" + "\x10\xe1" + "\x00\x50" +
+				"\xe0\x00\x11alice@example.com" +
+				"\xe1\x00\x06laptop",
+		},
+		{
+			name: "mixed_families",
+			src:  ipp("[fd7a:115c:a1e0::1]:4321"),
+			dst:  ipp("10.0.0.1:22"),
+			want: proxyV2Sig + "\x21\x21\x00\x24" +
+				"\xfd\x7a\x11\x5c\xa1\xe0\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\x0a\x00\x00\x01" +
+				"\x10\xe1" + "\x00\x16",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := appendProxyHeaderV2(nil, tt.src, tt.dst, tt.tlvs...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got  % x\nwant % x", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netstack
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+)
+
+const (
+	// pingTimeout is how long to wait for the reply to a forwarded
+	// ICMP echo request.
+	pingTimeout = 5 * time.Second
+
+	// maxInFlightPings bounds how many forwarded ICMP echo requests
+	// can be waiting for their replies at once.
+	maxInFlightPings = 64
+)
+
+// forwardPing sends the ICMP echo request p, whose destination is a
+// subnet-routed address, from this host to its real destination, and
+// injects the echo reply back towards the tailnet peer that sent it if
+// the destination answers.
+func (ns *Impl) forwardPing(p *packet.Parsed) {
+	if atomic.AddInt32(&ns.pingsInFlight, 1) > maxInFlightPings {
+		atomic.AddInt32(&ns.pingsInFlight, -1)
+		ns.logf("[v2] netstack: too many pings in flight; dropping ping to %v", p.Dst.IP())
+		return
+	}
+	buf := append([]byte(nil), p.Buffer()...)
+	go func() {
+		defer atomic.AddInt32(&ns.pingsInFlight, -1)
+		var q packet.Parsed
+		q.Decode(buf)
+		dst := q.Dst.IP()
+
+		ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+		defer cancel()
+		if err := ns.sendPing(ctx, dst, q.Payload()); err != nil {
+			ns.logf("[v2] netstack: forwarding ping to %v: %v", dst, err)
+			return
+		}
+		if err := ns.tundev.InjectOutbound(echoReply(&q)); err != nil {
+			ns.logf("netstack: injecting ping reply from %v: %v", dst, err)
+		}
+	}()
+}
+
+// echoReply returns the ICMP echo reply packet to the echo request p.
+func echoReply(p *packet.Parsed) []byte {
+	if p.IPVersion == 6 {
+		h := p.ICMP6Header()
+		h.ToResponse()
+		return packet.Generate(&h, p.Payload())
+	}
+	h := p.ICMP4Header()
+	h.ToResponse()
+	return packet.Generate(&h, p.Payload())
+}
+
+// errNoICMPSocket is returned by pingSocket when this host doesn't let
+// us open unprivileged ICMP sockets.
+var errNoICMPSocket = errors.New("unprivileged ICMP sockets not available")
+
+// sendPing sends an ICMP echo request to dst and waits for the reply.
+// payload is the echo request's body after the ICMP type, code and
+// checksum: its ID, sequence number and data.
+//
+// It uses an unprivileged ICMP socket if the host allows it (on
+// Linux, if our group is in the net.ipv4.ping_group_range sysctl)
+// and otherwise runs the ping command.
+func (ns *Impl) sendPing(ctx context.Context, dst netaddr.IP, payload []byte) error {
+	if atomic.LoadInt32(&ns.noICMPSocket) == 0 {
+		err := pingSocket(ctx, dst, payload)
+		if err != errNoICMPSocket {
+			return err
+		}
+		if atomic.CompareAndSwapInt32(&ns.noICMPSocket, 0, 1) {
+			ns.logf("netstack: %v; forwarding pings with the ping command", err)
+		}
+	}
+	return pingCommand(ctx, dst)
+}
+
+// pingSocket pings dst with an unprivileged ICMP socket. See
+// sendPing for payload.
+func pingSocket(ctx context.Context, dst netaddr.IP, payload []byte) error {
+	if len(payload) < 4 {
+		return errors.New("short echo request")
+	}
+	network, laddr, proto := "udp4", "0.0.0.0", 1
+	var reqType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if dst.Is6() {
+		network, laddr, proto = "udp6", "::", 58
+		reqType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+	c, err := icmp.ListenPacket(network, laddr)
+	if err != nil {
+		return errNoICMPSocket
+	}
+	defer c.Close()
+	if d, ok := ctx.Deadline(); ok {
+		c.SetDeadline(d)
+	}
+
+	// The kernel replaces the ID with one of its choosing for
+	// unprivileged sockets, so replies are matched by sequence
+	// number only.
+	seq := int(binary.BigEndian.Uint16(payload[2:4]))
+	req := icmp.Message{
+		Type: reqType,
+		Body: &icmp.Echo{
+			ID:   int(binary.BigEndian.Uint16(payload[0:2])),
+			Seq:  seq,
+			Data: payload[4:],
+		},
+	}
+	wb, err := req.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	if _, err := c.WriteTo(wb, &net.UDPAddr{IP: dst.IPAddr().IP, Zone: dst.Zone()}); err != nil {
+		return err
+	}
+	rb := make([]byte, 1500)
+	for {
+		n, from, err := c.ReadFrom(rb)
+		if err != nil {
+			return err
+		}
+		if ua, ok := from.(*net.UDPAddr); !ok || !ua.IP.Equal(dst.IPAddr().IP) {
+			continue
+		}
+		m, err := icmp.ParseMessage(proto, rb[:n])
+		if err != nil || m.Type != replyType {
+			continue
+		}
+		if echo, ok := m.Body.(*icmp.Echo); ok && echo.Seq == seq {
+			return nil
+		}
+	}
+}
+
+// pingCommand pings dst once with the system's ping command.
+func pingCommand(ctx context.Context, dst netaddr.IP) error {
+	name, args := "ping", []string{"-c", "1"}
+	if runtime.GOOS == "windows" {
+		args = []string{"-n", "1"}
+	}
+	if dst.Is6() {
+		if _, err := exec.LookPath("ping6"); err == nil {
+			name = "ping6"
+		} else if runtime.GOOS == "linux" || runtime.GOOS == "windows" {
+			args = append(args, "-6")
+		}
+	}
+	args = append(args, dst.String())
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%s: %v, %q", name, err, out)
+	}
+	return nil
+}
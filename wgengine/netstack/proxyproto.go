@@ -0,0 +1,88 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netstack
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"inet.af/netaddr"
+)
+
+// proxyV2Sig is the signature that starts a PROXY protocol v2 header.
+// See https://www.haproxy.org/download/2.4/doc/proxy-protocol.txt.
+const proxyV2Sig = "\r\n\r\n\x00\r\nQUIT\n"
+
+const (
+	proxyV2CmdProxy = 0x21 // version 2, PROXY command
+	proxyV2TCP4     = 0x11 // TCP over IPv4
+	proxyV2TCP6     = 0x21 // TCP over IPv6
+)
+
+// Types of the PROXY protocol v2 TLVs carrying the tailnet identity of
+// the client. They're in the range the spec reserves for custom use.
+const (
+	ProxyTLVLoginName = 0xE0 // login name of the user owning the client node
+	ProxyTLVNodeName  = 0xE1 // name of the client node
+)
+
+// proxyTLV is a type-length-value field of a PROXY protocol v2 header.
+type proxyTLV struct {
+	typ   byte
+	value string
+}
+
+// appendProxyHeaderV2 appends to b a PROXY protocol v2 header saying
+// that the connection came from src to dst, with tlvs.
+//
+// If src and dst aren't the same address family, both are sent as
+// IPv6, mapping the IPv4 one.
+func appendProxyHeaderV2(b []byte, src, dst netaddr.IPPort, tlvs ...proxyTLV) ([]byte, error) {
+	srcIP, dstIP := src.IP(), dst.IP()
+	if srcIP.Is4() != dstIP.Is4() {
+		srcIP, dstIP = srcIP.Unmap(), dstIP.Unmap()
+		if srcIP.Is4() {
+			srcIP = netaddr.IPv6Raw(srcIP.As16())
+		}
+		if dstIP.Is4() {
+			dstIP = netaddr.IPv6Raw(dstIP.As16())
+		}
+	}
+
+	var addrs []byte
+	fam := byte(proxyV2TCP6)
+	if srcIP.Is4() {
+		fam = proxyV2TCP4
+		s, d := srcIP.As4(), dstIP.As4()
+		addrs = append(append(addrs, s[:]...), d[:]...)
+	} else {
+		s, d := srcIP.As16(), dstIP.As16()
+		addrs = append(append(addrs, s[:]...), d[:]...)
+	}
+	addrs = appendUint16(addrs, src.Port())
+	addrs = appendUint16(addrs, dst.Port())
+	for _, tlv := range tlvs {
+		if len(tlv.value) > 0xffff {
+			return nil, errors.New("PROXY protocol TLV too long")
+		}
+		addrs = append(addrs, tlv.typ)
+		addrs = appendUint16(addrs, uint16(len(tlv.value)))
+		addrs = append(addrs, tlv.value...)
+	}
+	if len(addrs) > 0xffff {
+		return nil, errors.New("PROXY protocol header too long")
+	}
+
+	b = append(b, proxyV2Sig...)
+	b = append(b, proxyV2CmdProxy, fam)
+	b = appendUint16(b, uint16(len(addrs)))
+	return append(b, addrs...), nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], v)
+	return append(b, buf[:]...)
+}
@@ -42,6 +42,7 @@ import (
 	"tailscale.com/types/netmap"
 	"tailscale.com/types/wgkey"
 	"tailscale.com/util/deephash"
+	"tailscale.com/util/dnsname"
 	"tailscale.com/version"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/magicsock"
@@ -140,6 +141,20 @@ func (e *userspaceEngine) GetInternals() (_ *tstun.Wrapper, _ *magicsock.Conn, o
 	return e.tundev, e.magicConn, true
 }
 
+// DNSAnswerWatcher is implemented by Engines that can report the
+// addresses that MagicDNS forwards to clients for names within
+// dns.Config.WatchDomains.
+type DNSAnswerWatcher interface {
+	// SetDNSAnswerWatcher sets the func to call with each such
+	// answer. The answer is held until fn returns, so it may block
+	// briefly. A nil fn removes the watcher.
+	SetDNSAnswerWatcher(fn func(name dnsname.FQDN, ips []netaddr.IP))
+}
+
+func (e *userspaceEngine) SetDNSAnswerWatcher(fn func(name dnsname.FQDN, ips []netaddr.IP)) {
+	e.dns.SetAnswerWatcher(fn)
+}
+
 // Config is the engine configuration.
 type Config struct {
 	// Tun is the device used by the Engine to exchange packets with
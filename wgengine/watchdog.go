@@ -18,6 +18,7 @@ import (
 	"tailscale.com/net/tstun"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/netmap"
+	"tailscale.com/util/dnsname"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/magicsock"
 	"tailscale.com/wgengine/monitor"
@@ -138,6 +139,11 @@ func (e *watchdogEngine) GetInternals() (tw *tstun.Wrapper, c *magicsock.Conn, o
 	}
 	return
 }
+func (e *watchdogEngine) SetDNSAnswerWatcher(fn func(name dnsname.FQDN, ips []netaddr.IP)) {
+	if w, ok := e.wrap.(DNSAnswerWatcher); ok {
+		w.SetDNSAnswerWatcher(fn)
+	}
+}
 func (e *watchdogEngine) Wait() {
 	e.wrap.Wait()
 }